@@ -0,0 +1,113 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/research"
+	cli "github.com/urfave/cli/v2"
+)
+
+var AddressIndexCommand = &cli.Command{
+	Action: addressIndex,
+	Name:   "db-address-index",
+	Usage:  "Build a bloom index of addresses of each block in a given block segment",
+	Flags: []cli.Flag{
+		research.BlockSegmentFlag,
+		&cli.PathFlag{
+			Name:     "src-path",
+			Usage:    "Source DB path",
+			Required: true,
+		},
+	},
+	Description: `
+substate-cli db address-index stores a bloom of the senders, recipients and
+accounts in alloc of substates of each block in a given block segment in
+src-path, for db-address-blocks to skip blocks without a given address.
+Putting or deleting a substate of a block deletes the bloom of the block.
+`,
+	Category: "db",
+}
+
+func addressIndex(ctx *cli.Context) error {
+	var err error
+
+	srcPath := ctx.Path("src-path")
+	srcBackend, err := rawdb.NewLevelDBDatabase(srcPath, 1024, 100, "srcDB", false)
+	if err != nil {
+		return fmt.Errorf("substate-cli db address-index: error opening %s: %v", srcPath, err)
+	}
+	srcDB := research.NewSubstateDB(srcBackend)
+	defer srcDB.Close()
+
+	segment, err := research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), srcDB)
+	if err != nil {
+		return fmt.Errorf("substate-cli db address-index: error parsing block segment: %s", err)
+	}
+
+	numBlocks, err := srcDB.BuildAddressIndex(segment.First, segment.Last)
+	if err != nil {
+		return fmt.Errorf("substate-cli db address-index: %v", err)
+	}
+	fmt.Printf("substate-cli db address-index: %v blocks indexed in block segment %v-%v\n", numBlocks, segment.First, segment.Last)
+	return nil
+}
+
+var AddressBlocksCommand = &cli.Command{
+	Action: addressBlocks,
+	Name:   "db-address-blocks",
+	Usage:  "Print blocks with a given address in a given block segment",
+	Flags: []cli.Flag{
+		research.BlockSegmentFlag,
+		&cli.PathFlag{
+			Name:     "src-path",
+			Usage:    "Source DB path",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "address",
+			Usage:    "Address to find as sender, recipient or an account in alloc",
+			Required: true,
+		},
+	},
+	Description: `
+substate-cli db address-blocks prints blocks of src-path in a given block
+segment with a substate whose sender, recipient or account in alloc is the
+given address, one block per line. Blocks ruled out by the bloom index of
+db-address-index are skipped, and substates of the other blocks are decoded.
+`,
+	Category: "db",
+}
+
+func addressBlocks(ctx *cli.Context) error {
+	var err error
+
+	s := ctx.String("address")
+	if !common.IsHexAddress(s) {
+		return fmt.Errorf("substate-cli db address-blocks: invalid address %q", s)
+	}
+	addr := common.HexToAddress(s)
+
+	srcPath := ctx.Path("src-path")
+	srcBackend, err := rawdb.NewLevelDBDatabase(srcPath, 1024, 100, "srcDB", true)
+	if err != nil {
+		return fmt.Errorf("substate-cli db address-blocks: error opening %s: %v", srcPath, err)
+	}
+	srcDB := research.NewSubstateDB(srcBackend)
+	defer srcDB.Close()
+
+	segment, err := research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), srcDB)
+	if err != nil {
+		return fmt.Errorf("substate-cli db address-blocks: error parsing block segment: %s", err)
+	}
+
+	blocks, err := srcDB.BlocksTouchingAddress(addr, segment.First, segment.Last)
+	if err != nil {
+		return fmt.Errorf("substate-cli db address-blocks: %v", err)
+	}
+	for _, block := range blocks {
+		fmt.Println(block)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/research"
@@ -14,28 +15,88 @@ var CloneCommand = &cli.Command{
 	Usage:  "Create a clone DB of a given block segment",
 	Flags: []cli.Flag{
 		research.WorkersFlag,
+		research.ParallelTxsFlag,
+		research.TxLimitFlag,
+		research.BlockStrideFlag,
 		research.BlockSegmentFlag,
+		research.TargetAddressFlag,
+		research.SummaryJSONFlag,
+		research.CheckpointFlag,
+		research.MetricsAddrFlag,
+		research.ProfileFlag,
+		research.MemProfileFlag,
 		&cli.PathFlag{
 			Name:     "src-path",
 			Usage:    "Source DB path",
 			Required: true,
 		},
 		&cli.PathFlag{
-			Name:     "dst-path",
-			Usage:    "Destination DB path",
-			Required: true,
+			Name:  "dst-path",
+			Usage: "Destination DB path, required unless --dry-run is set",
+		},
+		&cli.PathFlag{
+			Name:  "fix-map",
+			Usage: "JSON or CSV file of storage slots to delete from cloned substates",
+		},
+		&cli.PathFlag{
+			Name:  "strip-slots",
+			Usage: "JSON or CSV file of storage slots to delete from every cloned substate",
+		},
+		&cli.BoolFlag{
+			Name:  "strip-unchanged-code",
+			Usage: "Skip writing bytecode unchanged between InputAlloc and OutputAlloc or already in dst-path, which saves writes but not disk space",
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "Number of substates written at once to dst-path, 1 to write each substate immediately",
+			Value: research.DefaultSubstateBatchSize,
+		},
+		&cli.IntFlag{
+			Name:  "write-buffer",
+			Usage: "Number of substates read from src-path but not written to dst-path yet, after which reading waits for writing",
+			Value: research.DefaultCloneWriteBuffer,
+		},
+		&cli.BoolFlag{
+			Name:  "verify",
+			Usage: "Check that every substate of src-path cloned in the block segment is stored in dst-path after cloning",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print substates to be cloned without creating dst-path",
 		},
 	},
 	Description: `
 substate-cli db clone creates a clone DB of a given block segment.
 This loads a complete substate from src-path, then save it to dst path.
 The dst-path will always store substates in the latest encoding.
+With --fix-map, storage slots listed in a JSON or CSV file of
+{block, tx, address, storageHash} entries are deleted from InputAlloc and
+OutputAlloc of cloned substates.
+With --strip-slots, storage slots listed in a JSON or CSV file of
+{address, storageHash} entries are deleted from every cloned substate,
+in addition to --fix-map.
+With --strip-unchanged-code, bytecode unchanged between InputAlloc and
+OutputAlloc or already stored in dst-path is not written again. Bytecode is
+stored by code hash, so this saves writes but not disk space.
+Substates are read by --workers workers and written to dst-path by
+a separate writer in batches of --batch-size substates, so that slow writes
+do not stall reads until --write-buffer substates are pending.
+With --verify, every substate of src-path in the block segment which is not
+filtered out is checked after cloning to be stored in dst-path with the same
+bytes as the substate with --fix-map and --strip-slots applied, and the
+command fails if any of them is missing or differs.
+With --dry-run, substates are only listed, dst-path is not created and
+need not be given.
 `,
 	Category: "db",
 }
 
-func clone(ctx *cli.Context) error {
-	var err error
+func clone(ctx *cli.Context) (err error) {
+	stopProfiles, err := research.StartProfilesCli("substate-cli db clone", ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli db clone: %v", err)
+	}
+	defer stopProfiles()
 
 	srcPath := ctx.Path("src-path")
 	srcBackend, err := rawdb.NewLevelDBDatabase(srcPath, 1024, 100, "srcDB", true)
@@ -45,34 +106,166 @@ func clone(ctx *cli.Context) error {
 	srcDB := research.NewSubstateDB(srcBackend)
 	defer srcDB.Close()
 
-	// Create dst DB
-	dstPath := ctx.Path("dst-path")
-	dstBackend, err := rawdb.NewLevelDBDatabase(dstPath, 1024, 100, "srcDB", false)
-	if err != nil {
-		return fmt.Errorf("substate-cli db clone: error creating %s: %v", dstPath, err)
+	fixMap := make(research.FixMap)
+	if ctx.IsSet("fix-map") {
+		fixMap, err = research.LoadFixMap(ctx.Path("fix-map"))
+		if err != nil {
+			return fmt.Errorf("substate-cli db clone: %v", err)
+		}
 	}
-	dstDB := research.NewSubstateDB(dstBackend)
-	defer dstDB.Close()
 
-	cloneTask := func(block uint64, tx int, substate *research.Substate, taskPool *research.SubstateTaskPool) error {
-		dstDB.PutSubstate(block, tx, substate)
-		return nil
+	slotFilter := make(research.SlotFilter)
+	if ctx.IsSet("strip-slots") {
+		slotFilter, err = research.LoadSlotFilter(ctx.Path("strip-slots"))
+		if err != nil {
+			return fmt.Errorf("substate-cli db clone: %v", err)
+		}
 	}
 
-	taskPool := &research.SubstateTaskPool{
-		Name:     "substate-cli db clone",
-		TaskFunc: cloneTask,
-		Config:   research.NewSubstateTaskConfigCli(ctx),
+	dryRun := ctx.Bool("dry-run")
+	verify := ctx.Bool("verify")
+	if dryRun && verify {
+		return fmt.Errorf("substate-cli db clone: --dry-run and --verify cannot be used together")
+	}
+	// substates not cloned after the tx limit cannot be told from lost ones
+	if verify && ctx.Int(research.TxLimitFlag.Name) > 0 {
+		return fmt.Errorf("substate-cli db clone: --%s and --verify cannot be used together", research.TxLimitFlag.Name)
+	}
 
-		DB: srcDB,
+	if !dryRun && !ctx.IsSet("dst-path") {
+		return fmt.Errorf("substate-cli db clone: --dst-path is required unless --dry-run is set")
 	}
 
-	segment, err := research.ParseBlockSegment(ctx.String(research.BlockSegmentFlag.Name))
+	stripCode := ctx.Bool("strip-unchanged-code")
+
+	config, err := research.NewSubstateTaskConfigCli(ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli db clone: %v", err)
+	}
+	taskMetrics, err := research.NewSubstateTaskMetricsCli("substate-cli db clone", ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli db clone: %v", err)
+	}
+
+	segment, err := research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), srcDB)
 	if err != nil {
 		return fmt.Errorf("substate-cli db clone: error parsing block segment: %s", err)
 	}
 
-	err = taskPool.ExecuteSegment(segment)
+	var numDryRun, numFixed, numStripped, numDuplicateCodes int64
+	var taskPool *research.SubstateTaskPool
+	var pipeline *research.SubstateClonePipeline
+	var dstDB *research.SubstateDB
+	var batch *research.SubstateBatch
+	if dryRun {
+		dryRunTask := func(block uint64, tx int, substate *research.Substate, taskPool *research.SubstateTaskPool) error {
+			fixed := fixMap.Apply(block, tx, substate)
+			stripped := slotFilter.Apply(substate)
+			fmt.Printf("substate-cli db clone: dry-run: would write substate %v_%v, %v slots fixed, %v slots stripped\n", block, tx, fixed, stripped)
+			atomic.AddInt64(&numDryRun, 1)
+			atomic.AddInt64(&numFixed, int64(fixed))
+			atomic.AddInt64(&numStripped, int64(stripped))
+			return nil
+		}
+		taskPool = research.NewSubstateTaskPoolWithDB("substate-cli db clone", dryRunTask, config, srcDB)
+	} else {
+		// Create dst DB
+		dstPath := ctx.Path("dst-path")
+		dstBackend, openErr := rawdb.NewLevelDBDatabase(dstPath, 1024, 100, "srcDB", false)
+		if openErr != nil {
+			return fmt.Errorf("substate-cli db clone: error creating %s: %v", dstPath, openErr)
+		}
+		dstDB = research.NewSubstateDB(dstBackend)
+		defer dstDB.Close()
+
+		// write the tail of the segment, also after an error or interruption
+		batch = dstDB.NewBatch(ctx.Int("batch-size"))
+		defer func() {
+			if flushErr := batch.Flush(); flushErr != nil && err == nil {
+				err = fmt.Errorf("substate-cli db clone: error writing %s: %v", dstPath, flushErr)
+			}
+		}()
+
+		// substates are written by the writer of the pipeline
+		write := func(block uint64, tx int, substate *research.Substate) error {
+			if stripCode {
+				duplicates, err := batch.PutSubstateStripCode(block, tx, substate)
+				numDuplicateCodes += int64(duplicates)
+				return err
+			}
+			return batch.PutSubstate(block, tx, substate)
+		}
+		pipeline = research.NewSubstateClonePipeline(research.CloneConfig{WriteBuffer: ctx.Int("write-buffer")}, write)
+
+		fixTask := func(block uint64, tx int, substate *research.Substate, taskPool *research.SubstateTaskPool) error {
+			fixMap.Apply(block, tx, substate)
+			stripped := slotFilter.Apply(substate)
+			atomic.AddInt64(&numStripped, int64(stripped))
+			return nil
+		}
+		taskPool = pipeline.NewTaskPool("substate-cli db clone", config, srcDB, fixTask)
+		// a block is checkpointed only after its substates are flushed to dst-path
+		taskPool.CheckpointSyncFunc = func() error {
+			return pipeline.Sync(batch.Flush)
+		}
+	}
+	taskPool.SummaryPath = ctx.Path(research.SummaryJSONFlag.Name)
+	taskPool.CheckpointPath = ctx.Path(research.CheckpointFlag.Name)
+	taskPool.Metrics = taskMetrics
+
+	// stop scheduling blocks on the first SIGINT or SIGTERM
+	signalCtx, stop := research.NotifySignalContext(ctx.Context)
+	defer stop()
+	err = taskPool.ExecuteSegmentContext(signalCtx, segment)
+	if pipeline != nil {
+		// write substates remaining in the pipeline before the batch is flushed
+		if closeErr := pipeline.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("substate-cli db clone: error writing %s: %v", ctx.Path("dst-path"), closeErr)
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("substate-cli db clone: dry-run: would write %v substates, %v slots fixed\n", numDryRun, numFixed)
+	}
+	if stripCode && !dryRun {
+		fmt.Printf("substate-cli db clone: %v duplicate code references not written\n", numDuplicateCodes)
+	}
+	if len(slotFilter) > 0 {
+		fmt.Printf("substate-cli db clone: %v storage slots stripped\n", numStripped)
+	}
+
+	if verify && err == nil {
+		err = verifyClone(srcDB, dstDB, batch, taskPool, segment, func(block uint64, tx int, substate *research.Substate) {
+			fixMap.Apply(block, tx, substate)
+			slotFilter.Apply(substate)
+		})
+	}
 
 	return err
 }
+
+// verifyClone checks that every substate of srcDB in segment selected by
+// taskPool is stored in dstDB after the remaining batch is written, with
+// transform applied to it.
+func verifyClone(srcDB, dstDB *research.SubstateDB, batch *research.SubstateBatch, taskPool *research.SubstateTaskPool, segment *research.BlockSegment, transform func(block uint64, tx int, substate *research.Substate)) error {
+	if err := batch.Flush(); err != nil {
+		return fmt.Errorf("substate-cli db clone: error writing dst-path: %v", err)
+	}
+
+	include := func(block uint64, tx int, substate *research.Substate) bool {
+		return taskPool.SelectsSubstate(segment, block, substate)
+	}
+	numChecked, diffs, err := research.VerifyClone(srcDB, dstDB, segment.First, segment.Last, include, transform, 0)
+	if err != nil {
+		return fmt.Errorf("substate-cli db clone: verify: %v", err)
+	}
+	for _, d := range diffs {
+		fmt.Printf("substate-cli db clone: verify: %v\n", d)
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("substate-cli db clone: verify: %v mismatches found in block segment %v-%v", len(diffs), segment.First, segment.Last)
+	}
+	fmt.Printf("substate-cli db clone: verify: %v substates match in block segment %v-%v\n", numChecked, segment.First, segment.Last)
+	return nil
+}
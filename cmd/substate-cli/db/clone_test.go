@@ -0,0 +1,103 @@
+package db
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/research"
+	cli "github.com/urfave/cli/v2"
+)
+
+// newTestSubstate returns a transfer substate of block.
+func newTestSubstate(block uint64, tx int) *research.Substate {
+	sender := common.Address{0x01, byte(tx)}
+	recipient := common.Address{0x02, byte(tx)}
+	inputAlloc := research.SubstateAlloc{
+		sender: research.NewSubstateAccount(0, big.NewInt(1_000_000), nil),
+	}
+	outputAlloc := research.SubstateAlloc{
+		sender:    research.NewSubstateAccount(1, big.NewInt(999_000), nil),
+		recipient: research.NewSubstateAccount(0, big.NewInt(1_000), nil),
+	}
+	env := &research.SubstateEnv{
+		Coinbase:    common.Address{0xcb},
+		Difficulty:  big.NewInt(1),
+		GasLimit:    30_000_000,
+		Number:      block,
+		Timestamp:   block * 12,
+		BlockHashes: make(map[uint64]common.Hash),
+	}
+	msg := &research.SubstateMessage{
+		CheckNonce: true,
+		GasPrice:   big.NewInt(0),
+		Gas:        21_000,
+		From:       sender,
+		To:         &recipient,
+		Value:      big.NewInt(1_000),
+	}
+	result := &research.SubstateResult{
+		Status:  types.ReceiptStatusSuccessful,
+		GasUsed: 21_000,
+	}
+	return research.NewSubstate(inputAlloc, outputAlloc, env, msg, result)
+}
+
+// newTestSrcDB creates a substate DB in a temporary directory with substates
+// of blocks 1 to 3, and returns its path.
+func newTestSrcDB(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "src")
+	backend, err := rawdb.NewLevelDBDatabase(path, 1024, 100, "srcDB", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db := research.NewSubstateDB(backend)
+	for block := uint64(1); block <= 3; block++ {
+		db.PutSubstate(block, 0, newTestSubstate(block, 0))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return path
+}
+
+func runClone(args ...string) error {
+	app := &cli.App{Commands: []*cli.Command{CloneCommand}}
+	return app.Run(append([]string{"substate-cli", "db-clone"}, args...))
+}
+
+func TestCloneDryRun(t *testing.T) {
+	srcPath := newTestSrcDB(t)
+
+	// dry-run does not create dst-path
+	dstPath := filepath.Join(t.TempDir(), "dst")
+	if err := runClone("--src-path", srcPath, "--dst-path", dstPath, "--block-segment", "1-3", "--dry-run"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(dstPath); !os.IsNotExist(err) {
+		t.Fatalf("dst-path is created by dry-run: %v", err)
+	}
+
+	// dry-run does not write to an existing dst-path
+	emptyPath := t.TempDir()
+	if err := runClone("--src-path", srcPath, "--dst-path", emptyPath, "--block-segment", "1-3", "--dry-run"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entries, err := os.ReadDir(emptyPath); err != nil || len(entries) != 0 {
+		t.Fatalf("dst-path is written by dry-run: %v (%v)", entries, err)
+	}
+
+	// dst-path is only required without dry-run
+	if err := runClone("--src-path", srcPath, "--block-segment", "1-3", "--dry-run"); err != nil {
+		t.Fatalf("unexpected error without dst-path: %v", err)
+	}
+	err := runClone("--src-path", srcPath, "--block-segment", "1-3")
+	if err == nil || !strings.Contains(err.Error(), "--dst-path is required") {
+		t.Fatalf("unexpected error: have %v, want --dst-path is required", err)
+	}
+}
@@ -2,13 +2,13 @@ package db
 
 import (
 	"fmt"
-	"sync"
+	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/research"
-	"github.com/syndtr/goleveldb/leveldb"
-	leveldb_opt "github.com/syndtr/goleveldb/leveldb/opt"
-	leveldb_util "github.com/syndtr/goleveldb/leveldb/util"
 	cli "github.com/urfave/cli/v2"
 )
 
@@ -18,44 +18,75 @@ var CompactCommand = &cli.Command{
 	Usage:  "Compat LevelDB isntance",
 	Flags: []cli.Flag{
 		research.SubstateDirFlag,
+		&cli.StringFlag{
+			Name:  research.BlockSegmentFlag.Name,
+			Usage: "Block segment of substates to compact (default: full key space)",
+		},
 	},
 	Description: `
 The substate-cli db compact LevelDB instance - discarding deleted and
-overwritten versions`,
+overwritten versions. If --block-segment is given, only substates of the
+block segment are compacted.`,
 	Category: "db",
 }
 
+// dirSize returns the total size of files in a directory.
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
 func compact(ctx *cli.Context) error {
 	var err error
 
 	dbPath := ctx.Path(research.SubstateDirFlag.Name)
-	dbOpt := &leveldb_opt.Options{
-		BlockCacheCapacity:     1 * leveldb_opt.GiB,
-		OpenFilesCacheCapacity: 50,
-
-		ErrorIfMissing: true,
-		ReadOnly:       false,
+	if _, err = os.Stat(dbPath); err != nil {
+		return fmt.Errorf("substate-cli db compact: error opening dbPath %s: %v", dbPath, err)
 	}
-	db, err := leveldb.OpenFile(dbPath, dbOpt)
+	backend, err := rawdb.NewLevelDBDatabase(dbPath, 1024, 50, "substatedir", false)
 	if err != nil {
 		return fmt.Errorf("substate-cli db compact: error opening dbPath %s: %v", dbPath, err)
 	}
+	db := research.NewSubstateDB(backend)
+	defer db.Close()
 
-	start := time.Now()
-	fmt.Printf("substate-cli db compact: compaction begin\n")
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		err = db.CompactRange(leveldb_util.Range{})
+	var segment *research.BlockSegment
+	if ctx.IsSet(research.BlockSegmentFlag.Name) {
+		segment, err = research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), db)
 		if err != nil {
-			panic(fmt.Errorf("substate-cli db compact: error compacting dbPath %s: %v", dbPath, err))
+			return fmt.Errorf("substate-cli db compact: error parsing block segment: %s", err)
 		}
-		wg.Done()
-	}()
-	wg.Wait()
+	}
+
+	sizeBefore, sizeErr := dirSize(dbPath)
+
+	start := time.Now()
+	if segment != nil {
+		fmt.Printf("substate-cli db compact: compaction begin: block segment %v-%v\n", segment.First, segment.Last)
+		err = db.CompactSubstates(segment.First, segment.Last)
+	} else {
+		fmt.Printf("substate-cli db compact: compaction begin\n")
+		err = db.Compact(nil, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("substate-cli db compact: error compacting dbPath %s: %v", dbPath, err)
+	}
 	duration := time.Since(start)
 	fmt.Printf("substate-cli db compact: compaction completed\n")
 	fmt.Printf("substate-cli db compact: elapsed time: %v\n", duration.Round(1*time.Millisecond))
 
+	if sizeAfter, err := dirSize(dbPath); sizeErr == nil && err == nil {
+		fmt.Printf("substate-cli db compact: size: %v -> %v\n", common.StorageSize(sizeBefore), common.StorageSize(sizeAfter))
+	}
+
 	return nil
 }
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/research"
+	cli "github.com/urfave/cli/v2"
+)
+
+var HistogramCommand = &cli.Command{
+	Action: histogram,
+	Name:   "db-histogram",
+	Usage:  "Print a histogram of transactions per block in a given block segment",
+	Flags: []cli.Flag{
+		research.BlockSegmentFlag,
+		&cli.PathFlag{
+			Name:     "src-path",
+			Usage:    "Source DB path",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "bucket-size",
+			Usage: "Number of transactions per histogram bucket",
+			Value: 10,
+		},
+		&cli.BoolFlag{
+			Name:  "csv",
+			Usage: "Print the number of transactions of each block in CSV instead of the histogram",
+		},
+	},
+	Description: `
+substate-cli db histogram counts substates of each block of src-path in a
+given block segment without decoding them, and prints a histogram of the
+numbers of transactions per block with their min, median, max and mean.
+Blocks without substates are counted as blocks of 0 transactions.
+`,
+	Category: "db",
+}
+
+// histogramBarWidth is the width of the longest bar of the histogram.
+const histogramBarWidth = 50
+
+func histogram(ctx *cli.Context) error {
+	var err error
+
+	srcPath := ctx.Path("src-path")
+	srcBackend, err := rawdb.NewLevelDBDatabase(srcPath, 1024, 100, "srcDB", true)
+	if err != nil {
+		return fmt.Errorf("substate-cli db histogram: error opening %s: %v", srcPath, err)
+	}
+	srcDB := research.NewSubstateDB(srcBackend)
+	defer srcDB.Close()
+
+	segment, err := research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), srcDB)
+	if err != nil {
+		return fmt.Errorf("substate-cli db histogram: error parsing block segment: %s", err)
+	}
+	bucketSize := ctx.Int("bucket-size")
+	if bucketSize < 1 {
+		return fmt.Errorf("substate-cli db histogram: --bucket-size must be positive: %v", bucketSize)
+	}
+
+	counts := srcDB.BlockTxCounts(segment.First, segment.Last)
+	if ctx.Bool("csv") {
+		fmt.Println("block,txs")
+		for _, count := range counts {
+			fmt.Printf("%v,%v\n", count.Block, count.Txs)
+		}
+		return nil
+	}
+
+	h := research.NewTxCountHistogram(counts, bucketSize)
+	if h.NumBlocks == 0 {
+		fmt.Printf("substate-cli db histogram: no block found in block segment %v-%v\n", segment.First, segment.Last)
+		return nil
+	}
+	fmt.Printf("substate-cli db histogram: %v blocks, %v txs\n", h.NumBlocks, h.NumTxs)
+	fmt.Printf("substate-cli db histogram: txs per block: min %v, median %v, max %v, mean %.2f\n", h.Min, h.Median, h.Max, h.Mean)
+
+	var maxBucket uint64
+	for _, n := range h.Buckets {
+		if n > maxBucket {
+			maxBucket = n
+		}
+	}
+	for i, n := range h.Buckets {
+		label := fmt.Sprintf("%v-%v", i*bucketSize, (i+1)*bucketSize-1)
+		if bucketSize == 1 {
+			label = fmt.Sprint(i)
+		}
+		bar := strings.Repeat("#", int(n*histogramBarWidth/maxBucket))
+		fmt.Printf("%12s txs | %10v | %s\n", label, n, bar)
+	}
+	return nil
+}
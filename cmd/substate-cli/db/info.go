@@ -0,0 +1,94 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/research"
+	cli "github.com/urfave/cli/v2"
+)
+
+var InfoCommand = &cli.Command{
+	Action: info,
+	Name:   "db-info",
+	Usage:  "Print a summary of a substate DB",
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:     "src-path",
+			Usage:    "Source DB path",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  research.BlockSegmentFlag.Name,
+			Usage: "Block segment to scope the substate count (default: all blocks)",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the summary in JSON",
+		},
+	},
+	Description: `
+substate-cli db info opens a substate DB read-only and prints its path, first
+and last block, the numbers of blocks and substates, and the encoding and
+encoding version of the first stored substate. The count and the encoding are
+scoped to the block segment if --block-segment is given.
+`,
+	Category: "db",
+}
+
+func info(ctx *cli.Context) error {
+	var err error
+
+	srcPath := ctx.Path("src-path")
+	srcBackend, err := rawdb.NewLevelDBDatabase(srcPath, 1024, 100, "srcDB", true)
+	if err != nil {
+		return fmt.Errorf("substate-cli db info: error opening %s: %v", srcPath, err)
+	}
+	srcDB := research.NewSubstateDB(srcBackend)
+	defer srcDB.Close()
+
+	segment := &research.BlockSegment{First: 0, Last: research.OpenBlockSegmentLast}
+	if ctx.IsSet(research.BlockSegmentFlag.Name) {
+		segment, err = research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), srcDB)
+		if err != nil {
+			return fmt.Errorf("substate-cli db info: error parsing block segment: %s", err)
+		}
+	}
+
+	dbInfo, err := srcDB.Info(segment.First, segment.Last)
+	if err != nil {
+		return fmt.Errorf("substate-cli db info: error reading %s: %v", srcPath, err)
+	}
+
+	if ctx.Bool("json") {
+		out := struct {
+			Path string `json:"path"`
+			*research.SubstateDBInfo
+		}{srcPath, dbInfo}
+		b, err := json.MarshalIndent(out, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	fmt.Printf("substate-cli db info: path: %s\n", srcPath)
+	if dbInfo.NumTxs == 0 && !ctx.IsSet(research.BlockSegmentFlag.Name) {
+		fmt.Printf("substate-cli db info: no substate found\n")
+		return nil
+	}
+	fmt.Printf("substate-cli db info: first block: %v\n", dbInfo.FirstBlock)
+	fmt.Printf("substate-cli db info: last block: %v\n", dbInfo.LastBlock)
+	if ctx.IsSet(research.BlockSegmentFlag.Name) {
+		fmt.Printf("substate-cli db info: block segment: %v-%v\n", segment.First, segment.Last)
+	}
+	fmt.Printf("substate-cli db info: blocks: %v\n", dbInfo.NumBlocks)
+	fmt.Printf("substate-cli db info: substates: %v\n", dbInfo.NumTxs)
+	if dbInfo.Encoding != "" {
+		fmt.Printf("substate-cli db info: encoding: %s (version %v)\n", dbInfo.Encoding, dbInfo.EncodingVersion)
+	}
+
+	return nil
+}
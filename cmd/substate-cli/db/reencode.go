@@ -0,0 +1,83 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/research"
+	cli "github.com/urfave/cli/v2"
+)
+
+var ReencodeCommand = &cli.Command{
+	Action: reencode,
+	Name:   "db-reencode",
+	Usage:  "Rewrite substates of a given block segment in the latest encoding",
+	Flags: []cli.Flag{
+		research.BlockSegmentFlag,
+		&cli.PathFlag{
+			Name:     "src-path",
+			Usage:    "Source DB path",
+			Required: true,
+		},
+		&cli.PathFlag{
+			Name:  "dst-path",
+			Usage: "Destination DB path, src-path is rewritten in place if it is not given",
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Usage: "Number of substates written at once",
+			Value: research.DefaultSubstateBatchSize,
+		},
+	},
+	Description: `
+substate-cli db reencode reads every substate of src-path in a given block
+segment and rewrites it in the latest encoding. Without --dst-path, only
+substates in the berlin or legacy encoding are rewritten in src-path. With
+--dst-path, every substate is written to dst-path and src-path is not
+modified. Unlike db-upgrade, this does not change the DB layout, and unlike
+db-clone, substates are not rewritten otherwise.
+`,
+	Category: "db",
+}
+
+func reencode(ctx *cli.Context) error {
+	var err error
+
+	srcPath := ctx.Path("src-path")
+	dstPath := ctx.Path("dst-path")
+	inPlace := dstPath == "" || dstPath == srcPath
+
+	srcBackend, err := rawdb.NewLevelDBDatabase(srcPath, 1024, 100, "srcDB", !inPlace)
+	if err != nil {
+		return fmt.Errorf("substate-cli db reencode: error opening %s: %v", srcPath, err)
+	}
+	srcDB := research.NewSubstateDB(srcBackend)
+	defer srcDB.Close()
+
+	dstDB := srcDB
+	if !inPlace {
+		dstBackend, err := rawdb.NewLevelDBDatabase(dstPath, 1024, 100, "dstDB", false)
+		if err != nil {
+			return fmt.Errorf("substate-cli db reencode: error creating %s: %v", dstPath, err)
+		}
+		dstDB = research.NewSubstateDB(dstBackend)
+		defer dstDB.Close()
+	}
+
+	segment, err := research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), srcDB)
+	if err != nil {
+		return fmt.Errorf("substate-cli db reencode: error parsing block segment: %s", err)
+	}
+
+	stats, err := research.ReencodeSubstates(srcDB, dstDB, segment.First, segment.Last, ctx.Int("batch-size"))
+	for _, encoding := range []string{research.SubstateEncodingBerlin, research.SubstateEncodingLegacy} {
+		if n := stats.Upgraded[encoding]; n > 0 {
+			fmt.Printf("substate-cli db reencode: %v substates upgraded from %v encoding\n", n, encoding)
+		}
+	}
+	fmt.Printf("substate-cli db reencode: %v substates upgraded, %v substates already in latest encoding\n", stats.NumUpgraded(), stats.Current)
+	if err != nil {
+		return fmt.Errorf("substate-cli db reencode: %v", err)
+	}
+	return nil
+}
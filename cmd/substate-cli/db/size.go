@@ -0,0 +1,74 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/research"
+	cli "github.com/urfave/cli/v2"
+)
+
+var SizeCommand = &cli.Command{
+	Action: size,
+	Name:   "db-size",
+	Usage:  "Print the storage footprint of substates in a given block segment",
+	Flags: []cli.Flag{
+		research.BlockSegmentFlag,
+		&cli.PathFlag{
+			Name:     "src-path",
+			Usage:    "Source DB path",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the report in JSON",
+		},
+	},
+	Description: `
+substate-cli db size decodes substates of src-path in a given block segment and
+prints the number of substates, the size of stored substate values, and the
+numbers of storage slots and the approximate sizes of input and output allocs.
+Bytecode is stored once per code hash and is not in the size of stored values,
+but in the sizes of allocs.
+`,
+	Category: "db",
+}
+
+func size(ctx *cli.Context) error {
+	var err error
+
+	srcPath := ctx.Path("src-path")
+	srcBackend, err := rawdb.NewLevelDBDatabase(srcPath, 1024, 100, "srcDB", true)
+	if err != nil {
+		return fmt.Errorf("substate-cli db size: error opening %s: %v", srcPath, err)
+	}
+	srcDB := research.NewSubstateDB(srcBackend)
+	defer srcDB.Close()
+
+	segment, err := research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), srcDB)
+	if err != nil {
+		return fmt.Errorf("substate-cli db size: error parsing block segment: %s", err)
+	}
+
+	report, err := srcDB.SizeReport(segment.First, segment.Last)
+	if err != nil {
+		return fmt.Errorf("substate-cli db size: %v", err)
+	}
+
+	if ctx.Bool("json") {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	fmt.Printf("substate-cli db size: block segment: %v-%v\n", segment.First, segment.Last)
+	fmt.Printf("substate-cli db size: substates: %v\n", report.NumTxs)
+	fmt.Printf("substate-cli db size: stored bytes: %v\n", report.EncodedBytes)
+	fmt.Printf("substate-cli db size: input alloc: %v storage slots, about %v bytes\n", report.InputStorageSlots, report.InputAllocBytes)
+	fmt.Printf("substate-cli db size: output alloc: %v storage slots, about %v bytes\n", report.OutputStorageSlots, report.OutputAllocBytes)
+	return nil
+}
@@ -108,7 +108,7 @@ func upgrade(ctx *cli.Context) error {
 			if err != nil {
 				panic(err)
 			}
-			key := research.Stage1SubstateKey(block, tx)
+			key := research.EncodeSubstateKey(block, tx)
 			err = newSubstateDB.Put(key, value, nil)
 			if err != nil {
 				panic(err)
@@ -0,0 +1,67 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/research"
+	cli "github.com/urfave/cli/v2"
+)
+
+// runExport exports substates of --block-segment in --src-path to --out, or
+// to stdout if --out is not given, with an exporter created by newExporter.
+func runExport(ctx *cli.Context, name string, newExporter func(w io.Writer) *research.SubstateExporter) (err error) {
+	srcPath := ctx.Path("src-path")
+	srcBackend, err := rawdb.NewLevelDBDatabase(srcPath, 1024, 100, "srcDB", true)
+	if err != nil {
+		return fmt.Errorf("%s: error opening %s: %v", name, srcPath, err)
+	}
+	srcDB := research.NewSubstateDB(srcBackend)
+	defer srcDB.Close()
+
+	segment, err := research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), srcDB)
+	if err != nil {
+		return fmt.Errorf("%s: error parsing block segment: %s", name, err)
+	}
+
+	config, err := research.NewSubstateTaskConfigCli(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	var out io.Writer = os.Stdout
+	if ctx.IsSet("out") {
+		outPath := ctx.Path("out")
+		file, err := os.Create(outPath)
+		if err != nil {
+			return fmt.Errorf("%s: error creating %s: %v", name, outPath, err)
+		}
+		defer func() {
+			if closeErr := file.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("%s: error closing %s: %v", name, outPath, closeErr)
+			}
+		}()
+		out = file
+	}
+
+	exporter := newExporter(out)
+	taskPool := &research.SubstateTaskPool{
+		Name:     name,
+		TaskFunc: exporter.Task,
+		Config:   config,
+
+		DB: srcDB,
+
+		// keep stdout for exported substates
+		Quiet:         !ctx.IsSet("out"),
+		BlockDoneFunc: exporter.BlockDone,
+	}
+
+	err = taskPool.ExecuteSegment(segment)
+	if closeErr := exporter.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("%s: error writing substates: %v", name, closeErr)
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package export
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/research"
+	cli "github.com/urfave/cli/v2"
+)
+
+var ExportAccountsCommand = &cli.Command{
+	Action: exportAccounts,
+	Name:   "export-accounts",
+	Usage:  "Export balances and nonces of accounts of a given block segment to CSV",
+	Flags: []cli.Flag{
+		research.WorkersFlag,
+		research.BlockSegmentFlag,
+		&cli.PathFlag{
+			Name:     "src-path",
+			Usage:    "Source DB path",
+			Required: true,
+		},
+		&cli.PathFlag{
+			Name:  "out",
+			Usage: "Output CSV file path (default: stdout)",
+		},
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "Export only the account of the given address",
+		},
+	},
+	Description: `
+substate-cli export-accounts writes a CSV row of
+block,tx,address,balanceBefore,balanceAfter,nonceBefore,nonceAfter
+for each account in InputAlloc or OutputAlloc of substates of a given block
+segment, ordered by block, tx and address. Balances are in wei, and before or
+after fields of an account missing in InputAlloc or OutputAlloc are empty.
+The progress is not printed if --out is not given.
+`,
+	Category: "export",
+}
+
+func exportAccounts(ctx *cli.Context) error {
+	var address *common.Address
+	if ctx.IsSet("address") {
+		s := ctx.String("address")
+		if !common.IsHexAddress(s) {
+			return fmt.Errorf("substate-cli export-accounts: invalid address %q", s)
+		}
+		addr := common.HexToAddress(s)
+		address = &addr
+	}
+
+	return runExport(ctx, "substate-cli export-accounts", func(w io.Writer) *research.SubstateExporter {
+		return research.NewSubstateAccountsCSVExporter(w, address)
+	})
+}
@@ -0,0 +1,36 @@
+package export
+
+import (
+	"github.com/ethereum/go-ethereum/research"
+	cli "github.com/urfave/cli/v2"
+)
+
+var ExportJSONCommand = &cli.Command{
+	Action: exportJSON,
+	Name:   "export-json",
+	Usage:  "Export substates of a given block segment to JSONL",
+	Flags: []cli.Flag{
+		research.WorkersFlag,
+		research.BlockSegmentFlag,
+		&cli.PathFlag{
+			Name:     "src-path",
+			Usage:    "Source DB path",
+			Required: true,
+		},
+		&cli.PathFlag{
+			Name:  "out",
+			Usage: "Output JSONL file path (default: stdout)",
+		},
+	},
+	Description: `
+substate-cli export-json writes substates of a given block segment as JSONL,
+one substate per line with "block" and "tx" fields, ordered by block then tx.
+Addresses, hashes and bytecode are hex-encoded. Substates are read in parallel
+with --workers, and the progress is not printed if --out is not given.
+`,
+	Category: "export",
+}
+
+func exportJSON(ctx *cli.Context) error {
+	return runExport(ctx, "substate-cli export-json", research.NewSubstateJSONLExporter)
+}
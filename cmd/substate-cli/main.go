@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/ethereum/go-ethereum/cmd/substate-cli/db"
+	"github.com/ethereum/go-ethereum/cmd/substate-cli/export"
 	"github.com/ethereum/go-ethereum/cmd/substate-cli/replay"
 	"github.com/ethereum/go-ethereum/internal/flags"
 	cli "github.com/urfave/cli/v2"
@@ -19,9 +20,23 @@ func init() {
 	app.Commands = []*cli.Command{
 		replay.ReplayCommand,
 		replay.ReplayForkCommand,
+		replay.ReplayBenchCommand,
+		replay.GasReportCommand,
 		db.UpgradeCommand,
 		db.CloneCommand,
 		db.CompactCommand,
+		db.InfoCommand,
+		db.DiffCommand,
+		db.ValidateCommand,
+		db.HistogramCommand,
+		db.ReencodeCommand,
+		db.SizeCommand,
+		db.AddressIndexCommand,
+		db.AddressBlocksCommand,
+		export.ExportJSONCommand,
+		export.ImportJSONCommand,
+		export.ExportAccountsCommand,
+		export.ExportCodeCommand,
 	}
 }
 
@@ -0,0 +1,26 @@
+package replay
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/research"
+	"github.com/ethereum/go-ethereum/research/replayer"
+)
+
+// ReplaySingleAccount executes the transaction of a substate with
+// ReplayChainConfig, ReplayBlockHashFunc, ReplayPrimeAccessList and
+// ReplayMaxGas, and returns the post-state of addr only. It returns an error
+// if addr is not in the post-state alloc.
+func ReplaySingleAccount(substate *research.Substate, addr common.Address) (*research.SubstateAccount, error) {
+	_, evmAlloc, err := replayer.ExecuteSubstateWithOptions(substate, ReplayChainConfig, vm.Config{}, replayOptions())
+	if err != nil {
+		return nil, err
+	}
+	account, exist := evmAlloc[addr]
+	if !exist {
+		return nil, fmt.Errorf("account %s is not in post-state alloc", addr.Hex())
+	}
+	return account, nil
+}
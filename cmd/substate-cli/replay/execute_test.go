@@ -0,0 +1,26 @@
+package replay
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestReplaySingleAccount(t *testing.T) {
+	substate := newTransferSubstate(5_000_000, 0)
+	recipient := common.Address{0x02, 0x00}
+
+	account, err := ReplaySingleAccount(substate, recipient)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := substate.OutputAlloc[recipient]
+	if account.Balance.Cmp(want.Balance) != 0 || account.Nonce != want.Nonce {
+		t.Fatalf("recipient mismatch: have balance %v nonce %v, want balance %v nonce %v", account.Balance, account.Nonce, want.Balance, want.Nonce)
+	}
+
+	// an account untouched by the transaction
+	if _, err := ReplaySingleAccount(substate, common.Address{0xff}); err == nil {
+		t.Fatalf("untouched account is found in post-state alloc")
+	}
+}
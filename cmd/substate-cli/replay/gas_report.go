@@ -0,0 +1,59 @@
+package replay
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/research"
+	cli "github.com/urfave/cli/v2"
+)
+
+// record-replay: substate-cli gas-report command
+var GasReportCommand = &cli.Command{
+	Action: gasReportAction,
+	Name:   "gas-report",
+	Usage:  "aggregate recorded gas used by transaction type, without execution",
+	Flags: []cli.Flag{
+		research.WorkersFlag,
+		research.SubstateDirFlag,
+		research.BlockSegmentFlag,
+		&cli.BoolFlag{
+			Name:  "csv",
+			Usage: "Print the report in CSV",
+		},
+	},
+	Description: `
+substate-cli gas-report reads substates in the given block segment and prints
+the number of transactions, the total gas used and the average gas used of
+each transaction type (transfer, call, create) and of all transactions, as
+recorded in their results. Transactions are not executed.`,
+	Category: "replay",
+}
+
+// record-replay: func gasReportAction for gas-report command
+func gasReportAction(ctx *cli.Context) error {
+	research.SetSubstateFlags(ctx)
+	research.OpenSubstateDBReadOnly()
+	defer research.CloseSubstateDB()
+
+	report := &research.GasReport{}
+	taskPool, err := research.NewSubstateTaskPoolCli("substate-cli gas-report", report.Task, ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli gas-report: %v", err)
+	}
+	// keep stdout for the report
+	taskPool.Quiet = ctx.Bool("csv")
+
+	segment, err := research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), taskPool.DB)
+	if err != nil {
+		return fmt.Errorf("substate-cli gas-report: error parsing block segment: %s", err)
+	}
+	if err := taskPool.ExecuteSegment(segment); err != nil {
+		return err
+	}
+
+	if ctx.Bool("csv") {
+		return report.WriteCSV(os.Stdout)
+	}
+	return report.WriteTable(os.Stdout)
+}
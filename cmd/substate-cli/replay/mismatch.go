@@ -0,0 +1,73 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+var ContinueOnMismatchFlag = &cli.BoolFlag{
+	Name:  "continue-on-mismatch",
+	Usage: "Collect inconsistent transactions and replay the whole block segment instead of stopping at the first one",
+}
+
+// replayMismatch is an inconsistent transaction and which of its outputs
+// differ.
+type replayMismatch struct {
+	Block  uint64
+	Tx     int
+	Result bool
+	Alloc  bool
+}
+
+// replayMismatchCollector collects inconsistent transactions of replayTask.
+// It is safe for concurrent use.
+type replayMismatchCollector struct {
+	mu         sync.Mutex
+	mismatches []replayMismatch
+}
+
+func newReplayMismatchCollector() *replayMismatchCollector {
+	return &replayMismatchCollector{}
+}
+
+func (c *replayMismatchCollector) Add(mismatch replayMismatch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mismatches = append(c.mismatches, mismatch)
+}
+
+// Mismatches returns collected inconsistent transactions ordered by block
+// then tx.
+func (c *replayMismatchCollector) Mismatches() []replayMismatch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mismatches := append([]replayMismatch(nil), c.mismatches...)
+	sort.Slice(mismatches, func(i, j int) bool {
+		x, y := mismatches[i], mismatches[j]
+		return x.Block < y.Block || (x.Block == y.Block && x.Tx < y.Tx)
+	})
+	return mismatches
+}
+
+// PrintSummary prints a table of collected inconsistent transactions.
+func (c *replayMismatchCollector) PrintSummary(w io.Writer, name string) {
+	mismatches := c.Mismatches()
+	fmt.Fprintf(w, "%s: %v inconsistent transactions\n", name, len(mismatches))
+	if len(mismatches) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s: %12s %6s %-6s %s\n", name, "block", "tx", "result", "alloc")
+	for _, m := range mismatches {
+		fmt.Fprintf(w, "%s: %12v %6v %-6v %v\n", name, m.Block, m.Tx, m.Result, m.Alloc)
+	}
+}
+
+// replayMismatches collects inconsistent transactions instead of failing
+// replayTask if it is not nil.
+var replayMismatches *replayMismatchCollector
@@ -0,0 +1,75 @@
+package replay
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/research"
+)
+
+func TestReplayContinueOnMismatch(t *testing.T) {
+	db := research.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	want := []replayMismatch{
+		{Block: 5_000_001, Tx: 0, Alloc: true},
+		{Block: 5_000_003, Tx: 1, Alloc: true},
+		{Block: 5_000_003, Tx: 2, Result: true},
+		{Block: 5_000_009, Tx: 0, Alloc: true},
+	}
+	for block := uint64(5_000_000); block < 5_000_010; block++ {
+		for tx := 0; tx < 3; tx++ {
+			db.PutSubstate(block, tx, newTransferSubstate(block, tx))
+		}
+	}
+	for _, m := range want {
+		substate := newMismatchSubstate(m.Block, m.Tx)
+		if m.Result {
+			substate = newTransferSubstate(m.Block, m.Tx)
+			substate.Result.GasUsed++
+		}
+		db.PutSubstate(m.Block, m.Tx, substate)
+	}
+
+	replayReport = newReplayReporter(&bytes.Buffer{})
+	replayMismatches = newReplayMismatchCollector()
+	defer func() {
+		replayReport = newReplayReporter(os.Stdout)
+		replayMismatches = nil
+	}()
+
+	pool := &research.SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: replayTask,
+		Config:   &research.SubstateTaskConfig{Workers: 4, ParallelTxs: 2},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	if err := pool.ExecuteSegment(research.NewBlockSegment(5_000_000, 5_000_009)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	have := replayMismatches.Mismatches()
+	if len(have) != len(want) {
+		t.Fatalf("mismatches mismatch: have %v, want %v", have, want)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("mismatch %v: have %+v, want %+v", i, have[i], want[i])
+		}
+	}
+
+	var summary bytes.Buffer
+	replayMismatches.PrintSummary(&summary, "test")
+	lines := strings.Split(strings.TrimSpace(summary.String()), "\n")
+	if len(lines) != 2+len(want) || lines[0] != "test: 4 inconsistent transactions" {
+		t.Fatalf("summary mismatch:\n%s", summary.String())
+	}
+	if fields := strings.Fields(lines[4]); strings.Join(fields, " ") != "test: 5000003 2 true false" {
+		t.Fatalf("summary row mismatch: %q", lines[4])
+	}
+}
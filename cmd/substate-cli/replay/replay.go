@@ -1,17 +1,21 @@
 package replay
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"math/big"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core"
-	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/vm"
-	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/tracers/logger"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/research"
+	"github.com/ethereum/go-ethereum/research/replayer"
 	"github.com/ethereum/go-ethereum/rlp"
 	cli "github.com/urfave/cli/v2"
 )
@@ -26,17 +30,220 @@ var ReplayCommand = &cli.Command{
 		research.SkipTransferTxsFlag,
 		research.SkipCallTxsFlag,
 		research.SkipCreateTxsFlag,
+		research.TxTypesFlag,
+		research.SkipSuccessTxsFlag,
+		research.SkipFailedTxsFlag,
+		research.MinValueFlag,
+		research.TargetAddressFlag,
+		research.CreatedContractFlag,
+		research.ParallelTxsFlag,
+		research.TxLimitFlag,
+		research.ErrorBudgetFlag,
+		research.TxTypeBreakdownFlag,
+		research.StrictDecodeFlag,
+		research.DebugSerialFlag,
+		research.MaxBlocksPerSecFlag,
+		research.MaxInFlightBytesFlag,
+		research.BlockStrideFlag,
 		research.SubstateDirFlag,
-		research.BlockSegmentFlag,
+		replayBlockSegmentFlag,
+		research.AllBlocksFlag,
+		research.SummaryJSONFlag,
+		research.CheckpointFlag,
+		research.MetricsAddrFlag,
+		research.ProfileFlag,
+		research.MemProfileFlag,
+		CompactDiffFlag,
+		ChainFlag,
+		ChainConfigFlag,
+		TraceFlag,
+		TraceDirFlag,
+		BlockHashesFromDBFlag,
+		PrimeAccessListFlag,
+		MaxGasPerBlockFlag,
+		RPCURLFlag,
+		RewriteOutputPathFlag,
+		ContinueOnMismatchFlag,
+		FollowFlag,
+		FollowIntervalFlag,
+		FollowTimeoutFlag,
 	},
 	Description: `
-substate-cli replay executes transactions in the given block segment
-and check output consistency for faithful replaying.`,
+substate-cli replay executes transactions in the given block segment, or in
+all blocks of the substate DB with --all, and check output consistency for
+faithful replaying. With --follow, it keeps replaying blocks put after the last
+block of the substate DB until interrupted or --follow-timeout.`,
 	Category: "replay",
 }
 
+// replayBlockSegmentFlag is research.BlockSegmentFlag that is not required if
+// --all is given.
+var replayBlockSegmentFlag = &cli.StringFlag{
+	Name:  research.BlockSegmentFlag.Name,
+	Usage: research.BlockSegmentFlag.Usage,
+}
+
+var FollowFlag = &cli.BoolFlag{
+	Name:  "follow",
+	Usage: "Keep replaying new blocks put after the last block of the substate DB, ignoring the last block of --block-segment",
+}
+
+var FollowIntervalFlag = &cli.DurationFlag{
+	Name:  "follow-interval",
+	Usage: "Interval of polling the substate DB for new blocks with --follow",
+	Value: 10 * time.Second,
+}
+
+var FollowTimeoutFlag = &cli.DurationFlag{
+	Name:  "follow-timeout",
+	Usage: "Stop --follow once no new block is found for the given duration, 0 to follow until interrupted",
+}
+
+var CompactDiffFlag = &cli.BoolFlag{
+	Name:  "compact-diff",
+	Usage: "Report only changed nonce, balance, code hash and storage slots of inconsistent accounts",
+}
+
+var ChainFlag = &cli.StringFlag{
+	Name:  "chain",
+	Usage: "Chain config to replay transactions: mainnet, sepolia, goerli, rinkeby or custom",
+	Value: "mainnet",
+}
+
+var ChainConfigFlag = &cli.PathFlag{
+	Name:  "chain-config",
+	Usage: "JSON file of chain config for --chain custom",
+}
+
+// ReplayChainConfig is the chain config to replay transactions, mainnet
+// by default.
+var ReplayChainConfig *params.ChainConfig = newMainnetChainConfig()
+
+// ReplayBlockHashFunc resolves BLOCKHASH of blocks missing in
+// Env.BlockHashes when it is not nil. Otherwise, BLOCKHASH of these blocks
+// returns zero.
+var ReplayBlockHashFunc research.BlockHashFunc
+
+// ReplayPrimeAccessList warms Message.AccessList before execution without
+// charging its intrinsic gas, as replayer.Options.PrimeAccessList.
+var ReplayPrimeAccessList bool
+
+// ReplayMaxGas caps the gas pool of a block, as replayer.Options.MaxGas.
+var ReplayMaxGas uint64
+
+// replayOptions returns replayer.Options of ReplayBlockHashFunc,
+// ReplayPrimeAccessList and ReplayMaxGas.
+func replayOptions() replayer.Options {
+	return replayer.Options{
+		GetBlockHash:    ReplayBlockHashFunc,
+		PrimeAccessList: ReplayPrimeAccessList,
+		MaxGas:          ReplayMaxGas,
+	}
+}
+
+// newMainnetChainConfig returns a copy of mainnet chain config for replay.
+func newMainnetChainConfig() *params.ChainConfig {
+	chainConfig := &params.ChainConfig{}
+	*chainConfig = *params.MainnetChainConfig
+	// disable DAOForkSupport, otherwise account states will be overwritten
+	chainConfig.DAOForkSupport = false
+	return chainConfig
+}
+
+// LoadChainConfig returns the chain config of the given chain name. For the
+// custom chain, the chain config is loaded from a JSON file.
+func LoadChainConfig(chain string, path string) (*params.ChainConfig, error) {
+	chainConfig := &params.ChainConfig{}
+	switch chain {
+	case "mainnet":
+		return newMainnetChainConfig(), nil
+	case "sepolia":
+		*chainConfig = *params.SepoliaChainConfig
+	case "goerli":
+		*chainConfig = *params.GoerliChainConfig
+	case "rinkeby":
+		*chainConfig = *params.RinkebyChainConfig
+	case "custom":
+		if path == "" {
+			return nil, fmt.Errorf("--%s is required for custom chain", ChainConfigFlag.Name)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading chain config %s: %v", path, err)
+		}
+		if err = json.Unmarshal(b, chainConfig); err != nil {
+			return nil, fmt.Errorf("error parsing chain config %s: %v", path, err)
+		}
+		if chainConfig.ChainID == nil {
+			return nil, fmt.Errorf("chain config %s has no chainId", path)
+		}
+	default:
+		return nil, fmt.Errorf("unknown chain %q", chain)
+	}
+	return chainConfig, nil
+}
+
+var TraceFlag = &cli.BoolFlag{
+	Name:  "trace",
+	Usage: "Trace transactions and write JSON traces of inconsistent transactions to --trace-dir",
+}
+
+var TraceDirFlag = &cli.PathFlag{
+	Name:  "trace-dir",
+	Usage: "Directory to write JSON traces of inconsistent transactions",
+	Value: "traces",
+}
+
+var PrimeAccessListFlag = &cli.BoolFlag{
+	Name:  "prime-access-list",
+	Usage: "Warm access list entries before execution without charging their intrinsic gas (EIP-2929 study; GasUsed of access list transactions will differ)",
+}
+
+var MaxGasPerBlockFlag = &cli.Uint64Flag{
+	Name:  "max-gas-per-block",
+	Usage: "Cap the gas pool of a block to the given gas if the block gas limit is greater, and fail transactions with more gas (0: no cap)",
+}
+
+var BlockHashesFromDBFlag = &cli.BoolFlag{
+	Name:  "block-hashes-from-db",
+	Usage: "Resolve BLOCKHASH of blocks not recorded in a substate from substates of the following 256 blocks",
+}
+
+// replayTraceDir is the directory to write traces of inconsistent
+// transactions. Transactions are not traced if it is empty.
+var replayTraceDir string
+
+// writeTrace writes the trace of a transaction to replayTraceDir.
+func writeTrace(block uint64, tx int, trace []byte) (string, error) {
+	path := filepath.Join(replayTraceDir, fmt.Sprintf("%v_%v.jsonl", block, tx))
+	if err := os.WriteFile(path, trace, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+var RewriteOutputPathFlag = &cli.PathFlag{
+	Name:  "rewrite-output-path",
+	Usage: "DB path to write substates with replayed output alloc and result instead of checking consistency",
+}
+
+// replayRewriteDB is the substate DB to write substates with replayed
+// OutputAlloc and Result. Output consistency is not checked if it is set.
+var replayRewriteDB *research.SubstateDB
+
+// replayNumRewritten is the number of rewritten inconsistent substates.
+var replayNumRewritten int64
+
+// replayCompactDiff is true if inconsistent accounts are reported with
+// SubstateAccount.Diff instead of full account JSON.
+var replayCompactDiff bool
+
 // replayTask replays a transaction substate
 func replayTask(block uint64, tx int, substate *research.Substate, taskPool *research.SubstateTaskPool) error {
+	// attribute a partially recorded env to data, not to the EVM
+	if err := research.ValidateEnv(substate.Env); err != nil {
+		return fmt.Errorf("invalid substate: %v", err)
+	}
 
 	inputAlloc := substate.InputAlloc
 	inputEnv := substate.Env
@@ -53,124 +260,93 @@ func replayTask(block uint64, tx int, substate *research.Substate, taskPool *res
 
 	vmConfig = vm.Config{}
 
-	chainConfig = &params.ChainConfig{}
-	*chainConfig = *params.MainnetChainConfig
-	// disable DAOForkSupport, otherwise account states will be overwritten
-	chainConfig.DAOForkSupport = false
+	chainConfig = ReplayChainConfig
 
+	// a tracer is created per transaction, so no locking is needed across workers
+	traceBuf := &bytes.Buffer{}
 	getTracerFn = func(txIndex int, txHash common.Hash) (tracer vm.EVMLogger, err error) {
-		return nil, nil
-	}
-
-	// getHash returns zero for block hash that does not exist
-	getHash := func(num uint64) common.Hash {
-		if inputEnv.BlockHashes == nil {
-			return common.Hash{}
+		if replayTraceDir == "" {
+			return nil, nil
 		}
-		h := inputEnv.BlockHashes[num]
-		return h
-	}
-
-	// Apply Message
-	var (
-		statedb   = MakeOffTheChainStateDB(inputAlloc)
-		gaspool   = new(core.GasPool)
-		blockHash = common.Hash{0x01}
-		txHash    = common.Hash{0x02}
-		txIndex   = tx
-	)
-
-	gaspool.AddGas(inputEnv.GasLimit)
-	blockCtx := vm.BlockContext{
-		CanTransfer: core.CanTransfer,
-		Transfer:    core.Transfer,
-		Coinbase:    inputEnv.Coinbase,
-		BlockNumber: new(big.Int).SetUint64(inputEnv.Number),
-		Time:        inputEnv.Timestamp,
-		Difficulty:  inputEnv.Difficulty,
-		GasLimit:    inputEnv.GasLimit,
-		GetHash:     getHash,
-	}
-
-	// If currentBaseFee is defined, add it to the vmContext.
-	if inputEnv.BaseFee != nil {
-		blockCtx.BaseFee = new(big.Int).Set(inputEnv.BaseFee)
-	}
-
-	msg := &core.Message{
-		To:         inputMessage.To,
-		From:       inputMessage.From,
-		Nonce:      inputMessage.Nonce,
-		Value:      inputMessage.Value,
-		GasLimit:   inputMessage.Gas,
-		GasPrice:   inputMessage.GasPrice,
-		GasFeeCap:  inputMessage.GasFeeCap,
-		GasTipCap:  inputMessage.GasTipCap,
-		Data:       inputMessage.Data,
-		AccessList: inputMessage.AccessList,
-
-		SkipAccountChecks: !inputMessage.CheckNonce,
+		return logger.NewJSONLogger(&logger.Config{}, traceBuf), nil
 	}
 
-	tracer, err := getTracerFn(txIndex, txHash)
+	tracer, err := getTracerFn(tx, common.Hash{0x02})
 	if err != nil {
 		return err
 	}
 	vmConfig.Tracer = tracer
 
-	txCtx := vm.TxContext{
-		GasPrice: msg.GasPrice,
-		Origin:   msg.From,
-	}
-
-	statedb.SetTxContext(txHash, tx)
-
-	evm := vm.NewEVM(blockCtx, txCtx, statedb, chainConfig, vmConfig)
-	msgResult, err := core.ApplyMessage(evm, msg, gaspool)
+	evmResult, evmAlloc, err := replayer.ExecuteSubstateWithOptions(substate, chainConfig, vmConfig, replayOptions())
 	if err != nil {
 		return err
 	}
-
-	if chainConfig.IsByzantium(blockCtx.BlockNumber) {
-		statedb.Finalise(true)
-	} else {
-		statedb.IntermediateRoot(chainConfig.IsEIP158(blockCtx.BlockNumber))
-	}
-
-	evmResult := &research.SubstateResult{}
-	if msgResult.Failed() {
-		evmResult.Status = types.ReceiptStatusFailed
-	} else {
-		evmResult.Status = types.ReceiptStatusSuccessful
-	}
-	evmResult.Logs = statedb.GetLogs(txHash, blockCtx.BlockNumber.Uint64(), blockHash)
-	evmResult.Bloom = types.BytesToBloom(types.LogsBloom(evmResult.Logs))
-	if to := msg.To; to == nil {
-		evmResult.ContractAddress = crypto.CreateAddress(evm.TxContext.Origin, msg.Nonce)
+	if err := checkRPCReceipt(block, tx, evmResult); err != nil {
+		return err
 	}
-	evmResult.GasUsed = msgResult.UsedGas
-
-	evmAlloc := statedb.ResearchPostAlloc
 
 	r := outputResult.Equal(evmResult)
 	a := outputAlloc.Equal(evmAlloc)
+
+	if replayRewriteDB != nil {
+		// keep Env, Message and InputAlloc, but replace outputs with replayed ones
+		rewritten := research.NewSubstate(inputAlloc, evmAlloc, inputEnv, inputMessage, evmResult)
+		replayRewriteDB.PutSubstate(block, tx, rewritten)
+		if !(r && a) {
+			replayReport.Report([]byte(fmt.Sprintf("block %v, tx %v, inconsistent output rewritten\n", block, tx)))
+			atomic.AddInt64(&replayNumRewritten, 1)
+		}
+		return nil
+	}
+
 	if !(r && a) {
-		fmt.Println()
-		fmt.Printf("block %v, tx %v, inconsistent output report BEGIN\n", block, tx)
+		// print the whole report at once, not interleaved with other workers
+		report := &bytes.Buffer{}
+		fmt.Fprintln(report)
+		fmt.Fprintf(report, "block %v, tx %v, inconsistent output report BEGIN\n", block, tx)
 		var jbytes []byte
 		if !r {
-			fmt.Printf("inconsistent result\n")
+			fmt.Fprintf(report, "inconsistent result\n")
+			resultDiff := outputResult.Diff(evmResult)
+			if resultDiff.Status {
+				fmt.Fprintf(report, "inconsistent status: %v -> %v\n", outputResult.Status, evmResult.Status)
+			}
+			if resultDiff.GasUsed {
+				fmt.Fprintf(report, "inconsistent gas used: %v -> %v (%+d)\n", outputResult.GasUsed, evmResult.GasUsed, resultDiff.GasUsedDelta)
+			}
+			if resultDiff.Bloom {
+				fmt.Fprintf(report, "inconsistent bloom\n")
+			}
+			if resultDiff.Logs {
+				fmt.Fprintf(report, "inconsistent logs: %v -> %v logs\n", len(outputResult.Logs), len(evmResult.Logs))
+			}
+			if resultDiff.ContractAddress {
+				fmt.Fprintf(report, "inconsistent contract address: %s -> %s\n", outputResult.ContractAddress.Hex(), evmResult.ContractAddress.Hex())
+			}
 			jbytes, _ = json.MarshalIndent(outputResult, "", " ")
-			fmt.Printf("==== outputResult:\n%s\n", jbytes)
+			fmt.Fprintf(report, "==== outputResult:\n%s\n", jbytes)
 			// Clear log fields which are not saved in DB
 			rlpBytes, _ := rlp.EncodeToBytes(evmResult.Logs)
 			_ = rlp.DecodeBytes(rlpBytes, &evmResult.Logs)
 			jbytes, _ = json.MarshalIndent(evmResult, "", " ")
-			fmt.Printf("==== evmResult:\n%s\n", jbytes)
-			fmt.Println()
+			fmt.Fprintf(report, "==== evmResult:\n%s\n", jbytes)
+			fmt.Fprintln(report)
 		}
 		if !a {
-			fmt.Printf("inconsistent output\n")
+			// printAccount prints an account without code, or null if the
+			// account is missing in the alloc
+			printAccount := func(name string, sa *research.SubstateAccount) {
+				fmt.Fprintf(report, "==== %s ====\n", name)
+				if sa == nil {
+					fmt.Fprintf(report, "null\n")
+					return
+				}
+				saCopy := sa.Copy()
+				saCopy.Code = nil
+				jbytes, _ := json.MarshalIndent(saCopy, "", " ")
+				fmt.Fprintf(report, "%s\nCodeHash: %s\n", jbytes, sa.CodeHash())
+			}
+			fmt.Fprintf(report, "inconsistent output\n")
 			addrs := make(map[common.Address]struct{})
 			for k, _ := range outputAlloc {
 				addrs[k] = struct{}{}
@@ -186,39 +362,61 @@ func replayTask(block uint64, tx int, substate *research.Substate, taskPool *res
 					continue
 				}
 				kHex := k.Hex()
-				ivCopy := iv.Copy()
-				ovCopy := ov.Copy()
-				evCopy := ev.Copy()
-				ivCopy.Code = nil
-				ovCopy.Code = nil
-				evCopy.Code = nil
-				fmt.Printf("account address: %s\n", kHex)
-				fmt.Printf("==== inputAlloc ====\n")
-				jbytes, _ = json.MarshalIndent(ivCopy, "", " ")
-				fmt.Printf("%s\nCodeHash: %s\n", jbytes, iv.CodeHash())
-				fmt.Printf("==== outputAlloc ====\n")
-				jbytes, _ = json.MarshalIndent(ovCopy, "", " ")
-				fmt.Printf("%s\nCodeHash: %s\n", jbytes, ov.CodeHash())
-				fmt.Printf("==== evmAlloc ====\n")
-				jbytes, _ = json.MarshalIndent(evCopy, "", " ")
-				fmt.Printf("%s\nCodeHash: %s\n", jbytes, ev.CodeHash())
-				fmt.Println()
+				if replayCompactDiff {
+					fmt.Fprintf(report, "account address: %s\n", kHex)
+					fmt.Fprintf(report, "==== outputAlloc -> evmAlloc ====\n")
+					jbytes, _ = json.MarshalIndent(ov.Diff(ev), "", " ")
+					fmt.Fprintf(report, "%s\n", jbytes)
+					fmt.Fprintln(report)
+					continue
+				}
+				fmt.Fprintf(report, "account address: %s\n", kHex)
+				printAccount("inputAlloc", iv)
+				printAccount("outputAlloc", ov)
+				printAccount("evmAlloc", ev)
+				fmt.Fprintln(report)
 			}
 		}
 
 		// information to search the transaction traces
-		fmt.Printf("message from %s\n", inputMessage.From.Hex())
-		fmt.Printf("message to %s\n", inputMessage.To.Hex())
-		fmt.Printf("result status: %v\n", outputResult.Status)
+		fmt.Fprintf(report, "message from %s\n", inputMessage.From.Hex())
+		fmt.Fprintf(report, "message to %s\n", inputMessage.To.Hex())
+		fmt.Fprintf(report, "result status: %v\n", outputResult.Status)
+		// the recorded gas price is the effective gas price since London
+		effectiveGasPrice := substate.EffectiveGasPrice()
+		fmt.Fprintf(report, "effective gas price: %v\n", effectiveGasPrice)
+		if inputMessage.GasPrice.Cmp(effectiveGasPrice) != 0 {
+			fmt.Fprintf(report, "inconsistent gas price: recorded %v, implied by env %v\n", inputMessage.GasPrice, effectiveGasPrice)
+		}
 		if !r {
-			fmt.Printf("inconsistent result\n")
+			fmt.Fprintf(report, "inconsistent result\n")
 		}
 		if !a {
-			fmt.Printf("inconsistent alloc\n")
+			fmt.Fprintf(report, "inconsistent alloc\n")
+		}
+		attrs := []interface{}{"block", block, "tx", tx, "from", inputMessage.From.Hex()}
+		if inputMessage.To != nil {
+			attrs = append(attrs, "to", inputMessage.To.Hex())
+		}
+		attrs = append(attrs, "status", outputResult.Status, "result", !r, "alloc", !a)
+		if replayTraceDir != "" {
+			path, err := writeTrace(block, tx, traceBuf.Bytes())
+			if err != nil {
+				fmt.Fprintf(report, "error writing trace: %v\n", err)
+			} else {
+				fmt.Fprintf(report, "trace: %s\n", path)
+				attrs = append(attrs, "trace", path)
+			}
+		}
+		fmt.Fprintf(report, "block %v, tx %v, inconsistent output report END\n", block, tx)
+		fmt.Fprintln(report)
+		replayReport.Report(report.Bytes())
+		taskPool.Log().Error("inconsistent output", attrs...)
+
+		if replayMismatches != nil {
+			replayMismatches.Add(replayMismatch{Block: block, Tx: tx, Result: !r, Alloc: !a})
+			return nil
 		}
-		fmt.Printf("block %v, tx %v, inconsistent output report END\n", block, tx)
-		fmt.Println()
-
 		return fmt.Errorf("inconsistent output")
 	}
 
@@ -227,20 +425,130 @@ func replayTask(block uint64, tx int, substate *research.Substate, taskPool *res
 
 // record-replay: func replayAction for replay command
 func replayAction(ctx *cli.Context) error {
-	var err error
+	stopProfiles, err := research.StartProfilesCli("substate-cli replay", ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay: %v", err)
+	}
+	defer stopProfiles()
+
+	if ctx.Bool(FollowFlag.Name) && ctx.Duration(FollowIntervalFlag.Name) <= 0 {
+		return fmt.Errorf("substate-cli replay: invalid --%s: must be positive", FollowIntervalFlag.Name)
+	}
+
+	replayCompactDiff = ctx.Bool(CompactDiffFlag.Name)
+	replayReport = newReplayReporter(os.Stdout)
+	if ctx.Bool(ContinueOnMismatchFlag.Name) {
+		replayMismatches = newReplayMismatchCollector()
+	}
+
+	ReplayChainConfig, err = LoadChainConfig(ctx.String(ChainFlag.Name), ctx.Path(ChainConfigFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli replay: %v", err)
+	}
+	fmt.Printf("substate-cli replay: chain: %s (chain ID %v)\n", ctx.String(ChainFlag.Name), ReplayChainConfig.ChainID)
+
+	if ctx.Bool(TraceFlag.Name) {
+		replayTraceDir = ctx.Path(TraceDirFlag.Name)
+		if err = os.MkdirAll(replayTraceDir, 0755); err != nil {
+			return fmt.Errorf("substate-cli replay: error creating trace dir %s: %v", replayTraceDir, err)
+		}
+		fmt.Printf("substate-cli replay: trace dir: %s\n", replayTraceDir)
+	}
 
 	research.SetSubstateFlags(ctx)
+
+	if ctx.IsSet(RewriteOutputPathFlag.Name) {
+		rewritePath := ctx.Path(RewriteOutputPathFlag.Name)
+		srcAbs, _ := filepath.Abs(ctx.Path(research.SubstateDirFlag.Name))
+		dstAbs, _ := filepath.Abs(rewritePath)
+		if srcAbs == dstAbs {
+			return fmt.Errorf("substate-cli replay: --%s must differ from --%s", RewriteOutputPathFlag.Name, research.SubstateDirFlag.Name)
+		}
+		rewriteBackend, err := rawdb.NewLevelDBDatabase(rewritePath, 1024, 100, "rewriteDB", false)
+		if err != nil {
+			return fmt.Errorf("substate-cli replay: error creating %s: %v", rewritePath, err)
+		}
+		replayRewriteDB = research.NewSubstateDB(rewriteBackend)
+		defer replayRewriteDB.Close()
+		fmt.Printf("substate-cli replay: rewrite output path: %s\n", rewritePath)
+	}
+
+	// the source substate DB stays read-only even if outputs are rewritten
 	research.OpenSubstateDBReadOnly()
 	defer research.CloseSubstateDB()
 
-	taskPool := research.NewSubstateTaskPoolCli("substate-cli replay", replayTask, ctx)
-
-	segment, err := research.ParseBlockSegment(ctx.String(research.BlockSegmentFlag.Name))
+	taskPool, err := research.NewSubstateTaskPoolCli("substate-cli replay", replayTask, ctx)
 	if err != nil {
-		return fmt.Errorf("substate-cli replay: error parsing block segment: %s", err)
+		return fmt.Errorf("substate-cli replay: %v", err)
+	}
+	ReplayPrimeAccessList = ctx.Bool(PrimeAccessListFlag.Name)
+	ReplayMaxGas = ctx.Uint64(MaxGasPerBlockFlag.Name)
+	if ctx.Bool(BlockHashesFromDBFlag.Name) {
+		ReplayBlockHashFunc = research.NewSubstateBlockHashFunc(taskPool.DB)
+	}
+	if ctx.IsSet(RPCURLFlag.Name) {
+		replayReceiptFetcher, err = research.NewRPCReceiptFetcher(ctx.String(RPCURLFlag.Name), nil)
+		if err != nil {
+			return fmt.Errorf("substate-cli replay: %v", err)
+		}
+		fmt.Printf("substate-cli replay: comparing with RPC receipts of %s\n", ctx.String(RPCURLFlag.Name))
+	}
+
+	all := ctx.Bool(research.AllBlocksFlag.Name)
+	var segment *research.BlockSegment
+	switch {
+	case all && ctx.IsSet(replayBlockSegmentFlag.Name):
+		return fmt.Errorf("substate-cli replay: --%s and --%s cannot be used together", research.AllBlocksFlag.Name, replayBlockSegmentFlag.Name)
+	case !all && !ctx.IsSet(replayBlockSegmentFlag.Name):
+		return fmt.Errorf("substate-cli replay: --%s or --%s is required", replayBlockSegmentFlag.Name, research.AllBlocksFlag.Name)
+	case !all:
+		segment, err = research.ParseBlockSegmentWithDB(ctx.String(replayBlockSegmentFlag.Name), taskPool.DB)
+		if err != nil {
+			return fmt.Errorf("substate-cli replay: error parsing block segment: %s", err)
+		}
+	}
+
+	// stop scheduling blocks on the first SIGINT or SIGTERM
+	signalCtx, stop := research.NotifySignalContext(ctx.Context)
+	defer stop()
+	switch {
+	case ctx.Bool(FollowFlag.Name):
+		var first uint64
+		if segment != nil {
+			first = segment.First
+		} else {
+			first, _ = taskPool.DB.FirstBlock()
+		}
+		err = taskPool.ExecuteFollowContext(signalCtx, first, research.FollowConfig{
+			Interval: ctx.Duration(FollowIntervalFlag.Name),
+			Timeout:  ctx.Duration(FollowTimeoutFlag.Name),
+			Release:  research.ReleaseSubstateDB,
+			Reopen:   research.ReopenSubstateDBReadOnly,
+		})
+	case all:
+		err = taskPool.ExecuteAllContext(signalCtx)
+	default:
+		err = taskPool.ExecuteSegmentContext(signalCtx, segment)
 	}
 
-	err = taskPool.ExecuteSegment(segment)
+	if replayRewriteDB != nil {
+		fmt.Printf("substate-cli replay: %v inconsistent substates rewritten\n", replayNumRewritten)
+	}
+
+	if replayReceiptFetcher != nil {
+		n := atomic.LoadInt64(&replayNumRPCMismatches)
+		fmt.Printf("substate-cli replay: %v transactions inconsistent with RPC receipts\n", n)
+		if n > 0 && err == nil {
+			err = fmt.Errorf("substate-cli replay: %v transactions inconsistent with RPC receipts", n)
+		}
+	}
+
+	if replayMismatches != nil {
+		replayMismatches.PrintSummary(os.Stdout, "substate-cli replay")
+		if n := len(replayMismatches.Mismatches()); n > 0 && err == nil {
+			err = fmt.Errorf("substate-cli replay: %v inconsistent transactions", n)
+		}
+	}
 
 	return err
 }
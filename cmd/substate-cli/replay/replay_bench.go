@@ -0,0 +1,185 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/research"
+	"github.com/ethereum/go-ethereum/research/replayer"
+	cli "github.com/urfave/cli/v2"
+)
+
+// record-replay: substate-cli replay-bench command
+var ReplayBenchCommand = &cli.Command{
+	Action: replayBenchAction,
+	Name:   "replay-bench",
+	Usage:  "replay transactions for timing only, without consistency checks",
+	Flags: []cli.Flag{
+		research.WorkersFlag,
+		research.ParallelTxsFlag,
+		research.TxLimitFlag,
+		research.BlockStrideFlag,
+		research.SubstateDirFlag,
+		research.BlockSegmentFlag,
+		research.ProfileFlag,
+		research.MemProfileFlag,
+		ChainFlag,
+		ChainConfigFlag,
+	},
+	Description: `
+substate-cli replay-bench executes transactions in the given block segment
+without checking output consistency, and reports throughput and percentile
+latencies of transaction execution.`,
+	Category: "replay",
+}
+
+// benchDurationsShardCap is the initial capacity of a shard of benchDurations.
+const benchDurationsShardCap = 1 << 14
+
+// benchDurations collects execution durations of transactions. Durations are
+// sharded by block and tx, so workers executing different blocks rarely
+// contend for a shard.
+type benchDurations struct {
+	shards []benchDurationsShard
+}
+
+type benchDurationsShard struct {
+	mu        sync.Mutex
+	durations []time.Duration
+}
+
+// newBenchDurations returns benchDurations with n preallocated shards.
+func newBenchDurations(n int) *benchDurations {
+	if n < 1 {
+		n = 1
+	}
+	d := &benchDurations{shards: make([]benchDurationsShard, n)}
+	for i := range d.shards {
+		d.shards[i].durations = make([]time.Duration, 0, benchDurationsShardCap)
+	}
+	return d
+}
+
+// Add adds the execution duration of a transaction.
+func (d *benchDurations) Add(block uint64, tx int, duration time.Duration) {
+	shard := &d.shards[(block+uint64(tx))%uint64(len(d.shards))]
+	shard.mu.Lock()
+	shard.durations = append(shard.durations, duration)
+	shard.mu.Unlock()
+}
+
+// Sorted returns all durations in ascending order.
+func (d *benchDurations) Sorted() []time.Duration {
+	var all []time.Duration
+	for i := range d.shards {
+		shard := &d.shards[i]
+		shard.mu.Lock()
+		all = append(all, shard.durations...)
+		shard.mu.Unlock()
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	return all
+}
+
+// benchSummary is throughput and latencies of a replay-bench run.
+type benchSummary struct {
+	Txs      int
+	Elapsed  time.Duration
+	TxPerSec float64
+	NsPerTx  int64
+
+	P50, P95, P99 time.Duration
+}
+
+// newBenchSummary returns the summary of sorted execution durations of a
+// run taking elapsed wall-clock time.
+func newBenchSummary(sorted []time.Duration, elapsed time.Duration) benchSummary {
+	s := benchSummary{Txs: len(sorted), Elapsed: elapsed}
+	if len(sorted) == 0 {
+		return s
+	}
+	if sec := elapsed.Seconds(); sec > 0 {
+		s.TxPerSec = float64(len(sorted)) / sec
+	}
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	s.NsPerTx = int64(total) / int64(len(sorted))
+
+	// nearest-rank percentile
+	percentile := func(p int) time.Duration {
+		rank := (p*len(sorted) + 99) / 100
+		return sorted[rank-1]
+	}
+	s.P50, s.P95, s.P99 = percentile(50), percentile(95), percentile(99)
+	return s
+}
+
+func (s benchSummary) Print(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s: %v txs in %v, %.2f tx/s, %v ns/tx\n", name, s.Txs, s.Elapsed.Round(time.Millisecond), s.TxPerSec, s.NsPerTx)
+	fmt.Fprintf(w, "%s: tx latency p50 %v, p95 %v, p99 %v\n", name, s.P50, s.P95, s.P99)
+}
+
+var replayBenchDurations *benchDurations
+
+// replayBenchTask executes a transaction with ReplayChainConfig and records
+// its execution duration. Outputs are not checked.
+func replayBenchTask(block uint64, tx int, substate *research.Substate, taskPool *research.SubstateTaskPool) error {
+	start := time.Now()
+	_, _, err := replayer.ExecuteSubstate(substate, ReplayChainConfig, vm.Config{})
+	duration := time.Since(start)
+	if err != nil {
+		return err
+	}
+	replayBenchDurations.Add(block, tx, duration)
+	return nil
+}
+
+// replayBench executes a replay-bench task pool in segment and prints the
+// summary to w.
+func replayBench(taskPool *research.SubstateTaskPool, segment *research.BlockSegment, w io.Writer) error {
+	replayBenchDurations = newBenchDurations(4 * taskPool.NumWorkers() * taskPool.Config.ParallelTxs)
+
+	start := time.Now()
+	if err := taskPool.ExecuteSegment(segment); err != nil {
+		return err
+	}
+	newBenchSummary(replayBenchDurations.Sorted(), time.Since(start)).Print(w, taskPool.Name)
+	return nil
+}
+
+// record-replay: func replayBenchAction for replay-bench command
+func replayBenchAction(ctx *cli.Context) error {
+	stopProfiles, err := research.StartProfilesCli("substate-cli replay-bench", ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay-bench: %v", err)
+	}
+	defer stopProfiles()
+
+	ReplayChainConfig, err = LoadChainConfig(ctx.String(ChainFlag.Name), ctx.Path(ChainConfigFlag.Name))
+	if err != nil {
+		return fmt.Errorf("substate-cli replay-bench: %v", err)
+	}
+
+	research.SetSubstateFlags(ctx)
+	research.OpenSubstateDBReadOnly()
+	defer research.CloseSubstateDB()
+
+	taskPool, err := research.NewSubstateTaskPoolCli("substate-cli replay-bench", replayBenchTask, ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay-bench: %v", err)
+	}
+
+	segment, err := research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), taskPool.DB)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay-bench: error parsing block segment: %s", err)
+	}
+
+	return replayBench(taskPool, segment, os.Stdout)
+}
@@ -0,0 +1,49 @@
+package replay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/research"
+)
+
+func TestReplayBench(t *testing.T) {
+	db := research.NewMemorySubstateDB()
+	defer db.Close()
+	// outputs are not checked, so mismatching substates do not fail the bench
+	for block := uint64(5_000_000); block < 5_000_004; block++ {
+		for tx := 0; tx < 3; tx++ {
+			db.PutSubstate(block, tx, newMismatchSubstate(block, tx))
+		}
+	}
+
+	config := &research.SubstateTaskConfig{Workers: 2, ParallelTxs: 1}
+	pool := research.NewSubstateTaskPoolWithDB("test", replayBenchTask, config, db)
+	pool.Quiet = true
+
+	var out bytes.Buffer
+	if err := replayBench(pool, research.NewBlockSegment(5_000_000, 5_000_003), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"test: 12 txs in ", " tx/s, ", " ns/tx\n", "test: tx latency p50 ", ", p95 ", ", p99 "} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("summary misses %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestBenchSummaryPercentiles(t *testing.T) {
+	d := newBenchDurations(3)
+	for i := 1; i <= 100; i++ {
+		d.Add(uint64(i), 0, time.Duration(101-i)*time.Microsecond)
+	}
+	s := newBenchSummary(d.Sorted(), time.Second)
+	if s.Txs != 100 || s.TxPerSec != 100 || s.NsPerTx != 50_500 {
+		t.Fatalf("summary mismatch: have %v txs %v tx/s %v ns/tx, want 100 txs 100 tx/s 50500 ns/tx", s.Txs, s.TxPerSec, s.NsPerTx)
+	}
+	if s.P50 != 50*time.Microsecond || s.P95 != 95*time.Microsecond || s.P99 != 99*time.Microsecond {
+		t.Fatalf("percentiles mismatch: have p50 %v p95 %v p99 %v, want 50µs 95µs 99µs", s.P50, s.P95, s.P99)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/research"
+	"github.com/ethereum/go-ethereum/research/replayer"
 	"github.com/ethereum/go-ethereum/tests"
 	cli "github.com/urfave/cli/v2"
 )
@@ -30,9 +31,27 @@ var ReplayForkCommand = &cli.Command{
 		research.SkipTransferTxsFlag,
 		research.SkipCallTxsFlag,
 		research.SkipCreateTxsFlag,
+		research.TxTypesFlag,
+		research.SkipSuccessTxsFlag,
+		research.SkipFailedTxsFlag,
+		research.MinValueFlag,
+		research.TargetAddressFlag,
+		research.CreatedContractFlag,
+		research.ParallelTxsFlag,
+		research.TxLimitFlag,
+		research.ErrorBudgetFlag,
+		research.TxTypeBreakdownFlag,
+		research.StrictDecodeFlag,
+		research.DebugSerialFlag,
+		research.MaxBlocksPerSecFlag,
+		research.MaxInFlightBytesFlag,
+		research.BlockStrideFlag,
 		HardForkFlag,
 		research.SubstateDirFlag,
 		research.BlockSegmentFlag,
+		research.SummaryJSONFlag,
+		research.CheckpointFlag,
+		research.MetricsAddrFlag,
 	},
 	Description: `
 substate-cli replay executes transactions in the given block segment
@@ -138,7 +157,7 @@ func replayForkTask(block uint64, tx int, substate *research.Substate, taskPool
 
 	// Apply Message
 	var (
-		statedb   = MakeOffTheChainStateDB(inputAlloc)
+		statedb   = replayer.NewReplayStateDB(inputAlloc)
 		gaspool   = new(core.GasPool)
 		txHash    = common.Hash{0x01}
 		blockHash = common.Hash{0x02}
@@ -193,6 +212,8 @@ func replayForkTask(block uint64, tx int, substate *research.Substate, taskPool
 		blockCtx.BaseFee = new(big.Int)
 	}
 
+	replayer.SetPostMergeContext(&blockCtx, inputEnv, chainConfig)
+
 	statedb.SetTxContext(txHash, tx)
 
 	evm := vm.NewEVM(blockCtx, txCtx, statedb, chainConfig, vmConfig)
@@ -224,7 +245,7 @@ func replayForkTask(block uint64, tx int, substate *research.Substate, taskPool
 	}
 	evmResult.GasUsed = msgResult.UsedGas
 
-	evmAlloc := statedb.ResearchPostAlloc
+	evmAlloc := replayer.PostAlloc(statedb)
 
 	if r, a := outputResult.Equal(evmResult), outputAlloc.Equal(evmAlloc); !(r && a) {
 		if outputResult.Status == types.ReceiptStatusSuccessful &&
@@ -389,9 +410,12 @@ func replayForkAction(ctx *cli.Context) error {
 		statWg.Done()
 	}()
 
-	taskPool := research.NewSubstateTaskPoolCli("substate-cli replay-fork", replayForkTask, ctx)
+	taskPool, err := research.NewSubstateTaskPoolCli("substate-cli replay-fork", replayForkTask, ctx)
+	if err != nil {
+		return fmt.Errorf("substate-cli replay-fork: %v", err)
+	}
 
-	segment, err := research.ParseBlockSegment(ctx.String(research.BlockSegmentFlag.Name))
+	segment, err := research.ParseBlockSegmentWithDB(ctx.String(research.BlockSegmentFlag.Name), taskPool.DB)
 	if err != nil {
 		return fmt.Errorf("substate-cli replay-fork: error parsing block segment: %s", err)
 	}
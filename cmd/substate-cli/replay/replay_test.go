@@ -0,0 +1,236 @@
+package replay
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/research"
+)
+
+func TestReplayTrace(t *testing.T) {
+	db := research.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	db.PutSubstate(5_000_000, 0, newTransferSubstate(5_000_000, 0))
+	// a result mismatch
+	substate := newTransferSubstate(5_000_001, 0)
+	substate.Result.GasUsed++
+	db.PutSubstate(5_000_001, 0, substate)
+
+	var out bytes.Buffer
+	replayReport = newReplayReporter(&out)
+	replayTraceDir = t.TempDir()
+	defer func() {
+		replayReport = newReplayReporter(os.Stdout)
+		replayTraceDir = ""
+	}()
+
+	pool := &research.SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: replayTask,
+		Config:   &research.SubstateTaskConfig{Workers: 1},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	err := pool.ExecuteSegment(research.NewBlockSegment(5_000_000, 5_000_001))
+	if err == nil || !strings.Contains(err.Error(), "inconsistent output") {
+		t.Fatalf("unexpected error: have %v, want inconsistent output", err)
+	}
+
+	path := filepath.Join(replayTraceDir, "5000001_0.jsonl")
+	trace, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("trace of the inconsistent transaction is not written: %v", err)
+	}
+	if len(trace) == 0 {
+		t.Fatalf("trace of the inconsistent transaction is empty")
+	}
+	if !strings.Contains(out.String(), "trace: "+path) {
+		t.Fatalf("trace path is not reported: %q", out.String())
+	}
+	// consistent transactions are not traced to files
+	if _, err := os.Stat(filepath.Join(replayTraceDir, "5000000_0.jsonl")); !os.IsNotExist(err) {
+		t.Fatalf("trace of a consistent transaction is written: %v", err)
+	}
+}
+
+func TestReplayRewriteOutput(t *testing.T) {
+	db := research.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	db.PutSubstate(5_000_000, 0, newTransferSubstate(5_000_000, 0))
+	db.PutSubstate(5_000_000, 1, newMismatchSubstate(5_000_000, 1))
+	// a result mismatch
+	substate := newTransferSubstate(5_000_001, 0)
+	substate.Result.GasUsed++
+	db.PutSubstate(5_000_001, 0, substate)
+
+	var out bytes.Buffer
+	replayReport = newReplayReporter(&out)
+	replayRewriteDB = research.NewSubstateDB(rawdb.NewMemoryDatabase())
+	replayNumRewritten = 0
+	defer func() {
+		replayReport = newReplayReporter(os.Stdout)
+		replayRewriteDB.Close()
+		replayRewriteDB = nil
+		replayNumRewritten = 0
+	}()
+
+	pool := &research.SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: replayTask,
+		Config:   &research.SubstateTaskConfig{Workers: 2},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	// inconsistent outputs are rewritten instead of failing the replay
+	if err := pool.ExecuteSegment(research.NewBlockSegment(5_000_000, 5_000_001)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if replayNumRewritten != 2 {
+		t.Fatalf("rewritten substates mismatch: have %v, want 2", replayNumRewritten)
+	}
+
+	for _, key := range []research.SubstateKey{{Block: 5_000_000, Tx: 0}, {Block: 5_000_000, Tx: 1}, {Block: 5_000_001, Tx: 0}} {
+		if !replayRewriteDB.HasSubstate(key.Block, key.Tx) {
+			t.Fatalf("substate %v_%v is not rewritten", key.Block, key.Tx)
+		}
+		recorded := db.GetSubstate(key.Block, key.Tx)
+		rewritten := replayRewriteDB.GetSubstate(key.Block, key.Tx)
+		// inputs are kept, and outputs are replaced with consistent ones
+		want := newTransferSubstate(key.Block, key.Tx)
+		if !rewritten.Env.Equal(recorded.Env) || !rewritten.Message.Equal(recorded.Message) || !rewritten.InputAlloc.Equal(recorded.InputAlloc) {
+			t.Fatalf("substate %v_%v: inputs are not kept", key.Block, key.Tx)
+		}
+		if !rewritten.OutputAlloc.Equal(want.OutputAlloc) || !rewritten.Result.Equal(want.Result) {
+			t.Fatalf("substate %v_%v: outputs are not replaced with replayed ones", key.Block, key.Tx)
+		}
+	}
+	if strings.Count(out.String(), "inconsistent output rewritten") != 2 {
+		t.Fatalf("rewrite report mismatch: %q", out.String())
+	}
+}
+
+func TestReplaySepolia(t *testing.T) {
+	// a call of PUSH0 STOP in a Sepolia block after Shanghai, which is before
+	// Shanghai on mainnet
+	const block = 3_000_000
+	substate := newTransferSubstate(block, 0)
+	sender, contract := common.Address{0x01, 0x00}, common.Address{0xc0}
+	code := []byte{0x5f, 0x00}
+	substate.InputAlloc[contract] = research.NewSubstateAccount(1, big.NewInt(0), code)
+	substate.OutputAlloc = research.SubstateAlloc{
+		sender:   research.NewSubstateAccount(1, big.NewInt(1_000_000), nil),
+		contract: research.NewSubstateAccount(1, big.NewInt(0), code),
+	}
+	substate.Message.To = &contract
+	substate.Message.Value = big.NewInt(0)
+	substate.Message.Gas = 100_000
+	substate.Result.GasUsed = 21_000 + 2
+	substate.Env.Timestamp = *params.SepoliaChainConfig.ShanghaiTime + 1
+	substate.Env.BaseFee = big.NewInt(0)
+	substate.Env.Difficulty = big.NewInt(0)
+	substate.Env.Random = &common.Hash{0xaa}
+	if params.MainnetChainConfig.IsShanghai(substate.Env.Timestamp) {
+		t.Fatalf("block %v is after Shanghai on mainnet", block)
+	}
+
+	db := research.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	db.PutSubstate(block, 0, substate)
+
+	var out bytes.Buffer
+	replayReport = newReplayReporter(&out)
+	defer func(chainConfig *params.ChainConfig) {
+		replayReport = newReplayReporter(os.Stdout)
+		ReplayChainConfig = chainConfig
+	}(ReplayChainConfig)
+
+	pool := &research.SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: replayTask,
+		Config:   &research.SubstateTaskConfig{Workers: 1},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	var err error
+	if ReplayChainConfig, err = LoadChainConfig("sepolia", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := pool.ExecuteSegment(research.NewBlockSegment(block, block)); err != nil {
+		t.Fatalf("sepolia: unexpected error: %v", err)
+	}
+
+	// PUSH0 is an invalid opcode under mainnet rules
+	if ReplayChainConfig, err = LoadChainConfig("mainnet", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = pool.ExecuteSegment(research.NewBlockSegment(block, block))
+	if err == nil || !strings.Contains(err.Error(), "inconsistent output") {
+		t.Fatalf("mainnet: unexpected error: have %v, want inconsistent output", err)
+	}
+}
+
+func TestLoadChainConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return path
+	}
+	customPath := writeFile("custom.json", `{"chainId": 1337, "homesteadBlock": 0, "berlinBlock": 10, "londonBlock": 20}`)
+	noChainIDPath := writeFile("no-chain-id.json", `{"homesteadBlock": 0}`)
+	invalidPath := writeFile("invalid.json", `{"chainId": `)
+
+	tests := []struct {
+		chain   string
+		path    string
+		chainID uint64
+		london  uint64
+		err     string
+	}{
+		{chain: "mainnet", chainID: 1, london: params.MainnetChainConfig.LondonBlock.Uint64()},
+		{chain: "sepolia", chainID: params.SepoliaChainConfig.ChainID.Uint64(), london: params.SepoliaChainConfig.LondonBlock.Uint64()},
+		{chain: "custom", path: customPath, chainID: 1337, london: 20},
+		{chain: "custom", err: "--chain-config is required"},
+		{chain: "custom", path: filepath.Join(dir, "missing.json"), err: "error reading chain config"},
+		{chain: "custom", path: invalidPath, err: "error parsing chain config"},
+		{chain: "custom", path: noChainIDPath, err: "has no chainId"},
+		{chain: "ropsten", err: `unknown chain "ropsten"`},
+	}
+	for _, tt := range tests {
+		chainConfig, err := LoadChainConfig(tt.chain, tt.path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("%s %s: unexpected error: have %v, want %s", tt.chain, tt.path, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s %s: unexpected error: %v", tt.chain, tt.path, err)
+		}
+		if chainConfig.ChainID.Uint64() != tt.chainID || chainConfig.LondonBlock.Uint64() != tt.london {
+			t.Fatalf("%s %s: chain config mismatch: have chain ID %v, London %v, want %v, %v", tt.chain, tt.path, chainConfig.ChainID, chainConfig.LondonBlock, tt.chainID, tt.london)
+		}
+	}
+
+	// loaded chain configs are copies
+	chainConfig, _ := LoadChainConfig("sepolia", "")
+	chainConfig.ChainID = nil
+	if params.SepoliaChainConfig.ChainID == nil {
+		t.Fatalf("sepolia chain config is modified")
+	}
+}
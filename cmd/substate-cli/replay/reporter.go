@@ -0,0 +1,30 @@
+package replay
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// replayReporter prints reports of replayTask. A report is written to a
+// buffer first and printed at once, so multi-line reports of concurrent
+// workers are not interleaved.
+type replayReporter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newReplayReporter(out io.Writer) *replayReporter {
+	return &replayReporter{out: out}
+}
+
+// Report prints a complete report as one contiguous write.
+func (r *replayReporter) Report(report []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.out.Write(report)
+}
+
+// replayReport is the reporter of replayTask, created per replay run.
+var replayReport = newReplayReporter(os.Stdout)
@@ -0,0 +1,150 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/research"
+)
+
+// newTransferSubstate returns a consistent substate of a transfer with zero
+// gas price in a pre-London block.
+func newTransferSubstate(block uint64, tx int) *research.Substate {
+	sender := common.Address{0x01, byte(tx)}
+	recipient := common.Address{0x02, byte(tx)}
+	inputAlloc := research.SubstateAlloc{
+		sender: research.NewSubstateAccount(0, big.NewInt(1_000_000), nil),
+	}
+	outputAlloc := research.SubstateAlloc{
+		sender:    research.NewSubstateAccount(1, big.NewInt(999_000), nil),
+		recipient: research.NewSubstateAccount(0, big.NewInt(1_000), nil),
+	}
+	env := &research.SubstateEnv{
+		Coinbase:    common.Address{0xcb},
+		Difficulty:  big.NewInt(1),
+		GasLimit:    30_000_000,
+		Number:      block,
+		Timestamp:   block * 12,
+		BlockHashes: make(map[uint64]common.Hash),
+	}
+	msg := &research.SubstateMessage{
+		CheckNonce: true,
+		GasPrice:   big.NewInt(0),
+		Gas:        21_000,
+		From:       sender,
+		To:         &recipient,
+		Value:      big.NewInt(1_000),
+		GasFeeCap:  big.NewInt(0),
+		GasTipCap:  big.NewInt(0),
+	}
+	result := &research.SubstateResult{
+		Status:  types.ReceiptStatusSuccessful,
+		GasUsed: 21_000,
+	}
+	return research.NewSubstate(inputAlloc, outputAlloc, env, msg, result)
+}
+
+// newMismatchSubstate returns a transfer substate whose recorded output alloc
+// differs from the replayed one.
+func newMismatchSubstate(block uint64, tx int) *research.Substate {
+	substate := newTransferSubstate(block, tx)
+	substate.OutputAlloc[common.Address{0x02, byte(tx)}].Balance = big.NewInt(1)
+	return substate
+}
+
+func TestReplayReporterNotInterleaved(t *testing.T) {
+	db := research.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	// pre-London blocks without base fee
+	for block := uint64(5_000_000); block < 5_000_016; block++ {
+		for tx := 0; tx < 8; tx++ {
+			db.PutSubstate(block, tx, newMismatchSubstate(block, tx))
+		}
+	}
+
+	var out bytes.Buffer
+	replayReport = newReplayReporter(&out)
+	defer func() { replayReport = newReplayReporter(os.Stdout) }()
+
+	pool := &research.SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: replayTask,
+		Config:   &research.SubstateTaskConfig{Workers: 8, ParallelTxs: 8},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	err := pool.ExecuteSegment(research.NewBlockSegment(5_000_000, 5_000_015))
+	if err == nil || !strings.Contains(err.Error(), "inconsistent output") {
+		t.Fatalf("unexpected error: have %v, want inconsistent output", err)
+	}
+
+	numReports := 0
+	var begin string
+	scanner := bufio.NewScanner(&out)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasSuffix(line, "inconsistent output report BEGIN"):
+			if begin != "" {
+				t.Fatalf("report %q begins inside report %q", line, begin)
+			}
+			begin = line
+		case strings.HasSuffix(line, "inconsistent output report END"):
+			if want := strings.TrimSuffix(begin, "BEGIN") + "END"; line != want {
+				t.Fatalf("report end mismatch: have %q, want %q", line, want)
+			}
+			begin = ""
+			numReports++
+		}
+	}
+	if begin != "" {
+		t.Fatalf("report %q does not end", begin)
+	}
+	if numReports == 0 {
+		t.Fatalf("no report is printed")
+	}
+}
+
+func TestReplayReporterConcurrent(t *testing.T) {
+	var out bytes.Buffer
+	reporter := newReplayReporter(&out)
+
+	done := make(chan struct{})
+	for i := 0; i < 16; i++ {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			report := &bytes.Buffer{}
+			fmt.Fprintf(report, "%v BEGIN\n", i)
+			for j := 0; j < 100; j++ {
+				fmt.Fprintf(report, "%v line %v\n", i, j)
+			}
+			fmt.Fprintf(report, "%v END\n", i)
+			reporter.Report(report.Bytes())
+		}(i)
+	}
+	for i := 0; i < 16; i++ {
+		<-done
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 16*102 {
+		t.Fatalf("number of lines mismatch: have %v, want %v", len(lines), 16*102)
+	}
+	for i := 0; i < len(lines); i += 102 {
+		id := strings.TrimSuffix(lines[i], " BEGIN")
+		if lines[i+101] != id+" END" {
+			t.Fatalf("report %s is interleaved", id)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package replay
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/research"
+	cli "github.com/urfave/cli/v2"
+)
+
+var RPCURLFlag = &cli.StringFlag{
+	Name:  "rpc-url",
+	Usage: "JSON-RPC URL of an archive node to compare status, gas used and number of logs of replayed transactions with canonical receipts",
+}
+
+// replayReceiptFetcher fetches canonical receipts to compare with replayed
+// results. Replayed results are not compared with receipts if it is nil.
+var replayReceiptFetcher research.ReceiptFetcher
+
+// replayNumRPCMismatches is the number of replayed transactions inconsistent
+// with their canonical receipts.
+var replayNumRPCMismatches int64
+
+// checkRPCReceipt compares evmResult of a replayed transaction with its
+// canonical receipt fetched with replayReceiptFetcher. An inconsistency is
+// reported and counted separately from inconsistencies with recorded outputs,
+// and does not stop the replay; an error fetching the receipt does.
+func checkRPCReceipt(block uint64, tx int, evmResult *research.SubstateResult) error {
+	if replayReceiptFetcher == nil {
+		return nil
+	}
+	receipt, err := replayReceiptFetcher.FetchReceipt(block, tx)
+	if err != nil {
+		return fmt.Errorf("error fetching RPC receipt: %v", err)
+	}
+	if diffs := research.CompareReceipt(receipt, evmResult); len(diffs) > 0 {
+		replayReport.Report([]byte(fmt.Sprintf("block %v, tx %v, inconsistent with RPC receipt: %s\n", block, tx, strings.Join(diffs, ", "))))
+		atomic.AddInt64(&replayNumRPCMismatches, 1)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/research"
+)
+
+// testReceiptFetcher returns receipts keyed by block, or an error for blocks
+// without a receipt.
+type testReceiptFetcher map[uint64]*research.ReceiptSummary
+
+func (f testReceiptFetcher) FetchReceipt(block uint64, tx int) (*research.ReceiptSummary, error) {
+	if receipt, ok := f[block]; ok {
+		return receipt, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func TestReplayRPCReceipt(t *testing.T) {
+	db := research.NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	for block := uint64(5_000_000); block < 5_000_003; block++ {
+		db.PutSubstate(block, 0, newTransferSubstate(block, 0))
+	}
+
+	status := uint64(1)
+	fetcher := testReceiptFetcher{
+		5_000_000: {Status: &status, GasUsed: 21_000},
+		// the canonical receipt differs from both recorded and replayed results
+		5_000_001: {Status: &status, GasUsed: 21_100, NumLogs: 1},
+		5_000_002: {GasUsed: 21_000},
+	}
+
+	var out bytes.Buffer
+	replayReport = newReplayReporter(&out)
+	replayReceiptFetcher = fetcher
+	replayNumRPCMismatches = 0
+	defer func() {
+		replayReport = newReplayReporter(os.Stdout)
+		replayReceiptFetcher = nil
+		replayNumRPCMismatches = 0
+	}()
+
+	pool := &research.SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: replayTask,
+		Config:   &research.SubstateTaskConfig{Workers: 2},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	// an inconsistency with a receipt does not stop the replay
+	if err := pool.ExecuteSegment(research.NewBlockSegment(5_000_000, 5_000_002)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if replayNumRPCMismatches != 1 {
+		t.Fatalf("RPC mismatches mismatch: have %v, want 1", replayNumRPCMismatches)
+	}
+	want := "block 5000001, tx 0, inconsistent with RPC receipt: gas used 21100 -> 21000, logs 1 -> 0\n"
+	if out.String() != want {
+		t.Fatalf("report mismatch: have %q, want %q", out.String(), want)
+	}
+
+	// a receipt which cannot be fetched fails the task
+	db.PutSubstate(5_000_003, 0, newTransferSubstate(5_000_003, 0))
+	err := pool.ExecuteSegment(research.NewBlockSegment(5_000_003, 5_000_003))
+	if err == nil || !strings.Contains(err.Error(), "error fetching RPC receipt") {
+		t.Fatalf("unexpected error: have %v, want error fetching RPC receipt", err)
+	}
+}
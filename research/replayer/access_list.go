@@ -0,0 +1,74 @@
+package replayer
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// accessListPrimer is a vm.EVMLogger warming the entries of an access list
+// at the top call frame, after core.ApplyMessage has reset the access list of
+// the statedb with StateDB.Prepare. Other events are passed to tracer if
+// it is not nil.
+type accessListPrimer struct {
+	tracer vm.EVMLogger
+	list   types.AccessList
+}
+
+func (p *accessListPrimer) CaptureTxStart(gasLimit uint64) {
+	if p.tracer != nil {
+		p.tracer.CaptureTxStart(gasLimit)
+	}
+}
+
+func (p *accessListPrimer) CaptureTxEnd(restGas uint64) {
+	if p.tracer != nil {
+		p.tracer.CaptureTxEnd(restGas)
+	}
+}
+
+func (p *accessListPrimer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	if env.ChainConfig().IsBerlin(env.Context.BlockNumber) {
+		for _, tuple := range p.list {
+			env.StateDB.AddAddressToAccessList(tuple.Address)
+			for _, key := range tuple.StorageKeys {
+				env.StateDB.AddSlotToAccessList(tuple.Address, key)
+			}
+		}
+	}
+	if p.tracer != nil {
+		p.tracer.CaptureStart(env, from, to, create, input, gas, value)
+	}
+}
+
+func (p *accessListPrimer) CaptureEnd(output []byte, gasUsed uint64, err error) {
+	if p.tracer != nil {
+		p.tracer.CaptureEnd(output, gasUsed, err)
+	}
+}
+
+func (p *accessListPrimer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	if p.tracer != nil {
+		p.tracer.CaptureEnter(typ, from, to, input, gas, value)
+	}
+}
+
+func (p *accessListPrimer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	if p.tracer != nil {
+		p.tracer.CaptureExit(output, gasUsed, err)
+	}
+}
+
+func (p *accessListPrimer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	if p.tracer != nil {
+		p.tracer.CaptureState(pc, op, gas, cost, scope, rData, depth, err)
+	}
+}
+
+func (p *accessListPrimer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+	if p.tracer != nil {
+		p.tracer.CaptureFault(pc, op, gas, cost, scope, depth, err)
+	}
+}
@@ -0,0 +1,183 @@
+package replayer
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/research"
+)
+
+// ExecuteSubstate executes the message of a substate on an off-the-chain
+// statedb of InputAlloc, and returns the result and post-state alloc to be
+// compared with Result and OutputAlloc of the substate. Logs of the result
+// have tx hash 0x02 and block hash 0x01, which are not recorded in substates.
+// Substates of Cancun-active blocks return an error.
+func ExecuteSubstate(substate *research.Substate, chainConfig *params.ChainConfig, vmConfig vm.Config) (*research.SubstateResult, research.SubstateAlloc, error) {
+	return ExecuteSubstateWithBlockHashes(substate, chainConfig, vmConfig, nil)
+}
+
+// ExecuteSubstateWithBlockHashes is ExecuteSubstate, but BLOCKHASH of a
+// block missing in Env.BlockHashes is resolved by getBlockHash if it is not
+// nil. Otherwise, or if getBlockHash does not know the block, BLOCKHASH
+// returns zero.
+func ExecuteSubstateWithBlockHashes(substate *research.Substate, chainConfig *params.ChainConfig, vmConfig vm.Config, getBlockHash research.BlockHashFunc) (*research.SubstateResult, research.SubstateAlloc, error) {
+	return ExecuteSubstateWithOptions(substate, chainConfig, vmConfig, Options{GetBlockHash: getBlockHash})
+}
+
+// Options are options of ExecuteSubstateWithOptions. The zero Options
+// execute a substate like ExecuteSubstate.
+type Options struct {
+	// GetBlockHash resolves BLOCKHASH of a block missing in
+	// Env.BlockHashes if it is not nil, like ExecuteSubstateWithBlockHashes.
+	GetBlockHash research.BlockHashFunc
+
+	// PrimeAccessList executes the message without its access list and
+	// warms the addresses and storage keys of Message.AccessList before the
+	// top call frame instead. Accesses to them are charged as warm (EIP-2929),
+	// but the intrinsic gas of the access list (EIP-2930) is not, so GasUsed
+	// differs from the recorded one for access list transactions. It has no
+	// effect before Berlin.
+	PrimeAccessList bool
+
+	// MaxGas caps the gas pool of the block to MaxGas if it is less than
+	// Env.GasLimit, and a message with more gas than MaxGas fails with an
+	// error instead of being executed. 0 means no cap.
+	MaxGas uint64
+}
+
+// SetPostMergeContext sets PREVRANDAO and DIFFICULTY of blockCtx if env is a
+// post-merge block of chainConfig: PREVRANDAO is the recorded mixHash and
+// DIFFICULTY is zero, and a non-nil Random enables the merge rules of the
+// EVM. blockCtx is not modified for pre-merge blocks.
+func SetPostMergeContext(blockCtx *vm.BlockContext, env *research.SubstateEnv, chainConfig *params.ChainConfig) {
+	if !env.IsPostMerge(chainConfig) {
+		return
+	}
+	random := common.Hash{}
+	if env.Random != nil {
+		random = *env.Random
+	}
+	blockCtx.Random = &random
+	blockCtx.Difficulty = new(big.Int)
+}
+
+// ExecuteSubstateWithOptions is ExecuteSubstate with opts.
+func ExecuteSubstateWithOptions(substate *research.Substate, chainConfig *params.ChainConfig, vmConfig vm.Config, opts Options) (*research.SubstateResult, research.SubstateAlloc, error) {
+	getBlockHash := opts.GetBlockHash
+	inputAlloc := substate.InputAlloc
+	inputEnv := substate.Env
+	inputMessage := substate.Message
+
+	// this EVM has no Cancun instruction set and no blob transactions
+	if chainConfig.IsCancun(inputEnv.Timestamp) {
+		return nil, nil, fmt.Errorf("record-replay: block %v is Cancun-active, which is not supported", inputEnv.Number)
+	}
+
+	// getHash returns zero for block hash that does not exist
+	getHash := func(num uint64) common.Hash {
+		if h, exist := inputEnv.BlockHashes[num]; exist {
+			return h
+		}
+		if getBlockHash != nil {
+			if h, ok := getBlockHash(num); ok {
+				return h
+			}
+		}
+		return common.Hash{}
+	}
+
+	// Apply Message
+	var (
+		statedb   = NewReplayStateDB(inputAlloc)
+		gaspool   = new(core.GasPool)
+		blockHash = common.Hash{0x01}
+		txHash    = common.Hash{0x02}
+	)
+
+	// a malformed env with an absurd GasLimit would let a message run unbounded
+	gasLimit := inputEnv.GasLimit
+	if opts.MaxGas > 0 && gasLimit > opts.MaxGas {
+		if inputMessage.Gas > opts.MaxGas {
+			return nil, nil, fmt.Errorf("record-replay: message gas %v exceeds the gas cap %v (block gas limit %v)", inputMessage.Gas, opts.MaxGas, gasLimit)
+		}
+		gasLimit = opts.MaxGas
+	}
+	gaspool.AddGas(gasLimit)
+	blockCtx := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		Coinbase:    inputEnv.Coinbase,
+		BlockNumber: new(big.Int).SetUint64(inputEnv.Number),
+		Time:        inputEnv.Timestamp,
+		Difficulty:  inputEnv.Difficulty,
+		GasLimit:    inputEnv.GasLimit,
+		GetHash:     getHash,
+	}
+
+	// If currentBaseFee is defined, add it to the vmContext.
+	if inputEnv.BaseFee != nil {
+		blockCtx.BaseFee = new(big.Int).Set(inputEnv.BaseFee)
+	}
+
+	SetPostMergeContext(&blockCtx, inputEnv, chainConfig)
+
+	msg := &core.Message{
+		To:         inputMessage.To,
+		From:       inputMessage.From,
+		Nonce:      inputMessage.Nonce,
+		Value:      inputMessage.Value,
+		GasLimit:   inputMessage.Gas,
+		GasPrice:   inputMessage.GasPrice,
+		GasFeeCap:  inputMessage.GasFeeCap,
+		GasTipCap:  inputMessage.GasTipCap,
+		Data:       inputMessage.Data,
+		AccessList: inputMessage.AccessList,
+
+		SkipAccountChecks: !inputMessage.CheckNonce,
+	}
+
+	txCtx := vm.TxContext{
+		GasPrice: msg.GasPrice,
+		Origin:   msg.From,
+	}
+
+	if opts.PrimeAccessList && len(msg.AccessList) > 0 {
+		vmConfig.Tracer = &accessListPrimer{tracer: vmConfig.Tracer, list: msg.AccessList}
+		msg.AccessList = nil
+	}
+
+	statedb.SetTxContext(txHash, 0)
+
+	evm := vm.NewEVM(blockCtx, txCtx, statedb, chainConfig, vmConfig)
+	msgResult, err := core.ApplyMessage(evm, msg, gaspool)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if chainConfig.IsByzantium(blockCtx.BlockNumber) {
+		statedb.Finalise(true)
+	} else {
+		statedb.IntermediateRoot(chainConfig.IsEIP158(blockCtx.BlockNumber))
+	}
+
+	evmResult := &research.SubstateResult{}
+	if msgResult.Failed() {
+		evmResult.Status = types.ReceiptStatusFailed
+	} else {
+		evmResult.Status = types.ReceiptStatusSuccessful
+	}
+	evmResult.Logs = statedb.GetLogs(txHash, blockCtx.BlockNumber.Uint64(), blockHash)
+	evmResult.Bloom = types.BytesToBloom(types.LogsBloom(evmResult.Logs))
+	if to := msg.To; to == nil {
+		evmResult.ContractAddress = crypto.CreateAddress(evm.TxContext.Origin, msg.Nonce)
+	}
+	evmResult.GasUsed = msgResult.UsedGas
+
+	return evmResult, PostAlloc(statedb), nil
+}
@@ -0,0 +1,410 @@
+package replayer
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/research"
+)
+
+// newTestSubstate returns a pre-London substate of a message from sender to
+// recipient without gas fees.
+func newTestSubstate(inputAlloc, outputAlloc research.SubstateAlloc, sender, recipient common.Address, value *big.Int, result *research.SubstateResult) *research.Substate {
+	env := &research.SubstateEnv{
+		Coinbase:    common.Address{0xcb},
+		Difficulty:  big.NewInt(1),
+		GasLimit:    30_000_000,
+		Number:      5_000_000,
+		Timestamp:   60_000_000,
+		BlockHashes: make(map[uint64]common.Hash),
+	}
+	msg := &research.SubstateMessage{
+		CheckNonce: true,
+		GasPrice:   big.NewInt(0),
+		Gas:        100_000,
+		From:       sender,
+		To:         &recipient,
+		Value:      value,
+		GasFeeCap:  big.NewInt(0),
+		GasTipCap:  big.NewInt(0),
+	}
+	return research.NewSubstate(inputAlloc, outputAlloc, env, msg, result)
+}
+
+func TestExecuteSubstate(t *testing.T) {
+	sender, recipient, contract := common.Address{0x01}, common.Address{0x02}, common.Address{0xc0}
+	// PUSH1 0 PUSH1 0 LOG0 STOP
+	logCode := []byte{0x60, 0x00, 0x60, 0x00, 0xa0, 0x00}
+	logs := []*types.Log{{Address: contract, Topics: []common.Hash{}, Data: []byte{}}}
+
+	tests := []struct {
+		name     string
+		substate *research.Substate
+	}{
+		{
+			name: "transfer",
+			substate: newTestSubstate(
+				research.SubstateAlloc{
+					sender: research.NewSubstateAccount(0, big.NewInt(1_000_000), nil),
+				},
+				research.SubstateAlloc{
+					sender:    research.NewSubstateAccount(1, big.NewInt(999_000), nil),
+					recipient: research.NewSubstateAccount(0, big.NewInt(1_000), nil),
+				},
+				sender, recipient, big.NewInt(1_000),
+				&research.SubstateResult{
+					Status:  types.ReceiptStatusSuccessful,
+					GasUsed: 21_000,
+				},
+			),
+		},
+		{
+			name: "log",
+			substate: newTestSubstate(
+				research.SubstateAlloc{
+					sender:   research.NewSubstateAccount(0, big.NewInt(1_000_000), nil),
+					contract: research.NewSubstateAccount(1, big.NewInt(0), logCode),
+				},
+				research.SubstateAlloc{
+					sender:   research.NewSubstateAccount(1, big.NewInt(1_000_000), nil),
+					contract: research.NewSubstateAccount(1, big.NewInt(0), logCode),
+				},
+				sender, contract, big.NewInt(0),
+				&research.SubstateResult{
+					Status:  types.ReceiptStatusSuccessful,
+					Bloom:   types.BytesToBloom(types.LogsBloom(logs)),
+					Logs:    logs,
+					GasUsed: 21_000 + 3 + 3 + 375,
+				},
+			),
+		},
+	}
+
+	for _, test := range tests {
+		result, alloc, err := ExecuteSubstate(test.substate, params.MainnetChainConfig, vm.Config{})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.substate.Result.Equal(result) {
+			t.Fatalf("%s: result mismatch: have %+v, want %+v", test.name, result, test.substate.Result)
+		}
+		if !test.substate.OutputAlloc.Equal(alloc) {
+			t.Fatalf("%s: post-state alloc mismatch: have %v, want %v", test.name, alloc, test.substate.OutputAlloc)
+		}
+	}
+}
+
+func TestExecuteSubstateWithBlockHashes(t *testing.T) {
+	sender, contract := common.Address{0x01}, common.Address{0xc0}
+	const num = 4_999_990
+	hash := common.Hash{0xbb}
+	// PUSH4 num BLOCKHASH PUSH1 0 SSTORE STOP
+	code := []byte{0x63, 0x00, 0x4c, 0x4b, 0x36, 0x40, 0x60, 0x00, 0x55, 0x00}
+	newSubstate := func() *research.Substate {
+		substate := newTestSubstate(
+			research.SubstateAlloc{
+				sender:   research.NewSubstateAccount(0, big.NewInt(1_000_000), nil),
+				contract: research.NewSubstateAccount(1, big.NewInt(0), code),
+			},
+			research.SubstateAlloc{
+				sender:   research.NewSubstateAccount(1, big.NewInt(1_000_000), nil),
+				contract: research.NewSubstateAccount(1, big.NewInt(0), code),
+			},
+			sender, contract, big.NewInt(0),
+			&research.SubstateResult{
+				Status:  types.ReceiptStatusSuccessful,
+				GasUsed: 21_000 + 3 + 20 + 3 + 20_000,
+			},
+		)
+		substate.OutputAlloc[contract].Storage[common.Hash{}] = hash
+		return substate
+	}
+
+	var lookups []uint64
+	getBlockHash := func(n uint64) (common.Hash, bool) {
+		lookups = append(lookups, n)
+		if n == num {
+			return hash, true
+		}
+		return common.Hash{}, false
+	}
+
+	// the block hash is not recorded, so the fallback is consulted
+	substate := newSubstate()
+	result, alloc, err := ExecuteSubstateWithBlockHashes(substate, params.MainnetChainConfig, vm.Config{}, getBlockHash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lookups) != 1 || lookups[0] != num {
+		t.Fatalf("fallback lookups mismatch: have %v, want [%v]", lookups, num)
+	}
+	if !substate.Result.Equal(result) || !substate.OutputAlloc.Equal(alloc) {
+		t.Fatalf("outputs mismatch with fallback block hash")
+	}
+
+	// without the fallback, BLOCKHASH returns zero
+	_, alloc, err = ExecuteSubstate(substate, params.MainnetChainConfig, vm.Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have := alloc[contract].Storage[common.Hash{}]; have != (common.Hash{}) {
+		t.Fatalf("block hash without fallback: have %v, want zero", have.Hex())
+	}
+
+	// recorded block hashes take precedence over the fallback
+	lookups = nil
+	substate = newSubstate()
+	substate.Env.BlockHashes[num] = common.Hash{0xcc}
+	substate.OutputAlloc[contract].Storage[common.Hash{}] = common.Hash{0xcc}
+	_, alloc, err = ExecuteSubstateWithBlockHashes(substate, params.MainnetChainConfig, vm.Config{}, getBlockHash)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lookups) != 0 {
+		t.Fatalf("fallback is consulted for recorded block hash: %v", lookups)
+	}
+	if !substate.OutputAlloc.Equal(alloc) {
+		t.Fatalf("outputs mismatch with recorded block hash")
+	}
+}
+
+func TestExecuteSubstateCancun(t *testing.T) {
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+	substate := newTestSubstate(
+		research.SubstateAlloc{
+			sender: research.NewSubstateAccount(0, big.NewInt(1_000_000), nil),
+		},
+		research.SubstateAlloc{
+			sender:    research.NewSubstateAccount(1, big.NewInt(999_000), nil),
+			recipient: research.NewSubstateAccount(0, big.NewInt(1_000), nil),
+		},
+		sender, recipient, big.NewInt(1_000),
+		&research.SubstateResult{
+			Status:  types.ReceiptStatusSuccessful,
+			GasUsed: 21_000,
+		},
+	)
+
+	chainConfig := *params.MainnetChainConfig
+	cancunTime := substate.Env.Timestamp + 1
+	chainConfig.CancunTime = &cancunTime
+
+	// pre-Cancun substates are unaffected
+	if _, _, err := ExecuteSubstate(substate, &chainConfig, vm.Config{}); err != nil {
+		t.Fatalf("unexpected error before Cancun: %v", err)
+	}
+
+	cancunTime = substate.Env.Timestamp
+	if _, _, err := ExecuteSubstate(substate, &chainConfig, vm.Config{}); err == nil {
+		t.Fatalf("Cancun-active substate is executed")
+	}
+}
+
+func TestExecuteSubstatePrimeAccessList(t *testing.T) {
+	sender, contract := common.Address{0x01}, common.Address{0xc0}
+	// PUSH1 0 SLOAD STOP
+	code := []byte{0x60, 0x00, 0x54, 0x00}
+	substate := newTestSubstate(
+		research.SubstateAlloc{
+			sender:   research.NewSubstateAccount(0, big.NewInt(1_000_000), nil),
+			contract: research.NewSubstateAccount(1, big.NewInt(0), code),
+		},
+		research.SubstateAlloc{
+			sender:   research.NewSubstateAccount(1, big.NewInt(1_000_000), nil),
+			contract: research.NewSubstateAccount(1, big.NewInt(0), code),
+		},
+		sender, contract, big.NewInt(0),
+		&research.SubstateResult{
+			Status: types.ReceiptStatusSuccessful,
+			// intrinsic gas with an address and a storage key, and a warm SLOAD
+			GasUsed: 21_000 + 2_400 + 1_900 + 3 + 100,
+		},
+	)
+	// Berlin, before London
+	substate.Env.Number = 12_300_000
+	substate.Message.AccessList = types.AccessList{{Address: contract, StorageKeys: []common.Hash{{}}}}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		gasUsed uint64
+	}{
+		{name: "recorded", gasUsed: substate.Result.GasUsed},
+		// a warm SLOAD without intrinsic gas of the access list
+		{name: "primed", opts: Options{PrimeAccessList: true}, gasUsed: 21_000 + 3 + 100},
+	}
+	for _, test := range tests {
+		result, _, err := ExecuteSubstateWithOptions(substate, params.MainnetChainConfig, vm.Config{}, test.opts)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if result.GasUsed != test.gasUsed {
+			t.Fatalf("%s: gas used mismatch: have %v, want %v", test.name, result.GasUsed, test.gasUsed)
+		}
+	}
+
+	// a cold SLOAD without the access list
+	substate.Message.AccessList = nil
+	result, _, err := ExecuteSubstateWithOptions(substate, params.MainnetChainConfig, vm.Config{}, Options{PrimeAccessList: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := uint64(21_000 + 3 + 2_100); result.GasUsed != want {
+		t.Fatalf("gas used without access list mismatch: have %v, want %v", result.GasUsed, want)
+	}
+}
+
+func TestExecuteSubstatePostMerge(t *testing.T) {
+	sender, contract := common.Address{0x01}, common.Address{0xc0}
+	random := common.Hash{0xaa, 0xbb}
+	// PREVRANDAO PUSH1 0 SSTORE STOP
+	code := []byte{0x44, 0x60, 0x00, 0x55, 0x00}
+	substate := newTestSubstate(
+		research.SubstateAlloc{
+			sender:   research.NewSubstateAccount(0, big.NewInt(1_000_000), nil),
+			contract: research.NewSubstateAccount(1, big.NewInt(0), code),
+		},
+		research.SubstateAlloc{
+			sender:   research.NewSubstateAccount(1, big.NewInt(1_000_000), nil),
+			contract: research.NewSubstateAccount(1, big.NewInt(0), code),
+		},
+		sender, contract, big.NewInt(0),
+		&research.SubstateResult{
+			Status:  types.ReceiptStatusSuccessful,
+			GasUsed: 21_000 + 2 + 3 + 22_100, // a cold SSTORE of a new slot
+		},
+	)
+	substate.OutputAlloc[contract].Storage[common.Hash{}] = random
+	// after London, like mainnet Paris
+	substate.Env.Number = 15_537_394
+	substate.Env.BaseFee = big.NewInt(0)
+	// a recorded non-zero difficulty is ignored after the merge
+	substate.Env.Difficulty = big.NewInt(1)
+
+	chainConfig := *params.MainnetChainConfig
+	chainConfig.MergeNetsplitBlock = new(big.Int).SetUint64(substate.Env.Number)
+	substate.Env.Random = &random
+
+	tests := []struct {
+		name        string
+		chainConfig *params.ChainConfig
+		random      *common.Hash
+		stored      common.Hash
+	}{
+		{"merge block", &chainConfig, &random, random},
+		{"recorded random", params.MainnetChainConfig, &random, random},
+		// DIFFICULTY before the merge
+		{"pre-merge", params.MainnetChainConfig, nil, common.BigToHash(big.NewInt(1))},
+		// a post-merge block without recorded random
+		{"missing random", &chainConfig, nil, common.Hash{}},
+	}
+	for _, test := range tests {
+		substate.Env.Random = test.random
+		result, alloc, err := ExecuteSubstate(substate, test.chainConfig, vm.Config{})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.stored == random && !substate.Result.Equal(result) {
+			t.Fatalf("%s: result mismatch: have %+v, want %+v", test.name, result, substate.Result)
+		}
+		if have := alloc[contract].Storage[common.Hash{}]; have != test.stored {
+			t.Fatalf("%s: stored value mismatch: have %v, want %v", test.name, have.Hex(), test.stored.Hex())
+		}
+		if consistent := substate.OutputAlloc.Equal(alloc); consistent != (test.stored == random) {
+			t.Fatalf("%s: consistency mismatch: have %v", test.name, consistent)
+		}
+	}
+}
+
+func TestExecuteSubstateMaxGas(t *testing.T) {
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+	substate := newTestSubstate(
+		research.SubstateAlloc{
+			sender: research.NewSubstateAccount(0, big.NewInt(1_000_000), nil),
+		},
+		research.SubstateAlloc{
+			sender:    research.NewSubstateAccount(1, big.NewInt(999_000), nil),
+			recipient: research.NewSubstateAccount(0, big.NewInt(1_000), nil),
+		},
+		sender, recipient, big.NewInt(1_000),
+		&research.SubstateResult{
+			Status:  types.ReceiptStatusSuccessful,
+			GasUsed: 21_000,
+		},
+	)
+	// an absurd gas limit of a malformed env
+	substate.Env.GasLimit = 1 << 62
+	substate.Message.Gas = 1 << 40
+
+	tests := []struct {
+		name   string
+		maxGas uint64
+		err    string
+	}{
+		{name: "no cap", maxGas: 0},
+		{name: "cap above block gas limit", maxGas: 1 << 63},
+		{name: "cap", maxGas: 30_000_000, err: "message gas 1099511627776 exceeds the gas cap 30000000 (block gas limit 4611686018427387904)"},
+	}
+	for _, test := range tests {
+		result, _, err := ExecuteSubstateWithOptions(substate, params.MainnetChainConfig, vm.Config{}, Options{MaxGas: test.maxGas})
+		if test.err == "" {
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", test.name, err)
+			}
+			if !substate.Result.Equal(result) {
+				t.Fatalf("%s: result mismatch: have %+v, want %+v", test.name, result, substate.Result)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("%s: error mismatch: have %v, want %q", test.name, err, test.err)
+		}
+	}
+
+	// a message within the cap is executed with the capped gas pool
+	substate.Message.Gas = 100_000
+	result, _, err := ExecuteSubstateWithOptions(substate, params.MainnetChainConfig, vm.Config{}, Options{MaxGas: 30_000_000})
+	if err != nil {
+		t.Fatalf("unexpected error within cap: %v", err)
+	}
+	if !substate.Result.Equal(result) {
+		t.Fatalf("result mismatch within cap: have %+v, want %+v", result, substate.Result)
+	}
+}
+
+func TestSetPostMergeContext(t *testing.T) {
+	chainConfig := *params.MainnetChainConfig
+	chainConfig.MergeNetsplitBlock = big.NewInt(15_537_394)
+	random := common.Hash{0xaa}
+
+	tests := []struct {
+		number     uint64
+		random     *common.Hash
+		wantRandom *common.Hash
+	}{
+		// pre-merge blocks keep their difficulty and have no PREVRANDAO
+		{number: 15_537_393},
+		{number: 15_537_394, random: &random, wantRandom: &random},
+		// a post-merge block without a recorded mixHash has a zero PREVRANDAO
+		{number: 15_537_394, wantRandom: &common.Hash{}},
+	}
+	for _, tt := range tests {
+		env := &research.SubstateEnv{Number: tt.number, Difficulty: big.NewInt(7), Random: tt.random}
+		blockCtx := vm.BlockContext{Difficulty: env.Difficulty}
+		SetPostMergeContext(&blockCtx, env, &chainConfig)
+		if tt.wantRandom == nil {
+			if blockCtx.Random != nil || blockCtx.Difficulty.Uint64() != 7 {
+				t.Fatalf("block %v: pre-merge context is modified: random %v, difficulty %v", tt.number, blockCtx.Random, blockCtx.Difficulty)
+			}
+			continue
+		}
+		if blockCtx.Random == nil || *blockCtx.Random != *tt.wantRandom || blockCtx.Difficulty.Sign() != 0 {
+			t.Fatalf("block %v: post-merge context mismatch: random %v, difficulty %v", tt.number, blockCtx.Random, blockCtx.Difficulty)
+		}
+	}
+}
@@ -1,4 +1,6 @@
-package replay
+// Package replayer executes transaction substates on off-the-chain statedbs.
+// It is separate from package research, which is imported by core/state.
+package replayer
 
 import (
 	"fmt"
@@ -16,8 +18,9 @@ func NewOffTheChainStateDB() *state.StateDB {
 	return state
 }
 
-// MakeOffTheChainStateDB returns an in-memory *state.StateDB initialized with alloc
-func MakeOffTheChainStateDB(alloc research.SubstateAlloc) *state.StateDB {
+// NewReplayStateDB returns an in-memory *state.StateDB initialized with alloc
+// to replay a transaction substate.
+func NewReplayStateDB(alloc research.SubstateAlloc) *state.StateDB {
 	statedb := NewOffTheChainStateDB()
 	for addr, a := range alloc {
 		statedb.SetCode(addr, a.Code)
@@ -31,7 +34,14 @@ func MakeOffTheChainStateDB(alloc research.SubstateAlloc) *state.StateDB {
 	// Commit and re-open to start with a clean state.
 	_, err := statedb.Commit(false)
 	if err != nil {
-		panic(fmt.Errorf("error calling statedb.Commit() in MakeOffTheChainStateDB(): %v", err))
+		panic(fmt.Errorf("error calling statedb.Commit() in NewReplayStateDB(): %v", err))
 	}
 	return statedb
 }
+
+// PostAlloc returns accounts accessed since statedb is created by
+// NewReplayStateDB, with their state after the transaction. It must be called
+// after statedb.Finalise or statedb.IntermediateRoot.
+func PostAlloc(statedb *state.StateDB) research.SubstateAlloc {
+	return statedb.ResearchPostAlloc
+}
@@ -0,0 +1,58 @@
+package replayer
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/research"
+)
+
+func TestNewReplayStateDB(t *testing.T) {
+	contract, sender := common.Address{0xc0}, common.Address{0x01}
+	alloc := research.SubstateAlloc{
+		contract: research.NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00}),
+		sender:   research.NewSubstateAccount(5, big.NewInt(1_000), nil),
+	}
+	alloc[contract].Storage[common.Hash{0x01}] = common.Hash{0x02}
+
+	statedb := NewReplayStateDB(alloc)
+	for addr, account := range alloc {
+		if have := statedb.GetNonce(addr); have != account.Nonce {
+			t.Fatalf("%v: nonce mismatch: have %v, want %v", addr.Hex(), have, account.Nonce)
+		}
+		if have := statedb.GetBalance(addr); have.Cmp(account.Balance) != 0 {
+			t.Fatalf("%v: balance mismatch: have %v, want %v", addr.Hex(), have, account.Balance)
+		}
+		if have := statedb.GetCode(addr); string(have) != string(account.Code) {
+			t.Fatalf("%v: code mismatch: have %x, want %x", addr.Hex(), have, account.Code)
+		}
+		for key, value := range account.Storage {
+			if have := statedb.GetState(addr, key); have != value {
+				t.Fatalf("%v: storage %v mismatch: have %v, want %v", addr.Hex(), key.Hex(), have.Hex(), value.Hex())
+			}
+		}
+	}
+}
+
+func TestPostAlloc(t *testing.T) {
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+	statedb := NewReplayStateDB(research.SubstateAlloc{
+		sender: research.NewSubstateAccount(0, big.NewInt(1_000), nil),
+	})
+
+	statedb.SubBalance(sender, big.NewInt(100))
+	statedb.SetNonce(sender, 1)
+	statedb.AddBalance(recipient, big.NewInt(100))
+	statedb.SetState(recipient, common.Hash{0x01}, common.Hash{0x02})
+	statedb.Finalise(true)
+
+	want := research.SubstateAlloc{
+		sender:    research.NewSubstateAccount(1, big.NewInt(900), nil),
+		recipient: research.NewSubstateAccount(0, big.NewInt(100), nil),
+	}
+	want[recipient].Storage[common.Hash{0x01}] = common.Hash{0x02}
+	if have := PostAlloc(statedb); !have.Equal(want) {
+		t.Fatalf("post alloc mismatch: have %v, want %v", have, want)
+	}
+}
@@ -1,7 +1,9 @@
 package research
 
 import (
+	"errors"
 	"fmt"
+	"syscall"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
@@ -36,9 +38,58 @@ func OpenSubstateDBReadOnly() {
 	staticSubstateDB = NewSubstateDB(backend)
 }
 
+// ErrSubstateDBLocked is wrapped by the error of ReopenSubstateDBReadOnly if
+// the substate DB is locked by another process, e.g. a recorder appending
+// substates.
+var ErrSubstateDBLocked = errors.New("substate DB is locked")
+
+// staticSubstateDBReleased is true while the substate DB is closed by
+// ReleaseSubstateDB.
+var staticSubstateDBReleased bool
+
+// ReleaseSubstateDB closes the substate DB opened by OpenSubstateDBReadOnly
+// until ReopenSubstateDBReadOnly reopens it, so that a recorder can open it
+// for writing meanwhile. A LevelDB opened read-only still holds a shared lock
+// of the DB directory. The substate DB must not be read while released.
+func ReleaseSubstateDB() error {
+	if staticSubstateDBReleased {
+		return nil
+	}
+	if err := staticSubstateDB.backend.Close(); err != nil {
+		return fmt.Errorf("error closing substate leveldb %s: %v", substateDir, err)
+	}
+	staticSubstateDBReleased = true
+	return nil
+}
+
+// ReopenSubstateDBReadOnly reopens the substate DB released by
+// ReleaseSubstateDB, which then reads substates put while it was released.
+// Readers of the substate DB, like task pools, keep reading the reopened one.
+// If the substate DB is locked by another process, it stays released and the
+// returned error wraps ErrSubstateDBLocked.
+func ReopenSubstateDBReadOnly() error {
+	if !staticSubstateDBReleased {
+		return nil
+	}
+	backend, err := rawdb.NewLevelDBDatabase(substateDir, 1024, 100, "substatedir", true)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return fmt.Errorf("%w: %s", ErrSubstateDBLocked, substateDir)
+	}
+	if err != nil {
+		return fmt.Errorf("error opening substate leveldb %s: %v", substateDir, err)
+	}
+	staticSubstateDB.backend = backend
+	staticSubstateDBReleased = false
+	return nil
+}
+
 func CloseSubstateDB() {
 	defer fmt.Println("record-replay: CloseSubstateDB")
 
+	if staticSubstateDBReleased {
+		staticSubstateDBReleased = false
+		return
+	}
 	err := staticSubstateDB.Close()
 	if err != nil {
 		panic(fmt.Errorf("error closing substate leveldb %s: %v", substateDir, err))
@@ -89,7 +140,7 @@ func GetSubstate(block uint64, tx int) *Substate {
 	return staticSubstateDB.GetSubstate(block, tx)
 }
 
-func GetBlockSubstates(block uint64) map[int]*Substate {
+func GetBlockSubstates(block uint64) BlockSubstates {
 	return staticSubstateDB.GetBlockSubstates(block)
 }
 
@@ -98,5 +149,8 @@ func PutSubstate(block uint64, tx int, substate *Substate) {
 }
 
 func DeleteSubstate(block uint64, tx int) {
-	staticSubstateDB.DeleteSubstate(block, tx)
+	err := staticSubstateDB.DeleteSubstate(block, tx)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: error deleting substate %v_%v from substate DB: %v", block, tx, err))
+	}
 }
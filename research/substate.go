@@ -2,11 +2,17 @@ package research
 
 import (
 	"bytes"
+	"fmt"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
+	cmath "github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 // SubstateAccount is modification of GenesisAccount in core/genesis.go
@@ -53,8 +59,64 @@ func (x *SubstateAccount) Equal(y *SubstateAccount) bool {
 	return true
 }
 
+// CompareOptions relaxes comparison of substate accounts by EqualWith.
+type CompareOptions struct {
+	// IgnoreCode does not compare bytecode.
+	IgnoreCode bool
+	// IgnoreNonce does not compare nonces.
+	IgnoreNonce bool
+	// TreatMissingStorageAsZero regards a storage slot missing in one account
+	// as equal to a zero value in the other account.
+	TreatMissingStorageAsZero bool
+}
+
+// EqualWith is Equal relaxed by opts. EqualWith with zero CompareOptions is
+// the same as Equal.
+func (x *SubstateAccount) EqualWith(y *SubstateAccount, opts CompareOptions) bool {
+	if x == y {
+		return true
+	}
+
+	if (x == nil || y == nil) && x != y {
+		return false
+	}
+
+	equal := ((opts.IgnoreNonce || x.Nonce == y.Nonce) &&
+		x.Balance.Cmp(y.Balance) == 0 &&
+		(opts.IgnoreCode || bytes.Equal(x.Code, y.Code)))
+	if !equal {
+		return false
+	}
+
+	if !opts.TreatMissingStorageAsZero {
+		if len(x.Storage) != len(y.Storage) {
+			return false
+		}
+		for k, xv := range x.Storage {
+			yv, exist := y.Storage[k]
+			if !(exist && xv == yv) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// missing values are zero, so y[k] is zero if k is only in x and vice versa
+	for k, xv := range x.Storage {
+		if y.Storage[k] != xv {
+			return false
+		}
+	}
+	for k, yv := range y.Storage {
+		if x.Storage[k] != yv {
+			return false
+		}
+	}
+	return true
+}
+
 func (sa *SubstateAccount) Copy() *SubstateAccount {
-	saCopy := NewSubstateAccount(sa.Nonce, sa.Balance, sa.Code)
+	saCopy := NewSubstateAccount(sa.Nonce, sa.Balance, common.CopyBytes(sa.Code))
 
 	for key, value := range sa.Storage {
 		saCopy.Storage[key] = value
@@ -67,8 +129,46 @@ func (sa *SubstateAccount) CodeHash() common.Hash {
 	return crypto.Keccak256Hash(sa.Code)
 }
 
+// StorageRoot returns the root hash of the storage trie of the account like
+// the storage root of types.StateAccount. Slots with zero values are not in
+// the trie, and types.EmptyRootHash is returned if there is no other slot.
+func (sa *SubstateAccount) StorageRoot() common.Hash {
+	tr := trie.NewEmpty(trie.NewDatabase(rawdb.NewMemoryDatabase()))
+	for key, value := range sa.Storage {
+		if value == (common.Hash{}) {
+			continue
+		}
+		// Encoding []byte cannot fail, ok to ignore the error.
+		v, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(value[:]))
+		if err := tr.Update(crypto.Keccak256(key[:]), v); err != nil {
+			panic(fmt.Errorf("record-replay: error updating storage trie: %v", err))
+		}
+	}
+	return tr.Hash()
+}
+
+// HasSameCode returns true if both accounts have the same bytecode.
+func (sa *SubstateAccount) HasSameCode(y *SubstateAccount) bool {
+	return bytes.Equal(sa.Code, y.Code)
+}
+
 type SubstateAlloc map[common.Address]*SubstateAccount
 
+// UnchangedCode returns addresses of accounts with bytecode in x that is
+// unchanged in y. Bytecode of these accounts in y is redundant.
+func (x SubstateAlloc) UnchangedCode(y SubstateAlloc) map[common.Address]struct{} {
+	unchanged := make(map[common.Address]struct{})
+	for k, xv := range x {
+		if len(xv.Code) == 0 {
+			continue
+		}
+		if yv, exist := y[k]; exist && xv.HasSameCode(yv) {
+			unchanged[k] = struct{}{}
+		}
+	}
+	return unchanged
+}
+
 func (x SubstateAlloc) Equal(y SubstateAlloc) bool {
 	if len(x) != len(y) {
 		return false
@@ -84,6 +184,51 @@ func (x SubstateAlloc) Equal(y SubstateAlloc) bool {
 	return true
 }
 
+// TotalStorageSlots returns the number of storage slots of all accounts.
+func (alloc SubstateAlloc) TotalStorageSlots() int {
+	slots := 0
+	for _, account := range alloc {
+		slots += len(account.Storage)
+	}
+	return slots
+}
+
+// ApproxEncodedSize returns the approximate size of the alloc in bytes: the
+// code of all accounts, a key and a value of each storage slot, and the
+// address, nonce and balance of each account.
+func (alloc SubstateAlloc) ApproxEncodedSize() int {
+	size := 0
+	for _, account := range alloc {
+		size += common.AddressLength + 8 + len(account.Code) + len(account.Storage)*2*common.HashLength
+		if account.Balance != nil {
+			size += len(account.Balance.Bytes())
+		}
+	}
+	return size
+}
+
+// Copy returns a deep copy of the alloc.
+func (alloc SubstateAlloc) Copy() SubstateAlloc {
+	if alloc == nil {
+		return nil
+	}
+
+	allocCopy := make(SubstateAlloc, len(alloc))
+	for addr, account := range alloc {
+		allocCopy[addr] = account.Copy()
+	}
+
+	return allocCopy
+}
+
+// copyBig returns a copy of x, or nil if x is nil.
+func copyBig(x *big.Int) *big.Int {
+	if x == nil {
+		return nil
+	}
+	return new(big.Int).Set(x)
+}
+
 type SubstateEnv struct {
 	Coinbase    common.Address
 	Difficulty  *big.Int
@@ -94,6 +239,9 @@ type SubstateEnv struct {
 
 	// London hard fork, EIP-1559
 	BaseFee *big.Int // nil if EIP-1559 is not activated
+
+	// Paris hard fork, EIP-4399
+	Random *common.Hash // mixHash for PREVRANDAO, nil before the merge
 }
 
 func NewSubstateEnv(b *types.Block, blockHashes map[uint64]common.Hash) *SubstateEnv {
@@ -111,9 +259,45 @@ func NewSubstateEnv(b *types.Block, blockHashes map[uint64]common.Hash) *Substat
 
 	env.BaseFee = b.BaseFee()
 
+	// like core.NewEVMBlockContext, a zero difficulty marks a post-merge block
+	if b.Difficulty().Sign() == 0 {
+		random := b.MixDigest()
+		env.Random = &random
+	}
+
 	return env
 }
 
+// ValidateEnv returns an error naming the first missing field of env which is
+// required to execute its transactions, i.e. a zero Number or GasLimit, or a
+// nil Difficulty. Difficulty is zero but not nil after the merge. A zero
+// Coinbase is valid, as Clique chains do not set it.
+func ValidateEnv(env *SubstateEnv) error {
+	switch {
+	case env == nil:
+		return fmt.Errorf("missing env")
+	case env.Number == 0:
+		return fmt.Errorf("missing env field Number")
+	case env.GasLimit == 0:
+		return fmt.Errorf("missing env field GasLimit")
+	case env.Difficulty == nil:
+		return fmt.Errorf("missing env field Difficulty")
+	}
+	return nil
+}
+
+// IsPostMerge returns true if the block of env is after the merge, i.e. the
+// chain config has reached MergeNetsplitBlock or Shanghai, or Random is
+// recorded. Mainnet has no merge block in its chain config, so blocks from
+// Paris to Shanghai are only known to be post-merge by their recorded Random.
+func (env *SubstateEnv) IsPostMerge(chainConfig *params.ChainConfig) bool {
+	number := new(big.Int).SetUint64(env.Number)
+	if mergeBlock := chainConfig.MergeNetsplitBlock; mergeBlock != nil && number.Cmp(mergeBlock) >= 0 {
+		return true
+	}
+	return chainConfig.IsShanghai(env.Timestamp) || env.Random != nil
+}
+
 func (x *SubstateEnv) Equal(y *SubstateEnv) bool {
 	if x == y {
 		return true
@@ -129,7 +313,9 @@ func (x *SubstateEnv) Equal(y *SubstateEnv) bool {
 		x.Number == y.Number &&
 		x.Timestamp == y.Timestamp &&
 		len(x.BlockHashes) == len(y.BlockHashes) &&
-		x.BaseFee.Cmp(y.BaseFee) == 0)
+		x.BaseFee.Cmp(y.BaseFee) == 0 &&
+		(x.Random == nil) == (y.Random == nil) &&
+		(x.Random == nil || *x.Random == *y.Random))
 	if !equal {
 		return false
 	}
@@ -144,6 +330,29 @@ func (x *SubstateEnv) Equal(y *SubstateEnv) bool {
 	return true
 }
 
+// Copy returns a deep copy of the env.
+func (env *SubstateEnv) Copy() *SubstateEnv {
+	if env == nil {
+		return nil
+	}
+
+	envCopy := *env
+	envCopy.Difficulty = copyBig(env.Difficulty)
+	envCopy.BaseFee = copyBig(env.BaseFee)
+	if env.Random != nil {
+		random := *env.Random
+		envCopy.Random = &random
+	}
+	if env.BlockHashes != nil {
+		envCopy.BlockHashes = make(map[uint64]common.Hash, len(env.BlockHashes))
+		for num, hash := range env.BlockHashes {
+			envCopy.BlockHashes[num] = hash
+		}
+	}
+
+	return &envCopy
+}
+
 type SubstateMessage struct {
 	Nonce      uint64
 	CheckNonce bool // inversion of IsFake
@@ -229,6 +438,50 @@ func (x *SubstateMessage) Equal(y *SubstateMessage) bool {
 	return true
 }
 
+// Copy returns a deep copy of the message.
+func (msg *SubstateMessage) Copy() *SubstateMessage {
+	if msg == nil {
+		return nil
+	}
+
+	msgCopy := *msg
+	msgCopy.GasPrice = copyBig(msg.GasPrice)
+	msgCopy.Value = copyBig(msg.Value)
+	msgCopy.GasFeeCap = copyBig(msg.GasFeeCap)
+	msgCopy.GasTipCap = copyBig(msg.GasTipCap)
+	msgCopy.Data = common.CopyBytes(msg.Data)
+	if msg.To != nil {
+		to := *msg.To
+		msgCopy.To = &to
+	}
+	if msg.dataHash != nil {
+		dataHash := *msg.dataHash
+		msgCopy.dataHash = &dataHash
+	}
+	if msg.AccessList != nil {
+		msgCopy.AccessList = make(types.AccessList, len(msg.AccessList))
+		for i, tuple := range msg.AccessList {
+			msgCopy.AccessList[i] = types.AccessTuple{
+				Address:     tuple.Address,
+				StorageKeys: append([]common.Hash(nil), tuple.StorageKeys...),
+			}
+		}
+	}
+
+	return &msgCopy
+}
+
+// EffectiveGasPrice returns the gas price paid per gas by the message in a
+// block with baseFee. It is GasPrice before London, where baseFee is nil, and
+// min(GasFeeCap, baseFee+GasTipCap) since London, where GasFeeCap and
+// GasTipCap of legacy and access list transactions are GasPrice.
+func (msg *SubstateMessage) EffectiveGasPrice(baseFee *big.Int) *big.Int {
+	if baseFee == nil {
+		return copyBig(msg.GasPrice)
+	}
+	return copyBig(cmath.BigMin(new(big.Int).Add(msg.GasTipCap, baseFee), msg.GasFeeCap))
+}
+
 func (msg *SubstateMessage) DataHash() common.Hash {
 	if msg.dataHash == nil {
 		dataHash := crypto.Keccak256Hash(msg.Data)
@@ -271,15 +524,47 @@ func (x *SubstateResult) Equal(y *SubstateResult) bool {
 
 	equal := (x.Status == y.Status &&
 		x.Bloom == y.Bloom &&
-		len(x.Logs) == len(y.Logs) &&
 		x.ContractAddress == y.ContractAddress &&
-		x.GasUsed == y.GasUsed)
-	if !equal {
+		x.GasUsed == y.GasUsed &&
+		equalLogs(x.Logs, y.Logs))
+
+	return equal
+}
+
+// Copy returns a deep copy of the result.
+func (result *SubstateResult) Copy() *SubstateResult {
+	if result == nil {
+		return nil
+	}
+
+	resultCopy := *result
+	if result.Logs != nil {
+		resultCopy.Logs = make([]*types.Log, len(result.Logs))
+		for i, log := range result.Logs {
+			logCopy := *log
+			logCopy.Topics = append([]common.Hash(nil), log.Topics...)
+			logCopy.Data = common.CopyBytes(log.Data)
+			resultCopy.Logs[i] = &logCopy
+		}
+	}
+
+	return &resultCopy
+}
+
+// BloomMatchesLogs returns whether Bloom is the bloom filter of Logs. A
+// mismatch in a recorded result indicates a corrupted record.
+func (r *SubstateResult) BloomMatchesLogs() bool {
+	return r.Bloom == types.BytesToBloom(types.LogsBloom(r.Logs))
+}
+
+// equalLogs compares addresses, topics and data of logs.
+func equalLogs(x, y []*types.Log) bool {
+	if len(x) != len(y) {
 		return false
 	}
 
-	for i, xl := range x.Logs {
-		yl := y.Logs[i]
+	for i, xl := range x {
+		yl := y[i]
 
 		equal := (xl.Address == yl.Address &&
 			len(xl.Topics) == len(yl.Topics) &&
@@ -333,3 +618,32 @@ func (x *Substate) Equal(y *Substate) bool {
 		x.Result.Equal(y.Result))
 	return equal
 }
+
+// EffectiveGasPrice returns the gas price paid per gas by the message of the
+// substate with the base fee of Env.
+func (substate *Substate) EffectiveGasPrice() *big.Int {
+	return substate.Message.EffectiveGasPrice(substate.Env.BaseFee)
+}
+
+// EstimatedSize returns a rough estimate of the memory of a decoded substate
+// in bytes: SubstateAlloc.ApproxEncodedSize of InputAlloc and OutputAlloc,
+// and Message.Data, which dominate the memory of large substates.
+func (substate *Substate) EstimatedSize() uint64 {
+	size := uint64(substate.InputAlloc.ApproxEncodedSize() + substate.OutputAlloc.ApproxEncodedSize())
+	if substate.Message != nil {
+		size += uint64(len(substate.Message.Data))
+	}
+	return size
+}
+
+// Copy returns a deep copy of the substate, so callers can mutate either
+// the copy or the original without affecting the other.
+func (substate *Substate) Copy() *Substate {
+	return NewSubstate(
+		substate.InputAlloc.Copy(),
+		substate.OutputAlloc.Copy(),
+		substate.Env.Copy(),
+		substate.Message.Copy(),
+		substate.Result.Copy(),
+	)
+}
@@ -0,0 +1,197 @@
+package research
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// addressBloomBitsPerAddress is the number of bits of an address bloom
+	// per address, for about 1% false positives with addressBloomHashes.
+	addressBloomBitsPerAddress = 10
+	// addressBloomHashes is the number of bits set per address.
+	addressBloomHashes = 6
+	// addressIndexBatchBlocks is the number of blooms written in a batch.
+	addressIndexBatchBlocks = 1000
+)
+
+// AddressBloomKey returns the key of the address bloom of the block in a
+// substate DB.
+func AddressBloomKey(block uint64) []byte {
+	key := make([]byte, len(stage1AddressBloomPrefix)+8)
+	copy(key, stage1AddressBloomPrefix)
+	binary.BigEndian.PutUint64(key[len(stage1AddressBloomPrefix):], block)
+	return key
+}
+
+// addressBloom is a bloom filter of addresses sized by the number of
+// addresses added to it.
+type addressBloom []byte
+
+func newAddressBloom(numAddrs int) addressBloom {
+	numBytes := (numAddrs*addressBloomBitsPerAddress + 7) / 8
+	if numBytes < 8 {
+		numBytes = 8
+	}
+	return make(addressBloom, numBytes)
+}
+
+// bits calls fn with the bit positions of addr.
+func (bloom addressBloom) bits(addr common.Address, fn func(i uint32)) {
+	h := crypto.Keccak256(addr.Bytes())
+	numBits := uint32(len(bloom)) * 8
+	for k := 0; k < addressBloomHashes; k++ {
+		fn(binary.BigEndian.Uint32(h[4*k:]) % numBits)
+	}
+}
+
+func (bloom addressBloom) add(addr common.Address) {
+	bloom.bits(addr, func(i uint32) { bloom[i/8] |= 1 << (i % 8) })
+}
+
+// test returns false if addr is not in the bloom, and true if it may be.
+func (bloom addressBloom) test(addr common.Address) bool {
+	found := true
+	bloom.bits(addr, func(i uint32) {
+		if bloom[i/8]&(1<<(i%8)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// substateAddresses adds the sender and the recipient of the transaction and
+// accounts in InputAlloc and OutputAlloc to addrs, the addresses matched by
+// substateHasAddress.
+func substateAddresses(substate *Substate, addrs map[common.Address]bool) {
+	msg := substate.Message
+	addrs[msg.From] = true
+	if msg.To != nil {
+		addrs[*msg.To] = true
+	}
+	for _, alloc := range []SubstateAlloc{substate.InputAlloc, substate.OutputAlloc} {
+		for addr := range alloc {
+			addrs[addr] = true
+		}
+	}
+}
+
+// encodeAddressBloom encodes a bloom of addrs of a block.
+func encodeAddressBloom(addrs map[common.Address]bool) []byte {
+	bloom := newAddressBloom(len(addrs))
+	for addr := range addrs {
+		bloom.add(addr)
+	}
+	return bloom
+}
+
+// getAddressBloom returns the address bloom of the block, or false if the
+// block has no bloom, e.g. because a substate of the block was put or
+// deleted after the bloom was built.
+func (db *SubstateDB) getAddressBloom(block uint64) (addressBloom, bool) {
+	value, err := db.backend.Get(AddressBloomKey(block))
+	if err != nil || len(value) == 0 {
+		return nil, false
+	}
+	return addressBloom(value), true
+}
+
+// BuildAddressIndex builds a bloom of the addresses of each block with
+// substates from block first to block last, i.e. senders, recipients and
+// accounts in InputAlloc and OutputAlloc, and stores it in the substate DB
+// for BlocksTouchingAddress. Existing blooms of the blocks are replaced. It
+// returns the number of indexed blocks.
+func (db *SubstateDB) BuildAddressIndex(first, last uint64) (numBlocks uint64, err error) {
+	batch := db.backend.NewBatch()
+	var (
+		block uint64
+		addrs map[common.Address]bool
+	)
+	flush := func() error {
+		if addrs == nil {
+			return nil
+		}
+		if err := batch.Put(AddressBloomKey(block), encodeAddressBloom(addrs)); err != nil {
+			return err
+		}
+		numBlocks++
+		if numBlocks%addressIndexBatchBlocks == 0 {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		return nil
+	}
+
+	err = db.IterateSubstates(first, last, func(key SubstateKey, substate *Substate) bool {
+		if addrs == nil || key.Block != block {
+			if err = flush(); err != nil {
+				return false
+			}
+			block, addrs = key.Block, make(map[common.Address]bool)
+		}
+		substateAddresses(substate, addrs)
+		return true
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return numBlocks, err
+	}
+	return numBlocks, batch.Write()
+}
+
+// BlocksTouchingAddress returns the blocks from block first to block last
+// with a substate whose sender, recipient, or account in InputAlloc or
+// OutputAlloc is addr, in ascending order. Blocks whose address bloom rules
+// out addr are skipped, and substates of the other blocks are decoded to
+// confirm addr, so false positives of blooms are not returned. Putting or
+// deleting a substate deletes the bloom of its block, and blocks without a
+// bloom are always decoded, so no block is missed.
+func (db *SubstateDB) BlocksTouchingAddress(addr common.Address, first, last uint64) ([]uint64, error) {
+	blocks, err := db.IterateBlocks(first, last)
+	if err != nil {
+		return nil, err
+	}
+
+	// iterate blooms of the blocks in ascending order along with the blocks
+	prefix := []byte(stage1AddressBloomPrefix)
+	iter := db.backend.NewIterator(prefix, AddressBloomKey(first)[len(prefix):])
+	defer iter.Release()
+	bloomBlock, hasBloom := uint64(0), iter.Next()
+	if hasBloom {
+		bloomBlock = binary.BigEndian.Uint64(iter.Key()[len(prefix):])
+	}
+
+	addrs := map[common.Address]bool{addr: true}
+	var touching []uint64
+	for _, block := range blocks {
+		for hasBloom && bloomBlock < block {
+			if hasBloom = iter.Next(); hasBloom {
+				bloomBlock = binary.BigEndian.Uint64(iter.Key()[len(prefix):])
+			}
+		}
+		if hasBloom && bloomBlock == block && len(iter.Value()) > 0 && !addressBloom(iter.Value()).test(addr) {
+			continue
+		}
+		substates, decodeErrs := db.GetBlockSubstatesTolerant(block)
+		if len(decodeErrs) > 0 {
+			return nil, fmt.Errorf("record-replay: %v", decodeErrs[0])
+		}
+		for _, substate := range substates {
+			if substateHasAddress(substate, addrs) {
+				touching = append(touching, block)
+				break
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return touching, nil
+}
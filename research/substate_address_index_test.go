@@ -0,0 +1,170 @@
+package research
+
+import (
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+func TestAddressBloom(t *testing.T) {
+	addrs := make([]common.Address, 100)
+	bloom := newAddressBloom(len(addrs))
+	for i := range addrs {
+		addrs[i] = common.BigToAddress(big.NewInt(int64(i + 1)))
+		bloom.add(addrs[i])
+	}
+	for _, addr := range addrs {
+		if !bloom.test(addr) {
+			t.Fatalf("false negative for %v", addr.Hex())
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10_000; i++ {
+		if bloom.test(common.BigToAddress(big.NewInt(int64(1_000_000 + i)))) {
+			falsePositives++
+		}
+	}
+	// about 1% with 10 bits per address
+	if falsePositives > 500 {
+		t.Fatalf("too many false positives: %v of 10000", falsePositives)
+	}
+}
+
+func TestBlocksTouchingAddress(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	addrs := make([]common.Address, 20)
+	for i := range addrs {
+		addrs[i] = common.BigToAddress(big.NewInt(int64(i + 1)))
+	}
+	randAddr := func() common.Address { return addrs[rng.Intn(len(addrs))] }
+
+	db := NewMemorySubstateDB()
+	defer db.Close()
+	for block := uint64(1); block <= 200; block++ {
+		if rng.Intn(4) == 0 {
+			// a block without substates
+			continue
+		}
+		for tx := 0; tx < 1+rng.Intn(3); tx++ {
+			substate := newTestSubstate(block, randAddr(), randAddr())
+			if rng.Intn(2) == 0 {
+				substate.InputAlloc[randAddr()] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+			}
+			db.PutSubstate(block, tx, substate)
+		}
+	}
+
+	// brute-force scan of decoded substates
+	bruteForce := func(addr common.Address, first, last uint64) []uint64 {
+		var blocks []uint64
+		err := db.IterateSubstates(first, last, func(key SubstateKey, substate *Substate) bool {
+			if substateHasAddress(substate, map[common.Address]bool{addr: true}) && (len(blocks) == 0 || blocks[len(blocks)-1] != key.Block) {
+				blocks = append(blocks, key.Block)
+			}
+			return true
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return blocks
+	}
+	check := func(name string, first, last uint64) {
+		for _, addr := range append(addrs, common.Address{0xff}) {
+			have, err := db.BlocksTouchingAddress(addr, first, last)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", name, err)
+			}
+			if want := bruteForce(addr, first, last); !reflect.DeepEqual(have, want) {
+				t.Fatalf("%s: blocks touching %v mismatch: have %v, want %v", name, addr.Hex(), have, want)
+			}
+		}
+	}
+
+	// without an index, every block is decoded
+	check("no index", 1, 200)
+
+	n, err := db.BuildAddressIndex(1, 150)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want, _ := db.IterateBlocks(1, 150); n != uint64(len(want)) {
+		t.Fatalf("number of indexed blocks mismatch: have %v, want %v", n, len(want))
+	}
+	// blocks 151-200 are not indexed
+	check("partial index", 1, 200)
+	check("sub-segment", 50, 120)
+
+	// putting a substate deletes the bloom of its block, also if it
+	// replaces a substate with other addresses
+	blocks, _ := db.IterateBlocks(1, 150)
+	for i, put := range []func(block uint64){
+		func(block uint64) {
+			db.PutSubstate(block, 10, newTestSubstate(block, common.Address{0xee}, common.Address{0xef}))
+		},
+		func(block uint64) {
+			db.PutSubstate(block, 0, newTestSubstate(block, common.Address{0xee}, common.Address{0xef}))
+		},
+		func(block uint64) {
+			db.PutSubstateBatch([]SubstateBatchEntry{{block, 0, newTestSubstate(block, common.Address{0xee}, common.Address{0xef})}})
+		},
+	} {
+		block := blocks[i]
+		put(block)
+		if _, ok := db.getAddressBloom(block); ok {
+			t.Fatalf("bloom of block %v is kept", block)
+		}
+		have, err := db.BlocksTouchingAddress(common.Address{0xee}, block, 200)
+		if err != nil || !reflect.DeepEqual(have, []uint64{block}) {
+			t.Fatalf("blocks touching new address mismatch: have %v (%v), want [%v]", have, err, block)
+		}
+	}
+	if err := db.DeleteSubstate(blocks[3], 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := db.getAddressBloom(blocks[3]); ok {
+		t.Fatalf("bloom of block %v is kept after deleting a substate", blocks[3])
+	}
+	check("invalidated blooms", 1, 200)
+}
+
+// blockDecodeCounter counts iterations over substates of a single block,
+// i.e. blocks decoded by GetBlockSubstatesTolerant.
+type blockDecodeCounter struct {
+	ethdb.Database
+	decoded int
+}
+
+func (db *blockDecodeCounter) NewIterator(prefix []byte, start []byte) ethdb.Iterator {
+	if len(prefix) == len(Stage1SubstateBlockPrefix(0)) && string(prefix[:2]) == stage1SubstatePrefix {
+		db.decoded++
+	}
+	return db.Database.NewIterator(prefix, start)
+}
+
+func TestBlocksTouchingAddressPrunes(t *testing.T) {
+	backend := &blockDecodeCounter{Database: rawdb.NewMemoryDatabase()}
+	db := NewSubstateDB(backend)
+	defer db.Close()
+	// each of 100 blocks touches its own sender and recipient
+	for block := uint64(1); block <= 100; block++ {
+		db.PutSubstate(block, 0, newTestSubstate(block, common.BigToAddress(big.NewInt(int64(block))), common.Address{0xff, byte(block)}))
+	}
+	if _, err := db.BuildAddressIndex(1, 100); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	backend.decoded = 0
+	have, err := db.BlocksTouchingAddress(common.BigToAddress(big.NewInt(42)), 1, 100)
+	if err != nil || !reflect.DeepEqual(have, []uint64{42}) {
+		t.Fatalf("blocks touching address mismatch: have %v (%v), want [42]", have, err)
+	}
+	// block 42 and a few false positives
+	if backend.decoded < 1 || backend.decoded > 10 {
+		t.Fatalf("decoded blocks mismatch: have %v, want 1-10 of 100", backend.decoded)
+	}
+}
@@ -0,0 +1,86 @@
+package research
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// DefaultSubstateBatchSize is the default number of substates written at once
+// by SubstateBatch.
+const DefaultSubstateBatchSize = 1000
+
+// SubstateBatch accumulates substates and their bytecode in a batch of the
+// substate DB, and writes them at once every size substates. Substates put
+// after the last write are not visible until Flush is called. SubstateBatch is
+// safe for concurrent use.
+type SubstateBatch struct {
+	db   *SubstateDB
+	size int
+
+	mu    sync.Mutex
+	batch ethdb.Batch
+	count int
+}
+
+// NewBatch returns a SubstateBatch writing every size substates. A size less
+// than 1 writes each substate immediately.
+func (db *SubstateDB) NewBatch(size int) *SubstateBatch {
+	if size < 1 {
+		size = 1
+	}
+	return &SubstateBatch{
+		db:    db,
+		size:  size,
+		batch: db.backend.NewBatch(),
+	}
+}
+
+// PutSubstate puts a substate like SubstateDB.PutSubstate in the batch.
+func (b *SubstateBatch) PutSubstate(block uint64, tx int, substate *Substate) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	putSubstate(b.batch, block, tx, substate)
+	return b.added()
+}
+
+// PutSubstateStripCode puts a substate like SubstateDB.PutSubstateStripCode
+// in the batch. Bytecode put in the batch but not written yet is not regarded
+// as already stored in the substate DB.
+func (b *SubstateBatch) PutSubstateStripCode(block uint64, tx int, substate *Substate) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	duplicates := b.db.putSubstateStripCode(b.batch, block, tx, substate)
+	return duplicates, b.added()
+}
+
+// added counts a substate put in the batch and writes the batch if it is full.
+func (b *SubstateBatch) added() error {
+	b.count++
+	if b.count < b.size {
+		return nil
+	}
+	return b.write()
+}
+
+func (b *SubstateBatch) write() error {
+	if b.count == 0 {
+		return nil
+	}
+	if err := b.batch.Write(); err != nil {
+		return err
+	}
+	b.batch.Reset()
+	b.count = 0
+	return nil
+}
+
+// Flush writes substates remaining in the batch.
+func (b *SubstateBatch) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.write()
+}
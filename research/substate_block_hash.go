@@ -0,0 +1,54 @@
+package research
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// BlockHashFunc returns the hash of block num, or false if it is unknown.
+type BlockHashFunc func(num uint64) (common.Hash, bool)
+
+// blockHashWindow is the number of recent blocks whose hashes are available
+// to BLOCKHASH.
+const blockHashWindow = 256
+
+// NewSubstateBlockHashFunc returns a BlockHashFunc looking up hashes recorded
+// in Env.BlockHashes of substates of the 256 blocks after block num in db,
+// which are the blocks able to read it with BLOCKHASH. Looked up hashes,
+// including unknown ones, are cached. The returned function is safe for
+// concurrent use.
+func NewSubstateBlockHashFunc(db SubstateReader) BlockHashFunc {
+	var mu sync.Mutex
+	type cached struct {
+		hash common.Hash
+		ok   bool
+	}
+	cache := make(map[uint64]cached)
+
+	return func(num uint64) (common.Hash, bool) {
+		mu.Lock()
+		c, exist := cache[num]
+		mu.Unlock()
+		if exist {
+			return c.hash, c.ok
+		}
+
+		for i := uint64(1); i <= blockHashWindow && num+i > num; i++ {
+			for _, substate := range db.GetBlockSubstates(num + i) {
+				if hash, exist := substate.Env.BlockHashes[num]; exist {
+					c = cached{hash: hash, ok: true}
+					break
+				}
+			}
+			if c.ok {
+				break
+			}
+		}
+
+		mu.Lock()
+		cache[num] = c
+		mu.Unlock()
+		return c.hash, c.ok
+	}
+}
@@ -0,0 +1,43 @@
+package research
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestNewSubstateBlockHashFunc(t *testing.T) {
+	db := NewMemorySubstateDB()
+	defer db.Close()
+
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+	for _, block := range []uint64{1_000, 1_100, 1_300} {
+		substate := newTestSubstate(block, sender, recipient)
+		substate.Env.BlockHashes[block-50] = common.Hash{byte(block / 100)}
+		db.PutSubstate(block, 0, substate)
+	}
+
+	tests := []struct {
+		num  uint64
+		hash common.Hash
+		ok   bool
+	}{
+		{num: 950, hash: common.Hash{10}, ok: true},
+		{num: 1_050, hash: common.Hash{11}, ok: true},
+		{num: 1_250, hash: common.Hash{13}, ok: true},
+		// not recorded in any substate
+		{num: 1_000},
+		{num: 2_000},
+	}
+
+	getBlockHash := NewSubstateBlockHashFunc(db)
+	// twice to check cached hashes
+	for i := 0; i < 2; i++ {
+		for _, test := range tests {
+			hash, ok := getBlockHash(test.num)
+			if hash != test.hash || ok != test.ok {
+				t.Fatalf("block %v: have %v %v, want %v %v", test.num, hash.Hex(), ok, test.hash.Hex(), test.ok)
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package research
+
+import (
+	"bytes"
+	"sync"
+)
+
+// DefaultCloneWriteBuffer is the default number of substates read but not
+// written yet by a SubstateClonePipeline.
+const DefaultCloneWriteBuffer = 1024
+
+// CloneConfig configures a SubstateClonePipeline.
+type CloneConfig struct {
+	// ReadWorkers is the number of workers reading substates, the number of
+	// workers of the task pool is used if it is not positive.
+	ReadWorkers int
+	// WriteBuffer is the number of substates read but not written yet, after
+	// which reading workers wait for the writer. DefaultCloneWriteBuffer is
+	// used if it is not positive.
+	WriteBuffer int
+}
+
+// SubstateWriteFunc writes a substate of block and tx.
+type SubstateWriteFunc func(block uint64, tx int, substate *Substate) error
+
+type cloneEntry struct {
+	block    uint64
+	tx       int
+	substate *Substate
+
+	// synced receives the result of flush if the entry is put by Sync
+	flush  func() error
+	synced chan error
+}
+
+// SubstateClonePipeline decouples reading substates from writing them.
+// Substates are put by reading workers of a task pool into a buffer, and a
+// single writer goroutine drains the buffer with the write function, so slow
+// writes do not stall reads until the buffer is full.
+type SubstateClonePipeline struct {
+	config CloneConfig
+	write  SubstateWriteFunc
+
+	entries chan cloneEntry
+	done    chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewSubstateClonePipeline returns a SubstateClonePipeline writing substates
+// with write, and starts its writer goroutine. Close must be called to write
+// the remaining substates and stop the writer.
+func NewSubstateClonePipeline(config CloneConfig, write SubstateWriteFunc) *SubstateClonePipeline {
+	if config.WriteBuffer < 1 {
+		config.WriteBuffer = DefaultCloneWriteBuffer
+	}
+	p := &SubstateClonePipeline{
+		config:  config,
+		write:   write,
+		entries: make(chan cloneEntry, config.WriteBuffer),
+		done:    make(chan struct{}),
+	}
+	go p.writer()
+	return p
+}
+
+func (p *SubstateClonePipeline) writer() {
+	defer close(p.done)
+	for entry := range p.entries {
+		if entry.synced != nil {
+			err := p.Err()
+			if err == nil && entry.flush != nil {
+				err = entry.flush()
+				p.setErr(err)
+			}
+			entry.synced <- err
+			continue
+		}
+		// keep draining after an error so that Put never blocks forever
+		if p.Err() != nil {
+			continue
+		}
+		p.setErr(p.write(entry.block, entry.tx, entry.substate))
+	}
+}
+
+func (p *SubstateClonePipeline) setErr(err error) {
+	if err == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+}
+
+// Err returns the first error of the write function, if any.
+func (p *SubstateClonePipeline) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Put puts a substate to be written by the writer goroutine. It waits while
+// the buffer is full, and returns an error of a previous write so that the
+// task pool stops reading. The substate must not be modified afterwards.
+func (p *SubstateClonePipeline) Put(block uint64, tx int, substate *Substate) error {
+	if err := p.Err(); err != nil {
+		return err
+	}
+	p.entries <- cloneEntry{block: block, tx: tx, substate: substate}
+	return nil
+}
+
+// Sync waits until all substates put before are written, and then calls
+// flush, if it is not nil, in the writer goroutine, so that flush does not
+// race with the write function. It returns the first error of the write
+// function or flush. Sync must not be called after Close.
+func (p *SubstateClonePipeline) Sync(flush func() error) error {
+	synced := make(chan error, 1)
+	p.entries <- cloneEntry{flush: flush, synced: synced}
+	return <-synced
+}
+
+// Close waits until all substates put are written, and returns the first
+// error of the write function. Put must not be called after Close.
+func (p *SubstateClonePipeline) Close() error {
+	close(p.entries)
+	<-p.done
+	return p.Err()
+}
+
+// NewTaskPool returns a task pool reading substates of db with
+// CloneConfig.ReadWorkers workers. Each substate is passed to transform, if
+// it is not nil, and then put into the pipeline.
+func (p *SubstateClonePipeline) NewTaskPool(name string, config *SubstateTaskConfig, db SubstateReader, transform SubstateTaskFunc) *SubstateTaskPool {
+	if p.config.ReadWorkers > 0 {
+		config.Workers = p.config.ReadWorkers
+	}
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		if transform != nil {
+			if err := transform(block, tx, substate, taskPool); err != nil {
+				return err
+			}
+		}
+		return p.Put(block, tx, substate)
+	}
+	return NewSubstateTaskPoolWithDB(name, taskFunc, config, db)
+}
+
+// VerifyClone checks that every substate of src from block first to block
+// last is stored in dst with the same bytes, after transform is applied to it
+// if transform is not nil, e.g. the rewrites of a FixMap applied while
+// cloning. Substates of src for which include returns false, e.g. those
+// filtered out while cloning, are not checked if include is not nil, and
+// substates of src failing to decode are not checked either since they are
+// skipped while cloning. Substates of dst missing in src are not reported, so
+// dst may hold other substates. It returns the number of substates checked
+// and substates missing in dst (MissingInB) or differing from src, and stops
+// after maxDiffs differences if maxDiffs > 0.
+func VerifyClone(src, dst *SubstateDB, first, last uint64, include func(block uint64, tx int, substate *Substate) bool, transform func(block uint64, tx int, substate *Substate), maxDiffs int) (numChecked int, diffs []SubstateDiff, err error) {
+	it := newSubstateKeyIterator(src, first, last)
+	defer func() {
+		if releaseErr := it.release(); err == nil {
+			err = releaseErr
+		}
+	}()
+
+	for ; it.valid && (maxDiffs <= 0 || len(diffs) < maxDiffs); it.next() {
+		key := it.key
+		want, err := src.decodeSubstate(it.iter.Value())
+		if err != nil {
+			continue
+		}
+		if include != nil && !include(key.Block, key.Tx, want) {
+			continue
+		}
+		numChecked++
+		if transform != nil {
+			transform(key.Block, key.Tx, want)
+		}
+
+		have, err := dst.backend.Get(key.Encode())
+		if err != nil {
+			diffs = append(diffs, SubstateDiff{Key: key, MissingInB: true})
+			continue
+		}
+		wantRLP, err := encodeSubstateRLP(want)
+		if err != nil {
+			return numChecked, diffs, err
+		}
+		if bytes.Equal(have, wantRLP) {
+			continue
+		}
+		field := SubstateFieldEncoding
+		if haveSubstate, err := dst.decodeSubstate(have); err == nil {
+			if f := want.FirstDiff(haveSubstate); f != "" {
+				field = f
+			}
+		}
+		diffs = append(diffs, SubstateDiff{Key: key, Field: field})
+	}
+
+	return numChecked, diffs, nil
+}
@@ -0,0 +1,243 @@
+package research
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubstateClonePipeline(t *testing.T) {
+	src := newTestSubstateDB(map[uint64][]int{
+		1: {0},
+		2: {0, 1, 2},
+		4: {0, 1},
+		5: {0},
+		7: {0, 1, 2, 3},
+	})
+	defer src.Close()
+	dst := NewMemorySubstateDB()
+	defer dst.Close()
+
+	batch := dst.NewBatch(3)
+	// a buffer smaller than the segment makes readers wait for the writer
+	pipeline := NewSubstateClonePipeline(CloneConfig{ReadWorkers: 3, WriteBuffer: 2}, batch.PutSubstate)
+	taskPool := pipeline.NewTaskPool("clone", &SubstateTaskConfig{Workers: 1}, src, nil)
+	taskPool.Quiet = true
+	if taskPool.Config.Workers != 3 {
+		t.Fatalf("workers mismatch: have %v, want 3", taskPool.Config.Workers)
+	}
+	err := taskPool.ExecuteSegment(NewBlockSegment(1, 7))
+	if closeErr := pipeline.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = batch.Flush()
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	srcKeys, err := src.IterateBlocks(0, OpenBlockSegmentLast)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dstKeys, err := dst.IterateBlocks(0, OpenBlockSegmentLast)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(srcKeys) != len(dstKeys) {
+		t.Fatalf("cloned blocks mismatch: have %v, want %v", dstKeys, srcKeys)
+	}
+	for i, block := range srcKeys {
+		if dstKeys[i] != block {
+			t.Fatalf("cloned blocks mismatch: have %v, want %v", dstKeys, srcKeys)
+		}
+		srcSubstates, dstSubstates := src.GetBlockSubstates(block), dst.GetBlockSubstates(block)
+		if len(srcSubstates) != len(dstSubstates) {
+			t.Fatalf("block %v: number of substates mismatch: have %v, want %v", block, len(dstSubstates), len(srcSubstates))
+		}
+		for tx, substate := range srcSubstates {
+			if !substate.Equal(dstSubstates[tx]) {
+				t.Fatalf("substate %v_%v mismatch", block, tx)
+			}
+		}
+	}
+}
+
+func TestSubstateClonePipelineWriteError(t *testing.T) {
+	src := newTestSubstateDB(map[uint64][]int{
+		1: {0}, 2: {0}, 3: {0}, 4: {0}, 5: {0}, 6: {0}, 7: {0}, 8: {0},
+	})
+	defer src.Close()
+
+	writeErr := errors.New("disk full")
+	var written int
+	pipeline := NewSubstateClonePipeline(CloneConfig{WriteBuffer: 1}, func(block uint64, tx int, substate *Substate) error {
+		if block == 3 {
+			return writeErr
+		}
+		written++
+		return nil
+	})
+	taskPool := pipeline.NewTaskPool("clone", &SubstateTaskConfig{Workers: 1}, src, nil)
+	taskPool.Quiet = true
+	err := taskPool.ExecuteSegment(NewBlockSegment(1, 8))
+	if closeErr := pipeline.Close(); !errors.Is(closeErr, writeErr) {
+		t.Fatalf("close error mismatch: have %v, want %v", closeErr, writeErr)
+	}
+	// the write error stops reading, unless all blocks were read before it
+	if err != nil && !strings.Contains(err.Error(), writeErr.Error()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// substates are read and written in order by a single worker
+	if written != 2 {
+		t.Fatalf("substates are written after the write error: %v", written)
+	}
+}
+
+func TestSubstateClonePipelineCheckpoint(t *testing.T) {
+	blocks := make(map[uint64][]int)
+	for block := uint64(1); block <= 20; block++ {
+		blocks[block] = []int{0, 1}
+	}
+	src := newTestSubstateDB(blocks)
+	defer src.Close()
+	dst := NewMemorySubstateDB()
+	defer dst.Close()
+
+	defer func(interval time.Duration) { checkpointInterval = interval }(checkpointInterval)
+	checkpointInterval = 0
+
+	// the batch is never flushed by itself, so substates not synced are lost
+	batch := dst.NewBatch(1000)
+	pipeline := NewSubstateClonePipeline(CloneConfig{WriteBuffer: 4}, batch.PutSubstate)
+	crash := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		if block == 15 {
+			return errors.New("crash")
+		}
+		return nil
+	}
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	// one worker reports blocks in order, so the checkpoint is deterministic
+	taskPool := pipeline.NewTaskPool("clone", &SubstateTaskConfig{Workers: 1}, src, crash)
+	taskPool.Quiet = true
+	taskPool.CheckpointPath = path
+	taskPool.CheckpointSyncFunc = func() error {
+		return pipeline.Sync(batch.Flush)
+	}
+
+	if err := taskPool.ExecuteSegment(NewBlockSegment(1, 20)); err == nil {
+		t.Fatalf("crash is not returned")
+	}
+	// the pipeline is not closed and the batch is not flushed, as in a crash
+	checkpoint, err := ReadSegmentCheckpoint(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading checkpoint: %v", err)
+	}
+	if checkpoint == nil || checkpoint.Block != 14 {
+		t.Fatalf("checkpoint mismatch: have %+v, want block 14", checkpoint)
+	}
+	for block := uint64(1); block <= checkpoint.Block; block++ {
+		for _, tx := range blocks[block] {
+			if !dst.HasSubstate(block, tx) {
+				t.Fatalf("substate %v_%v before the checkpoint is not written", block, tx)
+			}
+		}
+	}
+
+	// an error of the write function is returned by Sync
+	writeErr := errors.New("disk full")
+	failing := NewSubstateClonePipeline(CloneConfig{}, func(block uint64, tx int, substate *Substate) error {
+		return writeErr
+	})
+	failing.Put(1, 0, src.GetSubstate(1, 0))
+	flushed := false
+	if err := failing.Sync(func() error { flushed = true; return nil }); !errors.Is(err, writeErr) {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, writeErr)
+	}
+	if flushed {
+		t.Fatalf("flush is called after a write error")
+	}
+	failing.Close()
+	pipeline.Close()
+}
+
+func TestVerifyClone(t *testing.T) {
+	src := newTestSubstateDB(map[uint64][]int{
+		1: {0},
+		2: {0, 1},
+		3: {0},
+	})
+	defer src.Close()
+	dst := NewMemorySubstateDB()
+	defer dst.Close()
+
+	// clone with a rewrite of the timestamp
+	rewrite := func(block uint64, tx int, substate *Substate) {
+		substate.Env.Timestamp++
+	}
+	pipeline := NewSubstateClonePipeline(CloneConfig{}, func(block uint64, tx int, substate *Substate) error {
+		dst.PutSubstate(block, tx, substate)
+		return nil
+	})
+	taskPool := pipeline.NewTaskPool("clone", &SubstateTaskConfig{Workers: 2}, src, func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		rewrite(block, tx, substate)
+		return nil
+	})
+	taskPool.Quiet = true
+	err := taskPool.ExecuteSegment(NewBlockSegment(1, 3))
+	if closeErr := pipeline.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	numChecked, diffs, err := VerifyClone(src, dst, 1, 3, nil, rewrite, 0)
+	if err != nil || len(diffs) != 0 || numChecked != 4 {
+		t.Fatalf("clone does not verify clean: %v substates checked, %v (%v)", numChecked, diffs, err)
+	}
+	// without the rewrite, every substate differs
+	_, diffs, err = VerifyClone(src, dst, 1, 3, nil, nil, 0)
+	if err != nil || len(diffs) != 4 {
+		t.Fatalf("diffs without rewrite mismatch: have %v (%v), want 4", diffs, err)
+	}
+
+	// corrupt the destination, and delete a substate from it
+	substate := dst.GetSubstate(2, 1)
+	substate.Result.GasUsed++
+	dst.PutSubstate(2, 1, substate)
+	if err := dst.DeleteSubstate(1, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// substates only in the destination are not reported
+	dst.PutSubstate(3, 1, substate)
+
+	_, diffs, err = VerifyClone(src, dst, 1, 3, nil, rewrite, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []SubstateDiff{
+		{Key: SubstateKey{1, 0}, MissingInB: true},
+		{Key: SubstateKey{2, 1}, Field: SubstateFieldResult},
+	}
+	if len(diffs) != len(want) || diffs[0] != want[0] || diffs[1] != want[1] {
+		t.Fatalf("diffs mismatch: have %v, want %v", diffs, want)
+	}
+
+	_, diffs, err = VerifyClone(src, dst, 1, 3, nil, rewrite, 1)
+	if err != nil || len(diffs) != 1 || diffs[0] != want[0] {
+		t.Fatalf("diffs mismatch with max diffs: have %v (%v), want %v", diffs, err, want[:1])
+	}
+
+	// substates not included, e.g. filtered out while cloning, are not checked
+	include := func(block uint64, tx int, substate *Substate) bool {
+		return block != 1
+	}
+	numChecked, diffs, err = VerifyClone(src, dst, 1, 3, include, rewrite, 0)
+	if err != nil || len(diffs) != 1 || diffs[0] != want[1] || numChecked != 3 {
+		t.Fatalf("diffs mismatch with include: have %v substates checked, %v (%v), want %v", numChecked, diffs, err, want[1:])
+	}
+}
@@ -0,0 +1,62 @@
+package research
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SubstateCodeWriteFunc writes a contract code of the code hash.
+type SubstateCodeWriteFunc func(codeHash common.Hash, code []byte) error
+
+// SubstateCodeCollector collects unique contract codes of InputAlloc and
+// OutputAlloc of substates executed by a task pool. Codes are deduplicated by
+// code hash, and each unique code is written once by the worker finding it
+// first.
+type SubstateCodeCollector struct {
+	write SubstateCodeWriteFunc
+
+	codes sync.Map // common.Hash -> struct{}
+
+	numCodes int64
+	numBytes int64
+}
+
+// NewSubstateCodeCollector returns a SubstateCodeCollector writing unique codes
+// with write.
+func NewSubstateCodeCollector(write SubstateCodeWriteFunc) *SubstateCodeCollector {
+	return &SubstateCodeCollector{write: write}
+}
+
+// Task is a SubstateTaskFunc collecting codes of accounts of a substate.
+// Accounts without code are skipped.
+func (c *SubstateCodeCollector) Task(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+	for _, alloc := range []SubstateAlloc{substate.InputAlloc, substate.OutputAlloc} {
+		for _, account := range alloc {
+			if len(account.Code) == 0 {
+				continue
+			}
+			codeHash := account.CodeHash()
+			if _, loaded := c.codes.LoadOrStore(codeHash, struct{}{}); loaded {
+				continue
+			}
+			if err := c.write(codeHash, account.Code); err != nil {
+				return err
+			}
+			atomic.AddInt64(&c.numCodes, 1)
+			atomic.AddInt64(&c.numBytes, int64(len(account.Code)))
+		}
+	}
+	return nil
+}
+
+// NumCodes returns the number of unique codes written.
+func (c *SubstateCodeCollector) NumCodes() int64 {
+	return atomic.LoadInt64(&c.numCodes)
+}
+
+// NumBytes returns the total size of unique codes written.
+func (c *SubstateCodeCollector) NumBytes() int64 {
+	return atomic.LoadInt64(&c.numBytes)
+}
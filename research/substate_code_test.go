@@ -0,0 +1,60 @@
+package research
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestSubstateCodeCollector(t *testing.T) {
+	code, otherCode := []byte{0x60, 0x00, 0x00}, []byte{0x60, 0x01, 0x00}
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	// two accounts in different substates and allocs share code
+	substate := newTestSubstate(1, common.Address{0x01}, common.Address{0x02})
+	substate.InputAlloc[common.Address{0xc0}] = NewSubstateAccount(1, big.NewInt(0), code)
+	db.PutSubstate(1, 0, substate)
+	substate = newTestSubstate(2, common.Address{0x01}, common.Address{0x02})
+	substate.OutputAlloc[common.Address{0xc1}] = NewSubstateAccount(1, big.NewInt(0), code)
+	substate.OutputAlloc[common.Address{0xc2}] = NewSubstateAccount(1, big.NewInt(0), otherCode)
+	db.PutSubstate(2, 0, substate)
+
+	var mu sync.Mutex
+	written := make(map[common.Hash][]byte)
+	numWrites := 0
+	collector := NewSubstateCodeCollector(func(codeHash common.Hash, code []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		written[codeHash] = code
+		numWrites++
+		return nil
+	})
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: collector.Task,
+		Config:   &SubstateTaskConfig{Workers: 2},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 2)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if numWrites != 2 || len(written) != 2 {
+		t.Fatalf("number of written codes mismatch: have %v writes of %v codes, want 2", numWrites, len(written))
+	}
+	for _, c := range [][]byte{code, otherCode} {
+		if have := written[crypto.Keccak256Hash(c)]; string(have) != string(c) {
+			t.Fatalf("code mismatch: have %x, want %x", have, c)
+		}
+	}
+	if collector.NumCodes() != 2 || collector.NumBytes() != 6 {
+		t.Fatalf("stats mismatch: have %v codes of %v bytes, want 2 codes of 6 bytes", collector.NumCodes(), collector.NumBytes())
+	}
+}
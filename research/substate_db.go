@@ -4,8 +4,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -14,19 +17,28 @@ import (
 const (
 	stage1SubstatePrefix = "1s" // stage1SubstatePrefix + block (64-bit) + tx (64-bit) -> substateRLP
 	stage1CodePrefix     = "1c" // stage1CodePrefix + codeHash (256-bit) -> code
-)
 
-func Stage1SubstateKey(block uint64, tx int) []byte {
-	prefix := []byte(stage1SubstatePrefix)
+	stage1AddressBloomPrefix = "1b" // stage1AddressBloomPrefix + block (64-bit) -> address bloom
+)
 
-	blockTx := make([]byte, 16)
+// EncodeSubstateKey returns the key of the substate of block and tx in a
+// substate DB. A key is 18 bytes, the 2-byte prefix "1s", block in a
+// big-endian uint64 and tx in a big-endian uint64, so keys in ascending order
+// are substates in ascending order of block and then tx. tx must not be
+// negative.
+func EncodeSubstateKey(block uint64, tx int) []byte {
+	key := make([]byte, len(stage1SubstatePrefix)+8+8)
+	copy(key, stage1SubstatePrefix)
+	blockTx := key[len(stage1SubstatePrefix):]
 	binary.BigEndian.PutUint64(blockTx[0:8], block)
 	binary.BigEndian.PutUint64(blockTx[8:16], uint64(tx))
-
-	return append(prefix, blockTx...)
+	return key
 }
 
-func DecodeStage1SubstateKey(key []byte) (block uint64, tx int, err error) {
+// DecodeSubstateKey returns block and tx of a key encoded by
+// EncodeSubstateKey. It returns an error if the length or the prefix of the
+// key is invalid, or if tx overflows int.
+func DecodeSubstateKey(key []byte) (block uint64, tx int, err error) {
 	prefix := stage1SubstatePrefix
 	if len(key) != len(prefix)+8+8 {
 		err = fmt.Errorf("invalid length of stage1 substate key: %v", len(key))
@@ -37,11 +49,26 @@ func DecodeStage1SubstateKey(key []byte) (block uint64, tx int, err error) {
 		return
 	}
 	blockTx := key[len(prefix):]
+	txIndex := binary.BigEndian.Uint64(blockTx[8:16])
+	if txIndex > math.MaxInt {
+		err = fmt.Errorf("invalid tx of stage1 substate key: %v", txIndex)
+		return
+	}
 	block = binary.BigEndian.Uint64(blockTx[0:8])
-	tx = int(binary.BigEndian.Uint64(blockTx[8:16]))
+	tx = int(txIndex)
 	return
 }
 
+// Stage1SubstateKey is EncodeSubstateKey.
+func Stage1SubstateKey(block uint64, tx int) []byte {
+	return EncodeSubstateKey(block, tx)
+}
+
+// DecodeStage1SubstateKey is DecodeSubstateKey.
+func DecodeStage1SubstateKey(key []byte) (block uint64, tx int, err error) {
+	return DecodeSubstateKey(key)
+}
+
 func Stage1SubstateBlockPrefix(block uint64) []byte {
 	prefix := []byte(stage1SubstatePrefix)
 
@@ -84,14 +111,53 @@ type SubstateDB struct {
 	backend BackendDatabase
 }
 
+// SubstateCodeReader reads bytecode by code hash to decode SubstateRLP.
+type SubstateCodeReader interface {
+	GetCode(codeHash common.Hash) []byte
+}
+
+// SubstateReader reads substates from a substate DB, a local SubstateDB or a
+// remote one like HTTPSubstateReader. Like SubstateDB, implementations panic
+// on errors of the underlying storage.
+type SubstateReader interface {
+	GetSubstate(block uint64, tx int) *Substate
+	HasSubstate(block uint64, tx int) bool
+	GetBlockSubstates(block uint64) BlockSubstates
+
+	// FirstBlock and LastBlock return false if there is no substate.
+	FirstBlock() (uint64, bool)
+	LastBlock() (uint64, bool)
+}
+
 func NewSubstateDB(backend BackendDatabase) *SubstateDB {
 	return &SubstateDB{backend: backend}
 }
 
+// NewMemorySubstateDB returns an empty substate DB in memory. Substates are
+// encoded and decoded the same as in a substate DB on disk.
+func NewMemorySubstateDB() *SubstateDB {
+	return NewSubstateDB(rawdb.NewMemoryDatabase())
+}
+
 func (db *SubstateDB) Compact(start []byte, limit []byte) error {
 	return db.backend.Compact(start, limit)
 }
 
+// CompactSubstates compacts the underlying key range of substates from block
+// first to block last.
+func (db *SubstateDB) CompactSubstates(first, last uint64) error {
+	start := Stage1SubstateBlockPrefix(first)
+	var limit []byte
+	if last == math.MaxUint64 {
+		// the first key after all substate keys
+		limit = []byte(stage1SubstatePrefix)
+		limit[len(limit)-1]++
+	} else {
+		limit = Stage1SubstateBlockPrefix(last + 1)
+	}
+	return db.Compact(start, limit)
+}
+
 func (db *SubstateDB) Close() error {
 	return db.backend.Close()
 }
@@ -127,65 +193,265 @@ func (db *SubstateDB) GetCode(codeHash common.Hash) []byte {
 }
 
 func (db *SubstateDB) PutCode(code []byte) {
+	putCode(db.backend, code)
+}
+
+func putCode(w ethdb.KeyValueWriter, code []byte) {
 	if len(code) == 0 {
 		return
 	}
 	codeHash := crypto.Keccak256Hash(code)
 	key := Stage1CodeKey(codeHash)
-	err := db.backend.Put(key, code)
+	err := w.Put(key, code)
 	if err != nil {
 		panic(fmt.Errorf("record-replay: error putting code %s: %v", codeHash.Hex(), err))
 	}
 }
 
+// HasSubstate returns true if the substate exists, without decoding it.
 func (db *SubstateDB) HasSubstate(block uint64, tx int) bool {
-	key := Stage1SubstateKey(block, tx)
-	has, _ := db.backend.Has(key)
+	key := EncodeSubstateKey(block, tx)
+	has, err := db.backend.Has(key)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: error checking substate %v_%v in substate DB: %v", block, tx, err))
+	}
 	return has
 }
 
-func (db *SubstateDB) GetSubstate(block uint64, tx int) *Substate {
-	var err error
+// Encodings of substate values in a substate DB
+const (
+	SubstateEncodingLatest = "latest" // from London hard fork
+	SubstateEncodingBerlin = "berlin" // between Berlin and London hard forks
+	SubstateEncodingLegacy = "legacy" // before Berlin hard fork
+)
 
-	key := Stage1SubstateKey(block, tx)
-	value, err := db.backend.Get(key)
-	if err != nil {
-		panic(fmt.Errorf("record-replay: error getting substate %v_%v from substate DB: %v,", block, tx, err))
-	}
+// decodeSubstateRLP decodes a substate value in any encoding of latest and
+// legacy hard forks and returns the decoded encoding.
+func decodeSubstateRLP(value []byte) (*SubstateRLP, string, error) {
+	var err error
 
 	// try decoding as substates from latest hard forks
 	substateRLP := SubstateRLP{}
 	err = rlp.DecodeBytes(value, &substateRLP)
+	if err == nil {
+		return &substateRLP, SubstateEncodingLatest, nil
+	}
+
+	// try decoding as legacy substates between Berlin and London hard forks
+	berlinRLP := berlinSubstateRLP{}
+	err = rlp.DecodeBytes(value, &berlinRLP)
+	if err == nil {
+		substateRLP.setBerlinRLP(&berlinRLP)
+		return &substateRLP, SubstateEncodingBerlin, nil
+	}
+
+	// try decoding as legacy substates before Berlin hard fork
+	legacyRLP := legacySubstateRLP{}
+	err = rlp.DecodeBytes(value, &legacyRLP)
+	if err != nil {
+		return nil, "", err
+	}
+	substateRLP.setLegacyRLP(&legacyRLP)
+	return &substateRLP, SubstateEncodingLegacy, nil
+}
 
+// decodeSubstate decodes a substate value in any encoding of latest and
+// legacy hard forks.
+func (db *SubstateDB) decodeSubstate(value []byte) (*Substate, error) {
+	substateRLP, _, err := decodeSubstateRLP(value)
 	if err != nil {
-		// try decoding as legacy substates between Berlin and London hard forks
-		berlinRLP := berlinSubstateRLP{}
-		err = rlp.DecodeBytes(value, &berlinRLP)
-		if err == nil {
-			substateRLP.setBerlinRLP(&berlinRLP)
+		return nil, err
+	}
+
+	substate := Substate{}
+	substate.SetRLP(substateRLP, db)
+
+	return &substate, nil
+}
+
+// Versions of substate encodings, ordered from the oldest encoding
+const (
+	SubstateEncodingVersionLegacy = 0
+	SubstateEncodingVersionBerlin = 1
+	SubstateEncodingVersionLatest = 2
+)
+
+// substateEncodingVersions are the encodings of each encoding version.
+var substateEncodingVersions = []string{
+	SubstateEncodingVersionLegacy: SubstateEncodingLegacy,
+	SubstateEncodingVersionBerlin: SubstateEncodingBerlin,
+	SubstateEncodingVersionLatest: SubstateEncodingLatest,
+}
+
+// SubstateEncodingOfVersion returns the encoding of an encoding version, or
+// an empty string if the version is unknown.
+func SubstateEncodingOfVersion(version int) string {
+	if version < 0 || version >= len(substateEncodingVersions) {
+		return ""
+	}
+	return substateEncodingVersions[version]
+}
+
+// substateEncodingVersion returns the encoding version of a substate value
+// from the number of fields of its message. Encodings are not marked in
+// substate values, but each encoding appended fields to the message, so only
+// the RLP list headers are read without decoding the payload.
+func substateEncodingVersion(value []byte) (int, error) {
+	content, _, err := rlp.SplitList(value)
+	if err != nil {
+		return 0, err
+	}
+	// skip InputAlloc, OutputAlloc and Env
+	for i := 0; i < 3; i++ {
+		_, _, content, err = rlp.Split(content)
+		if err != nil {
+			return 0, err
 		}
 	}
+	msg, _, err := rlp.SplitList(content)
+	if err != nil {
+		return 0, err
+	}
+	numFields, err := rlp.CountValues(msg)
+	if err != nil {
+		return 0, err
+	}
+	switch numFields {
+	case 9:
+		return SubstateEncodingVersionLegacy, nil
+	case 10:
+		return SubstateEncodingVersionBerlin, nil
+	case 12:
+		return SubstateEncodingVersionLatest, nil
+	}
+	return 0, fmt.Errorf("unknown substate encoding with %v message fields", numFields)
+}
 
+// GetSubstateEncodingVersion returns the encoding version of a stored
+// substate, one of SubstateEncodingVersionLatest,
+// SubstateEncodingVersionBerlin, and SubstateEncodingVersionLegacy, without
+// decoding the substate.
+func (db *SubstateDB) GetSubstateEncodingVersion(block uint64, tx int) (int, error) {
+	key := EncodeSubstateKey(block, tx)
+	value, err := db.backend.Get(key)
 	if err != nil {
-		// try decoding as legacy substates before Berlin hard fork
-		legacyRLP := legacySubstateRLP{}
-		err = rlp.DecodeBytes(value, &legacyRLP)
+		return 0, fmt.Errorf("record-replay: error getting substate %v_%v from substate DB: %v", block, tx, err)
+	}
+
+	version, err := substateEncodingVersion(value)
+	if err != nil {
+		return 0, fmt.Errorf("error decoding substateRLP %v_%v: %v", block, tx, err)
+	}
+	return version, nil
+}
+
+// SubstateEncodingVersionUnknown is the version counted by
+// CountEncodingVersions for substate values of no known encoding.
+const SubstateEncodingVersionUnknown = -1
+
+// CountEncodingVersions returns the number of substates of each encoding
+// version from block first to block last. Substate values of no known
+// encoding are counted as SubstateEncodingVersionUnknown.
+func (db *SubstateDB) CountEncodingVersions(first, last uint64) (map[int]uint64, error) {
+	counts := make(map[int]uint64)
+	it := newSubstateKeyIterator(db, first, last)
+	for ; it.valid; it.next() {
+		version, err := substateEncodingVersion(it.iter.Value())
 		if err != nil {
-			panic(fmt.Errorf("error decoding substateRLP %v_%v: %v", block, tx, err))
+			version = SubstateEncodingVersionUnknown
 		}
-		substateRLP.setLegacyRLP(&legacyRLP)
+		counts[version]++
+	}
+	if err := it.release(); err != nil {
+		return nil, err
 	}
+	return counts, nil
+}
 
-	substate := Substate{}
-	substate.SetRLP(&substateRLP, db)
+// GetSubstateEncoding returns the encoding of a stored substate, one of
+// SubstateEncodingLatest, SubstateEncodingBerlin, and SubstateEncodingLegacy.
+func (db *SubstateDB) GetSubstateEncoding(block uint64, tx int) (string, error) {
+	key := EncodeSubstateKey(block, tx)
+	value, err := db.backend.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("record-replay: error getting substate %v_%v from substate DB: %v", block, tx, err)
+	}
 
-	return &substate
+	_, encoding, err := decodeSubstateRLP(value)
+	if err != nil {
+		return "", fmt.Errorf("error decoding substateRLP %v_%v: %v", block, tx, err)
+	}
+	return encoding, nil
 }
 
-func (db *SubstateDB) GetBlockSubstates(block uint64) map[int]*Substate {
+func (db *SubstateDB) GetSubstate(block uint64, tx int) *Substate {
 	var err error
 
-	txSubstate := make(map[int]*Substate)
+	key := EncodeSubstateKey(block, tx)
+	value, err := db.backend.Get(key)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: error getting substate %v_%v from substate DB: %v,", block, tx, err))
+	}
+
+	substate, err := db.decodeSubstate(value)
+	if err != nil {
+		panic(fmt.Errorf("error decoding substateRLP %v_%v: %v", block, tx, err))
+	}
+
+	return substate
+}
+
+// BlockSubstates maps tx indices of a block to their substates. Use Txs to
+// visit substates in ascending tx index order.
+type BlockSubstates map[int]*Substate
+
+// Txs returns tx indices of the substates in ascending order.
+func (substates BlockSubstates) Txs() []int {
+	txs := make([]int, 0, len(substates))
+	for tx := range substates {
+		txs = append(txs, tx)
+	}
+	sort.Ints(txs)
+	return txs
+}
+
+// SubstateDecodeError is an error decoding a stored substate.
+type SubstateDecodeError struct {
+	Key SubstateKey
+	Err error
+}
+
+func (e *SubstateDecodeError) Error() string {
+	return fmt.Sprintf("error decoding substateRLP %v_%v: %v", e.Key.Block, e.Key.Tx, e.Err)
+}
+
+func (e *SubstateDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// TolerantSubstateReader is a SubstateReader that can skip substates failing
+// to decode instead of panicking.
+type TolerantSubstateReader interface {
+	SubstateReader
+
+	// GetBlockSubstatesTolerant is GetBlockSubstates returning substates of
+	// a block that decode, and errors of the others in tx order.
+	GetBlockSubstatesTolerant(block uint64) (BlockSubstates, []*SubstateDecodeError)
+}
+
+func (db *SubstateDB) GetBlockSubstates(block uint64) BlockSubstates {
+	txSubstate, decodeErrs := db.GetBlockSubstatesTolerant(block)
+	if len(decodeErrs) > 0 {
+		panic(decodeErrs[0])
+	}
+	return txSubstate
+}
+
+func (db *SubstateDB) GetBlockSubstatesTolerant(block uint64) (BlockSubstates, []*SubstateDecodeError) {
+	var err error
+	var decodeErrs []*SubstateDecodeError
+
+	txSubstate := make(BlockSubstates)
 
 	prefix := Stage1SubstateBlockPrefix(block)
 
@@ -194,7 +460,7 @@ func (db *SubstateDB) GetBlockSubstates(block uint64) map[int]*Substate {
 		key := iter.Key()
 		value := iter.Value()
 
-		b, tx, err := DecodeStage1SubstateKey(key)
+		b, tx, err := DecodeSubstateKey(key)
 		if err != nil {
 			panic(fmt.Errorf("record-replay: invalid substate key found for block %v: %v", block, err))
 		}
@@ -203,80 +469,456 @@ func (db *SubstateDB) GetBlockSubstates(block uint64) map[int]*Substate {
 			panic(fmt.Errorf("record-replay: GetBlockSubstates(%v) iterated substates from block %v", block, b))
 		}
 
-		// try decoding as substates from latest hard forks
-		substateRLP := SubstateRLP{}
-		err = rlp.DecodeBytes(value, &substateRLP)
+		substate, err := db.decodeSubstate(value)
+		if err != nil {
+			decodeErrs = append(decodeErrs, &SubstateDecodeError{Key: SubstateKey{Block: block, Tx: tx}, Err: err})
+			continue
+		}
+
+		txSubstate[tx] = substate
+	}
+	iter.Release()
+	err = iter.Error()
+	if err != nil {
+		panic(err)
+	}
+
+	return txSubstate, decodeErrs
+}
+
+// SubstateSizeReader is a SubstateReader which returns the stored size of
+// the substates of a block without decoding them.
+type SubstateSizeReader interface {
+	SubstateReader
+
+	// GetBlockSubstatesSize returns the sum of the sizes of the stored
+	// values of substates of a block in bytes.
+	GetBlockSubstatesSize(block uint64) uint64
+}
+
+// GetBlockSubstatesSize returns the sum of the sizes of the stored values of
+// substates of the block without decoding them. Code stored by code hash is
+// not included.
+func (db *SubstateDB) GetBlockSubstatesSize(block uint64) uint64 {
+	prefix := Stage1SubstateBlockPrefix(block)
+
+	var size uint64
+	iter := db.backend.NewIterator(prefix, nil)
+	for iter.Next() {
+		size += uint64(len(iter.Value()))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		panic(err)
+	}
+
+	return size
+}
+
+// GetSubstateCountForBlock returns the number of substates of the block
+// without decoding them. Transaction indices need not be contiguous.
+func (db *SubstateDB) GetSubstateCountForBlock(block uint64) int {
+	prefix := Stage1SubstateBlockPrefix(block)
+
+	count := 0
+	iter := db.backend.NewIterator(prefix, nil)
+	for iter.Next() {
+		if _, _, err := DecodeSubstateKey(iter.Key()); err != nil {
+			panic(fmt.Errorf("record-replay: invalid substate key found for block %v: %v", block, err))
+		}
+		count++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		panic(err)
+	}
+
+	return count
+}
 
+// SubstateKey identifies a transaction substate in a substate DB.
+type SubstateKey struct {
+	Block uint64
+	Tx    int
+}
+
+// Encode returns the key of the substate in a substate DB, see
+// EncodeSubstateKey.
+func (key SubstateKey) Encode() []byte {
+	return EncodeSubstateKey(key.Block, key.Tx)
+}
+
+// IterateSubstates calls fn for every substate from block first to block last
+// in ascending order of block and transaction index, walking the key space of
+// the substate DB once. The iteration stops early if fn returns false.
+func (db *SubstateDB) IterateSubstates(first, last uint64, fn func(key SubstateKey, substate *Substate) bool) error {
+	prefix := []byte(stage1SubstatePrefix)
+	start := Stage1SubstateBlockPrefix(first)[len(prefix):]
+
+	iter := db.backend.NewIterator(prefix, start)
+	defer iter.Release()
+	for iter.Next() {
+		block, tx, err := DecodeSubstateKey(iter.Key())
 		if err != nil {
-			// try decoding as legacy substates between Berlin and London hard forks
-			berlinRLP := berlinSubstateRLP{}
-			err = rlp.DecodeBytes(value, &berlinRLP)
-			if err == nil {
-				substateRLP.setBerlinRLP(&berlinRLP)
-			}
+			return fmt.Errorf("record-replay: invalid substate key found: %v", err)
+		}
+		if block > last {
+			break
 		}
 
+		substate, err := db.decodeSubstate(iter.Value())
 		if err != nil {
-			// try decoding as legacy substates before Berlin hard fork
-			legacyRLP := legacySubstateRLP{}
-			err = rlp.DecodeBytes(value, &legacyRLP)
-			if err != nil {
-				panic(fmt.Errorf("error decoding substateRLP %v_%v: %v", block, tx, err))
-			}
-			substateRLP.setLegacyRLP(&legacyRLP)
+			return fmt.Errorf("error decoding substateRLP %v_%v: %v", block, tx, err)
+		}
+
+		if !fn(SubstateKey{Block: block, Tx: tx}, substate) {
+			break
 		}
+	}
+	return iter.Error()
+}
 
-		substate := Substate{}
-		substate.SetRLP(&substateRLP, db)
+// hasSubstateFrom returns true if there is any substate at block or later.
+func (db *SubstateDB) hasSubstateFrom(block uint64) bool {
+	prefix := []byte(stage1SubstatePrefix)
+	start := Stage1SubstateBlockPrefix(block)[len(prefix):]
+
+	iter := db.backend.NewIterator(prefix, start)
+	defer iter.Release()
+
+	return iter.Next()
+}
 
-		txSubstate[tx] = &substate
+// FirstBlock returns the lowest block number with a substate. It returns
+// false if the substate DB has no substate.
+func (db *SubstateDB) FirstBlock() (uint64, bool) {
+	iter := db.backend.NewIterator([]byte(stage1SubstatePrefix), nil)
+	defer iter.Release()
+
+	if !iter.Next() {
+		return 0, false
 	}
-	iter.Release()
-	err = iter.Error()
+	block, _, err := DecodeSubstateKey(iter.Key())
 	if err != nil {
-		panic(err)
+		panic(fmt.Errorf("record-replay: invalid substate key found: %v", err))
 	}
+	return block, true
+}
 
-	return txSubstate
+// LastBlock returns the highest block number with a substate. It returns
+// false if the substate DB has no substate.
+func (db *SubstateDB) LastBlock() (uint64, bool) {
+	if !db.hasSubstateFrom(0) {
+		return 0, false
+	}
+
+	// binary search on the last block, one iterator seek per step
+	lo, hi := uint64(0), uint64(math.MaxUint64)
+	for lo < hi {
+		mid := lo + (hi-lo)/2 + 1
+		if db.hasSubstateFrom(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	return lo, true
 }
 
 func (db *SubstateDB) PutSubstate(block uint64, tx int, substate *Substate) {
-	var err error
+	putSubstate(db.backend, block, tx, substate)
+}
 
-	// put deployed/creation code
+func putSubstate(w ethdb.KeyValueWriter, block uint64, tx int, substate *Substate) {
+	putSubstateCode(w, substate)
+	putSubstateRLP(w, block, tx, substate)
+}
+
+// putSubstateCode puts deployed/creation code of a substate.
+func putSubstateCode(w ethdb.KeyValueWriter, substate *Substate) {
 	for _, account := range substate.InputAlloc {
-		db.PutCode(account.Code)
+		putCode(w, account.Code)
 	}
 	for _, account := range substate.OutputAlloc {
-		db.PutCode(account.Code)
+		putCode(w, account.Code)
 	}
 	if msg := substate.Message; msg.To == nil {
-		db.PutCode(msg.Data)
+		putCode(w, msg.Data)
 	}
+}
+
+// encodeSubstateRLP encodes a substate in the latest encoding.
+func encodeSubstateRLP(substate *Substate) ([]byte, error) {
+	substateRLP := NewSubstateRLP(substate)
+	return rlp.EncodeToBytes(substateRLP)
+}
 
-	key := Stage1SubstateKey(block, tx)
+// putSubstateRLP puts a substate without its bytecode, and deletes the
+// address bloom of its block, which may not include its addresses.
+func putSubstateRLP(w ethdb.KeyValueWriter, block uint64, tx int, substate *Substate) {
+	var err error
+
+	key := EncodeSubstateKey(block, tx)
 	defer func() {
 		if err != nil {
 			panic(fmt.Errorf("record-replay: error putting substate %v_%v into substate DB: %v", block, tx, err))
 		}
 	}()
 
-	substateRLP := NewSubstateRLP(substate)
-	value, err := rlp.EncodeToBytes(substateRLP)
+	value, err := encodeSubstateRLP(substate)
 	if err != nil {
 		panic(err)
 	}
 
-	err = db.backend.Put(key, value)
+	err = w.Put(key, value)
 	if err != nil {
 		panic(err)
 	}
+	err = w.Delete(AddressBloomKey(block))
 }
 
-func (db *SubstateDB) DeleteSubstate(block uint64, tx int) {
-	key := Stage1SubstateKey(block, tx)
-	err := db.backend.Delete(key)
+// PutSubstateStripCode puts a substate like PutSubstate, but skips writing
+// bytecode unchanged between InputAlloc and OutputAlloc or already stored in
+// the substate DB. Code hashes of the substate are kept, so the substate is
+// decoded with the same bytecode. It returns the number of duplicate code
+// references skipped. Bytecode is stored by code hash, so skipping them saves
+// writes, not space of the substate DB.
+func (db *SubstateDB) PutSubstateStripCode(block uint64, tx int, substate *Substate) int {
+	return db.putSubstateStripCode(db.backend, block, tx, substate)
+}
+
+func (db *SubstateDB) putSubstateStripCode(w ethdb.KeyValueWriter, block uint64, tx int, substate *Substate) int {
+	duplicates := 0
+	putStrippedCode := func(code []byte) {
+		if len(code) == 0 {
+			return
+		}
+		if db.HasCode(crypto.Keccak256Hash(code)) {
+			duplicates++
+			return
+		}
+		putCode(w, code)
+	}
+
+	unchanged := substate.InputAlloc.UnchangedCode(substate.OutputAlloc)
+	for _, account := range substate.InputAlloc {
+		putStrippedCode(account.Code)
+	}
+	for addr, account := range substate.OutputAlloc {
+		if _, exist := unchanged[addr]; exist {
+			duplicates++
+			continue
+		}
+		putStrippedCode(account.Code)
+	}
+	if msg := substate.Message; msg.To == nil {
+		putStrippedCode(msg.Data)
+	}
+
+	putSubstateRLP(w, block, tx, substate)
+
+	return duplicates
+}
+
+// SubstateBatchEntry is a substate to be put by PutSubstateBatch.
+type SubstateBatchEntry struct {
+	Block    uint64
+	Tx       int
+	Substate *Substate
+}
+
+// PutSubstateBatch puts substates and their bytecode in a single batch of the
+// substate DB. All substates are encoded in the latest encoding before the
+// batch is written, so nothing is written if an entry fails encoding.
+func (db *SubstateDB) PutSubstateBatch(entries []SubstateBatchEntry) error {
+	values := make([][]byte, len(entries))
+	for i, entry := range entries {
+		if entry.Substate == nil {
+			return fmt.Errorf("record-replay: error encoding substate %v_%v: nil substate", entry.Block, entry.Tx)
+		}
+		value, err := encodeSubstateRLP(entry.Substate)
+		if err != nil {
+			return fmt.Errorf("record-replay: error encoding substate %v_%v: %v", entry.Block, entry.Tx, err)
+		}
+		values[i] = value
+	}
+
+	batch := db.backend.NewBatch()
+	for i, entry := range entries {
+		putSubstateCode(batch, entry.Substate)
+		if err := batch.Put(EncodeSubstateKey(entry.Block, entry.Tx), values[i]); err != nil {
+			return fmt.Errorf("record-replay: error putting substate %v_%v into substate DB: %v", entry.Block, entry.Tx, err)
+		}
+		if err := batch.Delete(AddressBloomKey(entry.Block)); err != nil {
+			return fmt.Errorf("record-replay: error putting substate %v_%v into substate DB: %v", entry.Block, entry.Tx, err)
+		}
+	}
+	return batch.Write()
+}
+
+// DeleteSubstate deletes the substate, and the address bloom of its block.
+func (db *SubstateDB) DeleteSubstate(block uint64, tx int) error {
+	if err := db.backend.Delete(AddressBloomKey(block)); err != nil {
+		return err
+	}
+	key := EncodeSubstateKey(block, tx)
+	return db.backend.Delete(key)
+}
+
+// DeleteBlock deletes all substates of the block and its address bloom, and
+// returns the number of deleted substates.
+func (db *SubstateDB) DeleteBlock(block uint64) (int, error) {
+	prefix := Stage1SubstateBlockPrefix(block)
+
+	numTx := 0
+	batch := db.backend.NewBatch()
+	if err := batch.Delete(AddressBloomKey(block)); err != nil {
+		return 0, err
+	}
+	iter := db.backend.NewIterator(prefix, nil)
+	for iter.Next() {
+		if err := batch.Delete(iter.Key()); err != nil {
+			iter.Release()
+			return 0, err
+		}
+		numTx++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	if err := batch.Write(); err != nil {
+		return 0, err
+	}
+	return numTx, nil
+}
+
+// Count returns the numbers of blocks and transactions with substates from
+// block first to block last, without decoding substates.
+func (db *SubstateDB) Count(first, last uint64) (numBlocks uint64, numTxs uint64, err error) {
+	prefix := []byte(stage1SubstatePrefix)
+	start := Stage1SubstateBlockPrefix(first)[len(prefix):]
+
+	iter := db.backend.NewIterator(prefix, start)
+	defer iter.Release()
+
+	var prevBlock uint64
+	for iter.Next() {
+		block, _, err := DecodeSubstateKey(iter.Key())
+		if err != nil {
+			return 0, 0, fmt.Errorf("record-replay: invalid substate key found: %v", err)
+		}
+		if block > last {
+			break
+		}
+		if numTxs == 0 || block != prevBlock {
+			numBlocks++
+			prevBlock = block
+		}
+		numTxs++
+	}
+	return numBlocks, numTxs, iter.Error()
+}
+
+// SubstateDBInfo summarizes substates stored in a substate DB.
+type SubstateDBInfo struct {
+	FirstBlock uint64 `json:"firstBlock"`
+	LastBlock  uint64 `json:"lastBlock"`
+	NumBlocks  uint64 `json:"numBlocks"`
+	NumTxs     uint64 `json:"numTxs"`
+	Encoding   string `json:"encoding,omitempty"`
+	// EncodingVersion is the version of Encoding, or
+	// SubstateEncodingVersionUnknown without substates.
+	EncodingVersion int `json:"encodingVersion"`
+}
+
+// Info returns a summary of substates from block first to block last. First
+// and last block are of the whole substate DB, while the numbers of blocks
+// and transactions and the encoding of the first substate are scoped to the
+// given range.
+func (db *SubstateDB) Info(first, last uint64) (*SubstateDBInfo, error) {
+	info := &SubstateDBInfo{EncodingVersion: SubstateEncodingVersionUnknown}
+	info.FirstBlock, _ = db.FirstBlock()
+	info.LastBlock, _ = db.LastBlock()
+
+	var err error
+	info.NumBlocks, info.NumTxs, err = db.Count(first, last)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	var firstKey *SubstateKey
+	prefix := []byte(stage1SubstatePrefix)
+	start := Stage1SubstateBlockPrefix(first)[len(prefix):]
+	iter := db.backend.NewIterator(prefix, start)
+	if iter.Next() {
+		block, tx, err := DecodeSubstateKey(iter.Key())
+		if err != nil {
+			iter.Release()
+			return nil, fmt.Errorf("record-replay: invalid substate key found: %v", err)
+		}
+		if block <= last {
+			firstKey = &SubstateKey{Block: block, Tx: tx}
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	if firstKey != nil {
+		info.Encoding, err = db.GetSubstateEncoding(firstKey.Block, firstKey.Tx)
+		if err != nil {
+			return nil, err
+		}
+		info.EncodingVersion, err = db.GetSubstateEncodingVersion(firstKey.Block, firstKey.Tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+// IterateBlocks returns the blocks with at least one substate from block
+// first to block last in ascending order. It seeks over distinct block
+// prefixes, so substates of a block are not iterated one by one.
+func (db *SubstateDB) IterateBlocks(first, last uint64) ([]uint64, error) {
+	var blocks []uint64
+	for block := first; block <= last; block++ {
+		b, ok, err := db.nextBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || b > last {
+			break
+		}
+		blocks = append(blocks, b)
+		if b == math.MaxUint64 {
+			break
+		}
+		block = b
+	}
+	return blocks, nil
+}
+
+// nextBlock returns the first block with substates from block, or false if
+// there is none.
+func (db *SubstateDB) nextBlock(block uint64) (uint64, bool, error) {
+	prefix := []byte(stage1SubstatePrefix)
+	start := Stage1SubstateBlockPrefix(block)[len(prefix):]
+
+	iter := db.backend.NewIterator(prefix, start)
+	defer iter.Release()
+
+	if !iter.Next() {
+		return 0, false, iter.Error()
+	}
+	b, _, err := DecodeSubstateKey(iter.Key())
+	if err != nil {
+		return 0, false, fmt.Errorf("record-replay: invalid substate key found: %v", err)
 	}
+	return b, true, nil
 }
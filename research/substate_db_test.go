@@ -0,0 +1,554 @@
+package research
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestSubstateKey(t *testing.T) {
+	keys := []SubstateKey{
+		{0, 0},
+		{1, 1},
+		{15_000_000, 255},
+		{15_000_000, 256},
+		{1 << 32, 1 << 32},
+		{math.MaxUint64, 0},
+		{math.MaxUint64, math.MaxInt},
+	}
+	for _, key := range keys {
+		encoded := EncodeSubstateKey(key.Block, key.Tx)
+		if len(encoded) != 18 || string(encoded[:2]) != "1s" {
+			t.Fatalf("%v: invalid key %x", key, encoded)
+		}
+		if !bytes.Equal(key.Encode(), encoded) {
+			t.Fatalf("%v: Encode mismatch: have %x, want %x", key, key.Encode(), encoded)
+		}
+		block, tx, err := DecodeSubstateKey(encoded)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", key, err)
+		}
+		if (SubstateKey{block, tx}) != key {
+			t.Fatalf("round trip mismatch: have %v_%v, want %v", block, tx, key)
+		}
+	}
+
+	// keys are ordered by block and then tx
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1].Encode(), keys[i].Encode()) >= 0 {
+			t.Fatalf("key %v is not before key %v", keys[i-1], keys[i])
+		}
+	}
+	if want := []byte("1s\x00\x00\x00\x00\x00\x00\x01\x02\x00\x00\x00\x00\x00\x00\x00\x03"); !bytes.Equal(EncodeSubstateKey(0x102, 3), want) {
+		t.Fatalf("key layout mismatch: have %x, want %x", EncodeSubstateKey(0x102, 3), want)
+	}
+
+	bad := [][]byte{
+		nil,
+		[]byte("1s"),
+		EncodeSubstateKey(1, 0)[:17],
+		append(EncodeSubstateKey(1, 0), 0),
+		append([]byte("1c"), EncodeSubstateKey(1, 0)[2:]...),
+		// a tx index overflowing int
+		append(EncodeSubstateKey(1, 0)[:10], 0x80, 0, 0, 0, 0, 0, 0, 0),
+	}
+	for _, key := range bad {
+		if _, _, err := DecodeSubstateKey(key); err == nil {
+			t.Fatalf("no error for invalid key %x", key)
+		}
+	}
+}
+
+func TestHasSubstate(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		10: {0, 1},
+	})
+	defer db.Close()
+
+	if !db.HasSubstate(10, 0) || !db.HasSubstate(10, 1) {
+		t.Fatalf("HasSubstate is false for stored substates")
+	}
+	if db.HasSubstate(10, 2) {
+		t.Fatalf("HasSubstate is true for a neighboring tx index")
+	}
+	if db.HasSubstate(11, 0) || db.HasSubstate(9, 0) {
+		t.Fatalf("HasSubstate is true for a missing block")
+	}
+}
+
+func TestDeleteSubstate(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		10: {0, 1, 2},
+		11: {0, 1},
+		12: {0},
+	})
+	defer db.Close()
+
+	if err := db.DeleteSubstate(10, 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if db.HasSubstate(10, 1) {
+		t.Fatalf("HasSubstate is true for a deleted substate")
+	}
+	substates := db.GetBlockSubstates(10)
+	if len(substates) != 2 || substates[0] == nil || substates[2] == nil {
+		t.Fatalf("remaining substates mismatch: %v", substates)
+	}
+
+	n, err := db.DeleteBlock(11)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("number of deleted substates mismatch: have %v, want 2", n)
+	}
+	if db.HasSubstate(11, 0) || db.HasSubstate(11, 1) || len(db.GetBlockSubstates(11)) != 0 {
+		t.Fatalf("substates of a deleted block still exist")
+	}
+	if !db.HasSubstate(12, 0) || len(db.GetBlockSubstates(10)) != 2 {
+		t.Fatalf("substates of other blocks are deleted")
+	}
+
+	if n, err := db.DeleteBlock(13); err != nil || n != 0 {
+		t.Fatalf("unexpected result for missing block: %v, %v", n, err)
+	}
+}
+
+func TestIterateSubstates(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1:  {0, 1},
+		3:  {0, 1, 2},
+		4:  {0},
+		10: {0},
+	})
+	defer db.Close()
+
+	var keys []SubstateKey
+	err := db.IterateSubstates(2, 4, func(key SubstateKey, substate *Substate) bool {
+		if substate.Env.Number != key.Block {
+			t.Fatalf("substate %v_%v has env number %v", key.Block, key.Tx, substate.Env.Number)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []SubstateKey{{3, 0}, {3, 1}, {3, 2}, {4, 0}}
+	if len(keys) != len(want) {
+		t.Fatalf("iterated keys mismatch: have %v, want %v", keys, want)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("iterated keys mismatch: have %v, want %v", keys, want)
+		}
+	}
+
+	// stop early
+	n := 0
+	db.IterateSubstates(0, 100, func(key SubstateKey, substate *Substate) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Fatalf("iteration did not stop early: %v substates", n)
+	}
+}
+
+// newBenchmarkSubstateDB returns an in-memory DB with 10k substates. Scanning
+// all substates per block versus with a single iterator:
+//
+//	BenchmarkGetBlockSubstates 	       2	 672493064 ns/op
+//	BenchmarkIterateSubstates  	      18	  67545569 ns/op
+func newBenchmarkSubstateDB() *SubstateDB {
+	blockTxs := make(map[uint64][]int)
+	for block := uint64(1); block <= 2_000; block++ {
+		blockTxs[block] = []int{0, 1, 2, 3, 4}
+	}
+	return newTestSubstateDB(blockTxs)
+}
+
+func BenchmarkGetBlockSubstates(b *testing.B) {
+	db := newBenchmarkSubstateDB()
+	defer db.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for block := uint64(1); block <= 2_000; block++ {
+			db.GetBlockSubstates(block)
+		}
+	}
+}
+
+func BenchmarkIterateSubstates(b *testing.B) {
+	db := newBenchmarkSubstateDB()
+	defer db.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.IterateSubstates(1, 2_000, func(key SubstateKey, substate *Substate) bool {
+			return true
+		})
+	}
+}
+
+func TestCountFirstLastBlock(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		5:     {0, 1, 2},
+		6:     {0},
+		100:   {0, 1},
+		4_000: {0, 3},
+	})
+	defer db.Close()
+
+	tests := []struct {
+		first, last       uint64
+		numBlocks, numTxs uint64
+	}{
+		{0, OpenBlockSegmentLast, 4, 8},
+		{5, 5, 1, 3},
+		{6, 100, 2, 3},
+		{7, 99, 0, 0},
+		{101, 4_000, 1, 2},
+	}
+	for _, tt := range tests {
+		numBlocks, numTxs, err := db.Count(tt.first, tt.last)
+		if err != nil {
+			t.Fatalf("%v-%v: unexpected error: %v", tt.first, tt.last, err)
+		}
+		if numBlocks != tt.numBlocks || numTxs != tt.numTxs {
+			t.Fatalf("%v-%v: count mismatch: have %v blocks %v txs, want %v blocks %v txs", tt.first, tt.last, numBlocks, numTxs, tt.numBlocks, tt.numTxs)
+		}
+	}
+
+	if first, ok := db.FirstBlock(); !ok || first != 5 {
+		t.Fatalf("FirstBlock mismatch: have %v (%v), want 5", first, ok)
+	}
+	if last, ok := db.LastBlock(); !ok || last != 4_000 {
+		t.Fatalf("LastBlock mismatch: have %v (%v), want 4000", last, ok)
+	}
+
+	empty := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer empty.Close()
+	if _, ok := empty.FirstBlock(); ok {
+		t.Fatalf("FirstBlock is found in empty DB")
+	}
+	if _, ok := empty.LastBlock(); ok {
+		t.Fatalf("LastBlock is found in empty DB")
+	}
+}
+
+func TestInfo(t *testing.T) {
+	path := t.TempDir()
+	backend, err := rawdb.NewLevelDBDatabase(path, 16, 16, "substatedir", false)
+	if err != nil {
+		t.Fatalf("error creating %s: %v", path, err)
+	}
+	db := NewSubstateDB(backend)
+	for _, key := range []SubstateKey{{10, 0}, {10, 1}, {12, 0}, {20, 0}} {
+		db.PutSubstate(key.Block, key.Tx, newTestSubstate(key.Block, common.Address{0x01}, common.Address{0x02}))
+	}
+	db.Close()
+
+	// reopen the seeded substate DB read-only like db-info does
+	backend, err = rawdb.NewLevelDBDatabase(path, 16, 16, "substatedir", true)
+	if err != nil {
+		t.Fatalf("error opening %s: %v", path, err)
+	}
+	db = NewSubstateDB(backend)
+	defer db.Close()
+
+	tests := []struct {
+		first, last uint64
+		want        SubstateDBInfo
+	}{
+		{0, OpenBlockSegmentLast, SubstateDBInfo{10, 20, 3, 4, SubstateEncodingLatest, SubstateEncodingVersionLatest}},
+		{11, 12, SubstateDBInfo{10, 20, 1, 1, SubstateEncodingLatest, SubstateEncodingVersionLatest}},
+		{13, 19, SubstateDBInfo{10, 20, 0, 0, "", SubstateEncodingVersionUnknown}},
+	}
+	for _, tt := range tests {
+		info, err := db.Info(tt.first, tt.last)
+		if err != nil {
+			t.Fatalf("%v-%v: unexpected error: %v", tt.first, tt.last, err)
+		}
+		if *info != tt.want {
+			t.Fatalf("%v-%v: info mismatch: have %+v, want %+v", tt.first, tt.last, *info, tt.want)
+		}
+	}
+}
+
+func TestCompactSubstates(t *testing.T) {
+	path := t.TempDir()
+	backend, err := rawdb.NewLevelDBDatabase(path, 16, 16, "substatedir", false)
+	if err != nil {
+		t.Fatalf("error creating %s: %v", path, err)
+	}
+	db := NewSubstateDB(backend)
+	defer db.Close()
+
+	for block := uint64(1); block <= 20; block++ {
+		db.PutSubstate(block, 0, newTestSubstate(block, common.Address{0x01}, common.Address{0x02}))
+	}
+	for block := uint64(1); block <= 10; block++ {
+		if _, err := db.DeleteBlock(block); err != nil {
+			t.Fatalf("error deleting block %v: %v", block, err)
+		}
+	}
+
+	if err := db.CompactSubstates(1, 10); err != nil {
+		t.Fatalf("error compacting block segment: %v", err)
+	}
+	if err := db.CompactSubstates(0, OpenBlockSegmentLast); err != nil {
+		t.Fatalf("error compacting all substates: %v", err)
+	}
+	if err := db.Compact(nil, nil); err != nil {
+		t.Fatalf("error compacting full key space: %v", err)
+	}
+
+	numBlocks, numTxs, err := db.Count(0, OpenBlockSegmentLast)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if numBlocks != 10 || numTxs != 10 {
+		t.Fatalf("count mismatch after compaction: have %v blocks %v txs, want 10 blocks 10 txs", numBlocks, numTxs)
+	}
+	if db.GetSubstate(15, 0) == nil {
+		t.Fatalf("substate 15_0 is missing after compaction")
+	}
+}
+
+func TestPutSubstateStripCode(t *testing.T) {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+
+	contract := common.Address{0xcc}
+	code := []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+	newCode := []byte{0x60, 0x01, 0x60, 0x00, 0xf3}
+
+	// contract code unchanged between InputAlloc and OutputAlloc
+	substate := newTestSubstate(1, common.Address{0x01}, contract)
+	substate.InputAlloc[contract] = NewSubstateAccount(0, big.NewInt(0), code)
+	substate.OutputAlloc[contract] = NewSubstateAccount(0, big.NewInt(1_000), code)
+	if duplicates := db.PutSubstateStripCode(1, 0, substate); duplicates != 1 {
+		t.Fatalf("duplicate code references mismatch: have %v, want 1", duplicates)
+	}
+
+	// contract code already stored in the substate DB
+	if duplicates := db.PutSubstateStripCode(2, 0, substate); duplicates != 2 {
+		t.Fatalf("duplicate code references mismatch: have %v, want 2", duplicates)
+	}
+
+	// changed contract code is written
+	changed := newTestSubstate(3, common.Address{0x01}, contract)
+	changed.InputAlloc[contract] = NewSubstateAccount(0, big.NewInt(0), code)
+	changed.OutputAlloc[contract] = NewSubstateAccount(0, big.NewInt(1_000), newCode)
+	if duplicates := db.PutSubstateStripCode(3, 0, changed); duplicates != 1 {
+		t.Fatalf("duplicate code references mismatch: have %v, want 1", duplicates)
+	}
+
+	for _, tt := range []struct {
+		block uint64
+		want  *Substate
+	}{{1, substate}, {2, substate}, {3, changed}} {
+		have := db.GetSubstate(tt.block, 0)
+		if !have.Equal(tt.want) {
+			t.Fatalf("block %v: substate mismatch after stripping code", tt.block)
+		}
+		for addr, account := range tt.want.OutputAlloc {
+			if have.OutputAlloc[addr].CodeHash() != account.CodeHash() {
+				t.Fatalf("block %v: code hash mismatch of %v", tt.block, addr.Hex())
+			}
+		}
+	}
+}
+
+func TestPutSubstateBatch(t *testing.T) {
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+
+	entries := make([]SubstateBatchEntry, 0, 1_000)
+	for i := 0; i < 1_000; i++ {
+		block, tx := uint64(1+i/10), i%10
+		substate := newTestSubstate(block, common.Address{0x01, byte(tx)}, common.Address{0x02, byte(tx)})
+		substate.OutputAlloc[common.Address{0x03}] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, byte(i)})
+		entries = append(entries, SubstateBatchEntry{Block: block, Tx: tx, Substate: substate})
+	}
+	if err := db.PutSubstateBatch(entries); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, entry := range entries {
+		have := db.GetSubstate(entry.Block, entry.Tx)
+		if have == nil || !have.Equal(entry.Substate) {
+			t.Fatalf("substate %v_%v mismatch", entry.Block, entry.Tx)
+		}
+		if encoding, err := db.GetSubstateEncoding(entry.Block, entry.Tx); err != nil || encoding != SubstateEncodingLatest {
+			t.Fatalf("substate %v_%v encoding mismatch: have %v (%v), want %v", entry.Block, entry.Tx, encoding, err, SubstateEncodingLatest)
+		}
+	}
+
+	// a negative balance cannot be encoded, and nothing is written
+	good := newTestSubstate(2_000, common.Address{0x01}, common.Address{0x02})
+	bad := newTestSubstate(2_001, common.Address{0x01}, common.Address{0x02})
+	bad.InputAlloc[common.Address{0x01}].Balance = big.NewInt(-1)
+	err := db.PutSubstateBatch([]SubstateBatchEntry{
+		{Block: 2_000, Tx: 0, Substate: good},
+		{Block: 2_001, Tx: 0, Substate: bad},
+	})
+	if err == nil || !strings.Contains(err.Error(), "2001_0") {
+		t.Fatalf("unexpected error: have %v, want encoding error of 2001_0", err)
+	}
+	if db.HasSubstate(2_000, 0) || db.HasSubstate(2_001, 0) {
+		t.Fatalf("substates are written despite the encoding error")
+	}
+}
+
+func TestGetSubstateCountForBlock(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		9:  {0},
+		10: {0, 1, 5},
+		11: {0, 1},
+	})
+	defer db.Close()
+
+	tests := []struct {
+		block uint64
+		want  int
+	}{
+		{9, 1},
+		{10, 3},
+		{11, 2},
+		{12, 0},
+		{0, 0},
+	}
+	for _, tt := range tests {
+		if have := db.GetSubstateCountForBlock(tt.block); have != tt.want {
+			t.Fatalf("block %v: count mismatch: have %v, want %v", tt.block, have, tt.want)
+		}
+		if have := len(db.GetBlockSubstates(tt.block)); have != tt.want {
+			t.Fatalf("block %v: count is inconsistent with GetBlockSubstates: %v", tt.block, have)
+		}
+	}
+}
+
+func TestGetBlockSubstatesSize(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{10: {0, 1, 5}})
+	defer db.Close()
+
+	var want uint64
+	for _, tx := range []int{0, 1, 5} {
+		value, err := db.backend.Get(Stage1SubstateKey(10, tx))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want += uint64(len(value))
+	}
+	if have := db.GetBlockSubstatesSize(10); have != want {
+		t.Fatalf("size mismatch: have %v, want %v", have, want)
+	}
+	if have := db.GetBlockSubstatesSize(11); have != 0 {
+		t.Fatalf("size of missing block mismatch: have %v, want 0", have)
+	}
+}
+
+func TestMemorySubstateDB(t *testing.T) {
+	db := NewMemorySubstateDB()
+	defer db.Close()
+
+	backend, err := rawdb.NewLevelDBDatabase(t.TempDir(), 16, 16, "substatedir", false)
+	if err != nil {
+		t.Fatalf("error creating substate DB: %v", err)
+	}
+	diskDB := NewSubstateDB(backend)
+	defer diskDB.Close()
+
+	// put substates out of order, one with bytecode
+	contract := common.Address{0xc0}
+	txs := []int{3, 0, 2, 1}
+	for _, tx := range txs {
+		substate := newTestSubstate(10, common.Address{0x01, byte(tx)}, contract)
+		if tx == 2 {
+			substate.InputAlloc[contract] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+			substate.OutputAlloc[contract] = substate.InputAlloc[contract].Copy()
+		}
+		db.PutSubstate(10, tx, substate)
+		diskDB.PutSubstate(10, tx, substate)
+
+		if have := db.GetSubstate(10, tx); !have.Equal(substate) {
+			t.Fatalf("substate 10_%v mismatch", tx)
+		}
+	}
+
+	// stored values are the same as on disk
+	for _, tx := range txs {
+		value, err := db.backend.Get(Stage1SubstateKey(10, tx))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		diskValue, err := diskDB.backend.Get(Stage1SubstateKey(10, tx))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(value) != string(diskValue) {
+			t.Fatalf("substate 10_%v is encoded differently in memory and on disk", tx)
+		}
+	}
+
+	// substates of a block are iterated in tx order
+	var iterated []int
+	err = db.IterateSubstates(10, 10, func(key SubstateKey, substate *Substate) bool {
+		iterated = append(iterated, key.Tx)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	blockSubstates := db.GetBlockSubstates(10)
+	if len(iterated) != len(txs) || len(blockSubstates) != len(txs) {
+		t.Fatalf("number of substates mismatch: iterated %v, GetBlockSubstates %v, want %v", iterated, len(blockSubstates), len(txs))
+	}
+	for i, tx := range iterated {
+		if tx != i {
+			t.Fatalf("iterated txs mismatch: have %v, want 0-%v", iterated, len(txs)-1)
+		}
+		if !blockSubstates[tx].Equal(diskDB.GetSubstate(10, tx)) {
+			t.Fatalf("GetBlockSubstates: substate 10_%v mismatch", tx)
+		}
+	}
+}
+
+func TestIterateBlocks(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		2:    {0, 1, 2},
+		3:    {0},
+		7:    {0, 1},
+		100:  {0},
+		1000: {0},
+	})
+	defer db.Close()
+
+	tests := []struct {
+		first, last uint64
+		want        []uint64
+	}{
+		{first: 0, last: OpenBlockSegmentLast, want: []uint64{2, 3, 7, 100, 1000}},
+		{first: 3, last: 100, want: []uint64{3, 7, 100}},
+		{first: 4, last: 99, want: []uint64{7}},
+		{first: 8, last: 99, want: nil},
+		{first: 1001, last: 2000, want: nil},
+	}
+	for _, test := range tests {
+		blocks, err := db.IterateBlocks(test.first, test.last)
+		if err != nil {
+			t.Fatalf("%v-%v: unexpected error: %v", test.first, test.last, err)
+		}
+		if !reflect.DeepEqual(blocks, test.want) {
+			t.Fatalf("%v-%v: blocks mismatch: have %v, want %v", test.first, test.last, blocks, test.want)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package research
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// SubstateStorageDiff is a storage slot value changed from From to To.
+type SubstateStorageDiff struct {
+	From common.Hash `json:"from"`
+	To   common.Hash `json:"to"`
+}
+
+// SubstateAccountDiff has only the fields changed between two accounts.
+type SubstateAccountDiff struct {
+	NonceDelta   int64                               `json:"nonceDelta,omitempty"`
+	BalanceDelta *big.Int                            `json:"balanceDelta,omitempty"`
+	CodeHash     *SubstateStorageDiff                `json:"codeHash,omitempty"`
+	Storage      map[common.Hash]SubstateStorageDiff `json:"storage,omitempty"`
+}
+
+// IsEmpty returns true if no field is changed.
+func (diff *SubstateAccountDiff) IsEmpty() bool {
+	return diff.NonceDelta == 0 && diff.BalanceDelta == nil && diff.CodeHash == nil && len(diff.Storage) == 0
+}
+
+// Diff returns the fields changed from account x to account y. A nil account
+// is regarded as an empty account.
+func (x *SubstateAccount) Diff(y *SubstateAccount) *SubstateAccountDiff {
+	empty := NewSubstateAccount(0, new(big.Int), nil)
+	if x == nil {
+		x = empty
+	}
+	if y == nil {
+		y = empty
+	}
+
+	diff := &SubstateAccountDiff{
+		NonceDelta: int64(y.Nonce - x.Nonce),
+	}
+	if delta := new(big.Int).Sub(y.Balance, x.Balance); delta.Sign() != 0 {
+		diff.BalanceDelta = delta
+	}
+	if !bytes.Equal(x.Code, y.Code) {
+		diff.CodeHash = &SubstateStorageDiff{From: x.CodeHash(), To: y.CodeHash()}
+	}
+
+	// a storage slot missing in either account is shown as zero
+	for key, xv := range x.Storage {
+		if yv := y.Storage[key]; xv != yv {
+			if diff.Storage == nil {
+				diff.Storage = make(map[common.Hash]SubstateStorageDiff)
+			}
+			diff.Storage[key] = SubstateStorageDiff{From: xv, To: yv}
+		}
+	}
+	for key, yv := range y.Storage {
+		if _, exist := x.Storage[key]; !exist {
+			if diff.Storage == nil {
+				diff.Storage = make(map[common.Hash]SubstateStorageDiff)
+			}
+			diff.Storage[key] = SubstateStorageDiff{To: yv}
+		}
+	}
+
+	return diff
+}
+
+// Diff compares alloc x to alloc y. It returns sorted addresses of accounts
+// added in y and removed from x, and post-state accounts in y of addresses in
+// both allocs whose accounts differ.
+func (x SubstateAlloc) Diff(y SubstateAlloc) (added, removed []common.Address, changed map[common.Address]*SubstateAccount) {
+	changed = make(map[common.Address]*SubstateAccount)
+	for addr, xv := range x {
+		yv, exist := y[addr]
+		if !exist {
+			removed = append(removed, addr)
+		} else if !xv.Equal(yv) {
+			changed[addr] = yv
+		}
+	}
+	for addr := range y {
+		if _, exist := x[addr]; !exist {
+			added = append(added, addr)
+		}
+	}
+
+	sortAddresses(added)
+	sortAddresses(removed)
+	return added, removed, changed
+}
+
+func sortAddresses(addrs []common.Address) {
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+}
+
+// SubstateResultDiff reports fields differing between two results.
+type SubstateResultDiff struct {
+	Status          bool
+	Bloom           bool
+	Logs            bool
+	ContractAddress bool
+	GasUsed         bool
+
+	GasUsedDelta int64 // GasUsed of y minus GasUsed of x
+}
+
+// IsEmpty returns true if no field differs.
+func (diff *SubstateResultDiff) IsEmpty() bool {
+	return !(diff.Status || diff.Bloom || diff.Logs || diff.ContractAddress || diff.GasUsed)
+}
+
+// Diff returns the fields differing between results x and y.
+func (x *SubstateResult) Diff(y *SubstateResult) *SubstateResultDiff {
+	return &SubstateResultDiff{
+		Status:          x.Status != y.Status,
+		Bloom:           x.Bloom != y.Bloom,
+		Logs:            !equalLogs(x.Logs, y.Logs),
+		ContractAddress: x.ContractAddress != y.ContractAddress,
+		GasUsed:         x.GasUsed != y.GasUsed,
+
+		GasUsedDelta: int64(y.GasUsed - x.GasUsed),
+	}
+}
+
+// Fields of a substate reported by Substate.FirstDiff
+const (
+	SubstateFieldEnv         = "Env"
+	SubstateFieldMessage     = "Message"
+	SubstateFieldInputAlloc  = "InputAlloc"
+	SubstateFieldOutputAlloc = "OutputAlloc"
+	SubstateFieldResult      = "Result"
+)
+
+// SubstateFieldEncoding is reported by VerifyClone for a substate whose
+// stored bytes differ although all fields are equal.
+const SubstateFieldEncoding = "encoding"
+
+// FirstDiff returns the first field of x that differs from y, in the order
+// of Env, Message, InputAlloc, OutputAlloc, and Result. It returns an empty
+// string if x and y are equal.
+func (x *Substate) FirstDiff(y *Substate) string {
+	switch {
+	case !x.Env.Equal(y.Env):
+		return SubstateFieldEnv
+	case !x.Message.Equal(y.Message):
+		return SubstateFieldMessage
+	case !x.InputAlloc.Equal(y.InputAlloc):
+		return SubstateFieldInputAlloc
+	case !x.OutputAlloc.Equal(y.OutputAlloc):
+		return SubstateFieldOutputAlloc
+	case !x.Result.Equal(y.Result):
+		return SubstateFieldResult
+	}
+	return ""
+}
+
+// SubstateDiff is a substate that differs between two substate DBs.
+type SubstateDiff struct {
+	Key SubstateKey
+
+	MissingInA bool
+	MissingInB bool
+
+	Field string // first differing field if the substate exists in both DBs
+}
+
+func (diff SubstateDiff) String() string {
+	key := fmt.Sprintf("%v_%v", diff.Key.Block, diff.Key.Tx)
+	switch {
+	case diff.MissingInA:
+		return key + ": missing in a"
+	case diff.MissingInB:
+		return key + ": missing in b"
+	}
+	return key + ": " + diff.Field + " differs"
+}
+
+// substateKeyIterator iterates substate keys from block first to block last
+// without decoding substates.
+type substateKeyIterator struct {
+	iter ethdb.Iterator
+	last uint64
+
+	key   SubstateKey
+	valid bool
+	err   error
+}
+
+func newSubstateKeyIterator(db *SubstateDB, first, last uint64) *substateKeyIterator {
+	prefix := []byte(stage1SubstatePrefix)
+	start := Stage1SubstateBlockPrefix(first)[len(prefix):]
+
+	it := &substateKeyIterator{
+		iter: db.backend.NewIterator(prefix, start),
+		last: last,
+	}
+	it.next()
+	return it
+}
+
+func (it *substateKeyIterator) next() {
+	it.valid = false
+	if it.err != nil || !it.iter.Next() {
+		return
+	}
+	block, tx, err := DecodeSubstateKey(it.iter.Key())
+	if err != nil {
+		it.err = fmt.Errorf("record-replay: invalid substate key found: %v", err)
+		return
+	}
+	if block > it.last {
+		return
+	}
+	it.key = SubstateKey{Block: block, Tx: tx}
+	it.valid = true
+}
+
+func (it *substateKeyIterator) release() error {
+	it.iter.Release()
+	if it.err != nil {
+		return it.err
+	}
+	return it.iter.Error()
+}
+
+// lessSubstateKey returns true if x is ordered before y in a substate DB.
+func lessSubstateKey(x, y SubstateKey) bool {
+	return x.Block < y.Block || (x.Block == y.Block && x.Tx < y.Tx)
+}
+
+// DiffSubstateDBs compares substates of substate DBs a and b from block first
+// to block last. It returns substates missing in either DB or differing
+// between them, and stops after maxDiffs differences if maxDiffs > 0.
+func DiffSubstateDBs(a, b *SubstateDB, first, last uint64, maxDiffs int) (diffs []SubstateDiff, err error) {
+	itA := newSubstateKeyIterator(a, first, last)
+	itB := newSubstateKeyIterator(b, first, last)
+	defer func() {
+		errA, errB := itA.release(), itB.release()
+		if err == nil && errA != nil {
+			err = errA
+		}
+		if err == nil && errB != nil {
+			err = errB
+		}
+	}()
+
+	for (itA.valid || itB.valid) && (maxDiffs <= 0 || len(diffs) < maxDiffs) {
+		switch {
+		case !itB.valid || (itA.valid && lessSubstateKey(itA.key, itB.key)):
+			diffs = append(diffs, SubstateDiff{Key: itA.key, MissingInB: true})
+			itA.next()
+		case !itA.valid || lessSubstateKey(itB.key, itA.key):
+			diffs = append(diffs, SubstateDiff{Key: itB.key, MissingInA: true})
+			itB.next()
+		default:
+			key := itA.key
+			substateA := a.GetSubstate(key.Block, key.Tx)
+			substateB := b.GetSubstate(key.Block, key.Tx)
+			if field := substateA.FirstDiff(substateB); field != "" {
+				diffs = append(diffs, SubstateDiff{Key: key, Field: field})
+			}
+			itA.next()
+			itB.next()
+		}
+	}
+
+	return diffs, nil
+}
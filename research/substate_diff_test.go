@@ -0,0 +1,226 @@
+package research
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestSubstateFirstDiff(t *testing.T) {
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+
+	tests := []struct {
+		mutate func(substate *Substate)
+		want   string
+	}{
+		{func(substate *Substate) {}, ""},
+		{func(substate *Substate) { substate.Env.Timestamp++ }, SubstateFieldEnv},
+		{func(substate *Substate) { substate.Message.Value = big.NewInt(1) }, SubstateFieldMessage},
+		{func(substate *Substate) { substate.InputAlloc[sender].Nonce++ }, SubstateFieldInputAlloc},
+		{func(substate *Substate) { substate.OutputAlloc[recipient].Balance = big.NewInt(1) }, SubstateFieldOutputAlloc},
+		{func(substate *Substate) { substate.Result.GasUsed++ }, SubstateFieldResult},
+		// Env is reported before Result
+		{func(substate *Substate) { substate.Result.GasUsed++; substate.Env.Number++ }, SubstateFieldEnv},
+	}
+	for i, tt := range tests {
+		x := newTestSubstate(10, sender, recipient)
+		y := newTestSubstate(10, sender, recipient)
+		tt.mutate(y)
+		if have := x.FirstDiff(y); have != tt.want {
+			t.Fatalf("test %v: first diff mismatch: have %q, want %q", i, have, tt.want)
+		}
+	}
+}
+
+func TestDiffSubstateDBs(t *testing.T) {
+	a := newTestSubstateDB(map[uint64][]int{
+		10: {0, 1},
+		11: {0},
+		12: {0},
+		20: {0},
+	})
+	defer a.Close()
+	b := newTestSubstateDB(map[uint64][]int{
+		10: {0, 1, 2},
+		12: {0},
+		20: {0},
+	})
+	defer b.Close()
+
+	// mutate substates of b
+	substate := b.GetSubstate(10, 1)
+	substate.Result.GasUsed++
+	b.PutSubstate(10, 1, substate)
+	substate = b.GetSubstate(20, 0)
+	substate.Env.Timestamp++
+	b.PutSubstate(20, 0, substate)
+
+	diffs, err := DiffSubstateDBs(a, b, 0, OpenBlockSegmentLast, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []SubstateDiff{
+		{Key: SubstateKey{10, 1}, Field: SubstateFieldResult},
+		{Key: SubstateKey{10, 2}, MissingInA: true},
+		{Key: SubstateKey{11, 0}, MissingInB: true},
+		{Key: SubstateKey{20, 0}, Field: SubstateFieldEnv},
+	}
+	if len(diffs) != len(want) {
+		t.Fatalf("diffs mismatch: have %v, want %v", diffs, want)
+	}
+	for i := range want {
+		if diffs[i] != want[i] {
+			t.Fatalf("diff %v mismatch: have %v, want %v", i, diffs[i], want[i])
+		}
+	}
+
+	// stop after max diffs
+	diffs, err = DiffSubstateDBs(a, b, 0, OpenBlockSegmentLast, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(diffs) != 2 || diffs[1] != want[1] {
+		t.Fatalf("diffs mismatch with max diffs: have %v, want %v", diffs, want[:2])
+	}
+
+	// scope to a block segment
+	diffs, err = DiffSubstateDBs(a, b, 11, 12, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(diffs) != 1 || diffs[0] != want[2] {
+		t.Fatalf("diffs mismatch in segment: have %v, want %v", diffs, want[2:3])
+	}
+}
+
+func TestSubstateAccountDiff(t *testing.T) {
+	x := NewSubstateAccount(1, big.NewInt(1_000), []byte{0x01})
+	x.Storage[common.Hash{0x01}] = common.Hash{0x01}
+	x.Storage[common.Hash{0x02}] = common.Hash{0x02}
+	x.Storage[common.Hash{0x03}] = common.Hash{0x03}
+
+	if diff := x.Diff(x.Copy()); !diff.IsEmpty() {
+		t.Fatalf("diff of equal accounts is not empty: %+v", diff)
+	}
+
+	y := x.Copy()
+	y.Nonce = 0
+	y.Balance = big.NewInt(1_500)
+	y.Storage[common.Hash{0x01}] = common.Hash{0x11}
+	delete(y.Storage, common.Hash{0x02})
+	y.Storage[common.Hash{0x04}] = common.Hash{}
+
+	diff := x.Diff(y)
+	if diff.NonceDelta != -1 {
+		t.Fatalf("nonce delta mismatch: have %v, want -1", diff.NonceDelta)
+	}
+	if diff.BalanceDelta == nil || diff.BalanceDelta.Cmp(big.NewInt(500)) != 0 {
+		t.Fatalf("balance delta mismatch: have %v, want 500", diff.BalanceDelta)
+	}
+	if diff.CodeHash != nil {
+		t.Fatalf("code hash is changed: %+v", diff.CodeHash)
+	}
+	want := map[common.Hash]SubstateStorageDiff{
+		{0x01}: {From: common.Hash{0x01}, To: common.Hash{0x11}},
+		{0x02}: {From: common.Hash{0x02}},
+		{0x04}: {},
+	}
+	if len(diff.Storage) != len(want) {
+		t.Fatalf("storage diff mismatch: have %v, want %v", diff.Storage, want)
+	}
+	for key, wv := range want {
+		if hv, exist := diff.Storage[key]; !exist || hv != wv {
+			t.Fatalf("storage diff mismatch at %v: have %v, want %v", key.Hex(), hv, wv)
+		}
+	}
+
+	// a missing account is regarded as an empty account
+	diff = x.Diff(nil)
+	if diff.NonceDelta != -1 || diff.BalanceDelta.Cmp(big.NewInt(-1_000)) != 0 || diff.CodeHash == nil || len(diff.Storage) != 3 {
+		t.Fatalf("diff to missing account mismatch: %+v", diff)
+	}
+	if diff.CodeHash.To != EmptyCodeHash {
+		t.Fatalf("code hash of missing account mismatch: have %v, want %v", diff.CodeHash.To.Hex(), EmptyCodeHash.Hex())
+	}
+}
+
+func TestSubstateResultDiff(t *testing.T) {
+	tests := []struct {
+		mutate func(result *SubstateResult)
+		want   SubstateResultDiff
+	}{
+		{func(result *SubstateResult) {}, SubstateResultDiff{}},
+		{func(result *SubstateResult) { result.GasUsed += 100 }, SubstateResultDiff{GasUsed: true, GasUsedDelta: 100}},
+		{func(result *SubstateResult) { result.GasUsed -= 1_000 }, SubstateResultDiff{GasUsed: true, GasUsedDelta: -1_000}},
+		{func(result *SubstateResult) { result.Status = types.ReceiptStatusFailed }, SubstateResultDiff{Status: true}},
+		{func(result *SubstateResult) { result.Bloom[0] = 0x01 }, SubstateResultDiff{Bloom: true}},
+		{func(result *SubstateResult) { result.ContractAddress = common.Address{0x01} }, SubstateResultDiff{ContractAddress: true}},
+		{func(result *SubstateResult) {
+			result.Logs = []*types.Log{{Address: common.Address{0x01}}}
+			result.Bloom = types.BytesToBloom(types.LogsBloom(result.Logs))
+		}, SubstateResultDiff{Bloom: true, Logs: true}},
+	}
+	for i, tt := range tests {
+		x := newTestSubstate(10, common.Address{0x01}, common.Address{0x02}).Result
+		y := newTestSubstate(10, common.Address{0x01}, common.Address{0x02}).Result
+		tt.mutate(y)
+		diff := x.Diff(y)
+		if *diff != tt.want {
+			t.Fatalf("test %v: result diff mismatch: have %+v, want %+v", i, *diff, tt.want)
+		}
+		if diff.IsEmpty() != x.Equal(y) {
+			t.Fatalf("test %v: IsEmpty is inconsistent with Equal", i)
+		}
+	}
+}
+
+func TestSubstateAllocDiff(t *testing.T) {
+	unchanged := common.Address{0x01}
+	balanceOnly := common.Address{0x02}
+	storageOnly := common.Address{0x03}
+	codeOnly := common.Address{0x04}
+	removed := common.Address{0x05}
+	added := common.Address{0x06}
+
+	x := SubstateAlloc{
+		unchanged:   NewSubstateAccount(1, big.NewInt(1), nil),
+		balanceOnly: NewSubstateAccount(1, big.NewInt(1), nil),
+		storageOnly: NewSubstateAccount(1, big.NewInt(1), []byte{0x00}),
+		codeOnly:    NewSubstateAccount(1, big.NewInt(1), []byte{0x00}),
+		removed:     NewSubstateAccount(1, big.NewInt(1), nil),
+	}
+	x[storageOnly].Storage[common.Hash{0x01}] = common.Hash{0x01}
+
+	y := x.Copy()
+	delete(y, removed)
+	y[added] = NewSubstateAccount(0, big.NewInt(0), nil)
+	y[balanceOnly].Balance = big.NewInt(2)
+	y[storageOnly].Storage[common.Hash{0x01}] = common.Hash{0x02}
+	y[codeOnly].Code = []byte{0x01}
+
+	haveAdded, haveRemoved, haveChanged := x.Diff(y)
+	if len(haveAdded) != 1 || haveAdded[0] != added {
+		t.Fatalf("added accounts mismatch: have %v, want %v", haveAdded, added)
+	}
+	if len(haveRemoved) != 1 || haveRemoved[0] != removed {
+		t.Fatalf("removed accounts mismatch: have %v, want %v", haveRemoved, removed)
+	}
+	if len(haveChanged) != 3 {
+		t.Fatalf("number of changed accounts mismatch: have %v, want 3", len(haveChanged))
+	}
+	for _, addr := range []common.Address{balanceOnly, storageOnly, codeOnly} {
+		if account, exist := haveChanged[addr]; !exist || account != y[addr] {
+			t.Fatalf("changed account %v mismatch: have %v, want post-state account", addr.Hex(), account)
+		}
+	}
+	if _, exist := haveChanged[unchanged]; exist {
+		t.Fatalf("unchanged account is reported as changed")
+	}
+
+	haveAdded, haveRemoved, haveChanged = x.Diff(x.Copy())
+	if len(haveAdded) != 0 || len(haveRemoved) != 0 || len(haveChanged) != 0 {
+		t.Fatalf("diff of equal allocs is not empty: %v %v %v", haveAdded, haveRemoved, haveChanged)
+	}
+}
@@ -0,0 +1,272 @@
+package research
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SubstateJSONLine is a line of a JSONL substate export, a substate in JSON
+// with its block and transaction index.
+type SubstateJSONLine struct {
+	Block uint64 `json:"block"`
+	Tx    int    `json:"tx"`
+	*SubstateJSON
+}
+
+// SubstateEncodeFunc encodes a substate to lines of an export.
+type SubstateEncodeFunc func(block uint64, tx int, substate *Substate) ([]byte, error)
+
+// SubstateExporter writes substates executed by a task pool ordered by block
+// then transaction index. Substates are encoded in parallel by Task, and are
+// written by a single goroutine once BlockDone is called for their block.
+type SubstateExporter struct {
+	encode SubstateEncodeFunc
+
+	mu     sync.Mutex
+	blocks map[uint64]map[int][]byte
+
+	lineChan chan []byte
+	doneChan chan error
+}
+
+// NewSubstateExporter writes header and then substates encoded by encode to
+// w until Close is called.
+func NewSubstateExporter(w io.Writer, header []byte, encode SubstateEncodeFunc) *SubstateExporter {
+	e := &SubstateExporter{
+		encode: encode,
+
+		blocks: make(map[uint64]map[int][]byte),
+
+		lineChan: make(chan []byte, 1000),
+		doneChan: make(chan error, 1),
+	}
+
+	go func() {
+		bw := bufio.NewWriter(w)
+		_, err := bw.Write(header)
+		for line := range e.lineChan {
+			if err == nil {
+				_, err = bw.Write(line)
+			}
+		}
+		if err == nil {
+			err = bw.Flush()
+		}
+		e.doneChan <- err
+	}()
+
+	return e
+}
+
+// NewSubstateJSONLExporter writes substates to w as JSONL, one
+// SubstateJSONLine per line.
+func NewSubstateJSONLExporter(w io.Writer) *SubstateExporter {
+	return NewSubstateExporter(w, nil, encodeSubstateJSONLine)
+}
+
+func encodeSubstateJSONLine(block uint64, tx int, substate *Substate) ([]byte, error) {
+	line, err := json.Marshal(&SubstateJSONLine{
+		Block:        block,
+		Tx:           tx,
+		SubstateJSON: NewSubstateJSON(substate),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// Task is a SubstateTaskFunc encoding a substate to be exported.
+func (e *SubstateExporter) Task(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+	line, err := e.encode(block, tx, substate)
+	if err != nil {
+		return fmt.Errorf("error encoding substate %v_%v: %v", block, tx, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	txs, exist := e.blocks[block]
+	if !exist {
+		txs = make(map[int][]byte)
+		e.blocks[block] = txs
+	}
+	txs[tx] = line
+	return nil
+}
+
+// BlockDone is a BlockDoneFunc writing encoded substates of the block.
+func (e *SubstateExporter) BlockDone(block uint64) {
+	e.mu.Lock()
+	txs := e.blocks[block]
+	delete(e.blocks, block)
+	e.mu.Unlock()
+
+	txList := make([]int, 0, len(txs))
+	for tx := range txs {
+		txList = append(txList, tx)
+	}
+	sort.Ints(txList)
+	for _, tx := range txList {
+		e.lineChan <- txs[tx]
+	}
+}
+
+// Close waits until all substates of finished blocks are written, and returns
+// the first error writing them.
+func (e *SubstateExporter) Close() error {
+	close(e.lineChan)
+	return <-e.doneChan
+}
+
+// SubstateAccountsCSVHeader is the header of a CSV account-state export.
+const SubstateAccountsCSVHeader = "block,tx,address,balanceBefore,balanceAfter,nonceBefore,nonceAfter\n"
+
+// NewSubstateAccountsCSVExporter writes a CSV row for each account in
+// InputAlloc or OutputAlloc of substates, ordered by address within a
+// substate. Balances are decimal, and fields of an account missing in
+// InputAlloc or OutputAlloc are empty. Only the account of address is written
+// if address is not nil.
+func NewSubstateAccountsCSVExporter(w io.Writer, address *common.Address) *SubstateExporter {
+	return NewSubstateExporter(w, []byte(SubstateAccountsCSVHeader), func(block uint64, tx int, substate *Substate) ([]byte, error) {
+		return encodeSubstateAccountsCSV(block, tx, substate, address)
+	})
+}
+
+func encodeSubstateAccountsCSV(block uint64, tx int, substate *Substate, address *common.Address) ([]byte, error) {
+	var addrs []common.Address
+	if address != nil {
+		_, inInput := substate.InputAlloc[*address]
+		_, inOutput := substate.OutputAlloc[*address]
+		if inInput || inOutput {
+			addrs = append(addrs, *address)
+		}
+	} else {
+		for addr := range substate.InputAlloc {
+			addrs = append(addrs, addr)
+		}
+		for addr := range substate.OutputAlloc {
+			if _, exist := substate.InputAlloc[addr]; !exist {
+				addrs = append(addrs, addr)
+			}
+		}
+		sortAddresses(addrs)
+	}
+
+	accountFields := func(account *SubstateAccount) (balance, nonce string) {
+		if account == nil {
+			return "", ""
+		}
+		return account.Balance.String(), strconv.FormatUint(account.Nonce, 10)
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	for _, addr := range addrs {
+		balanceBefore, nonceBefore := accountFields(substate.InputAlloc[addr])
+		balanceAfter, nonceAfter := accountFields(substate.OutputAlloc[addr])
+		record := []string{
+			strconv.FormatUint(block, 10),
+			strconv.Itoa(tx),
+			addr.Hex(),
+			balanceBefore,
+			balanceAfter,
+			nonceBefore,
+			nonceAfter,
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+// substateJSONLineFields has required fields of a SubstateJSONLine to check
+// whether they are present.
+type substateJSONLineFields struct {
+	Block *uint64 `json:"block"`
+	Tx    *int    `json:"tx"`
+
+	Env     *json.RawMessage `json:"env"`
+	Message *json.RawMessage `json:"message"`
+	Result  *json.RawMessage `json:"result"`
+}
+
+// ParseSubstateJSONLine parses a line of a JSONL substate export. It returns
+// an error if block, tx, env, message or result is missing, or if a field is
+// not decoded correctly.
+func ParseSubstateJSONLine(b []byte) (block uint64, tx int, substate *Substate, err error) {
+	var fields substateJSONLineFields
+	if err = json.Unmarshal(b, &fields); err != nil {
+		return 0, 0, nil, err
+	}
+	switch {
+	case fields.Block == nil:
+		return 0, 0, nil, fmt.Errorf("missing block")
+	case fields.Tx == nil:
+		return 0, 0, nil, fmt.Errorf("missing tx")
+	case *fields.Tx < 0:
+		return 0, 0, nil, fmt.Errorf("invalid tx %v", *fields.Tx)
+	case fields.Env == nil:
+		return 0, 0, nil, fmt.Errorf("missing env")
+	case fields.Message == nil:
+		return 0, 0, nil, fmt.Errorf("missing message")
+	case fields.Result == nil:
+		return 0, 0, nil, fmt.Errorf("missing result")
+	}
+
+	var line SubstateJSONLine
+	if err = json.Unmarshal(b, &line); err != nil {
+		return 0, 0, nil, err
+	}
+	for name, alloc := range map[string]SubstateAllocJSON{"inputAlloc": line.InputAlloc, "outputAlloc": line.OutputAlloc} {
+		for addr, account := range alloc {
+			if account == nil || account.Balance == nil {
+				return 0, 0, nil, fmt.Errorf("missing balance of %s account %v", name, addr.Hex())
+			}
+		}
+	}
+
+	substate = &Substate{}
+	substate.SetJSON(line.SubstateJSON)
+	return line.Block, line.Tx, substate, nil
+}
+
+// ImportSubstatesJSONL puts substates of a JSONL substate export into the
+// substate DB. It stops at the first malformed line unless skipBad is true, in
+// which case malformed lines are skipped and counted.
+func ImportSubstatesJSONL(r io.Reader, db *SubstateDB, skipBad bool) (numImported, numSkipped int, err error) {
+	reader := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		b, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return numImported, numSkipped, err
+		}
+		eof := err == io.EOF
+		if len(bytes.TrimSpace(b)) > 0 {
+			block, tx, substate, perr := ParseSubstateJSONLine(b)
+			switch {
+			case perr == nil:
+				db.PutSubstate(block, tx, substate)
+				numImported++
+			case skipBad:
+				numSkipped++
+			default:
+				return numImported, numSkipped, fmt.Errorf("line %v: %v", lineNum, perr)
+			}
+		}
+		if eof {
+			return numImported, numSkipped, nil
+		}
+	}
+}
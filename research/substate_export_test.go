@@ -0,0 +1,206 @@
+package research
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestSubstateJSONLExporter(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1:  {0, 1, 2},
+		3:  {0},
+		4:  {1, 0, 3},
+		10: {0, 1},
+	})
+	defer db.Close()
+	// a substate with code and storage
+	contract := common.Address{0xc0}
+	substate := db.GetSubstate(3, 0)
+	substate.InputAlloc[contract] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+	substate.InputAlloc[contract].Storage[common.Hash{0x01}] = common.Hash{0x02}
+	substate.OutputAlloc[contract] = substate.InputAlloc[contract].Copy()
+	db.PutSubstate(3, 0, substate)
+
+	var buf bytes.Buffer
+	exporter := NewSubstateJSONLExporter(&buf)
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: exporter.Task,
+		Config:   &SubstateTaskConfig{Workers: 4, ParallelTxs: 2},
+
+		DB: db,
+
+		Quiet:         true,
+		BlockDoneFunc: exporter.BlockDone,
+	}
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 10)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []SubstateKey{{1, 0}, {1, 1}, {1, 2}, {3, 0}, {4, 0}, {4, 1}, {4, 3}, {10, 0}, {10, 1}}
+	scanner := bufio.NewScanner(&buf)
+	i := 0
+	for ; scanner.Scan(); i++ {
+		var line SubstateJSONLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("line %v: unexpected error: %v", i+1, err)
+		}
+		if i >= len(want) || (SubstateKey{line.Block, line.Tx}) != want[i] {
+			t.Fatalf("line %v: substate key mismatch: have %v_%v", i+1, line.Block, line.Tx)
+		}
+		have := &Substate{}
+		have.SetJSON(line.SubstateJSON)
+		if !have.Equal(db.GetSubstate(line.Block, line.Tx)) {
+			t.Fatalf("line %v: substate %v_%v mismatch after round trip", i+1, line.Block, line.Tx)
+		}
+	}
+	if i != len(want) {
+		t.Fatalf("number of lines mismatch: have %v, want %v", i, len(want))
+	}
+}
+
+func TestImportSubstatesJSONL(t *testing.T) {
+	src := newTestSubstateDB(map[uint64][]int{
+		1: {0, 1},
+		2: {0},
+		5: {2},
+	})
+	defer src.Close()
+
+	var buf bytes.Buffer
+	exporter := NewSubstateJSONLExporter(&buf)
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: exporter.Task,
+		Config:   &SubstateTaskConfig{Workers: 2},
+
+		DB: src,
+
+		Quiet:         true,
+		BlockDoneFunc: exporter.BlockDone,
+	}
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 5)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exported := buf.String()
+
+	// clean round trip
+	dst := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer dst.Close()
+	numImported, numSkipped, err := ImportSubstatesJSONL(strings.NewReader(exported), dst, false)
+	if err != nil || numImported != 4 || numSkipped != 0 {
+		t.Fatalf("import mismatch: have %v imported, %v skipped (%v), want 4 imported", numImported, numSkipped, err)
+	}
+	diffs, err := DiffSubstateDBs(src, dst, 0, OpenBlockSegmentLast, 0)
+	if err != nil || len(diffs) != 0 {
+		t.Fatalf("imported substates differ: %v (%v)", diffs, err)
+	}
+
+	// a truncated line is rejected unless it is skipped
+	lines := strings.SplitAfter(exported, "\n")
+	truncated := lines[0] + lines[1][:len(lines[1])/2] + "\n" + lines[2]
+	_, _, err = ImportSubstatesJSONL(strings.NewReader(truncated), NewSubstateDB(rawdb.NewMemoryDatabase()), false)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Fatalf("unexpected error: have %v, want error at line 2", err)
+	}
+	numImported, numSkipped, err = ImportSubstatesJSONL(strings.NewReader(truncated), NewSubstateDB(rawdb.NewMemoryDatabase()), true)
+	if err != nil || numImported != 2 || numSkipped != 1 {
+		t.Fatalf("import mismatch with skip-bad: have %v imported, %v skipped (%v), want 2 imported, 1 skipped", numImported, numSkipped, err)
+	}
+}
+
+func TestParseSubstateJSONLineBad(t *testing.T) {
+	b, err := json.Marshal(&SubstateJSONLine{
+		Block:        10,
+		Tx:           1,
+		SubstateJSON: NewSubstateJSON(newTestSubstate(10, common.Address{0x01}, common.Address{0x02})),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, _, err := ParseSubstateJSONLine(b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	line := string(b)
+
+	tests := []struct {
+		old, new, err string
+	}{
+		{`"block":10,`, ``, "missing block"},
+		{`"tx":1,`, ``, "missing tx"},
+		{`"tx":1,`, `"tx":-1,`, "invalid tx"},
+		{`"env":{`, `"env":null,"x":{`, "missing env"},
+		{`"0x0100000000000000000000000000000000000000"`, `"0x01"`, "hex string has length 2"},
+		{`"balance":"0xf4240"`, `"balance":"0xzz"`, "invalid"},
+		{`"balance":"0xf4240"`, `"nonce":"0x0"`, "missing balance"},
+	}
+	for _, tt := range tests {
+		bad := strings.Replace(line, tt.old, tt.new, 1)
+		if bad == line {
+			t.Fatalf("%q is not found in %s", tt.old, line)
+		}
+		_, _, _, err := ParseSubstateJSONLine([]byte(bad))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("%q: error mismatch: have %v, want %q", tt.new, err, tt.err)
+		}
+	}
+}
+
+func TestSubstateAccountsCSVExporter(t *testing.T) {
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	// recipient only appears in OutputAlloc
+	db.PutSubstate(10, 0, newTestSubstate(10, sender, recipient))
+	db.PutSubstate(11, 1, newTestSubstate(11, sender, common.Address{0x03}))
+
+	export := func(address *common.Address) string {
+		var buf bytes.Buffer
+		exporter := NewSubstateAccountsCSVExporter(&buf, address)
+		pool := &SubstateTaskPool{
+			Name:     "test",
+			TaskFunc: exporter.Task,
+			Config:   &SubstateTaskConfig{Workers: 2},
+
+			DB: db,
+
+			Quiet:         true,
+			BlockDoneFunc: exporter.BlockDone,
+		}
+		if err := pool.ExecuteSegment(NewBlockSegment(10, 11)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := exporter.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return buf.String()
+	}
+
+	want := SubstateAccountsCSVHeader +
+		"10,0," + sender.Hex() + ",1000000,999000,0,1\n" +
+		"10,0," + recipient.Hex() + ",,1000,,0\n" +
+		"11,1," + sender.Hex() + ",1000000,999000,0,1\n" +
+		"11,1," + common.Address{0x03}.Hex() + ",,1000,,0\n"
+	if have := export(nil); have != want {
+		t.Fatalf("CSV mismatch:\nhave %s\nwant %s", have, want)
+	}
+
+	want = SubstateAccountsCSVHeader +
+		"10,0," + recipient.Hex() + ",,1000,,0\n"
+	if have := export(&recipient); have != want {
+		t.Fatalf("CSV mismatch with address filter:\nhave %s\nwant %s", have, want)
+	}
+}
@@ -0,0 +1,317 @@
+package research
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// FixMapEntry is a storage slot to be deleted from both InputAlloc and
+// OutputAlloc of a substate.
+type FixMapEntry struct {
+	Block       uint64
+	Tx          int
+	Address     common.Address
+	StorageHash common.Hash
+}
+
+// FixMap maps a substate to storage slots to be deleted from the substate.
+type FixMap map[SubstateKey][]FixMapEntry
+
+// fixMapEntryJSON is a FixMapEntry in a JSON fix map file.
+type fixMapEntryJSON struct {
+	Block       uint64 `json:"block"`
+	Tx          int    `json:"tx"`
+	Address     string `json:"address"`
+	StorageHash string `json:"storageHash"`
+}
+
+// parseFixMapHash parses a 0x-prefixed 32-byte hex string.
+func parseFixMapHash(s string) (common.Hash, error) {
+	if len(s) != 2+2*common.HashLength || !strings.HasPrefix(s, "0x") {
+		return common.Hash{}, fmt.Errorf("invalid storage hash %q", s)
+	}
+	for _, c := range s[2:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return common.Hash{}, fmt.Errorf("invalid storage hash %q", s)
+		}
+	}
+	return common.HexToHash(s), nil
+}
+
+// parseFixMapAddress parses a 0x-prefixed 20-byte hex string.
+func parseFixMapAddress(s string) (common.Address, error) {
+	if !strings.HasPrefix(s, "0x") || !common.IsHexAddress(s) {
+		return common.Address{}, fmt.Errorf("invalid address %q", s)
+	}
+	return common.HexToAddress(s), nil
+}
+
+// newFixMapEntry validates fields of a fix map entry.
+func newFixMapEntry(block uint64, tx int, address, storageHash string) (FixMapEntry, error) {
+	if tx < 0 {
+		return FixMapEntry{}, fmt.Errorf("invalid tx %v", tx)
+	}
+	addr, err := parseFixMapAddress(address)
+	if err != nil {
+		return FixMapEntry{}, err
+	}
+	hash, err := parseFixMapHash(storageHash)
+	if err != nil {
+		return FixMapEntry{}, err
+	}
+	return FixMapEntry{
+		Block:       block,
+		Tx:          tx,
+		Address:     addr,
+		StorageHash: hash,
+	}, nil
+}
+
+// Add adds an entry to the fix map. It returns an error for a duplicate
+// entry.
+func (fixMap FixMap) Add(entry FixMapEntry) error {
+	key := SubstateKey{Block: entry.Block, Tx: entry.Tx}
+	for _, e := range fixMap[key] {
+		if e == entry {
+			return fmt.Errorf("duplicate entry %v_%v %v %v", entry.Block, entry.Tx, entry.Address.Hex(), entry.StorageHash.Hex())
+		}
+	}
+	fixMap[key] = append(fixMap[key], entry)
+	return nil
+}
+
+// Apply deletes storage slots of the fix map from InputAlloc and OutputAlloc
+// of the substate. It returns the number of deleted slots, so entries whose
+// slot is not in the substate are not counted.
+func (fixMap FixMap) Apply(block uint64, tx int, substate *Substate) int {
+	numDeleted := 0
+	for _, entry := range fixMap[SubstateKey{Block: block, Tx: tx}] {
+		for _, alloc := range []SubstateAlloc{substate.InputAlloc, substate.OutputAlloc} {
+			account, exist := alloc[entry.Address]
+			if !exist {
+				continue
+			}
+			if _, exist := account.Storage[entry.StorageHash]; exist {
+				delete(account.Storage, entry.StorageHash)
+				numDeleted++
+			}
+		}
+	}
+	return numDeleted
+}
+
+// readFixMapJSON reads a JSON array of fix map entries.
+func readFixMapJSON(r io.Reader) (FixMap, error) {
+	var entries []fixMapEntryJSON
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	fixMap := make(FixMap)
+	for i, e := range entries {
+		entry, err := newFixMapEntry(e.Block, e.Tx, e.Address, e.StorageHash)
+		if err != nil {
+			return nil, fmt.Errorf("entry %v: %v", i, err)
+		}
+		if err = fixMap.Add(entry); err != nil {
+			return nil, fmt.Errorf("entry %v: %v", i, err)
+		}
+	}
+	return fixMap, nil
+}
+
+// readFixMapCSV reads fix map entries of block,tx,address,storageHash lines.
+// An optional header line starting with "block" is skipped.
+func readFixMapCSV(r io.Reader) (FixMap, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 4
+	reader.TrimLeadingSpace = true
+
+	fixMap := make(FixMap)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && record[0] == "block" {
+			continue
+		}
+
+		block, err := strconv.ParseUint(record[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: invalid block %q", line, record[0])
+		}
+		tx, err := strconv.Atoi(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: invalid tx %q", line, record[1])
+		}
+		entry, err := newFixMapEntry(block, tx, record[2], record[3])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		if err = fixMap.Add(entry); err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+	}
+	return fixMap, nil
+}
+
+// LoadFixMap loads a fix map from a JSON file (.json) of
+// {block, tx, address, storageHash} objects or from a CSV file of
+// block,tx,address,storageHash lines.
+func LoadFixMap(path string) (FixMap, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("record-replay: error opening fix map %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var fixMap FixMap
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		fixMap, err = readFixMapJSON(file)
+	} else {
+		fixMap, err = readFixMapCSV(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("record-replay: error loading fix map %s: %v", path, err)
+	}
+	return fixMap, nil
+}
+
+// SlotFilter is a set of storage slots to be deleted from every substate
+// regardless of block and transaction.
+type SlotFilter map[common.Address]map[common.Hash]struct{}
+
+// Add adds a storage slot to the slot filter. It returns an error for a
+// duplicate storage slot.
+func (filter SlotFilter) Add(address common.Address, storageHash common.Hash) error {
+	slots, exist := filter[address]
+	if !exist {
+		slots = make(map[common.Hash]struct{})
+		filter[address] = slots
+	}
+	if _, exist := slots[storageHash]; exist {
+		return fmt.Errorf("duplicate entry %v %v", address.Hex(), storageHash.Hex())
+	}
+	slots[storageHash] = struct{}{}
+	return nil
+}
+
+// Apply deletes storage slots of the slot filter from InputAlloc and
+// OutputAlloc of the substate. It returns the number of deleted slots.
+func (filter SlotFilter) Apply(substate *Substate) int {
+	numDeleted := 0
+	for _, alloc := range []SubstateAlloc{substate.InputAlloc, substate.OutputAlloc} {
+		for address, slots := range filter {
+			account, exist := alloc[address]
+			if !exist {
+				continue
+			}
+			for storageHash := range slots {
+				if _, exist := account.Storage[storageHash]; exist {
+					delete(account.Storage, storageHash)
+					numDeleted++
+				}
+			}
+		}
+	}
+	return numDeleted
+}
+
+// slotFilterEntryJSON is a storage slot in a JSON slot filter file.
+type slotFilterEntryJSON struct {
+	Address     string `json:"address"`
+	StorageHash string `json:"storageHash"`
+}
+
+// readSlotFilterJSON reads a JSON array of storage slots.
+func readSlotFilterJSON(r io.Reader) (SlotFilter, error) {
+	var entries []slotFilterEntryJSON
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	filter := make(SlotFilter)
+	for i, e := range entries {
+		address, err := parseFixMapAddress(e.Address)
+		if err != nil {
+			return nil, fmt.Errorf("entry %v: %v", i, err)
+		}
+		storageHash, err := parseFixMapHash(e.StorageHash)
+		if err != nil {
+			return nil, fmt.Errorf("entry %v: %v", i, err)
+		}
+		if err = filter.Add(address, storageHash); err != nil {
+			return nil, fmt.Errorf("entry %v: %v", i, err)
+		}
+	}
+	return filter, nil
+}
+
+// readSlotFilterCSV reads storage slots of address,storageHash lines.
+// An optional header line starting with "address" is skipped.
+func readSlotFilterCSV(r io.Reader) (SlotFilter, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	filter := make(SlotFilter)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && record[0] == "address" {
+			continue
+		}
+
+		address, err := parseFixMapAddress(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		storageHash, err := parseFixMapHash(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		if err = filter.Add(address, storageHash); err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+	}
+	return filter, nil
+}
+
+// LoadSlotFilter loads a slot filter from a JSON file (.json) of
+// {address, storageHash} objects or from a CSV file of address,storageHash
+// lines.
+func LoadSlotFilter(path string) (SlotFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("record-replay: error opening slot filter %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var filter SlotFilter
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		filter, err = readSlotFilterJSON(file)
+	} else {
+		filter, err = readSlotFilterCSV(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("record-replay: error loading slot filter %s: %v", path, err)
+	}
+	return filter, nil
+}
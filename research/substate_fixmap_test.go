@@ -0,0 +1,190 @@
+package research
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	testFixMapAddress = "0x0100000000000000000000000000000000000000"
+	testFixMapHash    = "0x0000000000000000000000000000000000000000000000000000000000000001"
+)
+
+func writeTestFixMap(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("error writing %s: %v", path, err)
+	}
+	return path
+}
+
+func TestLoadFixMap(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"fix.csv", "block,tx,address,storageHash\n10,1," + testFixMapAddress + "," + testFixMapHash + "\n"},
+		{"fix.csv", "10, 1, " + testFixMapAddress + ", " + testFixMapHash + "\n"},
+		{"fix.json", `[{"block": 10, "tx": 1, "address": "` + testFixMapAddress + `", "storageHash": "` + testFixMapHash + `"}]`},
+	}
+	want := FixMapEntry{
+		Block:       10,
+		Tx:          1,
+		Address:     common.HexToAddress(testFixMapAddress),
+		StorageHash: common.HexToHash(testFixMapHash),
+	}
+	for _, tt := range tests {
+		fixMap, err := LoadFixMap(writeTestFixMap(t, tt.name, tt.content))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		entries := fixMap[SubstateKey{Block: 10, Tx: 1}]
+		if len(fixMap) != 1 || len(entries) != 1 || entries[0] != want {
+			t.Fatalf("%s: fix map mismatch: have %v, want %v", tt.name, fixMap, want)
+		}
+	}
+}
+
+func TestLoadFixMapBad(t *testing.T) {
+	tests := []struct {
+		name, content, err string
+	}{
+		{"fix.csv", "10,1," + testFixMapAddress + "\n", "wrong number of fields"},
+		{"fix.csv", "x,1," + testFixMapAddress + "," + testFixMapHash + "\n", "invalid block"},
+		{"fix.csv", "10,-1," + testFixMapAddress + "," + testFixMapHash + "\n", "invalid tx"},
+		{"fix.csv", "10,1,0x01," + testFixMapHash + "\n", "invalid address"},
+		{"fix.csv", "10,1," + testFixMapAddress[2:] + "," + testFixMapHash + "\n", "invalid address"},
+		{"fix.csv", "10,1," + testFixMapAddress + ",0x01\n", "invalid storage hash"},
+		{"fix.csv", "10,1," + testFixMapAddress + ",0x" + strings.Repeat("zz", 32) + "\n", "invalid storage hash"},
+		{"fix.csv", "10,1," + testFixMapAddress + "," + testFixMapHash + "\n10,1," + testFixMapAddress + "," + testFixMapHash + "\n", "line 2: duplicate entry"},
+		{"fix.json", `[{"block": 10, "tx": 1, "address": "0x01", "storageHash": "` + testFixMapHash + `"}]`, "entry 0: invalid address"},
+		{"fix.json", `[{"block": 10, "tx": 1, "address": "` + testFixMapAddress + `", "storageHash": "` + testFixMapHash + `"},` +
+			`{"block": 10, "tx": 1, "address": "` + testFixMapAddress + `", "storageHash": "` + testFixMapHash + `"}]`, "entry 1: duplicate entry"},
+		{"fix.json", `{"block": 10}`, "cannot unmarshal"},
+	}
+	for _, tt := range tests {
+		_, err := LoadFixMap(writeTestFixMap(t, tt.name, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("%q: error mismatch: have %v, want %q", tt.content, err, tt.err)
+		}
+	}
+}
+
+func TestFixMapApply(t *testing.T) {
+	address := common.HexToAddress(testFixMapAddress)
+	slot := common.HexToHash(testFixMapHash)
+	other := common.HexToHash("0x02")
+
+	substate := newTestSubstate(10, address, common.Address{0x02})
+	substate.InputAlloc[address].Storage[slot] = common.Hash{0x01}
+	substate.InputAlloc[address].Storage[other] = common.Hash{0x01}
+	substate.OutputAlloc[address].Storage[slot] = common.Hash{0x02}
+
+	fixMap := make(FixMap)
+	if err := fixMap.Add(FixMapEntry{Block: 10, Tx: 1, Address: address, StorageHash: slot}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := fixMap.Apply(10, 0, substate); n != 0 {
+		t.Fatalf("fix map is applied to another tx: %v", n)
+	}
+	if err := fixMap.Add(FixMapEntry{Block: 10, Tx: 1, Address: address, StorageHash: common.HexToHash("0x03")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := fixMap.Add(FixMapEntry{Block: 10, Tx: 1, Address: common.Address{0xee}, StorageHash: slot}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// only the slot in InputAlloc and OutputAlloc is deleted
+	if n := fixMap.Apply(10, 1, substate); n != 2 {
+		t.Fatalf("deleted slots mismatch: have %v, want 2", n)
+	}
+	if _, exist := substate.InputAlloc[address].Storage[slot]; exist {
+		t.Fatalf("storage slot is not deleted from InputAlloc")
+	}
+	if _, exist := substate.OutputAlloc[address].Storage[slot]; exist {
+		t.Fatalf("storage slot is not deleted from OutputAlloc")
+	}
+	if _, exist := substate.InputAlloc[address].Storage[other]; !exist {
+		t.Fatalf("another storage slot is deleted from InputAlloc")
+	}
+	if n := fixMap.Apply(10, 1, substate); n != 0 {
+		t.Fatalf("deleted slots are counted again: %v", n)
+	}
+}
+
+func TestLoadSlotFilter(t *testing.T) {
+	tests := []struct {
+		name, content, err string
+	}{
+		{"strip.csv", "address,storageHash\n" + testFixMapAddress + "," + testFixMapHash + "\n", ""},
+		{"strip.json", `[{"address": "` + testFixMapAddress + `", "storageHash": "` + testFixMapHash + `"}]`, ""},
+		{"strip.csv", testFixMapAddress + "\n", "wrong number of fields"},
+		{"strip.csv", "0x01," + testFixMapHash + "\n", "line 1: invalid address"},
+		{"strip.csv", testFixMapAddress + ",0x01\n", "line 1: invalid storage hash"},
+		{"strip.csv", testFixMapAddress + "," + testFixMapHash + "\n" + testFixMapAddress + "," + testFixMapHash + "\n", "line 2: duplicate entry"},
+		{"strip.json", `[{"address": "` + testFixMapAddress + `", "storageHash": "0x01"}]`, "entry 0: invalid storage hash"},
+	}
+	for _, tt := range tests {
+		filter, err := LoadSlotFilter(writeTestFixMap(t, tt.name, tt.content))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("%q: error mismatch: have %v, want %q", tt.content, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.content, err)
+		}
+		if _, exist := filter[common.HexToAddress(testFixMapAddress)][common.HexToHash(testFixMapHash)]; !exist || len(filter) != 1 {
+			t.Fatalf("%q: slot filter mismatch: %v", tt.content, filter)
+		}
+	}
+}
+
+func TestSlotFilterApply(t *testing.T) {
+	address := common.HexToAddress(testFixMapAddress)
+	slot := common.HexToHash(testFixMapHash)
+	fixed := common.HexToHash("0x02")
+	other := common.HexToHash("0x03")
+
+	filter := make(SlotFilter)
+	if err := filter.Add(address, slot); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fixMap := make(FixMap)
+	if err := fixMap.Add(FixMapEntry{Block: 5, Tx: 0, Address: address, StorageHash: fixed}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for block := uint64(1); block <= 10; block++ {
+		substate := newTestSubstate(block, address, common.Address{0x02})
+		for _, alloc := range []SubstateAlloc{substate.InputAlloc, substate.OutputAlloc} {
+			alloc[address].Storage[slot] = common.Hash{0x01}
+			alloc[address].Storage[fixed] = common.Hash{0x01}
+			alloc[address].Storage[other] = common.Hash{0x01}
+		}
+
+		// both mechanisms apply in one run
+		fixMap.Apply(block, 0, substate)
+		if n := filter.Apply(substate); n != 2 {
+			t.Fatalf("block %v: number of stripped slots mismatch: have %v, want 2", block, n)
+		}
+
+		for _, alloc := range []SubstateAlloc{substate.InputAlloc, substate.OutputAlloc} {
+			storage := alloc[address].Storage
+			if _, exist := storage[slot]; exist {
+				t.Fatalf("block %v: storage slot is not stripped", block)
+			}
+			if _, exist := storage[fixed]; exist != (block != 5) {
+				t.Fatalf("block %v: fix map is not applied only to block 5", block)
+			}
+			if _, exist := storage[other]; !exist {
+				t.Fatalf("block %v: another storage slot is stripped", block)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package research
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+// GasReportEntry is the number of transactions and the total gas used by
+// them, as recorded in their results.
+type GasReportEntry struct {
+	Txs     uint64 `json:"txs"`
+	GasUsed uint64 `json:"gasUsed"`
+}
+
+// AvgGasUsed returns the average gas used per transaction, or 0 if there is
+// no transaction.
+func (e GasReportEntry) AvgGasUsed() float64 {
+	if e.Txs == 0 {
+		return 0
+	}
+	return float64(e.GasUsed) / float64(e.Txs)
+}
+
+// GasReport aggregates gas used recorded in Substate.Result by ClassifyTx.
+// Substates are not executed, so a report is as fast as reading them.
+type GasReport struct {
+	Transfer GasReportEntry `json:"transfer"`
+	Call     GasReportEntry `json:"call"`
+	Create   GasReportEntry `json:"create"`
+}
+
+// Task is a SubstateTaskFunc adding the recorded gas used of a substate to the
+// report.
+func (r *GasReport) Task(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+	var entry *GasReportEntry
+	switch ClassifyTx(substate) {
+	case TxTypeTransfer:
+		entry = &r.Transfer
+	case TxTypeCall:
+		entry = &r.Call
+	case TxTypeCreate:
+		entry = &r.Create
+	}
+	atomic.AddUint64(&entry.Txs, 1)
+	atomic.AddUint64(&entry.GasUsed, substate.Result.GasUsed)
+	return nil
+}
+
+// Total returns the entry of all transactions.
+func (r *GasReport) Total() GasReportEntry {
+	var total GasReportEntry
+	for _, entry := range []GasReportEntry{r.Transfer, r.Call, r.Create} {
+		total.Txs += entry.Txs
+		total.GasUsed += entry.GasUsed
+	}
+	return total
+}
+
+// rows returns the names and entries of each TxType and the total.
+func (r *GasReport) rows() ([]string, []GasReportEntry) {
+	names := []string{TxTypeTransfer.String(), TxTypeCall.String(), TxTypeCreate.String(), "total"}
+	entries := []GasReportEntry{r.Transfer, r.Call, r.Create, r.Total()}
+	return names, entries
+}
+
+// WriteTable writes the report to w as an aligned table.
+func (r *GasReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 1, 2, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "type\ttxs\tgas used\tavg gas used\t\n")
+	names, entries := r.rows()
+	for i, entry := range entries {
+		fmt.Fprintf(tw, "%s\t%v\t%v\t%.1f\t\n", names[i], entry.Txs, entry.GasUsed, entry.AvgGasUsed())
+	}
+	return tw.Flush()
+}
+
+// GasReportCSVHeader is the header of a CSV gas report.
+const GasReportCSVHeader = "type,txs,gasUsed,avgGasUsed\n"
+
+// WriteCSV writes the report to w in CSV with GasReportCSVHeader.
+func (r *GasReport) WriteCSV(w io.Writer) error {
+	if _, err := io.WriteString(w, GasReportCSVHeader); err != nil {
+		return err
+	}
+	writer := csv.NewWriter(w)
+	names, entries := r.rows()
+	for i, entry := range entries {
+		record := []string{
+			names[i],
+			strconv.FormatUint(entry.Txs, 10),
+			strconv.FormatUint(entry.GasUsed, 10),
+			strconv.FormatFloat(entry.AvgGasUsed(), 'f', 1, 64),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,84 @@
+package research
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestGasReport(t *testing.T) {
+	db := NewMemorySubstateDB()
+	defer db.Close()
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+	put := func(block uint64, tx int, txType TxType, gasUsed uint64) {
+		substate := newTestSubstate(block, sender, recipient)
+		switch txType {
+		case TxTypeCall:
+			substate.InputAlloc[recipient] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+		case TxTypeCreate:
+			substate.Message.To = nil
+		}
+		substate.Result.GasUsed = gasUsed
+		db.PutSubstate(block, tx, substate)
+	}
+	put(1, 0, TxTypeTransfer, 21_000)
+	put(1, 1, TxTypeCall, 50_000)
+	put(2, 0, TxTypeCall, 70_001)
+	put(3, 0, TxTypeTransfer, 21_000)
+	put(3, 1, TxTypeCreate, 100_000)
+	// out of the segment
+	put(4, 0, TxTypeCall, 1_000_000)
+
+	report := &GasReport{}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: report.Task,
+		Config:   &SubstateTaskConfig{Workers: 2, ParallelTxs: 2},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 3)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		entry GasReportEntry
+		want  GasReportEntry
+		avg   float64
+	}{
+		{"transfer", report.Transfer, GasReportEntry{2, 42_000}, 21_000},
+		{"call", report.Call, GasReportEntry{2, 120_001}, 60_000.5},
+		{"create", report.Create, GasReportEntry{1, 100_000}, 100_000},
+		{"total", report.Total(), GasReportEntry{5, 262_001}, 52_400.2},
+	}
+	for _, test := range tests {
+		if test.entry != test.want {
+			t.Fatalf("%s: entry mismatch: have %+v, want %+v", test.name, test.entry, test.want)
+		}
+		if have := test.entry.AvgGasUsed(); have != test.avg {
+			t.Fatalf("%s: average gas used mismatch: have %v, want %v", test.name, have, test.avg)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteCSV(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := GasReportCSVHeader +
+		"transfer,2,42000,21000.0\n" +
+		"call,2,120001,60000.5\n" +
+		"create,1,100000,100000.0\n" +
+		"total,5,262001,52400.2\n"
+	if have := buf.String(); have != want {
+		t.Fatalf("CSV mismatch:\nhave %s\nwant %s", have, want)
+	}
+
+	if avg := (GasReportEntry{}).AvgGasUsed(); avg != 0 {
+		t.Fatalf("average gas used without txs: have %v, want 0", avg)
+	}
+}
@@ -0,0 +1,85 @@
+package research
+
+import (
+	"sort"
+)
+
+// BlockTxCount is the number of substates of a block.
+type BlockTxCount struct {
+	Block uint64
+	Txs   int
+}
+
+// BlockTxCounts returns the numbers of substates of every block from block
+// first to block last, including blocks without substates, using
+// GetSubstateCountForBlock. If last is OpenBlockSegmentLast, blocks after the
+// last stored block are not counted.
+func (db *SubstateDB) BlockTxCounts(first, last uint64) []BlockTxCount {
+	if last == OpenBlockSegmentLast {
+		lastBlock, ok := db.LastBlock()
+		if !ok {
+			return nil
+		}
+		last = lastBlock
+	}
+
+	var counts []BlockTxCount
+	for block := first; block <= last; block++ {
+		counts = append(counts, BlockTxCount{Block: block, Txs: db.GetSubstateCountForBlock(block)})
+		if block == last {
+			// block++ overflows if last is the maximum uint64
+			break
+		}
+	}
+	return counts
+}
+
+// TxCountHistogram is the distribution of the numbers of substates per block.
+type TxCountHistogram struct {
+	// Buckets[i] is the number of blocks with i*BucketSize to
+	// (i+1)*BucketSize-1 substates.
+	BucketSize int
+	Buckets    []uint64
+
+	NumBlocks uint64
+	NumTxs    uint64
+
+	Min, Max int
+	Median   float64
+	Mean     float64
+}
+
+// NewTxCountHistogram returns the histogram of counts with buckets of
+// bucketSize substates. A bucketSize less than 1 is regarded as 1.
+func NewTxCountHistogram(counts []BlockTxCount, bucketSize int) *TxCountHistogram {
+	if bucketSize < 1 {
+		bucketSize = 1
+	}
+	h := &TxCountHistogram{BucketSize: bucketSize}
+	if len(counts) == 0 {
+		return h
+	}
+
+	txs := make([]int, len(counts))
+	for i, count := range counts {
+		txs[i] = count.Txs
+		h.NumTxs += uint64(count.Txs)
+		bucket := count.Txs / bucketSize
+		for len(h.Buckets) <= bucket {
+			h.Buckets = append(h.Buckets, 0)
+		}
+		h.Buckets[bucket]++
+	}
+	sort.Ints(txs)
+
+	n := len(txs)
+	h.NumBlocks = uint64(n)
+	h.Min, h.Max = txs[0], txs[n-1]
+	if n%2 == 1 {
+		h.Median = float64(txs[n/2])
+	} else {
+		h.Median = float64(txs[n/2-1]+txs[n/2]) / 2
+	}
+	h.Mean = float64(h.NumTxs) / float64(n)
+	return h
+}
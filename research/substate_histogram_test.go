@@ -0,0 +1,51 @@
+package research
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTxCountHistogram(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1: {0},
+		2: {0, 1, 2},
+		3: {0, 1, 2, 3, 4},
+		5: {0, 1},
+		6: {0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	})
+	defer db.Close()
+
+	counts := db.BlockTxCounts(1, OpenBlockSegmentLast)
+	wantCounts := []BlockTxCount{{1, 1}, {2, 3}, {3, 5}, {4, 0}, {5, 2}, {6, 12}}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Fatalf("block tx counts mismatch: have %v, want %v", counts, wantCounts)
+	}
+
+	tests := []struct {
+		bucketSize int
+		buckets    []uint64
+	}{
+		{bucketSize: 1, buckets: []uint64{1, 1, 1, 1, 0, 1, 0, 0, 0, 0, 0, 0, 1}},
+		{bucketSize: 5, buckets: []uint64{4, 1, 1}},
+		{bucketSize: 100, buckets: []uint64{6}},
+	}
+	for _, test := range tests {
+		h := NewTxCountHistogram(counts, test.bucketSize)
+		if !reflect.DeepEqual(h.Buckets, test.buckets) {
+			t.Fatalf("bucket size %v: buckets mismatch: have %v, want %v", test.bucketSize, h.Buckets, test.buckets)
+		}
+		if h.NumBlocks != 6 || h.NumTxs != 23 || h.Min != 0 || h.Max != 12 || h.Median != 2.5 {
+			t.Fatalf("bucket size %v: stats mismatch: have %+v", test.bucketSize, h)
+		}
+		if want := 23.0 / 6; h.Mean != want {
+			t.Fatalf("bucket size %v: mean mismatch: have %v, want %v", test.bucketSize, h.Mean, want)
+		}
+	}
+
+	// a closed segment also counts trailing blocks without substates
+	counts = db.BlockTxCounts(5, 8)
+	wantCounts = []BlockTxCount{{5, 2}, {6, 12}, {7, 0}, {8, 0}}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Fatalf("block tx counts mismatch: have %v, want %v", counts, wantCounts)
+	}
+}
@@ -0,0 +1,306 @@
+package research
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Paths of a substate DB served over HTTP, relative to the base URL:
+//
+//	GET first                  first block, 404 if there is no substate
+//	GET last                   last block, 404 if there is no substate
+//	GET substate/<block>/<tx>  stored substate value, 404 if missing
+//	GET block/<block>          RLP list of substateHTTPEntry of the block
+//	GET code/<codeHash>        bytecode, 404 if missing
+//
+// Substate values are stored ones, in any encoding, with bytecode
+// referenced by code hash.
+const (
+	substateHTTPFirstPath    = "first"
+	substateHTTPLastPath     = "last"
+	substateHTTPSubstatePath = "substate/"
+	substateHTTPBlockPath    = "block/"
+	substateHTTPCodePath     = "code/"
+)
+
+// substateHTTPEntry is a stored substate value of a block served over HTTP.
+type substateHTTPEntry struct {
+	Tx    uint64
+	Value []byte
+}
+
+// NewSubstateHTTPHandler returns an http.Handler serving substates of db to
+// HTTPSubstateReader.
+func NewSubstateHTTPHandler(db *SubstateDB) http.Handler {
+	return &substateHTTPHandler{db: db}
+}
+
+type substateHTTPHandler struct {
+	db *SubstateDB
+}
+
+func (h *substateHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+
+	switch {
+	case path == substateHTTPFirstPath || path == substateHTTPLastPath:
+		getBlock := h.db.FirstBlock
+		if path == substateHTTPLastPath {
+			getBlock = h.db.LastBlock
+		}
+		block, ok := getBlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, strconv.FormatUint(block, 10))
+
+	case strings.HasPrefix(path, substateHTTPSubstatePath):
+		var block uint64
+		var tx int
+		if _, err := fmt.Sscanf(strings.TrimPrefix(path, substateHTTPSubstatePath), "%d/%d", &block, &tx); err != nil || tx < 0 {
+			http.Error(w, "invalid substate path", http.StatusBadRequest)
+			return
+		}
+		value, err := h.db.backend.Get(EncodeSubstateKey(block, tx))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(value)
+
+	case strings.HasPrefix(path, substateHTTPBlockPath):
+		block, err := strconv.ParseUint(strings.TrimPrefix(path, substateHTTPBlockPath), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid block path", http.StatusBadRequest)
+			return
+		}
+		entries := []substateHTTPEntry{}
+		iter := h.db.backend.NewIterator(Stage1SubstateBlockPrefix(block), nil)
+		for iter.Next() {
+			_, tx, err := DecodeSubstateKey(iter.Key())
+			if err != nil {
+				iter.Release()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			value := common.CopyBytes(iter.Value())
+			entries = append(entries, substateHTTPEntry{Tx: uint64(tx), Value: value})
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, err := rlp.EncodeToBytes(entries)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+
+	case strings.HasPrefix(path, substateHTTPCodePath):
+		codeHash := common.HexToHash(strings.TrimPrefix(path, substateHTTPCodePath))
+		if !h.db.HasCode(codeHash) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(h.db.GetCode(codeHash))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// HTTPSubstateReader is a SubstateReader fetching substates from a substate
+// DB served by NewSubstateHTTPHandler. Bytecode is fetched once and cached.
+// HTTPSubstateReader is safe for concurrent use.
+type HTTPSubstateReader struct {
+	baseURL string
+	client  *http.Client
+
+	mu    sync.Mutex
+	codes map[common.Hash][]byte
+}
+
+// NewHTTPSubstateReader returns an HTTPSubstateReader fetching substates from
+// baseURL with client, or with http.DefaultClient if client is nil.
+func NewHTTPSubstateReader(baseURL string, client *http.Client) (*HTTPSubstateReader, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("record-replay: invalid substate DB URL %s: %v", baseURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("record-replay: invalid substate DB URL %s: scheme must be http or https", baseURL)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPSubstateReader{
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/",
+		client:  client,
+
+		codes: make(map[common.Hash][]byte),
+	}, nil
+}
+
+// get fetches path relative to the base URL. It returns false if path is not
+// found.
+func (r *HTTPSubstateReader) get(path string) ([]byte, bool, error) {
+	resp, err := r.client.Get(r.baseURL + path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, false, err
+		}
+		return b, true, nil
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+}
+
+func (r *HTTPSubstateReader) GetCode(codeHash common.Hash) []byte {
+	if codeHash == EmptyCodeHash {
+		return nil
+	}
+
+	r.mu.Lock()
+	code, exist := r.codes[codeHash]
+	r.mu.Unlock()
+	if exist {
+		return code
+	}
+
+	code, ok, err := r.get(substateHTTPCodePath + codeHash.Hex())
+	if err == nil && !ok {
+		err = fmt.Errorf("not found")
+	}
+	if err != nil {
+		panic(fmt.Errorf("record-replay: error getting code %s: %v", codeHash.Hex(), err))
+	}
+
+	r.mu.Lock()
+	r.codes[codeHash] = code
+	r.mu.Unlock()
+	return code
+}
+
+func (r *HTTPSubstateReader) decodeSubstate(value []byte) (*Substate, error) {
+	substateRLP, _, err := decodeSubstateRLP(value)
+	if err != nil {
+		return nil, err
+	}
+
+	substate := Substate{}
+	substate.SetRLP(substateRLP, r)
+
+	return &substate, nil
+}
+
+func (r *HTTPSubstateReader) HasSubstate(block uint64, tx int) bool {
+	_, ok, err := r.get(fmt.Sprintf("%s%v/%v", substateHTTPSubstatePath, block, tx))
+	if err != nil {
+		panic(fmt.Errorf("record-replay: error checking substate %v_%v in substate DB: %v", block, tx, err))
+	}
+	return ok
+}
+
+func (r *HTTPSubstateReader) GetSubstate(block uint64, tx int) *Substate {
+	value, ok, err := r.get(fmt.Sprintf("%s%v/%v", substateHTTPSubstatePath, block, tx))
+	if err == nil && !ok {
+		err = fmt.Errorf("not found")
+	}
+	if err != nil {
+		panic(fmt.Errorf("record-replay: error getting substate %v_%v from substate DB: %v", block, tx, err))
+	}
+
+	substate, err := r.decodeSubstate(value)
+	if err != nil {
+		panic(fmt.Errorf("error decoding substateRLP %v_%v: %v", block, tx, err))
+	}
+
+	return substate
+}
+
+func (r *HTTPSubstateReader) GetBlockSubstates(block uint64) BlockSubstates {
+	txSubstate, decodeErrs := r.GetBlockSubstatesTolerant(block)
+	if len(decodeErrs) > 0 {
+		panic(decodeErrs[0])
+	}
+	return txSubstate
+}
+
+func (r *HTTPSubstateReader) GetBlockSubstatesTolerant(block uint64) (BlockSubstates, []*SubstateDecodeError) {
+	b, ok, err := r.get(fmt.Sprintf("%s%v", substateHTTPBlockPath, block))
+	if err == nil && !ok {
+		err = fmt.Errorf("not found")
+	}
+	var entries []substateHTTPEntry
+	if err == nil {
+		err = rlp.DecodeBytes(b, &entries)
+	}
+	if err != nil {
+		panic(fmt.Errorf("record-replay: error getting substates of block %v from substate DB: %v", block, err))
+	}
+
+	var decodeErrs []*SubstateDecodeError
+	txSubstate := make(BlockSubstates)
+	for _, entry := range entries {
+		tx := int(entry.Tx)
+		substate, err := r.decodeSubstate(entry.Value)
+		if err != nil {
+			decodeErrs = append(decodeErrs, &SubstateDecodeError{Key: SubstateKey{Block: block, Tx: tx}, Err: err})
+			continue
+		}
+		txSubstate[tx] = substate
+	}
+
+	return txSubstate, decodeErrs
+}
+
+func (r *HTTPSubstateReader) getBlock(path string) (uint64, bool) {
+	b, ok, err := r.get(path)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: error getting %s block of substate DB: %v", path, err))
+	}
+	if !ok {
+		return 0, false
+	}
+	block, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		panic(fmt.Errorf("record-replay: invalid %s block of substate DB: %v", path, err))
+	}
+	return block, true
+}
+
+// FirstBlock returns the first block with substates, or false if the substate
+// DB is empty.
+func (r *HTTPSubstateReader) FirstBlock() (uint64, bool) {
+	return r.getBlock(substateHTTPFirstPath)
+}
+
+// LastBlock returns the last block with substates, or false if the substate
+// DB is empty.
+func (r *HTTPSubstateReader) LastBlock() (uint64, bool) {
+	return r.getBlock(substateHTTPLastPath)
+}
@@ -0,0 +1,131 @@
+package research
+
+import (
+	"math/big"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func newTestHTTPSubstateReader(t *testing.T, db *SubstateDB) *HTTPSubstateReader {
+	server := httptest.NewServer(NewSubstateHTTPHandler(db))
+	t.Cleanup(server.Close)
+
+	reader, err := NewHTTPSubstateReader(server.URL, server.Client())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return reader
+}
+
+func TestHTTPSubstateReader(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		3: {0, 2},
+		7: {1},
+	})
+	defer db.Close()
+	// a substate with bytecode referenced by code hash
+	contract := common.Address{0xc0}
+	substate := db.GetSubstate(7, 1)
+	substate.InputAlloc[contract] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+	substate.OutputAlloc[contract] = substate.InputAlloc[contract].Copy()
+	db.PutSubstate(7, 1, substate)
+
+	reader := newTestHTTPSubstateReader(t, db)
+
+	if first, ok := reader.FirstBlock(); !ok || first != 3 {
+		t.Fatalf("first block mismatch: have %v (%v), want 3", first, ok)
+	}
+	if last, ok := reader.LastBlock(); !ok || last != 7 {
+		t.Fatalf("last block mismatch: have %v (%v), want 7", last, ok)
+	}
+
+	tests := []struct {
+		block uint64
+		tx    int
+		has   bool
+	}{
+		{3, 0, true},
+		{3, 1, false},
+		{3, 2, true},
+		{7, 1, true},
+		{8, 0, false},
+	}
+	for _, tt := range tests {
+		if have := reader.HasSubstate(tt.block, tt.tx); have != tt.has {
+			t.Fatalf("%v_%v: HasSubstate mismatch: have %v, want %v", tt.block, tt.tx, have, tt.has)
+		}
+		if tt.has && !reader.GetSubstate(tt.block, tt.tx).Equal(db.GetSubstate(tt.block, tt.tx)) {
+			t.Fatalf("%v_%v: substate mismatch", tt.block, tt.tx)
+		}
+	}
+
+	for _, block := range []uint64{3, 5, 7} {
+		have, want := reader.GetBlockSubstates(block), db.GetBlockSubstates(block)
+		if len(have) != len(want) {
+			t.Fatalf("block %v: number of substates mismatch: have %v, want %v", block, len(have), len(want))
+		}
+		for tx, substate := range want {
+			if have[tx] == nil || !have[tx].Equal(substate) {
+				t.Fatalf("block %v: substate %v_%v mismatch", block, block, tx)
+			}
+		}
+	}
+
+	// an empty substate DB
+	empty := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer empty.Close()
+	emptyReader := newTestHTTPSubstateReader(t, empty)
+	if _, ok := emptyReader.FirstBlock(); ok {
+		t.Fatalf("first block of empty substate DB is found")
+	}
+	if _, ok := emptyReader.LastBlock(); ok {
+		t.Fatalf("last block of empty substate DB is found")
+	}
+}
+
+func TestHTTPSubstateReaderTaskPool(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1: {0, 1},
+		2: {0},
+		4: {0, 1, 2},
+	})
+	defer db.Close()
+
+	var mu sync.Mutex
+	visited := make(map[SubstateKey]bool)
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			if !substate.Equal(db.GetSubstate(block, tx)) {
+				t.Errorf("%v_%v: substate mismatch", block, tx)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			visited[SubstateKey{block, tx}] = true
+			return nil
+		},
+		Config: &SubstateTaskConfig{Workers: 2},
+
+		DB: newTestHTTPSubstateReader(t, db),
+
+		Quiet: true,
+	}
+	if err := pool.ExecuteAll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(visited) != 6 {
+		t.Fatalf("number of visited substates mismatch: have %v, want 6", len(visited))
+	}
+}
+
+func TestNewHTTPSubstateReaderInvalidURL(t *testing.T) {
+	for _, baseURL := range []string{"", "substate.ethereum", "ftp://example.com/substates", "http://[::1"} {
+		if _, err := NewHTTPSubstateReader(baseURL, nil); err == nil {
+			t.Fatalf("%q: invalid URL is accepted", baseURL)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package research
 
 import (
 	"encoding/json"
+	"fmt"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -11,6 +12,24 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 )
 
+// DecimalBig is a big.Int marshaled to JSON as a decimal string, and a nil
+// *DecimalBig is marshaled to null. Both decimal and 0x-prefixed hex strings
+// are unmarshaled, so JSON written with math.HexOrDecimal256 is still read.
+type DecimalBig big.Int
+
+func (b *DecimalBig) MarshalText() ([]byte, error) {
+	return []byte((*big.Int)(b).String()), nil
+}
+
+func (b *DecimalBig) UnmarshalText(input []byte) error {
+	value, ok := math.ParseBig256(string(input))
+	if !ok {
+		return fmt.Errorf("invalid decimal or hex big integer %q", input)
+	}
+	*b = DecimalBig(*value)
+	return nil
+}
+
 // SubstateAccountJSON is modification of core.GenesisAccount
 type SubstateAccountJSON struct {
 	Code    hexutil.Bytes               `json:"code,omitempty"`
@@ -105,20 +124,22 @@ func (alloc *SubstateAlloc) UnmarshalJSON(b []byte) error {
 // SubstateEnvJSON is modification of t8ntool.stEnv
 type SubstateEnvJSON struct {
 	Coinbase    common.Address                      `json:"coinbase" gencodec:"required"`
-	Difficulty  *math.HexOrDecimal256               `json:"difficulty" gencodec:"required"`
+	Difficulty  *DecimalBig                         `json:"difficulty" gencodec:"required"`
 	GasLimit    math.HexOrDecimal64                 `json:"gasLimit" gencodec:"required"`
 	Number      math.HexOrDecimal64                 `json:"number" gencodec:"required"`
 	Timestamp   math.HexOrDecimal64                 `json:"timestamp" gencodec:"required"`
 	BlockHashes map[math.HexOrDecimal64]common.Hash `json:"blockHashes,omitempty"`
 
-	BaseFee *math.HexOrDecimal256 `json:"baseFee,omitempty"`
+	BaseFee *DecimalBig `json:"baseFee"`
+
+	Random *common.Hash `json:"random,omitempty"`
 }
 
 func NewSubstateEnvJSON(env *SubstateEnv) *SubstateEnvJSON {
 	var envJSON SubstateEnvJSON
 
 	envJSON.Coinbase = env.Coinbase
-	envJSON.Difficulty = (*math.HexOrDecimal256)(env.Difficulty)
+	envJSON.Difficulty = (*DecimalBig)(env.Difficulty)
 	envJSON.GasLimit = math.HexOrDecimal64(env.GasLimit)
 	envJSON.Number = math.HexOrDecimal64(env.Number)
 	envJSON.Timestamp = math.HexOrDecimal64(env.Timestamp)
@@ -129,7 +150,9 @@ func NewSubstateEnvJSON(env *SubstateEnv) *SubstateEnvJSON {
 		}
 	}
 
-	envJSON.BaseFee = (*math.HexOrDecimal256)(env.BaseFee)
+	envJSON.BaseFee = (*DecimalBig)(env.BaseFee)
+
+	envJSON.Random = env.Random
 
 	return &envJSON
 }
@@ -148,9 +171,11 @@ func (env *SubstateEnv) SetJSON(envJSON *SubstateEnvJSON) {
 	}
 
 	env.BaseFee = (*big.Int)(envJSON.BaseFee)
-	if env.BaseFee.Cmp(big.NewInt(0)) == 0 {
+	if env.BaseFee != nil && env.BaseFee.Sign() == 0 {
 		env.BaseFee = nil
 	}
+
+	env.Random = envJSON.Random
 }
 
 func (env SubstateEnv) MarshalJSON() ([]byte, error) {
@@ -173,20 +198,20 @@ func (env *SubstateEnv) UnmarshalJSON(b []byte) error {
 
 // SubstateMessageJSON is modification of types.msgdata
 type SubstateMessageJSON struct {
-	Nonce      math.HexOrDecimal64   `json:"nonce" gencodec:"required"`
-	CheckNonce bool                  `json:"checkNonce" gencodec:"required"`
-	GasPrice   *math.HexOrDecimal256 `json:"gasPrice" gencodec:"required"`
-	Gas        math.HexOrDecimal64   `json:"gas" gencodec:"required"`
+	Nonce      math.HexOrDecimal64 `json:"nonce" gencodec:"required"`
+	CheckNonce bool                `json:"checkNonce" gencodec:"required"`
+	GasPrice   *DecimalBig         `json:"gasPrice" gencodec:"required"`
+	Gas        math.HexOrDecimal64 `json:"gas" gencodec:"required"`
 
-	From  common.Address        `json:"from"`
-	To    *common.Address       `json:"to"` // nil means contract creation
-	Value *math.HexOrDecimal256 `json:"value" gencodec:"required"`
-	Data  hexutil.Bytes         `json:"input" gencodec:"required"`
+	From  common.Address  `json:"from"`
+	To    *common.Address `json:"to"` // nil means contract creation
+	Value *DecimalBig     `json:"value" gencodec:"required"`
+	Data  hexutil.Bytes   `json:"input" gencodec:"required"`
 
 	AccessList types.AccessList `json:"accessList,omitempty"`
 
-	GasFeeCap *math.HexOrDecimal256 `json:"gasFeeCap,omitempty"`
-	GasTipCap *math.HexOrDecimal256 `json:"gasTipCap,omitempty"`
+	GasFeeCap *DecimalBig `json:"gasFeeCap"`
+	GasTipCap *DecimalBig `json:"gasTipCap"`
 }
 
 func NewSubstateMessageJSON(msg *SubstateMessage) *SubstateMessageJSON {
@@ -194,18 +219,18 @@ func NewSubstateMessageJSON(msg *SubstateMessage) *SubstateMessageJSON {
 
 	msgJSON.Nonce = math.HexOrDecimal64(msg.Nonce)
 	msgJSON.CheckNonce = msg.CheckNonce
-	msgJSON.GasPrice = (*math.HexOrDecimal256)(msg.GasPrice)
+	msgJSON.GasPrice = (*DecimalBig)(msg.GasPrice)
 	msgJSON.Gas = math.HexOrDecimal64(msg.Gas)
 
 	msgJSON.From = msg.From
 	msgJSON.To = msg.To
-	msgJSON.Value = (*math.HexOrDecimal256)(msg.Value)
+	msgJSON.Value = (*DecimalBig)(msg.Value)
 	msgJSON.Data = hexutil.Bytes(msg.Data)
 
 	msgJSON.AccessList = msg.AccessList
 
-	msgJSON.GasFeeCap = (*math.HexOrDecimal256)(msg.GasFeeCap)
-	msgJSON.GasTipCap = (*math.HexOrDecimal256)(msg.GasTipCap)
+	msgJSON.GasFeeCap = (*DecimalBig)(msg.GasFeeCap)
+	msgJSON.GasTipCap = (*DecimalBig)(msg.GasTipCap)
 
 	return &msgJSON
 }
@@ -224,11 +249,11 @@ func (msg *SubstateMessage) SetJSON(msgJSON *SubstateMessageJSON) {
 	msg.AccessList = msgJSON.AccessList
 
 	msg.GasFeeCap = (*big.Int)(msgJSON.GasFeeCap)
-	if msg.GasFeeCap.Cmp(big.NewInt(0)) == 0 {
+	if msg.GasFeeCap == nil || msg.GasFeeCap.Sign() == 0 {
 		msg.GasFeeCap = msg.GasPrice
 	}
 	msg.GasTipCap = (*big.Int)(msgJSON.GasTipCap)
-	if msg.GasTipCap.Cmp(big.NewInt(0)) == 0 {
+	if msg.GasTipCap == nil || msg.GasTipCap.Sign() == 0 {
 		msg.GasTipCap = msg.GasPrice
 	}
 }
@@ -321,6 +346,15 @@ func NewSubstateJSON(substate *Substate) *SubstateJSON {
 }
 
 func (substate *Substate) SetJSON(substateJSON *SubstateJSON) {
+	if substate.Env == nil {
+		substate.Env = new(SubstateEnv)
+	}
+	if substate.Message == nil {
+		substate.Message = new(SubstateMessage)
+	}
+	if substate.Result == nil {
+		substate.Result = new(SubstateResult)
+	}
 	substate.InputAlloc.SetJSON(substateJSON.InputAlloc)
 	substate.OutputAlloc.SetJSON(substateJSON.OutputAlloc)
 	substate.Env.SetJSON(substateJSON.Env)
@@ -0,0 +1,117 @@
+package research
+
+import (
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestDecimalBigJSON(t *testing.T) {
+	large, _ := new(big.Int).SetString("18446744073709551617", 10) // 2^64+1
+	tests := []struct {
+		value *big.Int
+		json  string
+	}{
+		{value: nil, json: `null`},
+		{value: big.NewInt(0), json: `"0"`},
+		{value: big.NewInt(1_000), json: `"1000"`},
+		{value: large, json: `"18446744073709551617"`},
+	}
+	for _, test := range tests {
+		b, err := json.Marshal((*DecimalBig)(test.value))
+		if err != nil {
+			t.Fatalf("%v: marshal error: %v", test.value, err)
+		}
+		if string(b) != test.json {
+			t.Fatalf("%v: json mismatch: have %s, want %s", test.value, b, test.json)
+		}
+
+		var decoded *DecimalBig
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatalf("%v: unmarshal error: %v", test.value, err)
+		}
+		if (decoded == nil) != (test.value == nil) || (decoded != nil && (*big.Int)(decoded).Cmp(test.value) != 0) {
+			t.Fatalf("%v: round trip mismatch: have %v", test.value, (*big.Int)(decoded))
+		}
+	}
+
+	// hex of math.HexOrDecimal256 is still accepted
+	var decoded DecimalBig
+	if err := json.Unmarshal([]byte(`"0x10000000000000001"`), &decoded); err != nil {
+		t.Fatalf("unmarshal hex error: %v", err)
+	}
+	if (*big.Int)(&decoded).Cmp(large) != 0 {
+		t.Fatalf("hex mismatch: have %v, want %v", (*big.Int)(&decoded), large)
+	}
+	if err := json.Unmarshal([]byte(`"1e3"`), &decoded); err == nil {
+		t.Fatalf("invalid integer is unmarshaled")
+	}
+}
+
+func TestSubstateEnvMessageJSON(t *testing.T) {
+	large, _ := new(big.Int).SetString("340282366920938463463374607431768211456", 10) // 2^128
+	tests := []struct {
+		name  string
+		value *big.Int
+	}{
+		{name: "nil", value: nil},
+		{name: "zero", value: big.NewInt(0)},
+		{name: "large", value: large},
+	}
+	for _, test := range tests {
+		env := &SubstateEnv{
+			Coinbase:    common.Address{0xcb},
+			Difficulty:  test.value,
+			BaseFee:     large,
+			BlockHashes: map[uint64]common.Hash{},
+		}
+		b, err := json.Marshal(env)
+		if err != nil {
+			t.Fatalf("%s: marshal env error: %v", test.name, err)
+		}
+		var decodedEnv SubstateEnv
+		if err := json.Unmarshal(b, &decodedEnv); err != nil {
+			t.Fatalf("%s: unmarshal env error: %v", test.name, err)
+		}
+		if !env.Equal(&decodedEnv) {
+			t.Fatalf("%s: env round trip mismatch: json %s", test.name, b)
+		}
+
+		to := common.Address{0x02}
+		msg := &SubstateMessage{
+			GasPrice:  big.NewInt(1),
+			From:      common.Address{0x01},
+			To:        &to,
+			Value:     test.value,
+			Data:      []byte{},
+			GasFeeCap: large,
+			GasTipCap: big.NewInt(1),
+		}
+		b, err = json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("%s: marshal message error: %v", test.name, err)
+		}
+		if test.value == nil && !strings.Contains(string(b), `"value":null`) {
+			t.Fatalf("%s: nil value is not null: json %s", test.name, b)
+		}
+		var decodedMsg SubstateMessage
+		if err := json.Unmarshal(b, &decodedMsg); err != nil {
+			t.Fatalf("%s: unmarshal message error: %v", test.name, err)
+		}
+		if !msg.Equal(&decodedMsg) {
+			t.Fatalf("%s: message round trip mismatch: json %s", test.name, b)
+		}
+	}
+
+	// a nil base fee is written as null rather than omitted
+	b, err := json.Marshal(&SubstateEnv{Difficulty: big.NewInt(1)})
+	if err != nil {
+		t.Fatalf("marshal env error: %v", err)
+	}
+	if !strings.Contains(string(b), `"baseFee":null`) {
+		t.Fatalf("nil base fee is not null: json %s", b)
+	}
+}
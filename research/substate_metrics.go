@@ -0,0 +1,107 @@
+package research
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/metrics/prometheus"
+	cli "github.com/urfave/cli/v2"
+)
+
+var MetricsAddrFlag = &cli.StringFlag{
+	Name:  "metrics-addr",
+	Usage: "Listening address of Prometheus /metrics endpoint, e.g., 127.0.0.1:6060. Disabled if empty",
+}
+
+// SubstateTaskMetrics has throughput metrics of a task pool registered in a
+// metrics registry.
+type SubstateTaskMetrics struct {
+	Registry metrics.Registry
+
+	NumBlock metrics.Counter
+	NumTx    metrics.Counter
+	NumError metrics.Counter
+
+	BlkPerSec metrics.GaugeFloat64
+	TxPerSec  metrics.GaugeFloat64
+}
+
+// NewSubstateTaskMetrics registers task pool metrics in the registry. The
+// metrics are updated even if metrics collection of geth is disabled.
+func NewSubstateTaskMetrics(registry metrics.Registry) *SubstateTaskMetrics {
+	blkPerSec := &metrics.StandardGaugeFloat64{}
+	txPerSec := &metrics.StandardGaugeFloat64{}
+	registry.Register("substate/task/blkpersec", blkPerSec)
+	registry.Register("substate/task/txpersec", txPerSec)
+
+	return &SubstateTaskMetrics{
+		Registry: registry,
+
+		NumBlock: metrics.NewRegisteredCounterForced("substate/task/blocks", registry),
+		NumTx:    metrics.NewRegisteredCounterForced("substate/task/txs", registry),
+		NumError: metrics.NewRegisteredCounterForced("substate/task/errors", registry),
+
+		BlkPerSec: blkPerSec,
+		TxPerSec:  txPerSec,
+	}
+}
+
+// NewSubstateTaskMetricsCli returns metrics served at --metrics-addr, or nil
+// if --metrics-addr is not set.
+func NewSubstateTaskMetricsCli(name string, ctx *cli.Context) (*SubstateTaskMetrics, error) {
+	addr := ctx.String(MetricsAddrFlag.Name)
+	if addr == "" {
+		return nil, nil
+	}
+
+	m := NewSubstateTaskMetrics(metrics.NewRegistry())
+	server, err := StartMetricsServer(addr, m.Registry)
+	if err != nil {
+		return nil, fmt.Errorf("error starting metrics server at %s: %v", addr, err)
+	}
+	fmt.Printf("%s: metrics at http://%s/metrics\n", name, server.Addr)
+
+	return m, nil
+}
+
+// addBlock counts an executed block. It does nothing if m is nil.
+func (m *SubstateTaskMetrics) addBlock(numTx int64, err error) {
+	if m == nil {
+		return
+	}
+	m.NumBlock.Inc(1)
+	m.NumTx.Inc(numTx)
+	if err != nil {
+		m.NumError.Inc(1)
+	}
+}
+
+// updateRate updates the current throughput. It does nothing if m is nil.
+func (m *SubstateTaskMetrics) updateRate(progress SegmentStats) {
+	if m == nil {
+		return
+	}
+	m.BlkPerSec.Update(progress.BlkPerSec)
+	m.TxPerSec.Update(progress.TxPerSec)
+}
+
+// StartMetricsServer serves metrics of the registry at /metrics of addr in
+// Prometheus format. Addr of the returned server is the listening address.
+func StartMetricsServer(addr string, registry metrics.Registry) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler(registry))
+	server := &http.Server{
+		Addr:    listener.Addr().String(),
+		Handler: mux,
+	}
+	go server.Serve(listener)
+
+	return server, nil
+}
@@ -0,0 +1,79 @@
+package research
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+func TestSubstateTaskMetrics(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		2: {0, 1},
+		4: {0},
+	})
+	defer db.Close()
+
+	fail := false
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		if fail && block == 4 {
+			return errors.New("task error")
+		}
+		return nil
+	}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 2},
+
+		DB: db,
+
+		Quiet:   true,
+		Metrics: NewSubstateTaskMetrics(metrics.NewRegistry()),
+	}
+
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 5)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := pool.Metrics
+	if m.NumBlock.Count() != 5 || m.NumTx.Count() != 3 || m.NumError.Count() != 0 {
+		t.Fatalf("metrics mismatch: have %v blocks %v txs %v errors, want 5 blocks 3 txs 0 errors", m.NumBlock.Count(), m.NumTx.Count(), m.NumError.Count())
+	}
+
+	fail = true
+	if err := pool.ExecuteSegment(NewBlockSegment(4, 4)); err == nil {
+		t.Fatalf("task error is not returned")
+	}
+	if m.NumBlock.Count() != 6 || m.NumError.Count() != 1 {
+		t.Fatalf("metrics mismatch after error: have %v blocks %v errors, want 6 blocks 1 error", m.NumBlock.Count(), m.NumError.Count())
+	}
+
+	m.updateRate(SegmentStats{BlkPerSec: 2.5, TxPerSec: 10})
+	if m.BlkPerSec.Value() != 2.5 || m.TxPerSec.Value() != 10 {
+		t.Fatalf("throughput mismatch: have %v blk/s, %v tx/s, want 2.5 blk/s, 10 tx/s", m.BlkPerSec.Value(), m.TxPerSec.Value())
+	}
+
+	server, err := StartMetricsServer("127.0.0.1:0", m.Registry)
+	if err != nil {
+		t.Fatalf("error starting metrics server: %v", err)
+	}
+	defer server.Close()
+
+	resp, err := http.Get("http://" + server.Addr + "/metrics")
+	if err != nil {
+		t.Fatalf("error getting metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading metrics: %v", err)
+	}
+	for _, want := range []string{"substate_task_blocks 6", "substate_task_txs 3", "substate_task_errors 1", "substate_task_txpersec 10"} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
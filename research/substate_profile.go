@@ -0,0 +1,74 @@
+package research
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+var ProfileFlag = &cli.PathFlag{
+	Name:  "profile",
+	Usage: "Write a pprof CPU profile of the run to the given file. Disabled if empty",
+}
+
+var MemProfileFlag = &cli.PathFlag{
+	Name:  "memprofile",
+	Usage: "Write a pprof heap profile at the end of the run to the given file. Disabled if empty",
+}
+
+// StartProfiles starts a CPU profile written to cpuPath. The returned stop
+// function stops the CPU profile and writes a heap profile to memPath. Empty
+// paths disable the profiles.
+func StartProfiles(cpuPath, memPath string) (stop func() error, err error) {
+	var cpuFile *os.File
+	if cpuPath != "" {
+		cpuFile, err = os.Create(cpuPath)
+		if err != nil {
+			return nil, fmt.Errorf("record-replay: error creating CPU profile: %v", err)
+		}
+		if err = pprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			return nil, fmt.Errorf("record-replay: error starting CPU profile: %v", err)
+		}
+	}
+
+	stop = func() error {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			if err := cpuFile.Close(); err != nil {
+				return fmt.Errorf("record-replay: error writing CPU profile: %v", err)
+			}
+		}
+		if memPath != "" {
+			memFile, err := os.Create(memPath)
+			if err != nil {
+				return fmt.Errorf("record-replay: error creating heap profile: %v", err)
+			}
+			defer memFile.Close()
+			// up-to-date statistics of allocations
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(memFile); err != nil {
+				return fmt.Errorf("record-replay: error writing heap profile: %v", err)
+			}
+		}
+		return nil
+	}
+	return stop, nil
+}
+
+// StartProfilesCli starts profiles of --profile and --memprofile. The
+// returned stop function prints errors of writing the profiles.
+func StartProfilesCli(name string, ctx *cli.Context) (stop func(), err error) {
+	stopProfiles, err := StartProfiles(ctx.Path(ProfileFlag.Name), ctx.Path(MemProfileFlag.Name))
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := stopProfiles(); err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+		}
+	}, nil
+}
@@ -0,0 +1,55 @@
+package research
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStartProfiles(t *testing.T) {
+	dir := t.TempDir()
+	cpuPath := filepath.Join(dir, "cpu.pprof")
+	memPath := filepath.Join(dir, "mem.pprof")
+
+	stop, err := StartProfiles(cpuPath, memPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db := newTestSubstateDB(map[uint64][]int{1: {0, 1}, 2: {0}})
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		db.GetBlockSubstates(1)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("unexpected error stopping profiles: %v", err)
+	}
+
+	// pprof profiles are gzipped protocol buffers
+	for _, path := range []string{cpuPath, memPath} {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			t.Fatalf("%s: not a gzipped profile: %v", path, err)
+		}
+		b, err := io.ReadAll(zr)
+		f.Close()
+		if err != nil || len(b) == 0 {
+			t.Fatalf("%s: empty or broken profile: %v bytes, %v", path, len(b), err)
+		}
+	}
+
+	// disabled profiles write nothing
+	stop, err = StartProfiles("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("unexpected error stopping disabled profiles: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package research
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// ReceiptSummary is the fields of a canonical receipt compared with a
+// replayed SubstateResult by CompareReceipt.
+type ReceiptSummary struct {
+	// Status is nil for receipts before Byzantium, which have a state root
+	// instead of a status.
+	Status  *uint64
+	GasUsed uint64
+	NumLogs int
+}
+
+// ReceiptFetcher fetches the canonical receipt of the transaction at index tx
+// of block, e.g. from an archive node with RPCReceiptFetcher.
+type ReceiptFetcher interface {
+	FetchReceipt(block uint64, tx int) (*ReceiptSummary, error)
+}
+
+// CompareReceipt returns descriptions of the fields of result differing from
+// receipt, e.g. "gas used 21000 -> 21100", or nil if they are consistent.
+// The status is only compared if the receipt has one.
+func CompareReceipt(receipt *ReceiptSummary, result *SubstateResult) []string {
+	var diffs []string
+	if receipt.Status != nil && *receipt.Status != result.Status {
+		diffs = append(diffs, fmt.Sprintf("status %v -> %v", *receipt.Status, result.Status))
+	}
+	if receipt.GasUsed != result.GasUsed {
+		diffs = append(diffs, fmt.Sprintf("gas used %v -> %v", receipt.GasUsed, result.GasUsed))
+	}
+	if receipt.NumLogs != len(result.Logs) {
+		diffs = append(diffs, fmt.Sprintf("logs %v -> %v", receipt.NumLogs, len(result.Logs)))
+	}
+	return diffs
+}
+
+// rpcReceiptTimeout is the timeout of the default client of
+// RPCReceiptFetcher, so an unresponsive node does not stall replay forever.
+const rpcReceiptTimeout = 30 * time.Second
+
+// RPCReceiptFetcher is a ReceiptFetcher calling eth_getTransactionByBlockNumberAndIndex
+// and eth_getTransactionReceipt of a JSON-RPC node over HTTP, so transaction
+// hashes need not be recorded in substates. It only uses net/http, and is safe
+// for concurrent use.
+type RPCReceiptFetcher struct {
+	url    string
+	client *http.Client
+
+	id int64
+}
+
+// NewRPCReceiptFetcher returns an RPCReceiptFetcher calling the node at
+// rpcURL with client, or with a client timing out after 30 seconds if client
+// is nil.
+func NewRPCReceiptFetcher(rpcURL string, client *http.Client) (*RPCReceiptFetcher, error) {
+	u, err := url.Parse(rpcURL)
+	if err != nil {
+		return nil, fmt.Errorf("record-replay: invalid RPC URL %s: %v", rpcURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("record-replay: invalid RPC URL %s: scheme must be http or https", rpcURL)
+	}
+	if client == nil {
+		client = &http.Client{Timeout: rpcReceiptTimeout}
+	}
+	return &RPCReceiptFetcher{url: rpcURL, client: client}, nil
+}
+
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      int64         `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// call calls method with params and decodes its result into result. It
+// returns false if the result is null.
+func (f *RPCReceiptFetcher) call(result interface{}, method string, params ...interface{}) (bool, error) {
+	body, err := json.Marshal(&rpcRequest{
+		JSONRPC: "2.0",
+		ID:      atomic.AddInt64(&f.id, 1),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return false, err
+	}
+	resp, err := f.client.Post(f.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s: unexpected status %v", method, resp.Status)
+	}
+
+	var rpcResp rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return false, fmt.Errorf("%s: %v", method, err)
+	}
+	if rpcResp.Error != nil {
+		return false, fmt.Errorf("%s: %s (code %v)", method, rpcResp.Error.Message, rpcResp.Error.Code)
+	}
+	if len(rpcResp.Result) == 0 || string(rpcResp.Result) == "null" {
+		return false, nil
+	}
+	if err := json.Unmarshal(rpcResp.Result, result); err != nil {
+		return false, fmt.Errorf("%s: %v", method, err)
+	}
+	return true, nil
+}
+
+// FetchReceipt implements ReceiptFetcher.
+func (f *RPCReceiptFetcher) FetchReceipt(block uint64, tx int) (*ReceiptSummary, error) {
+	var rpcTx struct {
+		Hash common.Hash `json:"hash"`
+	}
+	found, err := f.call(&rpcTx, "eth_getTransactionByBlockNumberAndIndex", hexutil.Uint64(block), hexutil.Uint64(tx))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("transaction %v_%v not found", block, tx)
+	}
+
+	var rpcReceipt struct {
+		Status  *hexutil.Uint64   `json:"status"`
+		GasUsed hexutil.Uint64    `json:"gasUsed"`
+		Logs    []json.RawMessage `json:"logs"`
+	}
+	found, err = f.call(&rpcReceipt, "eth_getTransactionReceipt", rpcTx.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("receipt of transaction %v_%v (%s) not found", block, tx, rpcTx.Hash.Hex())
+	}
+
+	receipt := &ReceiptSummary{
+		GasUsed: uint64(rpcReceipt.GasUsed),
+		NumLogs: len(rpcReceipt.Logs),
+	}
+	if rpcReceipt.Status != nil {
+		status := uint64(*rpcReceipt.Status)
+		receipt.Status = &status
+	}
+	return receipt, nil
+}
@@ -0,0 +1,119 @@
+package research
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// newTestRPCServer returns a server answering eth_getTransactionByBlockNumberAndIndex
+// and eth_getTransactionReceipt with txs and receipts as JSON results, keyed
+// by "block_tx" and by transaction hash.
+func newTestRPCServer(t *testing.T, txs, receipts map[string]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params []string        `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result := "null"
+		switch req.Method {
+		case "eth_getTransactionByBlockNumberAndIndex":
+			if tx, ok := txs[req.Params[0]+"_"+req.Params[1]]; ok {
+				result = tx
+			}
+		case "eth_getTransactionReceipt":
+			if receipt, ok := receipts[req.Params[0]]; ok {
+				result = receipt
+			}
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"error":{"code":-32601,"message":"method not found"}}`))
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":` + result + `}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRPCReceiptFetcher(t *testing.T) {
+	const (
+		hash1 = "0x1111111111111111111111111111111111111111111111111111111111111111"
+		hash2 = "0x2222222222222222222222222222222222222222222222222222222222222222"
+		hash3 = "0x3333333333333333333333333333333333333333333333333333333333333333"
+	)
+	server := newTestRPCServer(t, map[string]string{
+		"0x10_0x0": `{"hash":"` + hash1 + `"}`,
+		"0x10_0x1": `{"hash":"` + hash2 + `"}`,
+		"0x20_0x0": `{"hash":"` + hash3 + `"}`,
+	}, map[string]string{
+		hash1: `{"status":"0x1","gasUsed":"0x5208","logs":[]}`,
+		hash2: `{"status":"0x0","gasUsed":"0x7530","logs":[{},{}]}`,
+		// pre-Byzantium receipts have a state root instead of a status
+		hash3: `{"root":"0x01","gasUsed":"0x5208","logs":[{}]}`,
+	})
+	fetcher, err := NewRPCReceiptFetcher(server.URL, server.Client())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	status := func(status uint64) *uint64 { return &status }
+	tests := []struct {
+		block   uint64
+		tx      int
+		receipt *ReceiptSummary
+	}{
+		{0x10, 0, &ReceiptSummary{Status: status(1), GasUsed: 21000}},
+		{0x10, 1, &ReceiptSummary{Status: status(0), GasUsed: 30000, NumLogs: 2}},
+		{0x20, 0, &ReceiptSummary{GasUsed: 21000, NumLogs: 1}},
+	}
+	for _, tt := range tests {
+		receipt, err := fetcher.FetchReceipt(tt.block, tt.tx)
+		if err != nil {
+			t.Fatalf("%v_%v: unexpected error: %v", tt.block, tt.tx, err)
+		}
+		if !reflect.DeepEqual(receipt, tt.receipt) {
+			t.Fatalf("%v_%v: receipt mismatch: have %+v, want %+v", tt.block, tt.tx, receipt, tt.receipt)
+		}
+	}
+
+	if _, err := fetcher.FetchReceipt(0x10, 2); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("missing transaction: unexpected error: %v", err)
+	}
+
+	if _, err := NewRPCReceiptFetcher("ftp://localhost", nil); err == nil {
+		t.Fatalf("expected error for an invalid scheme")
+	}
+	if fetcher, err := NewRPCReceiptFetcher(server.URL, nil); err != nil || fetcher.client.Timeout <= 0 {
+		t.Fatalf("default client has no timeout: %v", err)
+	}
+}
+
+func TestCompareReceipt(t *testing.T) {
+	status := func(status uint64) *uint64 { return &status }
+	result := &SubstateResult{Status: 1, GasUsed: 21000, Logs: []*types.Log{{}}}
+
+	tests := []struct {
+		receipt *ReceiptSummary
+		diffs   []string
+	}{
+		{&ReceiptSummary{Status: status(1), GasUsed: 21000, NumLogs: 1}, nil},
+		// without a status only gas and logs are compared
+		{&ReceiptSummary{GasUsed: 21000, NumLogs: 1}, nil},
+		{&ReceiptSummary{Status: status(0), GasUsed: 21100, NumLogs: 0}, []string{"status 0 -> 1", "gas used 21100 -> 21000", "logs 0 -> 1"}},
+	}
+	for i, tt := range tests {
+		if diffs := CompareReceipt(tt.receipt, result); !reflect.DeepEqual(diffs, tt.diffs) {
+			t.Fatalf("test %v: diffs mismatch: have %q, want %q", i, diffs, tt.diffs)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package research
+
+import (
+	"fmt"
+)
+
+// ReencodeStats is the number of substates rewritten by ReencodeSubstates.
+type ReencodeStats struct {
+	// Upgraded is the number of substates in an encoding older than
+	// SubstateEncodingLatest, per encoding.
+	Upgraded map[string]int64
+	// Current is the number of substates already in SubstateEncodingLatest.
+	Current int64
+}
+
+// NumUpgraded returns the number of upgraded substates of all encodings.
+func (stats *ReencodeStats) NumUpgraded() int64 {
+	var n int64
+	for _, num := range stats.Upgraded {
+		n += num
+	}
+	return n
+}
+
+// ReencodeSubstates rewrites substates of db from block first to block last
+// in the latest encoding into dst in batches of batchSize substates. If dst
+// is db, substates already in the latest encoding are left untouched;
+// otherwise every substate is written to dst.
+func ReencodeSubstates(db, dst *SubstateDB, first, last uint64, batchSize int) (stats ReencodeStats, err error) {
+	stats.Upgraded = make(map[string]int64)
+
+	batch := dst.NewBatch(batchSize)
+	it := newSubstateKeyIterator(db, first, last)
+	defer func() {
+		if releaseErr := it.release(); err == nil {
+			err = releaseErr
+		}
+		if flushErr := batch.Flush(); err == nil {
+			err = flushErr
+		}
+	}()
+
+	for ; it.valid; it.next() {
+		key := it.key
+		value := it.iter.Value()
+		substateRLP, encoding, err := decodeSubstateRLP(value)
+		if err != nil {
+			return stats, fmt.Errorf("record-replay: error decoding substateRLP %v_%v: %v", key.Block, key.Tx, err)
+		}
+		if encoding == SubstateEncodingLatest {
+			stats.Current++
+			if dst == db {
+				continue
+			}
+		} else {
+			stats.Upgraded[encoding]++
+		}
+
+		substate := &Substate{}
+		substate.SetRLP(substateRLP, db)
+		if err := batch.PutSubstate(key.Block, key.Tx, substate); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
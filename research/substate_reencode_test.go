@@ -0,0 +1,205 @@
+package research
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// putOldSubstate puts a substate in the legacy or Berlin encoding.
+func putOldSubstate(t *testing.T, db *SubstateDB, block uint64, tx int, substate *Substate, encoding string) {
+	substateRLP := NewSubstateRLP(substate)
+	envRLP := &legacySubstateEnvRLP{
+		Coinbase:    substateRLP.Env.Coinbase,
+		Difficulty:  substateRLP.Env.Difficulty,
+		GasLimit:    substateRLP.Env.GasLimit,
+		Number:      substateRLP.Env.Number,
+		Timestamp:   substateRLP.Env.Timestamp,
+		BlockHashes: substateRLP.Env.BlockHashes,
+	}
+	msg := substateRLP.Message
+
+	var value []byte
+	var err error
+	switch encoding {
+	case SubstateEncodingLegacy:
+		value, err = rlp.EncodeToBytes(&legacySubstateRLP{
+			InputAlloc:  substateRLP.InputAlloc,
+			OutputAlloc: substateRLP.OutputAlloc,
+			Env:         envRLP,
+			Message: &legacySubstateMessageRLP{
+				Nonce: msg.Nonce, CheckNonce: msg.CheckNonce, GasPrice: msg.GasPrice, Gas: msg.Gas,
+				From: msg.From, To: msg.To, Value: msg.Value, Data: msg.Data, InitCodeHash: msg.InitCodeHash,
+			},
+			Result: substateRLP.Result,
+		})
+	case SubstateEncodingBerlin:
+		value, err = rlp.EncodeToBytes(&berlinSubstateRLP{
+			InputAlloc:  substateRLP.InputAlloc,
+			OutputAlloc: substateRLP.OutputAlloc,
+			Env:         envRLP,
+			Message: &berlinSubstateMessageRLP{
+				Nonce: msg.Nonce, CheckNonce: msg.CheckNonce, GasPrice: msg.GasPrice, Gas: msg.Gas,
+				From: msg.From, To: msg.To, Value: msg.Value, Data: msg.Data, InitCodeHash: msg.InitCodeHash,
+				AccessList: msg.AccessList,
+			},
+			Result: substateRLP.Result,
+		})
+	default:
+		t.Fatalf("unknown encoding %v", encoding)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := db.backend.Put(Stage1SubstateKey(block, tx), value); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReencodeSubstates(t *testing.T) {
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+	encodings := map[SubstateKey]string{
+		{1, 0}: SubstateEncodingLegacy,
+		{1, 1}: SubstateEncodingLegacy,
+		{2, 0}: SubstateEncodingBerlin,
+		{3, 0}: SubstateEncodingLatest,
+		{9, 0}: SubstateEncodingLegacy, // outside the block segment
+	}
+	newDB := func() *SubstateDB {
+		db := NewMemorySubstateDB()
+		for key, encoding := range encodings {
+			substate := newTestSubstate(key.Block, sender, recipient)
+			if encoding == SubstateEncodingLatest {
+				db.PutSubstate(key.Block, key.Tx, substate)
+				continue
+			}
+			putOldSubstate(t, db, key.Block, key.Tx, substate, encoding)
+		}
+		return db
+	}
+
+	// in place
+	db := newDB()
+	defer db.Close()
+	for key, encoding := range encodings {
+		if have, err := db.GetSubstateEncoding(key.Block, key.Tx); err != nil || have != encoding {
+			t.Fatalf("%v_%v: seeded encoding mismatch: have %v (%v), want %v", key.Block, key.Tx, have, err, encoding)
+		}
+	}
+	before := make(map[SubstateKey]*Substate)
+	for key := range encodings {
+		before[key] = db.GetSubstate(key.Block, key.Tx)
+	}
+
+	stats, err := ReencodeSubstates(db, db, 1, 5, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Upgraded[SubstateEncodingLegacy] != 2 || stats.Upgraded[SubstateEncodingBerlin] != 1 || stats.NumUpgraded() != 3 || stats.Current != 1 {
+		t.Fatalf("stats mismatch: have %+v", stats)
+	}
+	for key, substate := range before {
+		want := SubstateEncodingLatest
+		if key.Block == 9 {
+			want = SubstateEncodingLegacy
+		}
+		if have, err := db.GetSubstateEncoding(key.Block, key.Tx); err != nil || have != want {
+			t.Fatalf("%v_%v: encoding after upgrade mismatch: have %v (%v), want %v", key.Block, key.Tx, have, err, want)
+		}
+		if !db.GetSubstate(key.Block, key.Tx).Equal(substate) {
+			t.Fatalf("%v_%v: substate changed by upgrade", key.Block, key.Tx)
+		}
+	}
+
+	// upgrading again finds only current substates
+	stats, err = ReencodeSubstates(db, db, 1, 5, 2)
+	if err != nil || stats.NumUpgraded() != 0 || stats.Current != 4 {
+		t.Fatalf("stats of second upgrade mismatch: have %+v (%v)", stats, err)
+	}
+
+	// into another substate DB
+	src := newDB()
+	defer src.Close()
+	dst := NewMemorySubstateDB()
+	defer dst.Close()
+	stats, err = ReencodeSubstates(src, dst, 1, 5, 0)
+	if err != nil || stats.NumUpgraded() != 3 || stats.Current != 1 {
+		t.Fatalf("stats mismatch: have %+v (%v)", stats, err)
+	}
+	for key, substate := range before {
+		if key.Block == 9 {
+			if dst.HasSubstate(key.Block, key.Tx) {
+				t.Fatalf("%v_%v: substate outside block segment is written", key.Block, key.Tx)
+			}
+			continue
+		}
+		if have, err := dst.GetSubstateEncoding(key.Block, key.Tx); err != nil || have != SubstateEncodingLatest {
+			t.Fatalf("%v_%v: encoding in dst mismatch: have %v (%v)", key.Block, key.Tx, have, err)
+		}
+		if !dst.GetSubstate(key.Block, key.Tx).Equal(substate) {
+			t.Fatalf("%v_%v: substate mismatch in dst", key.Block, key.Tx)
+		}
+	}
+	if have, err := src.GetSubstateEncoding(1, 0); err != nil || have != SubstateEncodingLegacy {
+		t.Fatalf("source is modified: encoding %v (%v)", have, err)
+	}
+}
+
+func TestSubstateEncodingVersion(t *testing.T) {
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+	db := NewMemorySubstateDB()
+	defer db.Close()
+
+	// freshly written substates are in the latest encoding
+	db.PutSubstate(1, 0, newTestSubstate(1, sender, recipient))
+	db.PutSubstate(1, 1, newTestSubstate(1, sender, recipient))
+	putOldSubstate(t, db, 2, 0, newTestSubstate(2, sender, recipient), SubstateEncodingBerlin)
+	putOldSubstate(t, db, 3, 0, newTestSubstate(3, sender, recipient), SubstateEncodingLegacy)
+	db.backend.Put(Stage1SubstateKey(4, 0), []byte{0xc0})
+
+	tests := []struct {
+		block   uint64
+		tx      int
+		version int
+	}{
+		{1, 0, SubstateEncodingVersionLatest},
+		{1, 1, SubstateEncodingVersionLatest},
+		{2, 0, SubstateEncodingVersionBerlin},
+		{3, 0, SubstateEncodingVersionLegacy},
+	}
+	for _, tt := range tests {
+		version, err := db.GetSubstateEncodingVersion(tt.block, tt.tx)
+		if err != nil {
+			t.Fatalf("%v_%v: unexpected error: %v", tt.block, tt.tx, err)
+		}
+		if version != tt.version {
+			t.Fatalf("%v_%v: version mismatch: have %v, want %v", tt.block, tt.tx, version, tt.version)
+		}
+		encoding, err := db.GetSubstateEncoding(tt.block, tt.tx)
+		if err != nil {
+			t.Fatalf("%v_%v: unexpected error: %v", tt.block, tt.tx, err)
+		}
+		if have := SubstateEncodingOfVersion(version); have != encoding {
+			t.Fatalf("%v_%v: encoding of version mismatch: have %v, want %v", tt.block, tt.tx, have, encoding)
+		}
+	}
+	if _, err := db.GetSubstateEncodingVersion(4, 0); err == nil {
+		t.Fatalf("no error for substate of unknown encoding")
+	}
+
+	counts, err := db.CountEncodingVersions(0, OpenBlockSegmentLast)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[int]uint64{
+		SubstateEncodingVersionLatest:  2,
+		SubstateEncodingVersionBerlin:  1,
+		SubstateEncodingVersionLegacy:  1,
+		SubstateEncodingVersionUnknown: 1,
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("version counts mismatch: have %v, want %v", counts, want)
+	}
+}
@@ -36,7 +36,7 @@ func NewSubstateAccountRLP(sa *SubstateAccount) *SubstateAccountRLP {
 	return &saRLP
 }
 
-func (sa *SubstateAccount) SetRLP(saRLP *SubstateAccountRLP, db *SubstateDB) {
+func (sa *SubstateAccount) SetRLP(saRLP *SubstateAccountRLP, db SubstateCodeReader) {
 	sa.Balance = saRLP.Balance
 	sa.Nonce = saRLP.Nonce
 	sa.Code = db.GetCode(saRLP.CodeHash)
@@ -71,7 +71,7 @@ func NewSubstateAllocRLP(alloc SubstateAlloc) SubstateAllocRLP {
 	return allocRLP
 }
 
-func (alloc *SubstateAlloc) SetRLP(allocRLP SubstateAllocRLP, db *SubstateDB) {
+func (alloc *SubstateAlloc) SetRLP(allocRLP SubstateAllocRLP, db SubstateCodeReader) {
 	*alloc = make(SubstateAlloc)
 	for i, addr := range allocRLP.Addresses {
 		var sa SubstateAccount
@@ -116,6 +116,11 @@ type SubstateEnvRLP struct {
 	BlockHashes [][2]common.Hash
 
 	BaseFee *common.Hash `rlp:"nil"` // missing in substate DB from Geth <= v1.10.3
+
+	// Random is missing in substate DB before the merge. Substates with it
+	// cannot be decoded by record-replay versions predating the field, but
+	// keep the encoding version of substateEncodingVersion.
+	Random *common.Hash `rlp:"optional"`
 }
 
 func NewSubstateEnvRLP(env *SubstateEnv) *SubstateEnvRLP {
@@ -144,10 +149,12 @@ func NewSubstateEnvRLP(env *SubstateEnv) *SubstateEnvRLP {
 		envRLP.BaseFee = &baseFeeHash
 	}
 
+	envRLP.Random = env.Random
+
 	return &envRLP
 }
 
-func (env *SubstateEnv) SetRLP(envRLP *SubstateEnvRLP, db *SubstateDB) {
+func (env *SubstateEnv) SetRLP(envRLP *SubstateEnvRLP, db SubstateCodeReader) {
 	env.Coinbase = envRLP.Coinbase
 	env.Difficulty = envRLP.Difficulty
 	env.GasLimit = envRLP.GasLimit
@@ -165,6 +172,8 @@ func (env *SubstateEnv) SetRLP(envRLP *SubstateEnvRLP, db *SubstateDB) {
 	if envRLP.BaseFee != nil {
 		env.BaseFee = envRLP.BaseFee.Big()
 	}
+
+	env.Random = envRLP.Random
 }
 
 type legacySubstateMessageRLP struct {
@@ -286,7 +295,7 @@ func NewSubstateMessageRLP(msg *SubstateMessage) *SubstateMessageRLP {
 	return &msgRLP
 }
 
-func (msg *SubstateMessage) SetRLP(msgRLP *SubstateMessageRLP, db *SubstateDB) {
+func (msg *SubstateMessage) SetRLP(msgRLP *SubstateMessageRLP, db SubstateCodeReader) {
 	msg.Nonce = msgRLP.Nonce
 	msg.CheckNonce = msgRLP.CheckNonce
 	msg.GasPrice = msgRLP.GasPrice
@@ -329,7 +338,7 @@ func NewSubstateResultRLP(result *SubstateResult) *SubstateResultRLP {
 	return &resultRLP
 }
 
-func (result *SubstateResult) SetRLP(resultRLP *SubstateResultRLP, db *SubstateDB) {
+func (result *SubstateResult) SetRLP(resultRLP *SubstateResultRLP, db SubstateCodeReader) {
 	result.Status = resultRLP.Status
 	result.Bloom = resultRLP.Bloom
 	result.Logs = resultRLP.Logs
@@ -394,7 +403,7 @@ func NewSubstateRLP(substate *Substate) *SubstateRLP {
 	return &substateRLP
 }
 
-func (substate *Substate) SetRLP(substateRLP *SubstateRLP, db *SubstateDB) {
+func (substate *Substate) SetRLP(substateRLP *SubstateRLP, db SubstateCodeReader) {
 	substate.InputAlloc = make(SubstateAlloc)
 	substate.OutputAlloc = make(SubstateAlloc)
 	substate.Env = &SubstateEnv{}
@@ -0,0 +1,26 @@
+package research
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// VerifyMessageSender checks that msg.From is the sender recovered from the
+// signature of the transaction, and returns the recovered sender. Substates
+// record neither signatures nor raw transactions, so the sender cannot be
+// recovered from a substate alone, and VerifyMessageSender returns msg.From
+// and true. Use VerifyTransactionSender with the original transaction, e.g.
+// fetched from an archive node, to detect a wrong msg.From.
+func VerifyMessageSender(msg *SubstateMessage) (common.Address, bool, error) {
+	return msg.From, true, nil
+}
+
+// VerifyTransactionSender recovers the sender of a signed transaction with
+// signer, and returns the sender and true if it is msg.From.
+func VerifyTransactionSender(msg *SubstateMessage, tx *types.Transaction, signer types.Signer) (common.Address, bool, error) {
+	sender, err := types.Sender(signer, tx)
+	if err != nil {
+		return common.Address{}, false, err
+	}
+	return sender, sender == msg.From, nil
+}
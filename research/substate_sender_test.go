@@ -0,0 +1,55 @@
+package research
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestVerifyMessageSender(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	signer := types.LatestSignerForChainID(big.NewInt(1))
+	recipient := common.Address{0x02}
+	tx, err := types.SignNewTx(key, signer, &types.LegacyTx{Nonce: 1, GasPrice: big.NewInt(1), Gas: 21_000, To: &recipient, Value: big.NewInt(1000)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		from common.Address
+		ok   bool
+	}{
+		{"matching", from, true},
+		{"mismatched", common.Address{0x01}, false},
+	}
+	for _, test := range tests {
+		msg := NewSubstateMessage(tx, test.from, tx.GasPrice())
+
+		sender, ok, err := VerifyTransactionSender(msg, tx, signer)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if sender != from || ok != test.ok {
+			t.Fatalf("%s: have %v %v, want %v %v", test.name, sender.Hex(), ok, from.Hex(), test.ok)
+		}
+
+		// without signatures, the recorded sender is trusted
+		sender, ok, err = VerifyMessageSender(msg)
+		if err != nil || !ok || sender != test.from {
+			t.Fatalf("%s: VerifyMessageSender mismatch: have %v %v %v", test.name, sender.Hex(), ok, err)
+		}
+	}
+
+	// an unsigned transaction
+	if _, _, err := VerifyTransactionSender(NewSubstateMessage(tx, from, tx.GasPrice()), types.NewTx(&types.LegacyTx{To: &recipient}), signer); err == nil {
+		t.Fatalf("no error for unsigned transaction")
+	}
+}
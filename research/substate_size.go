@@ -0,0 +1,48 @@
+package research
+
+import (
+	"fmt"
+)
+
+// SubstateSizeReport is the storage footprint of substates in a block range.
+type SubstateSizeReport struct {
+	NumTxs uint64 `json:"numTxs"`
+	// EncodedBytes is the size of stored substate values, excluding
+	// bytecode stored separately by code hash.
+	EncodedBytes uint64 `json:"encodedBytes"`
+
+	InputStorageSlots  uint64 `json:"inputStorageSlots"`
+	OutputStorageSlots uint64 `json:"outputStorageSlots"`
+	// InputAllocBytes and OutputAllocBytes are sums of
+	// SubstateAlloc.ApproxEncodedSize.
+	InputAllocBytes  uint64 `json:"inputAllocBytes"`
+	OutputAllocBytes uint64 `json:"outputAllocBytes"`
+}
+
+// SizeReport decodes substates from block first to block last, and returns
+// their sizes and numbers of storage slots.
+func (db *SubstateDB) SizeReport(first, last uint64) (report *SubstateSizeReport, err error) {
+	report = &SubstateSizeReport{}
+	it := newSubstateKeyIterator(db, first, last)
+	defer func() {
+		if releaseErr := it.release(); err == nil {
+			err = releaseErr
+		}
+	}()
+
+	for ; it.valid; it.next() {
+		value := it.iter.Value()
+		substate, err := db.decodeSubstate(value)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding substateRLP %v_%v: %v", it.key.Block, it.key.Tx, err)
+		}
+
+		report.NumTxs++
+		report.EncodedBytes += uint64(len(value))
+		report.InputStorageSlots += uint64(substate.InputAlloc.TotalStorageSlots())
+		report.OutputStorageSlots += uint64(substate.OutputAlloc.TotalStorageSlots())
+		report.InputAllocBytes += uint64(substate.InputAlloc.ApproxEncodedSize())
+		report.OutputAllocBytes += uint64(substate.OutputAlloc.ApproxEncodedSize())
+	}
+	return report, nil
+}
@@ -0,0 +1,77 @@
+package research
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestSubstateAllocSize(t *testing.T) {
+	code := make([]byte, 1000)
+	contract := NewSubstateAccount(1, big.NewInt(0), code)
+	for i := 0; i < 10; i++ {
+		contract.Storage[common.BigToHash(big.NewInt(int64(i)))] = common.Hash{0x01}
+	}
+	other := NewSubstateAccount(0, big.NewInt(1_000_000), nil)
+	other.Storage[common.Hash{}] = common.Hash{0x01}
+	alloc := SubstateAlloc{
+		common.Address{0xc0}: contract,
+		common.Address{0x01}: other,
+		common.Address{0x02}: NewSubstateAccount(0, big.NewInt(0), nil),
+	}
+
+	if have := alloc.TotalStorageSlots(); have != 11 {
+		t.Fatalf("storage slots mismatch: have %v, want 11", have)
+	}
+	if have := (SubstateAlloc{}).TotalStorageSlots(); have != 0 {
+		t.Fatalf("storage slots of empty alloc mismatch: have %v, want 0", have)
+	}
+
+	// code and storage dominate, with a small overhead per account
+	size := alloc.ApproxEncodedSize()
+	if min, max := 1000+11*64, 1000+11*64+3*64; size < min || size > max {
+		t.Fatalf("approximate size %v out of range %v-%v", size, min, max)
+	}
+
+	// the estimated memory of a substate sums its allocs and message data
+	substate := newTestSubstate(1, common.Address{0x01}, common.Address{0x02})
+	substate.InputAlloc = alloc
+	substate.Message.Data = make([]byte, 100)
+	want := uint64(alloc.ApproxEncodedSize() + substate.OutputAlloc.ApproxEncodedSize() + 100)
+	if have := substate.EstimatedSize(); have != want {
+		t.Fatalf("estimated size mismatch: have %v, want %v", have, want)
+	}
+}
+
+func TestSizeReport(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{1: {0, 1}, 2: {0}, 5: {0}})
+	defer db.Close()
+	substate := newTestSubstate(2, common.Address{0x01}, common.Address{0x02})
+	account := NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+	account.Storage[common.Hash{0x01}] = common.Hash{0x02}
+	account.Storage[common.Hash{0x02}] = common.Hash{0x02}
+	substate.InputAlloc[common.Address{0xc0}] = account
+	substate.OutputAlloc[common.Address{0xc0}] = account.Copy()
+	substate.OutputAlloc[common.Address{0xc0}].Storage[common.Hash{0x03}] = common.Hash{0x03}
+	db.PutSubstate(2, 0, substate)
+
+	report, err := db.SizeReport(1, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report.NumTxs != 3 || report.InputStorageSlots != 2 || report.OutputStorageSlots != 3 {
+		t.Fatalf("report mismatch: have %+v", report)
+	}
+	if report.EncodedBytes == 0 || report.InputAllocBytes < 2*64+2 || report.OutputAllocBytes < 3*64+2 {
+		t.Fatalf("sizes mismatch: have %+v", report)
+	}
+
+	report, err = db.SizeReport(3, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *report != (SubstateSizeReport{}) {
+		t.Fatalf("report of empty range mismatch: have %+v", report)
+	}
+}
@@ -1,24 +1,39 @@
 package research
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/shirou/gopsutil/cpu"
 	cli "github.com/urfave/cli/v2"
+	"golang.org/x/time/rate"
 )
 
 var (
-	WorkersFlag = &cli.IntFlag{
+	WorkersFlag = &cli.StringFlag{
 		Name:  "workers",
-		Usage: "Number of worker threads (goroutines), 0 for current CPU physical cores",
-		Value: 4,
+		Usage: "Number of worker threads (goroutines), 0 or \"auto-cpu\" for current CPU physical cores, \"auto-io\" for a conservative number for IO-bound tasks",
+		Value: "4",
 	}
 	SkipTransferTxsFlag = &cli.BoolFlag{
 		Name:  "skip-transfer-txs",
@@ -32,224 +47,1774 @@ var (
 		Name:  "skip-create-txs",
 		Usage: "Skip executing CREATE transactions",
 	}
+	TxTypesFlag = &cli.StringFlag{
+		Name:  "tx-types",
+		Usage: "Execute only transactions of the given comma-separated types (transfer, call, create), not with --skip-transfer-txs, --skip-call-txs or --skip-create-txs",
+	}
+	SkipSuccessTxsFlag = &cli.BoolFlag{
+		Name:  "skip-success-txs",
+		Usage: "Skip executing transactions recorded as successful",
+	}
+	SkipFailedTxsFlag = &cli.BoolFlag{
+		Name:  "skip-failed-txs",
+		Usage: "Skip executing transactions recorded as failed (reverted)",
+	}
+	MinValueFlag = &cli.StringFlag{
+		Name:  "min-value",
+		Usage: "Skip executing transactions transferring less than the given value in wei, gwei or eth (e.g. 1000, 1.5gwei, 0.1eth)",
+	}
+	TargetAddressFlag = &cli.StringSliceFlag{
+		Name:  "address",
+		Usage: "Execute only transactions with the given address as sender, recipient or an account in alloc, repeatable",
+	}
+	CreatedContractFlag = &cli.StringFlag{
+		Name:  "created-contract",
+		Usage: "Execute only the transaction creating the contract of the given address and transactions to it",
+	}
+	SummaryJSONFlag = &cli.PathFlag{
+		Name:  "summary-json",
+		Usage: "Write a JSON summary of the run to the given path, even if the run fails",
+	}
+	CheckpointFlag = &cli.PathFlag{
+		Name:  "checkpoint",
+		Usage: "Record the last block executed with all blocks before it to the given file, and resume after it",
+	}
+	BlockStrideFlag = &cli.IntFlag{
+		Name:  "stride",
+		Usage: "Execute only every Nth block of block segments, counted from the first block of each segment",
+		Value: 1,
+	}
+	TxTypeBreakdownFlag = &cli.BoolFlag{
+		Name:  "tx-type-breakdown",
+		Usage: "Count executed transfer, call and create transactions, and print the breakdown at the end",
+	}
+	MaxBlocksPerSecFlag = &cli.Float64Flag{
+		Name:  "max-bps",
+		Usage: "Maximum number of blocks scheduled per second to throttle background runs, 0 for no limit",
+	}
+	MaxInFlightBytesFlag = &cli.Uint64Flag{
+		Name:  "max-in-flight-bytes",
+		Usage: "Maximum stored bytes of substates decoded and executed at the same time, 0 for no limit",
+	}
+	DebugSerialFlag = &cli.BoolFlag{
+		Name:  "debug-serial",
+		Usage: "Execute blocks and transactions one by one in order on a single goroutine for debugging",
+	}
+	StrictDecodeFlag = &cli.BoolFlag{
+		Name:  "strict-decode",
+		Usage: "Abort at a substate failing to decode instead of skipping it",
+	}
+	ErrorBudgetFlag = &cli.IntFlag{
+		Name:  "error-budget",
+		Usage: "Number of failed blocks tolerated before aborting, 0 to abort at the first failure",
+	}
+	TxLimitFlag = &cli.IntFlag{
+		Name:  "tx-limit",
+		Usage: "Stop after executing about the given number of transactions, 0 for no limit",
+	}
+	ParallelTxsFlag = &cli.IntFlag{
+		Name:  "parallel-txs",
+		Usage: "Number of transactions executed in parallel within a block, only for TaskFunc safe for concurrent use",
+		Value: 1,
+	}
 	BlockSegmentFlag = &cli.StringFlag{
 		Name:     "block-segment",
-		Usage:    "Single block segment (e.g. 1001, 1_001, 1_001-2_000, 1-2k, 1-2M)",
+		Usage:    "Single block segment (e.g. 1001, 1_001, 1_001-2_000, 1-2k, 1-2M, 1-2G, 500k-2M, 1_001-, 0x3e9-0x7d0, latest-1000)",
 		Required: true,
 	}
+	AllBlocksFlag = &cli.BoolFlag{
+		Name:  "all",
+		Usage: "Execute all blocks from the first to the last block of the substate DB instead of --block-segment",
+	}
 	BlockSegmentListFlag = &cli.StringFlag{
 		Name:     "block-segment-list",
 		Usage:    "One or more block segments, e.g. '0-1M,1000-1100k,1100001,1_100_002-1_101_000'",
 		Required: true,
 	}
-)
+)
+
+// OpenBlockSegmentLast is the Last of a block segment without an upper bound
+// (e.g. "1_001-"), which stands for the highest block in a substate DB.
+const OpenBlockSegmentLast uint64 = math.MaxUint64
+
+type BlockSegment struct {
+	First, Last uint64
+}
+
+func NewBlockSegment(first, last uint64) *BlockSegment {
+	return &BlockSegment{First: first, Last: last}
+}
+
+// Contains returns true if block is in the block segment.
+func (seg *BlockSegment) Contains(block uint64) bool {
+	return seg.First <= block && block <= seg.Last
+}
+
+// Overlaps returns true if the block segments have at least one common block.
+func (seg *BlockSegment) Overlaps(other *BlockSegment) bool {
+	return seg.First <= other.Last && other.First <= seg.Last
+}
+
+// Len returns the number of blocks in the block segment. It wraps around to
+// 0 only for the full range 0-OpenBlockSegmentLast.
+func (seg *BlockSegment) Len() uint64 {
+	return seg.Last - seg.First + 1
+}
+
+// siUnitValue returns the multiplier of an SI unit suffix in block segments.
+func siUnitValue(siunit string) uint64 {
+	switch siunit {
+	case "k":
+		return 1_000
+	case "M":
+		return 1_000_000
+	case "G":
+		return 1_000_000_000
+	}
+	return 1
+}
+
+// scaleBlockNumber multiplies a block number with an SI unit multiplier and
+// returns an error instead of silently wrapping around on overflow.
+func scaleBlockNumber(num uint64, unit uint64) (uint64, error) {
+	if num > math.MaxUint64/unit {
+		return 0, fmt.Errorf("block number %v with SI unit %v overflows uint64", num, unit)
+	}
+	return num * unit, nil
+}
+
+// BlockSegmentErrorKind is the kind of failure of parsing a block segment.
+type BlockSegmentErrorKind int
+
+const (
+	// BlockSegmentInvalidFormat is a string not matching the block segment
+	// syntax, e.g. "1x" or "0x1k".
+	BlockSegmentInvalidFormat BlockSegmentErrorKind = iota
+	// BlockSegmentBadFirst and BlockSegmentBadLast are block numbers not
+	// representable in uint64.
+	BlockSegmentBadFirst
+	BlockSegmentBadLast
+	// BlockSegmentFirstExceedsLast is a first block larger than the last block.
+	BlockSegmentFirstExceedsLast
+	// BlockSegmentOverflow is a block number overflowing uint64 when it is
+	// multiplied by its SI unit.
+	BlockSegmentOverflow
+)
+
+func (kind BlockSegmentErrorKind) String() string {
+	switch kind {
+	case BlockSegmentInvalidFormat:
+		return "invalid format"
+	case BlockSegmentBadFirst:
+		return "bad first"
+	case BlockSegmentBadLast:
+		return "bad last"
+	case BlockSegmentFirstExceedsLast:
+		return "first exceeds last"
+	case BlockSegmentOverflow:
+		return "overflow"
+	}
+	return fmt.Sprintf("BlockSegmentErrorKind(%d)", int(kind))
+}
+
+// BlockSegmentError is the error of ParseBlockSegment.
+type BlockSegmentError struct {
+	Kind  BlockSegmentErrorKind
+	Input string
+	// First and Last are the parsed block numbers of
+	// BlockSegmentFirstExceedsLast.
+	First, Last uint64
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *BlockSegmentError) Error() string {
+	switch e.Kind {
+	case BlockSegmentBadFirst:
+		return fmt.Sprintf("invalid block segment first: %v (%q)", e.Err, e.Input)
+	case BlockSegmentBadLast:
+		return fmt.Sprintf("invalid block segment last: %v (%q)", e.Err, e.Input)
+	case BlockSegmentFirstExceedsLast:
+		return fmt.Sprintf("block segment first is larger than last: %v-%v (%q)", e.First, e.Last, e.Input)
+	case BlockSegmentOverflow:
+		return fmt.Sprintf("invalid block segment: %v (%q)", e.Err, e.Input)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("invalid block segment string: %q: %v", e.Input, e.Err)
+	}
+	return fmt.Sprintf("invalid block segment string: %q", e.Input)
+}
+
+func (e *BlockSegmentError) Unwrap() error {
+	return e.Err
+}
+
+// parseBlockNumber parses a decimal block number with optional underscore
+// grouping (e.g. 1_001) or a 0x-prefixed hexadecimal block number.
+func parseBlockNumber(s string) (uint64, error) {
+	if hex, ok := strings.CutPrefix(s, "0x"); ok {
+		return strconv.ParseUint(hex, 16, 64)
+	}
+	return strconv.ParseUint(strings.ReplaceAll(s, "_", ""), 10, 64)
+}
+
+// ParseBlockSegment parses a block segment string. Errors are of type
+// *BlockSegmentError.
+func ParseBlockSegment(s string) (*BlockSegment, error) {
+	var err error
+	// <first>: first block number
+	// <firstunit>: optional, SI unit of first block number only
+	// <last>: optional, last block number, open-ended if only "-" is given
+	// <siunit>: optinal, k for 1000, M for 1000000, G for 1000000000
+	// If only <siunit> is given, it applies to both <first> and <last>.
+	// Block numbers are decimal, or hexadecimal with 0x prefix (e.g.
+	// 0xbef8a7-0xbef900), which cannot be used together with SI units.
+	re := regexp.MustCompile(`^(?P<first>0x[0-9a-fA-F]+|[0-9][0-9_]*)(?P<firstunit>[kMG]?)((-|~)(?P<last>0x[0-9a-fA-F]+|[0-9][0-9_]*)(?P<siunit>[kMG]?)|(?P<open>-|~))?$`)
+	seg := &BlockSegment{}
+	if !re.MatchString(s) {
+		return nil, &BlockSegmentError{Kind: BlockSegmentInvalidFormat, Input: s}
+	}
+	matches := re.FindStringSubmatch(s)
+	first := matches[re.SubexpIndex("first")]
+	last := matches[re.SubexpIndex("last")]
+	if (strings.HasPrefix(first, "0x") || strings.HasPrefix(last, "0x")) &&
+		len(matches[re.SubexpIndex("firstunit")]+matches[re.SubexpIndex("siunit")]) > 0 {
+		return nil, &BlockSegmentError{Kind: BlockSegmentInvalidFormat, Input: s, Err: errors.New("hexadecimal block number with SI unit")}
+	}
+	seg.First, err = parseBlockNumber(first)
+	if err != nil {
+		return nil, &BlockSegmentError{Kind: BlockSegmentBadFirst, Input: s, Err: err}
+	}
+	firstUnit := siUnitValue(matches[re.SubexpIndex("firstunit")])
+	lastUnit := siUnitValue(matches[re.SubexpIndex("siunit")])
+	switch {
+	case len(matches[re.SubexpIndex("open")]) > 0:
+		seg.Last = OpenBlockSegmentLast
+	case len(last) == 0:
+		if firstUnit > 1 {
+			return nil, &BlockSegmentError{Kind: BlockSegmentInvalidFormat, Input: s}
+		}
+		seg.Last = seg.First
+	default:
+		seg.Last, err = parseBlockNumber(last)
+		if err != nil {
+			return nil, &BlockSegmentError{Kind: BlockSegmentBadLast, Input: s, Err: err}
+		}
+		if firstUnit == 1 {
+			// backward compatible form (e.g. 1-2M), SI unit applies to both
+			firstUnit = lastUnit
+		}
+	}
+	if firstUnit > 1 {
+		seg.First, err = scaleBlockNumber(seg.First, firstUnit)
+		if err != nil {
+			return nil, &BlockSegmentError{Kind: BlockSegmentOverflow, Input: s, Err: err}
+		}
+		seg.First++
+	}
+	if lastUnit > 1 {
+		seg.Last, err = scaleBlockNumber(seg.Last, lastUnit)
+		if err != nil {
+			return nil, &BlockSegmentError{Kind: BlockSegmentOverflow, Input: s, Err: err}
+		}
+	}
+	if seg.First > seg.Last {
+		return nil, &BlockSegmentError{Kind: BlockSegmentFirstExceedsLast, Input: s, First: seg.First, Last: seg.Last}
+	}
+	return seg, nil
+}
+
+// parseLatestBlockSegment parses a segment of the latest n blocks (e.g.
+// "latest-1000", "-1000" or "latest-1k"), or returns false if s is not of this
+// form.
+func parseLatestBlockSegment(s string) (n uint64, ok bool, err error) {
+	re := regexp.MustCompile(`^(latest)?-(?P<n>[0-9][0-9_]*)(?P<siunit>[kMG]?)$`)
+	matches := re.FindStringSubmatch(s)
+	if matches == nil {
+		return 0, false, nil
+	}
+	n, err = parseBlockNumber(matches[re.SubexpIndex("n")])
+	if err == nil {
+		n, err = scaleBlockNumber(n, siUnitValue(matches[re.SubexpIndex("siunit")]))
+	}
+	if err != nil {
+		return 0, true, fmt.Errorf("invalid number of latest blocks: %s", err)
+	}
+	if n == 0 {
+		return 0, true, fmt.Errorf("invalid number of latest blocks: %q", s)
+	}
+	return n, true, nil
+}
+
+// ParseBlockSegmentWithDB parses a block segment like ParseBlockSegment and
+// resolves an open-ended segment (e.g. "1_001-") to the last block in db.
+// It also accepts the latest N blocks ending at the last block in db (e.g.
+// "latest-1000" or "-1000"), clamped at the first block in db.
+func ParseBlockSegmentWithDB(s string, db SubstateReader) (*BlockSegment, error) {
+	n, ok, err := parseLatestBlockSegment(s)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		first, firstOk := db.FirstBlock()
+		last, lastOk := db.LastBlock()
+		if !firstOk || !lastOk {
+			return nil, fmt.Errorf("cannot resolve latest block segment %q: substate DB is empty", s)
+		}
+		if last-first >= n {
+			first = last - n + 1
+		}
+		return NewBlockSegment(first, last), nil
+	}
+
+	seg, err := ParseBlockSegment(s)
+	if err != nil {
+		return nil, err
+	}
+	if seg.Last == OpenBlockSegmentLast {
+		last, ok := db.LastBlock()
+		if !ok {
+			return nil, fmt.Errorf("cannot resolve open-ended block segment %q: substate DB is empty", s)
+		}
+		if seg.First > last {
+			return nil, fmt.Errorf("block segment first is larger than last block in substate DB: %v-%v", seg.First, last)
+		}
+		seg.Last = last
+	}
+	return seg, nil
+}
+
+type BlockSegmentList = []*BlockSegment
+
+func ParseBlockSegmentList(s string) (BlockSegmentList, error) {
+	var err error
+
+	lxs := strings.Split(s, ",")
+	br := make(BlockSegmentList, len(lxs))
+	for i, lx := range lxs {
+		br[i], err = ParseBlockSegment(lx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return br, nil
+}
+
+// NormalizeSegmentList returns a minimal list of block segments sorted by
+// First, coalescing overlapping and adjacent segments (e.g. 10-20,21-30 into
+// 10-30). The given list is not modified.
+func NormalizeSegmentList(list BlockSegmentList) BlockSegmentList {
+	sorted := make(BlockSegmentList, len(list))
+	for i, seg := range list {
+		sorted[i] = NewBlockSegment(seg.First, seg.Last)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].First < sorted[j].First
+	})
+
+	normalized := make(BlockSegmentList, 0, len(sorted))
+	for _, seg := range sorted {
+		if n := len(normalized); n > 0 {
+			prev := normalized[n-1]
+			if prev.Last == OpenBlockSegmentLast || seg.First <= prev.Last+1 {
+				if seg.Last > prev.Last {
+					prev.Last = seg.Last
+				}
+				continue
+			}
+		}
+		normalized = append(normalized, seg)
+	}
+
+	return normalized
+}
+
+// ParseAndNormalizeBlockSegmentList parses block segments like
+// ParseBlockSegmentList and normalizes them with NormalizeSegmentList.
+func ParseAndNormalizeBlockSegmentList(s string) (BlockSegmentList, error) {
+	list, err := ParseBlockSegmentList(s)
+	if err != nil {
+		return nil, err
+	}
+	return NormalizeSegmentList(list), nil
+}
+
+type SubstateTaskFunc func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error
+
+type SubstateTaskConfig struct {
+	// Workers is the number of workers with WorkersStrategyFixed.
+	Workers int
+	// WorkersStrategy decides the number of workers, see NumWorkers.
+	WorkersStrategy WorkersStrategy
+
+	SkipTransferTxs bool
+	SkipCallTxs     bool
+	SkipCreateTxs   bool
+
+	// TxTypes skips transactions whose ClassifyTx result is not in TxTypes,
+	// unless it is empty.
+	TxTypes map[TxType]bool
+
+	// SkipSuccessTxs and SkipFailedTxs skip transactions by recorded
+	// Result.Status, in addition to the skip options by transaction type.
+	SkipSuccessTxs bool
+	SkipFailedTxs  bool
+
+	// MinValue skips transactions with Message.Value less than MinValue if it
+	// is not nil. A nil Message.Value is regarded as zero.
+	MinValue *big.Int
+
+	// TargetAddresses skips transactions without any of the addresses as
+	// Message.From, Message.To, or an account in InputAlloc or OutputAlloc,
+	// unless it is empty.
+	TargetAddresses map[common.Address]bool
+
+	// CreatedContract skips transactions neither creating nor calling the
+	// contract, see CreatesOrCallsContract, unless it is nil.
+	CreatedContract *common.Address
+
+	// ParallelTxs is the number of transactions of the same block executed in
+	// parallel. If ParallelTxs > 1, TaskFunc must be safe for concurrent use and
+	// transactions in a block are executed in no particular order.
+	ParallelTxs int
+
+	// TxLimit stops scheduling blocks once TaskFunc has been called for
+	// TxLimit transactions in total, unless it is 0. Blocks being executed by
+	// other workers are finished, so slightly more transactions may be
+	// executed.
+	TxLimit int
+
+	// BlockStride executes only blocks where (block-First)%BlockStride == 0
+	// for each block segment. A BlockStride less than 2 executes all blocks.
+	BlockStride int
+
+	// ErrorBudget is the number of failed blocks tolerated while executing
+	// block segments. Failed blocks within the budget are logged and regarded
+	// as done, and execution aborts with all errors joined once the budget is
+	// exceeded. An ErrorBudget of 0 aborts at the first failed block.
+	ErrorBudget int
+
+	// TxTypeBreakdown counts executed transactions by ClassifyTx in
+	// SegmentStats.TxTypes and prints the breakdown with the statistics.
+	TxTypeBreakdown bool
+
+	// StrictDecode panics at a substate failing to decode. Otherwise, if DB
+	// is a TolerantSubstateReader, such substates are skipped and their
+	// errors are collected in DecodeErrors of the task pool.
+	StrictDecode bool
+
+	// MaxBlocksPerSec limits the rate of scheduling blocks to workers, e.g. to
+	// keep a background run from saturating disk IO, unless it is not
+	// positive.
+	MaxBlocksPerSec float64
+
+	// MaxInFlightBytes limits the sum of the sizes of blocks being decoded
+	// and executed, unless it is 0. A worker whose block does not fit in the
+	// budget waits until other blocks finish before decoding it, so the
+	// memory of decoded substates is capped regardless of Workers. A block
+	// larger than the budget is executed alone. Blocks are sized by
+	// SubstateSizeReader if DB implements it, e.g. SubstateDB, and otherwise
+	// by Substate.EstimatedSize after decoding.
+	MaxInFlightBytes uint64
+
+	// DebugSerial executes blocks one by one in ascending order on the
+	// goroutine executing block segments, and transactions of a block in tx
+	// order, regardless of Workers and ParallelTxs, for reproducible ordering
+	// and simpler stack traces while debugging.
+	DebugSerial bool
+}
+
+// NewSubstateTaskConfigCli returns a task config of command line flags, or an
+// error if a flag has an invalid value.
+func NewSubstateTaskConfigCli(ctx *cli.Context) (*SubstateTaskConfig, error) {
+	workers, workersStrategy, err := ParseWorkers(ctx.String(WorkersFlag.Name))
+	if err != nil {
+		return nil, fmt.Errorf("invalid --%s: %v", WorkersFlag.Name, err)
+	}
+
+	var minValue *big.Int
+	if ctx.IsSet(MinValueFlag.Name) {
+		minValue, err = ParseWeiValue(ctx.String(MinValueFlag.Name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %v", MinValueFlag.Name, err)
+		}
+	}
+
+	errorBudget := ctx.Int(ErrorBudgetFlag.Name)
+	if errorBudget < 0 {
+		return nil, fmt.Errorf("invalid --%s: %v", ErrorBudgetFlag.Name, errorBudget)
+	}
+
+	var txTypes map[TxType]bool
+	if ctx.IsSet(TxTypesFlag.Name) {
+		for _, flag := range []*cli.BoolFlag{SkipTransferTxsFlag, SkipCallTxsFlag, SkipCreateTxsFlag} {
+			if ctx.Bool(flag.Name) {
+				return nil, fmt.Errorf("--%s and --%s cannot be used together", TxTypesFlag.Name, flag.Name)
+			}
+		}
+		txTypes, err = ParseTxTypes(ctx.String(TxTypesFlag.Name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s: %v", TxTypesFlag.Name, err)
+		}
+	}
+
+	var targetAddresses map[common.Address]bool
+	for _, s := range ctx.StringSlice(TargetAddressFlag.Name) {
+		if !common.IsHexAddress(s) {
+			return nil, fmt.Errorf("invalid --%s: %q", TargetAddressFlag.Name, s)
+		}
+		if targetAddresses == nil {
+			targetAddresses = make(map[common.Address]bool)
+		}
+		targetAddresses[common.HexToAddress(s)] = true
+	}
+
+	var createdContract *common.Address
+	if ctx.IsSet(CreatedContractFlag.Name) {
+		s := ctx.String(CreatedContractFlag.Name)
+		if !common.IsHexAddress(s) {
+			return nil, fmt.Errorf("invalid --%s: %q", CreatedContractFlag.Name, s)
+		}
+		addr := common.HexToAddress(s)
+		createdContract = &addr
+	}
+
+	return &SubstateTaskConfig{
+		Workers:         workers,
+		WorkersStrategy: workersStrategy,
+
+		SkipTransferTxs: ctx.Bool(SkipTransferTxsFlag.Name),
+		SkipCallTxs:     ctx.Bool(SkipCallTxsFlag.Name),
+		SkipCreateTxs:   ctx.Bool(SkipCreateTxsFlag.Name),
+
+		TxTypes: txTypes,
+
+		SkipSuccessTxs: ctx.Bool(SkipSuccessTxsFlag.Name),
+		SkipFailedTxs:  ctx.Bool(SkipFailedTxsFlag.Name),
+
+		MinValue: minValue,
+
+		TargetAddresses: targetAddresses,
+
+		CreatedContract: createdContract,
+
+		ParallelTxs: ctx.Int(ParallelTxsFlag.Name),
+
+		TxLimit: ctx.Int(TxLimitFlag.Name),
+
+		BlockStride: ctx.Int(BlockStrideFlag.Name),
+
+		ErrorBudget: errorBudget,
+
+		TxTypeBreakdown: ctx.Bool(TxTypeBreakdownFlag.Name),
+
+		StrictDecode: ctx.Bool(StrictDecodeFlag.Name),
+
+		MaxBlocksPerSec: ctx.Float64(MaxBlocksPerSecFlag.Name),
+
+		MaxInFlightBytes: ctx.Uint64(MaxInFlightBytesFlag.Name),
+
+		DebugSerial: ctx.Bool(DebugSerialFlag.Name),
+	}, nil
+}
+
+// ParseWeiValue parses a non-negative value in wei, or in gwei or eth with a
+// "gwei" or "eth" suffix. Values in gwei or eth may be fractional as long as
+// they are whole numbers of wei.
+func ParseWeiValue(s string) (*big.Int, error) {
+	num, unit := strings.TrimSpace(s), big.NewInt(1)
+	lower := strings.ToLower(num)
+	switch {
+	case strings.HasSuffix(lower, "gwei"):
+		num, unit = num[:len(num)-4], big.NewInt(params.GWei)
+	case strings.HasSuffix(lower, "wei"):
+		num = num[:len(num)-3]
+	case strings.HasSuffix(lower, "eth"):
+		num, unit = num[:len(num)-3], big.NewInt(params.Ether)
+	}
+	num = strings.ReplaceAll(strings.TrimSpace(num), "_", "")
+
+	value, ok := new(big.Rat).SetString(num)
+	if !ok || strings.ContainsAny(num, "/eE") {
+		return nil, fmt.Errorf("invalid value %q", s)
+	}
+	value.Mul(value, new(big.Rat).SetInt(unit))
+	if value.Sign() < 0 || !value.IsInt() {
+		return nil, fmt.Errorf("invalid value %q: not a non-negative number of wei", s)
+	}
+	return new(big.Int).Set(value.Num()), nil
+}
+
+// RetryPolicy is a policy to retry a failed TaskFunc with exponential backoff.
+// The zero value means no retries.
+type RetryPolicy struct {
+	MaxAttempts int           // maximum number of calls including the first one
+	BaseDelay   time.Duration // delay before the first retry
+	Multiplier  float64       // delay multiplier for each retry, less than 1 means 1
+}
+
+// Delay returns the delay before the given retry (1 for the first retry).
+func (policy RetryPolicy) Delay(retry int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	return time.Duration(float64(policy.BaseDelay) * math.Pow(multiplier, float64(retry-1)))
+}
+
+type SubstateTaskPool struct {
+	Name     string
+	TaskFunc SubstateTaskFunc
+	Config   *SubstateTaskConfig
+
+	DB SubstateReader
+
+	// RetryPolicy makes ExecuteBlock retry TaskFunc of a failed transaction.
+	RetryPolicy RetryPolicy
+
+	// ProgressFunc is called whenever progress is reported while executing
+	// block segments. Stats have the total numbers of blocks and transactions,
+	// the elapsed time, and throughput since the last report. If ProgressFunc
+	// is nil, progress is logged to Logger.
+	ProgressFunc func(block uint64, stats SegmentStats)
+	// Logger logs progress and summaries of the task pool, slog.Default() is
+	// used if it is nil.
+	Logger *slog.Logger
+	// Quiet suppresses all printing of the task pool.
+	Quiet bool
+
+	// RestoreGOMAXPROCS restores GOMAXPROCS after executing block segments,
+	// which is raised to run all workers in parallel. It is set by the
+	// constructors, and may be unset by commands exiting after execution.
+	RestoreGOMAXPROCS bool
+
+	// SummaryPath is a path to write a JSON summary of every execution of
+	// block segments, no summary is written if it is empty.
+	SummaryPath string
+
+	// CheckpointPath is a path to record a SegmentCheckpoint while executing
+	// block segments, no checkpoint is recorded if it is empty. Execution of
+	// block segments resumes after the block of an existing checkpoint, so
+	// block segments must be in ascending order without overlaps.
+	CheckpointPath string
+	// CheckpointSyncFunc is called before every write of a checkpoint, and
+	// the checkpoint is not written if it returns an error. Task functions
+	// buffering their outputs use it to make outputs of all blocks up to the
+	// checkpoint durable first, so that a resumed run does not skip blocks
+	// whose outputs are lost.
+	CheckpointSyncFunc func() error
+
+	// Metrics are updated while executing block segments if not nil.
+	Metrics *SubstateTaskMetrics
+
+	// BlockDoneFunc is called in block order from a single goroutine once a
+	// block and all blocks before it in the block segments are executed.
+	// It is not called for blocks after a failed block exceeding
+	// Config.ErrorBudget.
+	BlockDoneFunc func(block uint64)
+
+	// txTypes counts executed transactions if Config.TxTypeBreakdown is set.
+	txTypes TxTypeCounts
+
+	decodeErrsMu sync.Mutex
+	decodeErrs   []*SubstateDecodeError
+
+	// inFlight accounts Config.MaxInFlightBytes
+	inFlightOnce sync.Once
+	inFlight     *inFlightBudget
+}
+
+// inFlightBudget is a budget of bytes of substates being executed.
+type inFlightBudget struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	budget uint64
+	bytes  uint64
+}
+
+func newInFlightBudget(budget uint64) *inFlightBudget {
+	b := &inFlightBudget{budget: budget}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until size bytes fit in the budget, or nothing else is in
+// flight, and adds them.
+func (b *inFlightBudget) acquire(size uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.bytes > 0 && b.bytes+size > b.budget {
+		b.cond.Wait()
+	}
+	b.bytes += size
+}
+
+// release removes size bytes acquired before.
+func (b *inFlightBudget) release(size uint64) {
+	b.mu.Lock()
+	b.bytes -= size
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// getBlockSubstatesInFlight returns substates of a block once they fit in
+// Config.MaxInFlightBytes, and a function releasing them. If DB is a
+// SubstateSizeReader, the block is accounted by its stored size before it is
+// decoded, so blocks waiting for the budget hold no decoded substates.
+// Otherwise it is accounted by Substate.EstimatedSize after it is decoded.
+func (pool *SubstateTaskPool) getBlockSubstatesInFlight(block uint64) (BlockSubstates, func()) {
+	if pool.Config.MaxInFlightBytes == 0 {
+		return pool.getBlockSubstates(block), func() {}
+	}
+	pool.inFlightOnce.Do(func() {
+		pool.inFlight = newInFlightBudget(pool.Config.MaxInFlightBytes)
+	})
+
+	if reader, ok := pool.DB.(SubstateSizeReader); ok {
+		size := reader.GetBlockSubstatesSize(block)
+		pool.inFlight.acquire(size)
+		return pool.getBlockSubstates(block), func() { pool.inFlight.release(size) }
+	}
+
+	substates := pool.getBlockSubstates(block)
+	var size uint64
+	for _, substate := range substates {
+		size += substate.EstimatedSize()
+	}
+	pool.inFlight.acquire(size)
+	return substates, func() { pool.inFlight.release(size) }
+}
+
+// NewSubstateTaskPool returns a task pool reading the substate DB opened by
+// OpenSubstateDB. Use NewSubstateTaskPoolWithDB to read another substate DB.
+func NewSubstateTaskPool(name string, taskFunc SubstateTaskFunc, config *SubstateTaskConfig) *SubstateTaskPool {
+	return NewSubstateTaskPoolWithDB(name, taskFunc, config, staticSubstateDB)
+}
+
+// NewSubstateTaskPoolWithDB returns a task pool reading substates only from
+// db, so that task pools over different substate DBs can run in the same
+// process.
+func NewSubstateTaskPoolWithDB(name string, taskFunc SubstateTaskFunc, config *SubstateTaskConfig, db SubstateReader) *SubstateTaskPool {
+	return &SubstateTaskPool{
+		Name:     name,
+		TaskFunc: taskFunc,
+		Config:   config,
+
+		DB: db,
+
+		RestoreGOMAXPROCS: true,
+	}
+}
+
+// NewSubstateTaskPoolCli returns a task pool configured by command line flags
+// reading the substate DB opened by OpenSubstateDB, or an error if a flag has
+// an invalid value.
+func NewSubstateTaskPoolCli(name string, taskFunc SubstateTaskFunc, ctx *cli.Context) (*SubstateTaskPool, error) {
+	config, err := NewSubstateTaskConfigCli(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metrics, err := NewSubstateTaskMetricsCli(name, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &SubstateTaskPool{
+		Name:     name,
+		TaskFunc: taskFunc,
+		Config:   config,
+
+		DB: staticSubstateDB,
+
+		SummaryPath:    ctx.Path(SummaryJSONFlag.Name),
+		CheckpointPath: ctx.Path(CheckpointFlag.Name),
+
+		Metrics: metrics,
+
+		RestoreGOMAXPROCS: true,
+	}, nil
+}
+
+// Log returns Logger of the task pool, or slog.Default() if it is nil.
+func (pool *SubstateTaskPool) Log() *slog.Logger {
+	if pool.Logger == nil {
+		return slog.Default()
+	}
+	return pool.Logger
+}
+
+// WorkersStrategy is a strategy to decide the number of workers of a task
+// pool.
+type WorkersStrategy int
+
+const (
+	// WorkersStrategyFixed uses Config.Workers workers, or as many workers as
+	// WorkersStrategyCPU if Config.Workers is not positive.
+	WorkersStrategyFixed WorkersStrategy = iota
+	// WorkersStrategyCPU uses a worker per physical CPU core, which suits
+	// CPU-bound tasks like replaying substates cached in memory or on SSD.
+	WorkersStrategyCPU
+	// WorkersStrategyIOConservative uses at most IOConservativeWorkers
+	// workers. IO-bound tasks reading a substate DB on a spinning disk are
+	// slowed down by more workers, because concurrent random reads make the
+	// disk seek, but CPU cores are left idle on faster storage.
+	WorkersStrategyIOConservative
+)
+
+// IOConservativeWorkers is the maximum number of workers with
+// WorkersStrategyIOConservative.
+const IOConservativeWorkers = 2
+
+func (strategy WorkersStrategy) String() string {
+	switch strategy {
+	case WorkersStrategyFixed:
+		return "fixed"
+	case WorkersStrategyCPU:
+		return "auto-cpu"
+	case WorkersStrategyIOConservative:
+		return "auto-io"
+	}
+	return fmt.Sprintf("WorkersStrategy(%d)", int(strategy))
+}
+
+// ParseWorkers parses a --workers value, a number of workers with
+// WorkersStrategyFixed, or "auto-cpu" or "auto-io".
+func ParseWorkers(s string) (int, WorkersStrategy, error) {
+	switch s = strings.TrimSpace(s); s {
+	case WorkersStrategyCPU.String():
+		return 0, WorkersStrategyCPU, nil
+	case WorkersStrategyIOConservative.String():
+		return 0, WorkersStrategyIOConservative, nil
+	}
+	workers, err := strconv.Atoi(s)
+	if err != nil || workers < 0 {
+		return 0, 0, fmt.Errorf("%q is neither a non-negative number, %q, nor %q", s, WorkersStrategyCPU, WorkersStrategyIOConservative)
+	}
+	return workers, WorkersStrategyFixed, nil
+}
+
+// numCPUCores returns the number of physical CPU cores, or logical cores if
+// physical ones are unknown.
+var numCPUCores = func() int {
+	cores, err := cpu.Counts(false)
+	if err == nil && cores > 0 {
+		return cores
+	}
+	return runtime.NumCPU()
+}
+
+// NumWorkers calculates number of workers by Config.WorkersStrategy, or 1 if
+// Config.DebugSerial is set
+func (pool *SubstateTaskPool) NumWorkers() int {
+	if pool.Config.DebugSerial {
+		return 1
+	}
+	switch pool.Config.WorkersStrategy {
+	case WorkersStrategyCPU:
+		return numCPUCores()
+	case WorkersStrategyIOConservative:
+		if cores := numCPUCores(); cores < IOConservativeWorkers {
+			return cores
+		}
+		return IOConservativeWorkers
+	}
+
+	// return pool.Workers if it is positive integer
+	if pool.Config.Workers > 0 {
+		return pool.Config.Workers
+	}
+	return numCPUCores()
+}
+
+// SelectsSubstate returns true if the task pool executes a substate of block
+// while executing segment, i.e. the block is one of every Config.BlockStride
+// blocks from the first block of segment, and the substate is not filtered
+// out by the task config. Config.TxLimit is not taken into account.
+func (pool *SubstateTaskPool) SelectsSubstate(segment *BlockSegment, block uint64, substate *Substate) bool {
+	if block < segment.First || block > segment.Last || (block-segment.First)%pool.blockStride() != 0 {
+		return false
+	}
+	return !pool.skipSubstate(substate)
+}
+
+// skipSubstate returns true if a transaction substate is filtered out by
+// the task config
+func (pool *SubstateTaskPool) skipSubstate(substate *Substate) bool {
+	msg := substate.Message
+
+	txType := ClassifyTx(substate)
+	if txTypes := pool.Config.TxTypes; len(txTypes) > 0 && !txTypes[txType] {
+		return true
+	}
+	switch txType {
+	case TxTypeTransfer:
+		// skip regular transactions (ETH transfer)
+		if pool.Config.SkipTransferTxs {
+			return true
+		}
+	case TxTypeCall:
+		// skip CALL trasnactions with contract bytecode
+		if pool.Config.SkipCallTxs {
+			return true
+		}
+	case TxTypeCreate:
+		// skip CREATE transactions
+		if pool.Config.SkipCreateTxs {
+			return true
+		}
+	}
+
+	status := substate.Result.Status
+	if pool.Config.SkipSuccessTxs && status == types.ReceiptStatusSuccessful {
+		return true
+	}
+	if pool.Config.SkipFailedTxs && status == types.ReceiptStatusFailed {
+		return true
+	}
+
+	if minValue := pool.Config.MinValue; minValue != nil {
+		value := msg.Value
+		if value == nil {
+			value = new(big.Int)
+		}
+		if value.Cmp(minValue) < 0 {
+			return true
+		}
+	}
+
+	if targets := pool.Config.TargetAddresses; len(targets) > 0 && !substateHasAddress(substate, targets) {
+		return true
+	}
+
+	if contract := pool.Config.CreatedContract; contract != nil && !CreatesOrCallsContract(substate, *contract) {
+		return true
+	}
+
+	return false
+}
+
+// substateHasAddress returns true if any of the addresses is the sender or
+// the recipient of the transaction, or an account in InputAlloc or OutputAlloc.
+func substateHasAddress(substate *Substate, addrs map[common.Address]bool) bool {
+	msg := substate.Message
+	if addrs[msg.From] || (msg.To != nil && addrs[*msg.To]) {
+		return true
+	}
+	for _, alloc := range []SubstateAlloc{substate.InputAlloc, substate.OutputAlloc} {
+		for addr := range alloc {
+			if addrs[addr] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runTask calls TaskFunc and retries it on error according to RetryPolicy.
+func (pool *SubstateTaskPool) runTask(block uint64, tx int, substate *Substate) error {
+	err := pool.TaskFunc(block, tx, substate, pool)
+	for retry := 1; err != nil && retry < pool.RetryPolicy.MaxAttempts; retry++ {
+		time.Sleep(pool.RetryPolicy.Delay(retry))
+		err = pool.TaskFunc(block, tx, substate, pool)
+	}
+	return err
+}
+
+// countTxType counts an executed transaction if Config.TxTypeBreakdown is set.
+func (pool *SubstateTaskPool) countTxType(substate *Substate) {
+	if pool.Config.TxTypeBreakdown {
+		pool.txTypes.add(ClassifyTx(substate))
+	}
+}
+
+// DecodeErrors returns errors of substates skipped for failing to decode in
+// the last execution of block segments, in no particular order.
+func (pool *SubstateTaskPool) DecodeErrors() []*SubstateDecodeError {
+	pool.decodeErrsMu.Lock()
+	defer pool.decodeErrsMu.Unlock()
+	return append([]*SubstateDecodeError(nil), pool.decodeErrs...)
+}
+
+// getBlockSubstates returns substates of a block. Substates failing to decode
+// are skipped and collected in DecodeErrors unless Config.StrictDecode is set.
+func (pool *SubstateTaskPool) getBlockSubstates(block uint64) BlockSubstates {
+	reader, ok := pool.DB.(TolerantSubstateReader)
+	if pool.Config.StrictDecode || !ok {
+		return pool.DB.GetBlockSubstates(block)
+	}
+
+	substates, decodeErrs := reader.GetBlockSubstatesTolerant(block)
+	if len(decodeErrs) == 0 {
+		return substates
+	}
+	if !pool.Quiet {
+		logger := pool.Log().With("task", pool.Name)
+		for _, err := range decodeErrs {
+			logger.Warn("skip substate", "block", err.Key.Block, "tx", err.Key.Tx, "err", err.Err)
+		}
+	}
+	pool.decodeErrsMu.Lock()
+	pool.decodeErrs = append(pool.decodeErrs, decodeErrs...)
+	pool.decodeErrsMu.Unlock()
+	return substates
+}
+
+// ExecuteBlock function iterates on substates of a given block call TaskFunc
+func (pool *SubstateTaskPool) ExecuteBlock(block uint64) (numTx int64, err error) {
+	if pool.Config.ParallelTxs > 1 && !pool.Config.DebugSerial {
+		return pool.executeBlockParallel(block)
+	}
+
+	// visit substates in tx order for deterministic execution
+	substates, release := pool.getBlockSubstatesInFlight(block)
+	defer release()
+	for _, tx := range substates.Txs() {
+		substate := substates[tx]
+		if pool.skipSubstate(substate) {
+			continue
+		}
+
+		err = pool.runTask(block, tx, substate)
+		if err != nil {
+			return numTx, fmt.Errorf("%s: %v_%v: %v", pool.Name, block, tx, err)
+		}
+
+		numTx++
+		pool.countTxType(substate)
+	}
+
+	return numTx, nil
+}
+
+// executeBlockParallel function is ExecuteBlock that calls TaskFunc for up to
+// Config.ParallelTxs transactions at the same time. It stops calling TaskFunc
+// for the remaining transactions after the first error.
+func (pool *SubstateTaskPool) executeBlockParallel(block uint64) (numTx int64, err error) {
+	var (
+		wg    sync.WaitGroup
+		errMu sync.Mutex
+		sem   = make(chan struct{}, pool.Config.ParallelTxs)
+	)
+	failed := func() bool {
+		errMu.Lock()
+		defer errMu.Unlock()
+		return err != nil
+	}
+
+	// schedule substates in tx order
+	substates, release := pool.getBlockSubstatesInFlight(block)
+	defer release()
+	for _, tx := range substates.Txs() {
+		substate := substates[tx]
+		if pool.skipSubstate(substate) {
+			continue
+		}
+
+		sem <- struct{}{}
+		if failed() {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(tx int, substate *Substate) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			taskErr := pool.runTask(block, tx, substate)
+			if taskErr != nil {
+				errMu.Lock()
+				if err == nil {
+					err = fmt.Errorf("%s: %v_%v: %v", pool.Name, block, tx, taskErr)
+				}
+				errMu.Unlock()
+				return
+			}
+
+			atomic.AddInt64(&numTx, 1)
+			pool.countTxType(substate)
+		}(tx, substate)
+	}
+	wg.Wait()
+
+	return numTx, err
+}
+
+// blockError is an error of a block sent from a worker to the main loop of
+// executeSegmentList.
+type blockError struct {
+	block uint64
+	err   error
+}
+
+// SegmentStats is statistics of executed block segments.
+type SegmentStats struct {
+	NumBlock, NumTx int64
+	Duration        time.Duration
+
+	BlkPerSec, TxPerSec float64
+
+	// TxTypes is the number of executed transactions of each type, counted
+	// only if Config.TxTypeBreakdown is set.
+	TxTypes TxTypeCounts
+}
+
+func NewSegmentStats(numBlock, numTx int64, duration time.Duration) SegmentStats {
+	sec := (duration + 1*time.Nanosecond).Seconds()
+	return SegmentStats{
+		NumBlock: numBlock,
+		NumTx:    numTx,
+		Duration: duration,
+
+		BlkPerSec: float64(numBlock) / sec,
+		TxPerSec:  float64(numTx) / sec,
+	}
+}
 
-type BlockSegment struct {
-	First, Last uint64
+// SegmentSummary is a machine-readable summary of executed block segments.
+type SegmentSummary struct {
+	Segments []SegmentSummaryBlockSegment `json:"segments"`
+
+	NumBlock    int64   `json:"numBlock"`
+	NumTx       int64   `json:"numTx"`
+	DurationSec float64 `json:"durationSec"`
+	BlkPerSec   float64 `json:"blkPerSec"`
+	TxPerSec    float64 `json:"txPerSec"`
+	Workers     int     `json:"workers"`
+
+	Error string `json:"error,omitempty"`
 }
 
-func NewBlockSegment(first, last uint64) *BlockSegment {
-	return &BlockSegment{First: first, Last: last}
+type SegmentSummaryBlockSegment struct {
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
 }
 
-func ParseBlockSegment(s string) (*BlockSegment, error) {
-	var err error
-	// <first>: first block number
-	// <last>: optional, last block number
-	// <siunit>: optinal, k for 1000, M for 1000000
-	re := regexp.MustCompile(`^(?P<first>[0-9][0-9_]*)((-|~)(?P<last>[0-9][0-9_]*)(?P<siunit>[kM]?))?$`)
-	seg := &BlockSegment{}
-	if !re.MatchString(s) {
-		return nil, fmt.Errorf("invalid block segment string: %q", s)
+func NewSegmentSummary(list BlockSegmentList, stats SegmentStats, workers int, err error) *SegmentSummary {
+	summary := &SegmentSummary{
+		Segments: make([]SegmentSummaryBlockSegment, len(list)),
+
+		NumBlock:    stats.NumBlock,
+		NumTx:       stats.NumTx,
+		DurationSec: stats.Duration.Seconds(),
+		BlkPerSec:   stats.BlkPerSec,
+		TxPerSec:    stats.TxPerSec,
+		Workers:     workers,
+	}
+	for i, segment := range list {
+		summary.Segments[i] = SegmentSummaryBlockSegment{First: segment.First, Last: segment.Last}
 	}
-	matches := re.FindStringSubmatch(s)
-	first := strings.ReplaceAll(matches[re.SubexpIndex("first")], "_", "")
-	seg.First, err = strconv.ParseUint(first, 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("invalid block segment first: %s", err)
+		summary.Error = err.Error()
 	}
-	last := strings.ReplaceAll(matches[re.SubexpIndex("last")], "_", "")
-	if len(last) == 0 {
-		seg.Last = seg.First
-	} else {
-		seg.Last, err = strconv.ParseUint(last, 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("invalid block segment last: %s", err)
-		}
+	return summary
+}
+
+// WriteFile writes the summary in JSON to path atomically.
+func (summary *SegmentSummary) WriteFile(path string) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
 	}
-	siunit := matches[re.SubexpIndex("siunit")]
-	switch siunit {
-	case "k":
-		seg.First = seg.First*1_000 + 1
-		seg.Last = seg.Last * 1_000
-	case "M":
-		seg.First = seg.First*1_000_000 + 1
-		seg.Last = seg.Last * 1_000_000
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path, so
+// that path is never left partially written.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
 	}
-	if seg.First > seg.Last {
-		return nil, fmt.Errorf("block segment first is larger than last: %v-%v", seg.First, seg.Last)
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
 	}
-	return seg, nil
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
 }
 
-type BlockSegmentList = []*BlockSegment
+// SegmentCheckpoint is the last block executed along with all blocks
+// before it in block segments.
+type SegmentCheckpoint struct {
+	Block uint64 `json:"block"`
+}
 
-func ParseBlockSegmentList(s string) (BlockSegmentList, error) {
-	var err error
+// maxProgressInterval is the maximum interval in seconds between progress
+// reports of executeSegmentList.
+const maxProgressInterval = 60
 
-	lxs := strings.Split(s, ",")
-	br := make(BlockSegmentList, len(lxs))
-	for i, lx := range lxs {
-		br[i], err = ParseBlockSegment(lx)
-		if err != nil {
-			return nil, err
+// progressCadence decides when executeSegmentList reports progress while
+// waiting for a block to finish.
+type progressCadence struct {
+	// maxPending is the number of finished blocks waiting in doneChan above
+	// which reports are coalesced. Blocks finishing faster than the blocks
+	// are counted in order make the throughput of a report jumpy, so the
+	// backlog is drained first.
+	maxPending int
+	// lastSec is the elapsed time of the last report in seconds.
+	lastSec float64
+}
+
+// due returns true if progress is reported at block, the block waited for,
+// after sec seconds with pending finished blocks waiting in doneChan. Last is
+// the last block of the segment. Blocks divisible by large powers of ten are
+// reported more often, and progress is reported at least every
+// maxProgressInterval seconds, even while coalescing.
+func (c *progressCadence) due(block, last uint64, sec float64, pending int) bool {
+	if block == last {
+		return true
+	}
+	if pending > c.maxPending && sec <= c.lastSec+maxProgressInterval {
+		return false
+	}
+	return (block%10000 == 0 && sec > c.lastSec+5) ||
+		(block%1000 == 0 && sec > c.lastSec+10) ||
+		(block%100 == 0 && sec > c.lastSec+20) ||
+		(block%10 == 0 && sec > c.lastSec+40) ||
+		(sec > c.lastSec+maxProgressInterval)
+}
+
+// checkpointInterval is the minimum interval between checkpoint writes.
+var checkpointInterval = 10 * time.Second
+
+// writeCheckpoint writes checkpoint to CheckpointPath after
+// CheckpointSyncFunc succeeds.
+func (pool *SubstateTaskPool) writeCheckpoint(checkpoint *SegmentCheckpoint) error {
+	if pool.CheckpointSyncFunc != nil {
+		if err := pool.CheckpointSyncFunc(); err != nil {
+			return err
 		}
 	}
+	return checkpoint.WriteFile(pool.CheckpointPath)
+}
 
-	return br, nil
+// ReadSegmentCheckpoint reads a checkpoint written to path by a task pool. It
+// returns nil if path does not exist.
+func ReadSegmentCheckpoint(path string) (*SegmentCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &SegmentCheckpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("record-replay: invalid checkpoint %s: %v", path, err)
+	}
+	return checkpoint, nil
 }
 
-type SubstateTaskFunc func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error
+// WriteFile writes the checkpoint in JSON to path atomically.
+func (checkpoint *SegmentCheckpoint) WriteFile(path string) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
 
-type SubstateTaskConfig struct {
-	Workers int
+// Resume returns block segments of list with blocks after the checkpoint
+// executed every stride blocks. Block segments ending at or before the
+// checkpoint are removed.
+func (checkpoint *SegmentCheckpoint) Resume(list BlockSegmentList, stride uint64) BlockSegmentList {
+	var resumed BlockSegmentList
+	for _, segment := range list {
+		last := strideLast(segment, stride)
+		if last <= checkpoint.Block {
+			continue
+		}
+		if segment.First <= checkpoint.Block {
+			first := segment.First + ((checkpoint.Block-segment.First)/stride+1)*stride
+			segment = NewBlockSegment(first, segment.Last)
+		}
+		resumed = append(resumed, segment)
+	}
+	return resumed
+}
 
-	SkipTransferTxs bool
-	SkipCallTxs     bool
-	SkipCreateTxs   bool
+// printSegmentStats logs the summary of executed block segments.
+func (pool *SubstateTaskPool) printSegmentStats(list BlockSegmentList, stats SegmentStats) {
+	if pool.Quiet {
+		return
+	}
+	logger := pool.Log().With("task", pool.Name)
+	for _, segment := range list {
+		logger.Info("block segment", "first", segment.First, "last", segment.Last)
+	}
+	logger.Info("done",
+		"blocks", stats.NumBlock,
+		"txs", stats.NumTx,
+		"blkPerSec", roundRate(stats.BlkPerSec),
+		"txPerSec", roundRate(stats.TxPerSec),
+		"duration", stats.Duration.Round(1*time.Millisecond),
+	)
+	if pool.Config.TxTypeBreakdown {
+		logger.Info("tx types",
+			"transfer", stats.TxTypes.Transfer,
+			"call", stats.TxTypes.Call,
+			"create", stats.TxTypes.Create,
+		)
+	}
+	if decodeErrs := pool.DecodeErrors(); len(decodeErrs) > 0 {
+		logger.Warn("skipped substates failing to decode", "substates", len(decodeErrs))
+	}
 }
 
-func NewSubstateTaskConfigCli(ctx *cli.Context) *SubstateTaskConfig {
-	return &SubstateTaskConfig{
-		Workers: ctx.Int(WorkersFlag.Name),
+// roundRate rounds a rate to 2 decimal places for logging.
+func roundRate(rate float64) float64 {
+	return math.Round(rate*100) / 100
+}
 
-		SkipTransferTxs: ctx.Bool(SkipTransferTxsFlag.Name),
-		SkipCallTxs:     ctx.Bool(SkipCallTxsFlag.Name),
-		SkipCreateTxs:   ctx.Bool(SkipCreateTxsFlag.Name),
+// EstimateETA returns the estimated time to execute the remaining blocks at
+// the given rate. It returns false if the rate is not known yet.
+func EstimateETA(remaining uint64, blkPerSec float64) (time.Duration, bool) {
+	if blkPerSec <= 0 || math.IsInf(blkPerSec, 0) || math.IsNaN(blkPerSec) {
+		return 0, false
 	}
+	sec := float64(remaining) / blkPerSec
+	if sec >= float64(math.MaxInt64)/float64(time.Second) {
+		return 0, false
+	}
+	return time.Duration(sec * float64(time.Second)), true
 }
 
-type SubstateTaskPool struct {
-	Name     string
-	TaskFunc SubstateTaskFunc
-	Config   *SubstateTaskConfig
+// NotifySignalContext returns a copy of parent that is cancelled on the first
+// SIGINT or SIGTERM, so that ExecuteSegmentContext stops scheduling blocks and
+// returns after in-flight blocks. A second signal terminates the process.
+func NotifySignalContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// restore the default behavior to terminate on the next signal
+		stop()
+	}()
+	return ctx, stop
+}
 
-	DB *SubstateDB
+// Execute function spawns worker goroutines and schedule tasks.
+func (pool *SubstateTaskPool) ExecuteSegment(segment *BlockSegment) error {
+	return pool.ExecuteSegmentContext(context.Background(), segment)
 }
 
-func NewSubstateTaskPool(name string, taskFunc SubstateTaskFunc, config *SubstateTaskConfig) *SubstateTaskPool {
-	return &SubstateTaskPool{
-		Name:     name,
-		TaskFunc: taskFunc,
-		Config:   config,
+// ExecuteSegmentContext function is ExecuteSegment that stops scheduling and
+// executing blocks and returns ctx.Err() when ctx is cancelled.
+func (pool *SubstateTaskPool) ExecuteSegmentContext(ctx context.Context, segment *BlockSegment) error {
+	list := BlockSegmentList{segment}
+	stats, err := pool.executeSegmentList(ctx, list)
+	pool.printSegmentStats(list, stats)
+	return err
+}
 
-		DB: staticSubstateDB,
-	}
+// ExecuteSegmentStats function is ExecuteSegment that returns statistics of
+// the execution instead of printing them.
+func (pool *SubstateTaskPool) ExecuteSegmentStats(segment *BlockSegment) (SegmentStats, error) {
+	return pool.executeSegmentList(context.Background(), BlockSegmentList{segment})
 }
 
-func NewSubstateTaskPoolCli(name string, taskFunc SubstateTaskFunc, ctx *cli.Context) *SubstateTaskPool {
-	return &SubstateTaskPool{
-		Name:     name,
-		TaskFunc: taskFunc,
-		Config:   NewSubstateTaskConfigCli(ctx),
+// ExecuteSegmentList function schedules blocks of all block segments through
+// the same worker goroutines in the given order. A single producer feeds
+// blocks of all segments to NumWorkers workers, so at most NumWorkers blocks
+// are executed at once regardless of the number of segments, and workers do
+// not wait for the previous segment to finish before starting the next one.
+func (pool *SubstateTaskPool) ExecuteSegmentList(list BlockSegmentList) error {
+	return pool.ExecuteSegmentListContext(context.Background(), list)
+}
 
-		DB: staticSubstateDB,
-	}
+// ExecuteSegmentListContext function is ExecuteSegmentList that can be
+// cancelled with ctx like ExecuteSegmentContext.
+func (pool *SubstateTaskPool) ExecuteSegmentListContext(ctx context.Context, list BlockSegmentList) error {
+	stats, err := pool.executeSegmentList(ctx, list)
+	pool.printSegmentStats(list, stats)
+	return err
 }
 
-// NumWorkers calculates number of workers especially when --workers=0
-func (pool *SubstateTaskPool) NumWorkers() int {
-	// return pool.Workers if it is positive integer
-	if pool.Config.Workers > 0 {
-		return pool.Config.Workers
-	}
+// ExecuteAll function executes all blocks from the first to the last block of
+// the substate DB. It returns immediately with zero stats if the substate DB
+// is empty.
+func (pool *SubstateTaskPool) ExecuteAll() error {
+	return pool.ExecuteAllContext(context.Background())
+}
 
-	// try to return number of physical cores
-	cores, err := cpu.Counts(false)
-	if err == nil {
-		return cores
+// ExecuteAllContext function is ExecuteAll that can be cancelled with ctx
+// like ExecuteSegmentContext.
+func (pool *SubstateTaskPool) ExecuteAllContext(ctx context.Context) error {
+	first, ok := pool.DB.FirstBlock()
+	if !ok {
+		pool.printSegmentStats(nil, SegmentStats{})
+		return nil
 	}
+	last, _ := pool.DB.LastBlock()
+	return pool.ExecuteSegmentContext(ctx, NewBlockSegment(first, last))
+}
 
-	// return number of logical cores
-	return runtime.NumCPU()
+// FollowConfig configures ExecuteFollowContext.
+type FollowConfig struct {
+	// Interval is the interval of polling the substate DB for new blocks. It
+	// must be positive.
+	Interval time.Duration
+	// Timeout stops following once no new block is found for Timeout, unless
+	// it is 0.
+	Timeout time.Duration
+	// Release is called before waiting for new blocks if it is not nil, e.g.
+	// to close a substate DB so that a recorder can open it for writing.
+	Release func() error
+	// Reopen is called after waiting if Release is not nil, to reopen the
+	// substate DB closed by Release. If its error wraps ErrSubstateDBLocked,
+	// the substate DB stays released and no new block is found until the next
+	// poll.
+	Reopen func() error
 }
 
-// ExecuteBlock function iterates on substates of a given block call TaskFunc
-func (pool *SubstateTaskPool) ExecuteBlock(block uint64) (numTx int64, err error) {
-	for tx, substate := range pool.DB.GetBlockSubstates(block) {
-		alloc := substate.InputAlloc
-		msg := substate.Message
-
-		to := msg.To
-		if pool.Config.SkipTransferTxs && to != nil {
-			// skip regular transactions (ETH transfer)
-			if account, exist := alloc[*to]; !exist || len(account.Code) == 0 {
-				continue
+// ExecuteFollowContext function executes blocks from block first to the last
+// block of the substate DB, and keeps following the last block: the substate
+// DB is polled every FollowConfig.Interval, and blocks put after the last
+// executed block are executed. It returns nil once ctx is cancelled while
+// polling or no new block is found for FollowConfig.Timeout, and the error of
+// ExecuteSegmentListContext if executing blocks fails or is interrupted. The
+// substate DB may still be released by FollowConfig.Release when it returns.
+func (pool *SubstateTaskPool) ExecuteFollowContext(ctx context.Context, first uint64, config FollowConfig) error {
+	if config.Interval <= 0 {
+		return fmt.Errorf("%s: invalid follow interval %v, must be positive", pool.Name, config.Interval)
+	}
+	logger := pool.Log().With("task", pool.Name)
+	next := first
+	lastFound := time.Now()
+	released := false
+	for {
+		if !released {
+			if last, ok := pool.DB.LastBlock(); ok && last >= next {
+				if err := pool.ExecuteSegmentListContext(ctx, BlockSegmentList{NewBlockSegment(next, last)}); err != nil {
+					return err
+				}
+				if last == math.MaxUint64 {
+					return nil
+				}
+				next, lastFound = last+1, time.Now()
 			}
 		}
-		if pool.Config.SkipCallTxs && to != nil {
-			// skip CALL trasnactions with contract bytecode
-			if account, exist := alloc[*to]; exist && len(account.Code) > 0 {
-				continue
+
+		wait := config.Interval
+		if config.Timeout > 0 {
+			remaining := config.Timeout - time.Since(lastFound)
+			if remaining <= 0 {
+				if !pool.Quiet {
+					logger.Info("follow timeout", "timeout", config.Timeout, "next", next)
+				}
+				return nil
+			}
+			// poll once more at the timeout
+			if remaining < wait {
+				wait = remaining
 			}
 		}
-		if pool.Config.SkipCreateTxs && to == nil {
-			// skip CREATE transactions
-			continue
+		if config.Release != nil && !released {
+			if err := config.Release(); err != nil {
+				return fmt.Errorf("%s: error releasing substate DB: %v", pool.Name, err)
+			}
+			released = true
 		}
-
-		err = pool.TaskFunc(block, tx, substate, pool)
-		if err != nil {
-			return numTx, fmt.Errorf("%s: %v_%v: %v", pool.Name, block, tx, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			if !pool.Quiet {
+				logger.Info("follow stopped", "next", next)
+			}
+			return nil
 		}
+		if released {
+			err := config.Reopen()
+			switch {
+			case errors.Is(err, ErrSubstateDBLocked):
+				if !pool.Quiet {
+					logger.Info("follow substate DB locked", "next", next)
+				}
+			case err != nil:
+				return fmt.Errorf("%s: error reopening substate DB: %v", pool.Name, err)
+			default:
+				released = false
+			}
+		}
+	}
+}
 
-		numTx++
+// blockStride returns the stride between executed blocks, at least 1.
+func (pool *SubstateTaskPool) blockStride() uint64 {
+	if pool.Config.BlockStride < 1 {
+		return 1
 	}
+	return uint64(pool.Config.BlockStride)
+}
 
-	return numTx, nil
+// strideLast returns the last block of segment executed every stride blocks.
+func strideLast(segment *BlockSegment, stride uint64) uint64 {
+	return segment.First + (segment.Last-segment.First)/stride*stride
 }
 
-// Execute function spawns worker goroutines and schedule tasks.
-func (pool *SubstateTaskPool) ExecuteSegment(segment *BlockSegment) error {
+// strideLen returns the number of blocks of segment executed every stride
+// blocks. It saturates at math.MaxUint64 for the full range
+// 0-OpenBlockSegmentLast with stride 1, instead of wrapping around to 0.
+func strideLen(segment *BlockSegment, stride uint64) uint64 {
+	n := (segment.Last - segment.First) / stride
+	if n == math.MaxUint64 {
+		return n
+	}
+	return n + 1
+}
+
+// resolveOpenSegments returns list with the Last of an open-ended block
+// segment replaced with the last block of DB, and the segment removed if DB
+// has no block from its First. Other segments are kept as they are. An
+// open-ended segment is never executed up to OpenBlockSegmentLast, so it is
+// an error if there is no DB to resolve it.
+func (pool *SubstateTaskPool) resolveOpenSegments(list BlockSegmentList) (BlockSegmentList, error) {
+	resolved := make(BlockSegmentList, 0, len(list))
+	for _, segment := range list {
+		if segment.Last != OpenBlockSegmentLast {
+			resolved = append(resolved, segment)
+			continue
+		}
+		if pool.DB == nil {
+			return nil, fmt.Errorf("cannot resolve open-ended block segment %v-: no substate DB", segment.First)
+		}
+		last, ok := pool.DB.LastBlock()
+		if !ok || last < segment.First {
+			continue
+		}
+		resolved = append(resolved, NewBlockSegment(segment.First, last))
+	}
+	return resolved, nil
+}
+
+// executeSegmentList function spawns worker goroutines, schedules blocks of
+// all block segments, and returns aggregated statistics.
+func (pool *SubstateTaskPool) executeSegmentList(ctx context.Context, list BlockSegmentList) (stats SegmentStats, err error) {
 	start := time.Now()
+	numWorkers := pool.NumWorkers()
+	stride := pool.blockStride()
+	logger := pool.Log().With("task", pool.Name)
+	pool.txTypes = TxTypeCounts{}
+	pool.decodeErrsMu.Lock()
+	pool.decodeErrs = nil
+	pool.decodeErrsMu.Unlock()
+
+	list, err = pool.resolveOpenSegments(list)
+	if err != nil {
+		return stats, fmt.Errorf("%s: %v", pool.Name, err)
+	}
+
+	if pool.CheckpointPath != "" {
+		checkpoint, err := ReadSegmentCheckpoint(pool.CheckpointPath)
+		if err != nil {
+			return stats, fmt.Errorf("%s: %v", pool.Name, err)
+		}
+		if checkpoint != nil {
+			list = checkpoint.Resume(list, stride)
+			if !pool.Quiet {
+				logger.Info("resume from checkpoint", "block", checkpoint.Block, "path", pool.CheckpointPath)
+			}
+		}
+	}
+
+	// no more workers than blocks to execute
+	var numBlocks uint64
+	for _, segment := range list {
+		if n := strideLen(segment, stride); numBlocks+n < numBlocks {
+			numBlocks = math.MaxUint64
+		} else {
+			numBlocks += n
+		}
+	}
+	if numBlocks < uint64(numWorkers) {
+		numWorkers = int(numBlocks)
+	}
 
 	var totalNumBlock, totalNumTx int64
+	// checkpoint is the last block done in order, if any
+	var checkpoint *SegmentCheckpoint
+	var lastCheckpointWrite time.Time
 	defer func() {
-		duration := time.Since(start) + 1*time.Nanosecond
-		sec := duration.Seconds()
-
 		nb, nt := atomic.LoadInt64(&totalNumBlock), atomic.LoadInt64(&totalNumTx)
-		blkPerSec := float64(nb) / sec
-		txPerSec := float64(nt) / sec
-		fmt.Printf("%s: block segment = %v %v\n", pool.Name, segment.First, segment.Last)
-		fmt.Printf("%s: total #block = %v\n", pool.Name, nb)
-		fmt.Printf("%s: total #tx    = %v\n", pool.Name, nt)
-		fmt.Printf("%s: %.2f blk/s, %.2f tx/s\n", pool.Name, blkPerSec, txPerSec)
-		fmt.Printf("%s done in %v\n", pool.Name, duration.Round(1*time.Millisecond))
+		stats = NewSegmentStats(nb, nt, time.Since(start))
+		stats.TxTypes = pool.txTypes.load()
+
+		if pool.CheckpointPath != "" && checkpoint != nil {
+			if werr := pool.writeCheckpoint(checkpoint); werr != nil && err == nil {
+				err = fmt.Errorf("%s: error writing checkpoint: %v", pool.Name, werr)
+			}
+		}
+
+		if pool.SummaryPath != "" {
+			summary := NewSegmentSummary(list, stats, numWorkers, err)
+			if werr := summary.WriteFile(pool.SummaryPath); werr != nil && err == nil {
+				err = werr
+			}
+		}
 	}()
 
-	numWorkers := pool.NumWorkers()
 	// numProcs = numWorkers + work producer (1) + main thread (1)
 	numProcs := numWorkers + 2
-	if goMaxProcs := runtime.GOMAXPROCS(0); goMaxProcs < numProcs {
+	if goMaxProcs := runtime.GOMAXPROCS(0); numWorkers > 1 && goMaxProcs < numProcs {
 		runtime.GOMAXPROCS(numProcs)
+		if pool.RestoreGOMAXPROCS {
+			// deferred before stopping workers, so restored after they stop
+			defer runtime.GOMAXPROCS(goMaxProcs)
+		}
+	}
+
+	if !pool.Quiet {
+		for _, segment := range list {
+			logger.Info("block segment", "first", segment.First, "last", segment.Last, "blocks", strideLen(segment, stride))
+		}
+		logger.Info("workers", "workers", numWorkers)
+	}
+
+	// blockDone is called for each block done in order
+	blockDone := func(block uint64) error {
+		if pool.BlockDoneFunc != nil {
+			pool.BlockDoneFunc(block)
+		}
+		if pool.CheckpointPath != "" {
+			checkpoint = &SegmentCheckpoint{Block: block}
+			if time.Since(lastCheckpointWrite) >= checkpointInterval {
+				if err := pool.writeCheckpoint(checkpoint); err != nil {
+					return fmt.Errorf("%s: error writing checkpoint: %v", pool.Name, err)
+				}
+				lastCheckpointWrite = time.Now()
+			}
+		}
+		return nil
+	}
+
+	// reportProgress reports progress while waiting for block of list[i]
+	// ending at last, with pending finished blocks not counted yet
+	cadence := progressCadence{maxPending: numWorkers}
+	var lastNumBlock, lastNumTx int64
+	reportProgress := func(i int, block, last uint64, pending int) {
+		duration := time.Since(start) + 1*time.Nanosecond
+		sec := duration.Seconds()
+		if cadence.due(block, last, sec, pending) {
+			lastSec := cadence.lastSec
+			nb, nt := atomic.LoadInt64(&totalNumBlock), atomic.LoadInt64(&totalNumTx)
+			progress := SegmentStats{
+				NumBlock: nb,
+				NumTx:    nt,
+				Duration: duration,
+
+				BlkPerSec: float64(nb-lastNumBlock) / (sec - lastSec),
+				TxPerSec:  float64(nt-lastNumTx) / (sec - lastSec),
+			}
+			pool.Metrics.updateRate(progress)
+			if pool.ProgressFunc != nil {
+				pool.ProgressFunc(block, progress)
+			} else if !pool.Quiet {
+				attrs := []interface{}{
+					"block", block,
+					"elapsed", duration.Round(1 * time.Millisecond),
+					"blkPerSec", roundRate(progress.BlkPerSec),
+					"txPerSec", roundRate(progress.TxPerSec),
+				}
+				if len(list) > 1 {
+					attrs = append(attrs, "segment", fmt.Sprintf("%v/%v", i+1, len(list)))
+				}
+				remaining := (last-block)/stride + 1
+				for _, next := range list[i+1:] {
+					remaining += strideLen(next, stride)
+				}
+				if eta, ok := EstimateETA(remaining, progress.BlkPerSec); ok {
+					attrs = append(attrs, "eta", eta.Round(1*time.Second), "etaAt", time.Now().Add(eta).Format("2006-01-02 15:04:05"))
+				} else {
+					attrs = append(attrs, "eta", "unknown")
+				}
+				logger.Info("progress", attrs...)
+			}
+
+			cadence.lastSec, lastNumBlock, lastNumTx = sec, nb, nt
+		}
+	}
+
+	// tolerated are errors of failed blocks within Config.ErrorBudget
+	var tolerated []error
+	// tolerate returns an error aborting execution if a failed block exceeds
+	// Config.ErrorBudget
+	tolerate := func(t blockError) error {
+		if len(tolerated) >= pool.Config.ErrorBudget {
+			if len(tolerated) == 0 {
+				return t.err
+			}
+			return errors.Join(append(tolerated, t.err)...)
+		}
+		tolerated = append(tolerated, t.err)
+		if !pool.Quiet {
+			logger.Warn("tolerated error", "block", t.block, "errors", len(tolerated), "budget", pool.Config.ErrorBudget, "err", t.err)
+		}
+		return nil
+	}
+
+	// limiter paces scheduling blocks if Config.MaxBlocksPerSec is positive
+	var limiter *rate.Limiter
+	if pool.Config.MaxBlocksPerSec > 0 {
+		limiter = rate.NewLimiter(rate.Limit(pool.Config.MaxBlocksPerSec), 1)
+	}
+
+	if pool.Config.DebugSerial {
+		// execute blocks in order on the calling goroutine
+		for i, segment := range list {
+			last := strideLast(segment, stride)
+			for block := segment.First; block <= last; block += stride {
+				err := ctx.Err()
+				if err == nil && limiter != nil {
+					err = limiter.Wait(ctx)
+				}
+				if err != nil {
+					// all blocks before block are finished
+					return stats, fmt.Errorf("%s: interrupted at block %v: %w", pool.Name, block, err)
+				}
+				reportProgress(i, block, last, 0)
+
+				nt, err := pool.ExecuteBlock(block)
+				total := atomic.AddInt64(&totalNumTx, nt)
+				atomic.AddInt64(&totalNumBlock, 1)
+				pool.Metrics.addBlock(nt, err)
+				if err != nil {
+					if err := tolerate(blockError{block: block, err: err}); err != nil {
+						return stats, err
+					}
+				}
+				if err := blockDone(block); err != nil {
+					return stats, err
+				}
+
+				if pool.Config.TxLimit > 0 && total >= int64(pool.Config.TxLimit) {
+					if !pool.Quiet {
+						logger.Info("tx limit reached", "limit", pool.Config.TxLimit, "block", block)
+					}
+					return stats, nil
+				}
+			}
+		}
+		return stats, nil
 	}
 
-	fmt.Printf("%s: block segment = %v-%v\n", pool.Name, segment.First, segment.Last)
-	fmt.Printf("%s: workers = %v\n", pool.Name, numWorkers)
+	// limitChan is closed once Config.TxLimit transactions are executed
+	limitChan := make(chan struct{})
+	var limitOnce sync.Once
 
 	workChan := make(chan uint64, numWorkers*1000)
 	doneChan := make(chan interface{}, numWorkers*1000)
-	stopChan := make(chan struct{}, numWorkers)
+	// stop workers and work producer when returning or when ctx is cancelled
+	ctx, cancel := context.WithCancel(ctx)
 	wg := sync.WaitGroup{}
 	defer func() {
-		// stop all workers
-		for i := 0; i < numWorkers; i++ {
-			stopChan <- struct{}{}
-		}
-		// stop work producer (1)
-		stopChan <- struct{}{}
-
+		cancel()
 		wg.Wait()
 		close(workChan)
 		close(doneChan)
@@ -265,16 +1830,30 @@ func (pool *SubstateTaskPool) ExecuteSegment(segment *BlockSegment) error {
 				select {
 
 				case block := <-workChan:
+					// stop promptly without draining workChan
+					select {
+					case <-limitChan:
+						return
+					default:
+					}
+
+					var done interface{} = block
 					nt, err := pool.ExecuteBlock(block)
-					atomic.AddInt64(&totalNumTx, nt)
+					if total := atomic.AddInt64(&totalNumTx, nt); pool.Config.TxLimit > 0 && total >= int64(pool.Config.TxLimit) {
+						limitOnce.Do(func() { close(limitChan) })
+					}
 					atomic.AddInt64(&totalNumBlock, 1)
+					pool.Metrics.addBlock(nt, err)
 					if err != nil {
-						doneChan <- err
-					} else {
-						doneChan <- block
+						done = blockError{block: block, err: err}
+					}
+					select {
+					case doneChan <- done:
+					case <-ctx.Done():
+						return
 					}
 
-				case <-stopChan:
+				case <-ctx.Done():
 					return
 
 				}
@@ -287,65 +1866,81 @@ func (pool *SubstateTaskPool) ExecuteSegment(segment *BlockSegment) error {
 	go func() {
 		defer wg.Done()
 
-		for block := segment.First; block <= segment.Last; block++ {
-			select {
+		for _, segment := range list {
+			last := strideLast(segment, stride)
+			for block := segment.First; block <= last; block += stride {
+				if limiter != nil && limiter.Wait(ctx) != nil {
+					return
+				}
+				select {
 
-			case workChan <- block:
-				continue
+				case workChan <- block:
+					continue
 
-			case <-stopChan:
-				return
+				case <-limitChan:
+					return
+
+				case <-ctx.Done():
+					return
 
+				}
 			}
 		}
 	}()
 
 	// Count finished blocks in order and report execution speed
-	var lastSec float64
-	var lastNumBlock, lastNumTx int64
-	waitMap := make(map[uint64]struct{})
-	for block := segment.First; block <= segment.Last; {
-
-		// Count finshed blocks from waitMap in order
-		if _, ok := waitMap[block]; ok {
-			delete(waitMap, block)
+	// waitMap counts finished blocks, a block may appear in several segments
+	waitMap := make(map[uint64]int)
+	for i, segment := range list {
+		last := strideLast(segment, stride)
+		for block := segment.First; block <= last; {
 
-			block++
-			continue
-		}
+			// Count finshed blocks from waitMap in order
+			if n := waitMap[block]; n > 0 {
+				if n == 1 {
+					delete(waitMap, block)
+				} else {
+					waitMap[block] = n - 1
+				}
+				if err := blockDone(block); err != nil {
+					return stats, err
+				}
 
-		duration := time.Since(start) + 1*time.Nanosecond
-		sec := duration.Seconds()
-		if block == segment.Last ||
-			(block%10000 == 0 && sec > lastSec+5) ||
-			(block%1000 == 0 && sec > lastSec+10) ||
-			(block%100 == 0 && sec > lastSec+20) ||
-			(block%10 == 0 && sec > lastSec+40) ||
-			(sec > lastSec+60) {
-			nb, nt := atomic.LoadInt64(&totalNumBlock), atomic.LoadInt64(&totalNumTx)
-			blkPerSec := float64(nb-lastNumBlock) / (sec - lastSec)
-			txPerSec := float64(nt-lastNumTx) / (sec - lastSec)
-			fmt.Printf("%s: elapsed time: %v, number = %v\n", pool.Name, duration.Round(1*time.Millisecond), block)
-			fmt.Printf("%s: %.2f blk/s, %.2f tx/s\n", pool.Name, blkPerSec, txPerSec)
+				block += stride
+				continue
+			}
 
-			lastSec, lastNumBlock, lastNumTx = sec, nb, nt
-		}
+			reportProgress(i, block, last, len(doneChan))
 
-		data := <-doneChan
-		switch t := data.(type) {
+			var data interface{}
+			select {
+			case data = <-doneChan:
+			case <-limitChan:
+				if !pool.Quiet {
+					logger.Info("tx limit reached", "limit", pool.Config.TxLimit, "block", block)
+				}
+				return stats, nil
+			case <-ctx.Done():
+				// all blocks before block are finished
+				return stats, fmt.Errorf("%s: interrupted at block %v: %w", pool.Name, block, ctx.Err())
+			}
+			switch t := data.(type) {
 
-		case uint64:
-			waitMap[data.(uint64)] = struct{}{}
+			case uint64:
+				waitMap[data.(uint64)]++
 
-		case error:
-			err := data.(error)
-			return err
+			case blockError:
+				if err := tolerate(t); err != nil {
+					return stats, err
+				}
+				waitMap[t.block]++
 
-		default:
-			panic(fmt.Errorf("%s: unknown type %T value from doneChan", pool.Name, t))
+			default:
+				panic(fmt.Errorf("%s: unknown type %T value from doneChan", pool.Name, t))
 
+			}
 		}
 	}
 
-	return nil
+	return stats, nil
 }
@@ -0,0 +1,2038 @@
+package research
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	cli "github.com/urfave/cli/v2"
+)
+
+func TestExecuteSegmentList(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1:  {0},
+		2:  {0, 1},
+		5:  {0, 1, 2},
+		11: {0},
+		20: {0, 1},
+	})
+	defer db.Close()
+
+	var mu sync.Mutex
+	visited := make(map[uint64]int)
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		visited[block]++
+		return nil
+	}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 3},
+
+		DB: db,
+	}
+
+	list := BlockSegmentList{NewBlockSegment(1, 5), NewBlockSegment(10, 20)}
+	if err := pool.ExecuteSegmentList(list); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[uint64]int{1: 1, 2: 2, 5: 3, 11: 1, 20: 2}
+	if len(visited) != len(want) {
+		t.Fatalf("visited blocks mismatch: have %v, want %v", visited, want)
+	}
+	for block, n := range want {
+		if visited[block] != n {
+			t.Fatalf("block %v: visited txs mismatch: have %v, want %v", block, visited[block], n)
+		}
+	}
+}
+
+func TestExecuteSegmentListWorkerBudget(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1:  {0},
+		2:  {0},
+		10: {0},
+		11: {0},
+		20: {0},
+		21: {0},
+	})
+	defer db.Close()
+
+	var running, maxRunning int64
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		n := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			m := atomic.LoadInt64(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 3},
+
+		DB: db,
+
+		Quiet: true,
+	}
+
+	// segments of 2 blocks each share the 3 workers
+	list := BlockSegmentList{NewBlockSegment(1, 2), NewBlockSegment(10, 11), NewBlockSegment(20, 21)}
+	if err := pool.ExecuteSegmentList(list); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if numWorkers := int64(pool.NumWorkers()); maxRunning > numWorkers {
+		t.Fatalf("too many concurrent tasks: have %v, want at most %v", maxRunning, numWorkers)
+	}
+	if maxRunning < 3 {
+		t.Fatalf("blocks of different segments are not executed concurrently: %v concurrent tasks", maxRunning)
+	}
+}
+
+func TestExecuteSegmentListError(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1:  {0},
+		11: {0},
+		20: {0},
+	})
+	defer db.Close()
+
+	errTask := errors.New("task error")
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		if block == 11 {
+			return errTask
+		}
+		return nil
+	}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 2},
+
+		DB: db,
+	}
+
+	list := BlockSegmentList{NewBlockSegment(1, 5), NewBlockSegment(10, 20)}
+	if err := pool.ExecuteSegmentList(list); err == nil {
+		t.Fatalf("error is not returned from TaskFunc")
+	}
+}
+
+func TestExecuteSegmentContextCancel(t *testing.T) {
+	blockTxs := make(map[uint64][]int)
+	for block := uint64(1); block <= 1_000; block++ {
+		blockTxs[block] = []int{0}
+	}
+	db := newTestSubstateDB(blockTxs)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var numTx int64
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		if atomic.AddInt64(&numTx, 1) == 10 {
+			cancel()
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 4},
+
+		DB: db,
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- pool.ExecuteSegmentContext(ctx, NewBlockSegment(1, 1_000))
+	}()
+	select {
+	case err := <-errChan:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("unexpected error: have %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ExecuteSegmentContext did not return after cancellation")
+	}
+	if n := atomic.LoadInt64(&numTx); n >= 1_000 {
+		t.Fatalf("all %v transactions are executed despite cancellation", n)
+	}
+}
+
+func TestExecuteSegmentStats(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1: {0, 1, 2},
+		3: {0},
+		7: {0, 1},
+	})
+	defer db.Close()
+
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		return nil
+	}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 2},
+
+		DB: db,
+	}
+
+	stats, err := pool.ExecuteSegmentStats(NewBlockSegment(1, 10))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.NumBlock != 10 || stats.NumTx != 6 {
+		t.Fatalf("stats mismatch: have %v blocks %v txs, want 10 blocks 6 txs", stats.NumBlock, stats.NumTx)
+	}
+	if stats.Duration <= 0 || stats.BlkPerSec <= 0 || stats.TxPerSec <= 0 {
+		t.Fatalf("invalid throughput in stats: %+v", stats)
+	}
+}
+
+func TestProgressFunc(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1: {0},
+		5: {0, 1},
+	})
+	defer db.Close()
+
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		if block == 5 {
+			// make the reporting loop wait for the last block
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}
+	var reported []uint64
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 2},
+
+		DB: db,
+
+		ProgressFunc: func(block uint64, stats SegmentStats) {
+			reported = append(reported, block)
+		},
+		Quiet: true,
+	}
+
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 5)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// progress is reported when waiting for the last block of a segment
+	if len(reported) == 0 || reported[len(reported)-1] != 5 {
+		t.Fatalf("progress is not reported at the last block: %v", reported)
+	}
+}
+
+func TestExecuteBlockParallelTxs(t *testing.T) {
+	txs := make([]int, 200)
+	for i := range txs {
+		txs[i] = i
+	}
+	db := newTestSubstateDB(map[uint64][]int{1: txs})
+	defer db.Close()
+
+	var mu sync.Mutex
+	visited := make(map[int]int)
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		visited[tx]++
+		return nil
+	}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 1, ParallelTxs: 8},
+
+		DB: db,
+	}
+
+	numTx, err := pool.ExecuteBlock(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if numTx != int64(len(txs)) || len(visited) != len(txs) {
+		t.Fatalf("visited txs mismatch: have %v (numTx %v), want %v", len(visited), numTx, len(txs))
+	}
+	for tx, n := range visited {
+		if n != 1 {
+			t.Fatalf("tx %v is visited %v times", tx, n)
+		}
+	}
+
+	errTask := errors.New("task error")
+	pool.TaskFunc = func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		if tx == 100 {
+			return errTask
+		}
+		return nil
+	}
+	numTx, err = pool.ExecuteBlock(1)
+	if err == nil {
+		t.Fatalf("error is not returned from parallel TaskFunc")
+	}
+	if numTx >= int64(len(txs)) {
+		t.Fatalf("numTx counts a failed tx: %v", numTx)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{1: {0}})
+	defer db.Close()
+
+	const failures = 3
+	var attempts []time.Time
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		attempts = append(attempts, time.Now())
+		if len(attempts) <= failures {
+			return errors.New("transient error")
+		}
+		return nil
+	}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 1},
+
+		DB: db,
+
+		RetryPolicy: RetryPolicy{
+			MaxAttempts: failures + 1,
+			BaseDelay:   5 * time.Millisecond,
+			Multiplier:  2,
+		},
+	}
+
+	numTx, err := pool.ExecuteBlock(1)
+	if err != nil || numTx != 1 {
+		t.Fatalf("unexpected result: numTx %v, err %v", numTx, err)
+	}
+	if len(attempts) != failures+1 {
+		t.Fatalf("number of attempts mismatch: have %v, want %v", len(attempts), failures+1)
+	}
+	for retry := 1; retry < len(attempts); retry++ {
+		if delay := attempts[retry].Sub(attempts[retry-1]); delay < pool.RetryPolicy.Delay(retry) {
+			t.Fatalf("retry %v: delay %v is shorter than %v", retry, delay, pool.RetryPolicy.Delay(retry))
+		}
+	}
+
+	// not enough attempts
+	attempts = nil
+	pool.RetryPolicy.MaxAttempts = failures
+	if _, err := pool.ExecuteBlock(1); err == nil {
+		t.Fatalf("error is not returned after the last attempt")
+	}
+	if len(attempts) != failures {
+		t.Fatalf("number of attempts mismatch: have %v, want %v", len(attempts), failures)
+	}
+
+	// zero value means no retries
+	attempts = nil
+	pool.RetryPolicy = RetryPolicy{}
+	if _, err := pool.ExecuteBlock(1); err == nil || len(attempts) != 1 {
+		t.Fatalf("zero RetryPolicy retried: %v attempts, err %v", len(attempts), err)
+	}
+}
+
+func TestSummaryJSON(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		2: {0, 1},
+		4: {0},
+	})
+	defer db.Close()
+
+	fail := false
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		if fail && block == 4 {
+			return errors.New("task error")
+		}
+		return nil
+	}
+	path := filepath.Join(t.TempDir(), "summary.json")
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 2},
+
+		DB: db,
+
+		Quiet:       true,
+		SummaryPath: path,
+	}
+
+	readSummary := func() *SegmentSummary {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("error reading summary: %v", err)
+		}
+		var summary SegmentSummary
+		if err := json.Unmarshal(data, &summary); err != nil {
+			t.Fatalf("error decoding summary: %v", err)
+		}
+		return &summary
+	}
+
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 5)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	summary := readSummary()
+	if len(summary.Segments) != 1 || summary.Segments[0].First != 1 || summary.Segments[0].Last != 5 {
+		t.Fatalf("segments mismatch: %+v", summary.Segments)
+	}
+	if summary.NumBlock != 5 || summary.NumTx != 3 || summary.Workers != 2 || summary.Error != "" {
+		t.Fatalf("summary mismatch: %+v", summary)
+	}
+	if summary.DurationSec <= 0 || summary.BlkPerSec <= 0 || summary.TxPerSec <= 0 {
+		t.Fatalf("invalid throughput in summary: %+v", summary)
+	}
+
+	fail = true
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 5)); err == nil {
+		t.Fatalf("error is not returned from TaskFunc")
+	}
+	if summary := readSummary(); summary.Error == "" {
+		t.Fatalf("error is not recorded in summary: %+v", summary)
+	}
+}
+
+func TestEstimateETA(t *testing.T) {
+	tests := []struct {
+		remaining uint64
+		blkPerSec float64
+		eta       time.Duration
+		ok        bool
+	}{
+		{1_000, 100, 10 * time.Second, true},
+		{20_000_000, 500, 40_000 * time.Second, true},
+		{0, 100, 0, true},
+		{1, 0.5, 2 * time.Second, true},
+		{1_000, 0, 0, false},
+		{1_000, -1, 0, false},
+		{1_000, math.Inf(1), 0, false},
+		{1_000, math.NaN(), 0, false},
+		{math.MaxUint64, 1e-9, 0, false},
+	}
+	for _, tt := range tests {
+		eta, ok := EstimateETA(tt.remaining, tt.blkPerSec)
+		if eta != tt.eta || ok != tt.ok {
+			t.Fatalf("EstimateETA(%v, %v) mismatch: have %v (%v), want %v (%v)", tt.remaining, tt.blkPerSec, eta, ok, tt.eta, tt.ok)
+		}
+	}
+}
+
+func TestWorkersClampedToSegmentLen(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1: {0},
+		2: {0},
+	})
+	defer db.Close()
+
+	var running, maxRunning int64
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		n := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			m := atomic.LoadInt64(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 8},
+
+		DB: db,
+
+		Quiet: true,
+	}
+
+	path := filepath.Join(t.TempDir(), "summary.json")
+	pool.SummaryPath = path
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 2)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if maxRunning > 2 {
+		t.Fatalf("too many concurrent tasks for 2 blocks: %v", maxRunning)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading summary: %v", err)
+	}
+	var summary SegmentSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("error decoding summary: %v", err)
+	}
+	if summary.Workers != 2 {
+		t.Fatalf("number of workers mismatch: have %v, want 2", summary.Workers)
+	}
+}
+
+func TestNotifySignalContext(t *testing.T) {
+	blockTxs := make(map[uint64][]int)
+	for block := uint64(1); block <= 1_000; block++ {
+		blockTxs[block] = []int{0}
+	}
+	srcDB := newTestSubstateDB(blockTxs)
+	defer srcDB.Close()
+	dstDB := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer dstDB.Close()
+
+	ctx, stop := NotifySignalContext(context.Background())
+	defer stop()
+
+	var numTx int64
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		dstDB.PutSubstate(block, tx, substate)
+		if atomic.AddInt64(&numTx, 1) == 10 {
+			process, err := os.FindProcess(os.Getpid())
+			if err != nil {
+				return err
+			}
+			if err = process.Signal(os.Interrupt); err != nil {
+				return err
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 4},
+
+		DB: srcDB,
+
+		Quiet: true,
+	}
+
+	err := pool.ExecuteSegmentContext(ctx, NewBlockSegment(1, 1_000))
+	if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "interrupted at block") {
+		t.Fatalf("unexpected error: have %v, want interruption", err)
+	}
+
+	// every written substate is intact
+	n := atomic.LoadInt64(&numTx)
+	if n >= 1_000 {
+		t.Fatalf("all %v transactions are executed despite the signal", n)
+	}
+	numBlocks, numTxs, err := dstDB.Count(0, OpenBlockSegmentLast)
+	if err != nil || numBlocks != uint64(n) || numTxs != uint64(n) {
+		t.Fatalf("written substates mismatch: have %v blocks %v txs (%v), want %v", numBlocks, numTxs, err, n)
+	}
+	err = dstDB.IterateSubstates(0, OpenBlockSegmentLast, func(key SubstateKey, substate *Substate) bool {
+		if !substate.Equal(srcDB.GetSubstate(key.Block, key.Tx)) {
+			t.Fatalf("written substate %v_%v is corrupted", key.Block, key.Tx)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSkipTxsByStatus(t *testing.T) {
+	// block 1: successful transfer, call and create, block 2: the same but failed
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	for block := uint64(1); block <= 2; block++ {
+		for tx := 0; tx < 3; tx++ {
+			sender, recipient := common.Address{0x01, byte(tx)}, common.Address{0x02, byte(tx)}
+			substate := newTestSubstate(block, sender, recipient)
+			switch tx {
+			case 1:
+				substate.InputAlloc[recipient] = NewSubstateAccount(0, big.NewInt(0), []byte{0x00})
+			case 2:
+				substate.Message.To = nil
+			}
+			if block == 2 {
+				substate.Result.Status = types.ReceiptStatusFailed
+			}
+			db.PutSubstate(block, tx, substate)
+		}
+	}
+
+	tests := []struct {
+		config SubstateTaskConfig
+		want   []SubstateKey
+	}{
+		{SubstateTaskConfig{}, []SubstateKey{{1, 0}, {1, 1}, {1, 2}, {2, 0}, {2, 1}, {2, 2}}},
+		{SubstateTaskConfig{SkipSuccessTxs: true}, []SubstateKey{{2, 0}, {2, 1}, {2, 2}}},
+		{SubstateTaskConfig{SkipFailedTxs: true}, []SubstateKey{{1, 0}, {1, 1}, {1, 2}}},
+		{SubstateTaskConfig{SkipSuccessTxs: true, SkipFailedTxs: true}, nil},
+		{SubstateTaskConfig{SkipSuccessTxs: true, SkipTransferTxs: true}, []SubstateKey{{2, 1}, {2, 2}}},
+		{SubstateTaskConfig{SkipFailedTxs: true, SkipCallTxs: true, SkipCreateTxs: true}, []SubstateKey{{1, 0}}},
+		// a transaction matching several skip options is skipped once
+		{SubstateTaskConfig{SkipSuccessTxs: true, SkipCreateTxs: true}, []SubstateKey{{2, 0}, {2, 1}}},
+	}
+	for i, tt := range tests {
+		for _, parallelTxs := range []int{1, 2} {
+			var mu sync.Mutex
+			executed := make(map[SubstateKey]int)
+			taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+				mu.Lock()
+				defer mu.Unlock()
+				executed[SubstateKey{block, tx}]++
+				return nil
+			}
+			config := tt.config
+			config.Workers = 2
+			config.ParallelTxs = parallelTxs
+			pool := &SubstateTaskPool{
+				Name:     "test",
+				TaskFunc: taskFunc,
+				Config:   &config,
+
+				DB: db,
+
+				Quiet: true,
+			}
+
+			stats, err := pool.ExecuteSegmentStats(NewBlockSegment(1, 2))
+			if err != nil {
+				t.Fatalf("test %v: unexpected error: %v", i, err)
+			}
+			if stats.NumTx != int64(len(tt.want)) || len(executed) != len(tt.want) {
+				t.Fatalf("test %v, parallel txs %v: number of txs mismatch: have %v (executed %v), want %v", i, parallelTxs, stats.NumTx, executed, tt.want)
+			}
+			for _, key := range tt.want {
+				if executed[key] != 1 {
+					t.Fatalf("test %v, parallel txs %v: tx %v_%v executed %v times, want once", i, parallelTxs, key.Block, key.Tx, executed[key])
+				}
+			}
+		}
+	}
+}
+
+func TestParseWeiValue(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"0", "0"},
+		{"1000", "1000"},
+		{"1_000wei", "1000"},
+		{"2gwei", "2000000000"},
+		{"1.5GWei", "1500000000"},
+		{"1eth", "1000000000000000000"},
+		{"0.1eth", "100000000000000000"},
+		{" 3 ETH ", "3000000000000000000"},
+	}
+	for _, tt := range tests {
+		have, err := ParseWeiValue(tt.s)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.s, err)
+		}
+		if have.String() != tt.want {
+			t.Fatalf("%q: value mismatch: have %v, want %v", tt.s, have, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", "eth", "-1", "1.5", "0.1gwei1", "1e18", "1/2eth", "0.0000000000000000001eth", "x"} {
+		if _, err := ParseWeiValue(s); err == nil {
+			t.Fatalf("%q: invalid value is parsed", s)
+		}
+	}
+}
+
+func TestMinValue(t *testing.T) {
+	values := []int64{0, 999, 1_000, 1_001, 1_000_000}
+	blockTxs := make(map[uint64][]int)
+	for block := uint64(1); block <= uint64(len(values)); block++ {
+		blockTxs[block] = []int{0}
+	}
+	db := newTestSubstateDB(blockTxs)
+	defer db.Close()
+	for i, value := range values {
+		block := uint64(i + 1)
+		substate := db.GetSubstate(block, 0)
+		substate.Message.Value = big.NewInt(value)
+		db.PutSubstate(block, 0, substate)
+	}
+
+	var mu sync.Mutex
+	var executed []int64
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		executed = append(executed, substate.Message.Value.Int64())
+		return nil
+	}
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 2, MinValue: big.NewInt(1_000)},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	stats, err := pool.ExecuteSegmentStats(NewBlockSegment(1, uint64(len(values))))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Slice(executed, func(i, j int) bool { return executed[i] < executed[j] })
+	if stats.NumTx != 3 || len(executed) != 3 || executed[0] != 1_000 || executed[1] != 1_001 || executed[2] != 1_000_000 {
+		t.Fatalf("executed values mismatch: have %v (%v txs), want [1000 1001 1000000]", executed, stats.NumTx)
+	}
+
+	// a nil value is regarded as zero
+	substate := newTestSubstate(1, common.Address{0x01}, common.Address{0x02})
+	substate.Message.Value = nil
+	if !pool.skipSubstate(substate) {
+		t.Fatalf("substate with nil value is not skipped")
+	}
+	pool.Config.MinValue = big.NewInt(0)
+	if pool.skipSubstate(substate) {
+		t.Fatalf("substate with nil value is skipped with zero MinValue")
+	}
+	pool.Config.MinValue = nil
+	if pool.skipSubstate(substate) {
+		t.Fatalf("substate is skipped without MinValue")
+	}
+}
+
+func TestSelectsSubstate(t *testing.T) {
+	target := common.Address{0xaa}
+	pool := &SubstateTaskPool{
+		Name:   "test",
+		Config: &SubstateTaskConfig{BlockStride: 3, TargetAddresses: map[common.Address]bool{target: true}},
+	}
+	segment := NewBlockSegment(10, 20)
+	tests := []struct {
+		block     uint64
+		recipient common.Address
+		selects   bool
+	}{
+		{10, target, true},
+		{11, target, false},
+		{13, target, true},
+		{13, common.Address{0x02}, false},
+		{19, target, true},
+		{22, target, false},
+		{7, target, false},
+	}
+	for _, tt := range tests {
+		substate := newTestSubstate(tt.block, common.Address{0x01}, tt.recipient)
+		if selects := pool.SelectsSubstate(segment, tt.block, substate); selects != tt.selects {
+			t.Fatalf("block %v, recipient %v: selects mismatch: have %v, want %v", tt.block, tt.recipient, selects, tt.selects)
+		}
+	}
+}
+
+func TestTargetAddresses(t *testing.T) {
+	target := common.Address{0xaa}
+	other := common.Address{0xbb}
+
+	senderOnly := newTestSubstate(1, target, other)
+	delete(senderOnly.InputAlloc, target)
+	delete(senderOnly.OutputAlloc, target)
+	recipientOnly := newTestSubstate(1, other, target)
+	delete(recipientOnly.OutputAlloc, target)
+	inputAllocOnly := newTestSubstate(1, other, common.Address{0xcc})
+	inputAllocOnly.InputAlloc[target] = NewSubstateAccount(0, big.NewInt(0), nil)
+	outputAllocOnly := newTestSubstate(1, other, common.Address{0xcc})
+	outputAllocOnly.OutputAlloc[target] = NewSubstateAccount(0, big.NewInt(0), nil)
+	unrelated := newTestSubstate(1, other, common.Address{0xcc})
+	create := newTestSubstate(1, other, common.Address{0xcc})
+	create.Message.To = nil
+
+	tests := []struct {
+		name     string
+		substate *Substate
+		skip     bool
+	}{
+		{"sender only", senderOnly, false},
+		{"recipient only", recipientOnly, false},
+		{"input alloc only", inputAllocOnly, false},
+		{"output alloc only", outputAllocOnly, false},
+		{"unrelated", unrelated, true},
+		{"unrelated create", create, true},
+	}
+	pool := &SubstateTaskPool{
+		Name:   "test",
+		Config: &SubstateTaskConfig{TargetAddresses: map[common.Address]bool{target: true}},
+	}
+	for _, tt := range tests {
+		if skip := pool.skipSubstate(tt.substate); skip != tt.skip {
+			t.Fatalf("%s: skip mismatch: have %v, want %v", tt.name, skip, tt.skip)
+		}
+	}
+
+	// an empty set means no filtering
+	pool.Config.TargetAddresses = map[common.Address]bool{}
+	for _, tt := range tests {
+		if pool.skipSubstate(tt.substate) {
+			t.Fatalf("%s: substate is skipped without target addresses", tt.name)
+		}
+	}
+
+	// only matching substates reach TaskFunc
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	for tx, tt := range tests {
+		db.PutSubstate(1, tx, tt.substate)
+	}
+	var numTx int64
+	pool = &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			if tests[tx].skip {
+				t.Errorf("%s: substate reaches TaskFunc", tests[tx].name)
+			}
+			atomic.AddInt64(&numTx, 1)
+			return nil
+		},
+		Config: &SubstateTaskConfig{Workers: 1, TargetAddresses: map[common.Address]bool{target: true}},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if numTx != 4 {
+		t.Fatalf("number of executed txs mismatch: have %v, want 4", numTx)
+	}
+}
+
+func TestCreatedContract(t *testing.T) {
+	deployer, other := common.Address{0xaa}, common.Address{0xbb}
+	contract := crypto.CreateAddress(deployer, 5)
+
+	creation := newTestSubstate(1, deployer, other)
+	creation.Message.To = nil
+	creation.Message.Nonce = 5
+	call := newTestSubstate(2, other, contract)
+	call.InputAlloc[contract] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+	// another contract by the same deployer
+	otherCreation := newTestSubstate(2, deployer, other)
+	otherCreation.Message.To = nil
+	otherCreation.Message.Nonce = 6
+	// the contract in alloc only, e.g. called by another contract
+	inAlloc := newTestSubstate(3, other, common.Address{0xcc})
+	inAlloc.InputAlloc[contract] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+	unrelated := newTestSubstate(3, other, common.Address{0xcc})
+
+	tests := []struct {
+		name     string
+		substate *Substate
+		match    bool
+	}{
+		{"creation", creation, true},
+		{"call", call, true},
+		{"other creation", otherCreation, false},
+		{"in alloc", inAlloc, false},
+		{"unrelated", unrelated, false},
+	}
+	for _, tt := range tests {
+		if match := CreatesOrCallsContract(tt.substate, contract); match != tt.match {
+			t.Fatalf("%s: match mismatch: have %v, want %v", tt.name, match, tt.match)
+		}
+	}
+
+	db := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer db.Close()
+	for tx, tt := range tests {
+		db.PutSubstate(1, tx, tt.substate)
+	}
+	var numTx int64
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			if !tests[tx].match {
+				t.Errorf("%s: substate reaches TaskFunc", tests[tx].name)
+			}
+			atomic.AddInt64(&numTx, 1)
+			return nil
+		},
+		Config: &SubstateTaskConfig{Workers: 1, CreatedContract: &contract},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if numTx != 2 {
+		t.Fatalf("number of executed txs mismatch: have %v, want 2", numTx)
+	}
+}
+
+// testLogHandler is a slog.Handler capturing log records.
+type testLogHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *testLogHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *testLogHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+func (h *testLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &testLogHandlerWithAttrs{h, attrs}
+}
+
+func (h *testLogHandler) WithGroup(string) slog.Handler { return h }
+
+// testLogHandlerWithAttrs adds attrs to records captured by testLogHandler.
+type testLogHandlerWithAttrs struct {
+	*testLogHandler
+	attrs []slog.Attr
+}
+
+func (h *testLogHandlerWithAttrs) Handle(ctx context.Context, r slog.Record) error {
+	r = r.Clone()
+	r.AddAttrs(h.attrs...)
+	return h.testLogHandler.Handle(ctx, r)
+}
+
+func TestSubstateTaskPoolLogger(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		3: {0, 1, 2, 3},
+	})
+	defer db.Close()
+
+	handler := &testLogHandler{}
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			return nil
+		},
+		Config: &SubstateTaskConfig{Workers: 2},
+
+		DB: db,
+
+		Logger: slog.New(handler),
+	}
+	if err := pool.ExecuteSegment(NewBlockSegment(3, 3)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	messages := make(map[string]map[string]slog.Value)
+	for _, r := range handler.records {
+		if r.Level != slog.LevelInfo {
+			t.Fatalf("%q: level mismatch: have %v, want %v", r.Message, r.Level, slog.LevelInfo)
+		}
+		attrs := make(map[string]slog.Value)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		messages[r.Message] = attrs
+	}
+
+	// progress is always reported at the only block of the segment, which is
+	// not finished before it is waited for
+	progress, exist := messages["progress"]
+	if !exist {
+		t.Fatalf("progress is not logged: %v", messages)
+	}
+	for _, key := range []string{"task", "block", "elapsed", "blkPerSec", "txPerSec", "eta"} {
+		if _, exist := progress[key]; !exist {
+			t.Fatalf("progress attribute %q is missing: %v", key, progress)
+		}
+	}
+	if have := progress["block"].Uint64(); have != 3 {
+		t.Fatalf("progress block mismatch: have %v, want 3", have)
+	}
+	if have := progress["task"].String(); have != "test" {
+		t.Fatalf("progress task mismatch: have %q, want %q", have, "test")
+	}
+
+	done, exist := messages["done"]
+	if !exist {
+		t.Fatalf("summary is not logged: %v", messages)
+	}
+	if have := done["blocks"].Int64(); have != 1 {
+		t.Fatalf("summary blocks mismatch: have %v, want 1", have)
+	}
+	if have := done["txs"].Int64(); have != 4 {
+		t.Fatalf("summary txs mismatch: have %v, want 4", have)
+	}
+	if _, exist := done["blkPerSec"]; !exist {
+		t.Fatalf("summary attribute blkPerSec is missing: %v", done)
+	}
+
+	// nothing is logged if the task pool is quiet
+	handler.records = nil
+	pool.Quiet = true
+	if err := pool.ExecuteSegment(NewBlockSegment(3, 3)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(handler.records) != 0 {
+		t.Fatalf("quiet task pool logged %v records", len(handler.records))
+	}
+}
+
+func TestExecuteAll(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		3:  {0, 1},
+		7:  {0},
+		12: {2},
+	})
+	defer db.Close()
+
+	var mu sync.Mutex
+	visited := make(map[uint64]int)
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			mu.Lock()
+			defer mu.Unlock()
+			visited[block]++
+			return nil
+		},
+		Config: &SubstateTaskConfig{Workers: 2},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	if err := pool.ExecuteAll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[uint64]int{3: 2, 7: 1, 12: 1}
+	if len(visited) != len(want) {
+		t.Fatalf("visited blocks mismatch: have %v, want %v", visited, want)
+	}
+	for block, n := range want {
+		if visited[block] != n {
+			t.Fatalf("block %v: visited txs mismatch: have %v, want %v", block, visited[block], n)
+		}
+	}
+
+	// an empty substate DB executes nothing
+	empty := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer empty.Close()
+	visited = make(map[uint64]int)
+	pool.DB = empty
+	if err := pool.ExecuteAll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(visited) != 0 {
+		t.Fatalf("visited blocks of empty substate DB: %v", visited)
+	}
+}
+
+func TestSubstateTaskPoolsWithDB(t *testing.T) {
+	newDB := func(sender common.Address, blocks ...uint64) *SubstateDB {
+		backend, err := rawdb.NewLevelDBDatabase(t.TempDir(), 16, 16, "substatedir", false)
+		if err != nil {
+			t.Fatalf("error creating substate DB: %v", err)
+		}
+		db := NewSubstateDB(backend)
+		for _, block := range blocks {
+			db.PutSubstate(block, 0, newTestSubstate(block, sender, common.Address{0xff}))
+		}
+		return db
+	}
+	senderA, senderB := common.Address{0x0a}, common.Address{0x0b}
+	dbA := newDB(senderA, 1, 2, 3, 4)
+	defer dbA.Close()
+	dbB := newDB(senderB, 3, 4, 5, 6)
+	defer dbB.Close()
+
+	// each pool records senders of the substates it visits
+	newPool := func(name string, db *SubstateDB) (*SubstateTaskPool, map[uint64]common.Address) {
+		var mu sync.Mutex
+		visited := make(map[uint64]common.Address)
+		taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			mu.Lock()
+			defer mu.Unlock()
+			visited[block] = substate.Message.From
+			return nil
+		}
+		pool := NewSubstateTaskPoolWithDB(name, taskFunc, &SubstateTaskConfig{Workers: 2}, db)
+		pool.Quiet = true
+		return pool, visited
+	}
+	poolA, visitedA := newPool("a", dbA)
+	poolB, visitedB := newPool("b", dbB)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, pool := range []*SubstateTaskPool{poolA, poolB} {
+		wg.Add(1)
+		go func(i int, pool *SubstateTaskPool) {
+			defer wg.Done()
+			errs[i] = pool.ExecuteSegment(NewBlockSegment(1, 6))
+		}(i, pool)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		visited map[uint64]common.Address
+		sender  common.Address
+		blocks  []uint64
+	}{
+		{visitedA, senderA, []uint64{1, 2, 3, 4}},
+		{visitedB, senderB, []uint64{3, 4, 5, 6}},
+	}
+	for _, tt := range tests {
+		if len(tt.visited) != len(tt.blocks) {
+			t.Fatalf("visited blocks mismatch: have %v, want %v", tt.visited, tt.blocks)
+		}
+		for _, block := range tt.blocks {
+			if from, exist := tt.visited[block]; !exist || from != tt.sender {
+				t.Fatalf("block %v: sender mismatch: have %v (%v), want %v", block, from.Hex(), exist, tt.sender.Hex())
+			}
+		}
+	}
+}
+
+func TestExecuteBlockTxOrder(t *testing.T) {
+	txs := []int{7, 0, 3, 1, 2, 5, 4, 6}
+	db := newTestSubstateDB(map[uint64][]int{10: txs})
+	defer db.Close()
+
+	have := db.GetBlockSubstates(10).Txs()
+	for tx := range txs {
+		if len(have) != len(txs) || have[tx] != tx {
+			t.Fatalf("tx indices mismatch: have %v, want 0-%v", have, len(txs)-1)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		var visited []int
+		pool := &SubstateTaskPool{
+			Name: "test",
+			TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+				visited = append(visited, tx)
+				return nil
+			},
+			Config: &SubstateTaskConfig{Workers: 1},
+
+			DB: db,
+		}
+		if _, err := pool.ExecuteBlock(10); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for tx := range txs {
+			if tx >= len(visited) || visited[tx] != tx {
+				t.Fatalf("visited tx order mismatch: have %v, want 0-%v", visited, len(txs)-1)
+			}
+		}
+	}
+}
+
+func TestExecuteSegmentTxLimit(t *testing.T) {
+	blockTxs := make(map[uint64][]int)
+	for block := uint64(1); block <= 1000; block++ {
+		blockTxs[block] = []int{0, 1}
+	}
+	db := newTestSubstateDB(blockTxs)
+	defer db.Close()
+
+	var numTx int64
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			atomic.AddInt64(&numTx, 1)
+			return nil
+		},
+		Config: &SubstateTaskConfig{Workers: 4, TxLimit: 100},
+
+		DB: db,
+	}
+	stats, err := pool.ExecuteSegmentStats(NewBlockSegment(1, 1000))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// in-flight blocks of other workers may overshoot the limit
+	if numTx < 100 || numTx > 100+4*2 {
+		t.Fatalf("number of executed txs mismatch: have %v, want 100-108", numTx)
+	}
+	if stats.NumTx != numTx {
+		t.Fatalf("reported number of txs mismatch: have %v, want %v", stats.NumTx, numTx)
+	}
+}
+
+func TestExecuteSegmentBlockStride(t *testing.T) {
+	blockTxs := make(map[uint64][]int)
+	for block := uint64(1); block <= 100; block++ {
+		blockTxs[block] = []int{0}
+	}
+	db := newTestSubstateDB(blockTxs)
+	defer db.Close()
+
+	tests := []struct {
+		first, last uint64
+		stride      int
+		want        []uint64
+	}{
+		{1, 100, 10, []uint64{1, 11, 21, 31, 41, 51, 61, 71, 81, 91}},
+		{5, 25, 10, []uint64{5, 15, 25}},
+		{1, 5, 1, []uint64{1, 2, 3, 4, 5}},
+		{1, 5, 0, []uint64{1, 2, 3, 4, 5}},
+		{3, 3, 10, []uint64{3}},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var scheduled, done []uint64
+		pool := &SubstateTaskPool{
+			Name: "test",
+			TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+				mu.Lock()
+				defer mu.Unlock()
+				scheduled = append(scheduled, block)
+				return nil
+			},
+			Config: &SubstateTaskConfig{Workers: 4, BlockStride: tt.stride},
+
+			DB: db,
+
+			Quiet: true,
+			BlockDoneFunc: func(block uint64) {
+				done = append(done, block)
+			},
+		}
+		stats, err := pool.ExecuteSegmentStats(NewBlockSegment(tt.first, tt.last))
+		if err != nil {
+			t.Fatalf("%v-%v/%v: unexpected error: %v", tt.first, tt.last, tt.stride, err)
+		}
+		sort.Slice(scheduled, func(i, j int) bool { return scheduled[i] < scheduled[j] })
+		if len(scheduled) != len(tt.want) || stats.NumBlock != int64(len(tt.want)) {
+			t.Fatalf("%v-%v/%v: scheduled blocks mismatch: have %v (%v blocks), want %v", tt.first, tt.last, tt.stride, scheduled, stats.NumBlock, tt.want)
+		}
+		for i, block := range tt.want {
+			if scheduled[i] != block || done[i] != block {
+				t.Fatalf("%v-%v/%v: blocks mismatch: scheduled %v, done %v, want %v", tt.first, tt.last, tt.stride, scheduled, done, tt.want)
+			}
+		}
+	}
+}
+
+func TestExecuteSegmentCheckpoint(t *testing.T) {
+	blocks := make(map[uint64][]int)
+	for block := uint64(1); block <= 50; block++ {
+		blocks[block] = []int{0}
+	}
+	db := newTestSubstateDB(blocks)
+	defer db.Close()
+
+	var mu sync.Mutex
+	executed := make(map[uint64]int)
+	crash := true
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if crash && block == 30 {
+			return errors.New("crash")
+		}
+		executed[block]++
+		return nil
+	}
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	// one worker reports blocks in order, so the checkpoint is deterministic
+	pool := &SubstateTaskPool{
+		Name:     "test",
+		TaskFunc: taskFunc,
+		Config:   &SubstateTaskConfig{Workers: 1},
+
+		DB: db,
+
+		Quiet:          true,
+		CheckpointPath: path,
+	}
+
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 50)); err == nil {
+		t.Fatalf("crash is not returned")
+	}
+	checkpoint, err := ReadSegmentCheckpoint(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading checkpoint: %v", err)
+	}
+	if checkpoint == nil || checkpoint.Block != 29 {
+		t.Fatalf("checkpoint mismatch: have %+v, want block 29", checkpoint)
+	}
+	firstRun := make(map[uint64]int)
+	for block, n := range executed {
+		firstRun[block] = n
+	}
+
+	crash = false
+	executed = make(map[uint64]int)
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 50)); err != nil {
+		t.Fatalf("unexpected error resuming: %v", err)
+	}
+	for block := uint64(1); block <= 50; block++ {
+		// blocks after the checkpoint are re-executed, even if the crashed
+		// run executed some of them out of order
+		n := firstRun[block]
+		if block > checkpoint.Block {
+			n = executed[block]
+		}
+		if n != 1 {
+			t.Fatalf("block %v is executed %v times", block, n)
+		}
+		if block <= checkpoint.Block && executed[block] != 0 {
+			t.Fatalf("block %v before the checkpoint is executed again", block)
+		}
+	}
+	checkpoint, _ = ReadSegmentCheckpoint(path)
+	if checkpoint == nil || checkpoint.Block != 50 {
+		t.Fatalf("checkpoint mismatch after resuming: have %+v, want block 50", checkpoint)
+	}
+
+	// a finished segment is not executed again
+	executed = make(map[uint64]int)
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 50)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(executed) != 0 {
+		t.Fatalf("blocks are executed after the last checkpoint: %v", executed)
+	}
+}
+
+func TestSegmentCheckpointResume(t *testing.T) {
+	list := BlockSegmentList{NewBlockSegment(1, 10), NewBlockSegment(20, 30), NewBlockSegment(40, 50)}
+	tests := []struct {
+		block  uint64
+		stride uint64
+		want   BlockSegmentList
+	}{
+		{block: 0, stride: 1, want: list},
+		{block: 5, stride: 1, want: BlockSegmentList{NewBlockSegment(6, 10), NewBlockSegment(20, 30), NewBlockSegment(40, 50)}},
+		{block: 15, stride: 1, want: BlockSegmentList{NewBlockSegment(20, 30), NewBlockSegment(40, 50)}},
+		{block: 25, stride: 4, want: BlockSegmentList{NewBlockSegment(28, 30), NewBlockSegment(40, 50)}},
+		// the last executed block of 40-50 with stride 4 is 48
+		{block: 48, stride: 4, want: nil},
+		{block: 50, stride: 1, want: nil},
+	}
+	for _, test := range tests {
+		have := (&SegmentCheckpoint{Block: test.block}).Resume(list, test.stride)
+		if len(have) != len(test.want) {
+			t.Fatalf("block %v stride %v: resumed %v, want %v", test.block, test.stride, have, test.want)
+		}
+		for i := range have {
+			if *have[i] != *test.want[i] {
+				t.Fatalf("block %v stride %v: resumed %v, want %v", test.block, test.stride, have, test.want)
+			}
+		}
+	}
+}
+
+func TestExecuteSegmentErrorBudget(t *testing.T) {
+	blocks := make(map[uint64][]int)
+	for block := uint64(1); block <= 20; block++ {
+		blocks[block] = []int{0, 1}
+	}
+	db := newTestSubstateDB(blocks)
+	defer db.Close()
+
+	// tx 1 of blocks 5, 10 and 15 fails
+	var numExecuted int64
+	taskFunc := func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		atomic.AddInt64(&numExecuted, 1)
+		if block%5 == 0 && block < 20 && tx == 1 {
+			return errors.New("task error")
+		}
+		return nil
+	}
+
+	tests := []struct {
+		budget int
+		fail   bool
+	}{
+		{budget: 0, fail: true},
+		{budget: 2, fail: true},
+		{budget: 3},
+		{budget: 10},
+	}
+	for _, test := range tests {
+		atomic.StoreInt64(&numExecuted, 0)
+		var done []uint64
+		pool := &SubstateTaskPool{
+			Name:     "test",
+			TaskFunc: taskFunc,
+			Config:   &SubstateTaskConfig{Workers: 4, ErrorBudget: test.budget},
+
+			DB: db,
+
+			Quiet:         true,
+			BlockDoneFunc: func(block uint64) { done = append(done, block) },
+		}
+		err := pool.ExecuteSegment(NewBlockSegment(1, 20))
+		if !test.fail {
+			if err != nil {
+				t.Fatalf("budget %v: unexpected error: %v", test.budget, err)
+			}
+			if numExecuted != 40 || len(done) != 20 {
+				t.Fatalf("budget %v: have %v txs %v blocks done, want 40 txs 20 blocks", test.budget, numExecuted, len(done))
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("budget %v: exceeded budget is not returned", test.budget)
+		}
+		// tolerated and exceeding errors are listed with block and tx
+		lines := strings.Split(err.Error(), "\n")
+		if len(lines) != test.budget+1 {
+			t.Fatalf("budget %v: %v errors are joined, want %v: %q", test.budget, len(lines), test.budget+1, err)
+		}
+		for _, line := range lines {
+			if line != "test: 5_1: task error" && line != "test: 10_1: task error" && line != "test: 15_1: task error" {
+				t.Fatalf("budget %v: unexpected error %q", test.budget, line)
+			}
+		}
+	}
+}
+
+func TestExecuteSegmentDecodeErrors(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{1: {0, 1, 2}, 2: {0}})
+	defer db.Close()
+	// a corrupt substate in the middle of block 1
+	if err := db.backend.Put(Stage1SubstateKey(1, 1), []byte{0xde, 0xad}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var mu sync.Mutex
+	var visited []SubstateKey
+	newPool := func(strict bool) *SubstateTaskPool {
+		visited = nil
+		pool := NewSubstateTaskPoolWithDB("test", func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			mu.Lock()
+			visited = append(visited, SubstateKey{block, tx})
+			mu.Unlock()
+			return nil
+		}, &SubstateTaskConfig{Workers: 2, StrictDecode: strict}, db)
+		pool.Quiet = true
+		return pool
+	}
+
+	pool := newPool(false)
+	if err := pool.ExecuteSegment(NewBlockSegment(1, 2)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Slice(visited, func(i, j int) bool {
+		return visited[i].Block < visited[j].Block || visited[i].Block == visited[j].Block && visited[i].Tx < visited[j].Tx
+	})
+	if want := []SubstateKey{{1, 0}, {1, 2}, {2, 0}}; !reflect.DeepEqual(visited, want) {
+		t.Fatalf("visited substates mismatch: have %v, want %v", visited, want)
+	}
+	decodeErrs := pool.DecodeErrors()
+	if len(decodeErrs) != 1 || decodeErrs[0].Key != (SubstateKey{1, 1}) || decodeErrs[0].Err == nil {
+		t.Fatalf("decode errors mismatch: have %v", decodeErrs)
+	}
+
+	// errors are reset for every execution
+	if err := pool.ExecuteSegment(NewBlockSegment(2, 2)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decodeErrs := pool.DecodeErrors(); len(decodeErrs) != 0 {
+		t.Fatalf("decode errors are not reset: %v", decodeErrs)
+	}
+
+	pool = newPool(true)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("no panic at corrupt substate with StrictDecode")
+			}
+		}()
+		pool.ExecuteBlock(1)
+	}()
+}
+
+func TestExecuteSegmentOpenEnded(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1: {0},
+		3: {0, 1},
+		5: {0},
+	})
+	defer db.Close()
+
+	var numTx int64
+	pool := &SubstateTaskPool{
+		Name: "test",
+		TaskFunc: func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			atomic.AddInt64(&numTx, 1)
+			return nil
+		},
+		Config: &SubstateTaskConfig{Workers: 4},
+
+		DB: db,
+
+		Quiet: true,
+	}
+	// execute blocks with a timeout, since an unresolved open end used to
+	// leave no workers and hang
+	execute := func(list BlockSegmentList) error {
+		done := make(chan error, 1)
+		go func() { done <- pool.ExecuteSegmentList(list) }()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%v: execution does not finish", list)
+			return nil
+		}
+	}
+
+	if err := execute(BlockSegmentList{NewBlockSegment(0, OpenBlockSegmentLast)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if numTx != 4 {
+		t.Fatalf("executed txs mismatch: have %v, want 4", numTx)
+	}
+
+	// an open-ended segment after the last block is empty
+	numTx = 0
+	if err := execute(BlockSegmentList{NewBlockSegment(1, 1), NewBlockSegment(6, OpenBlockSegmentLast)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if numTx != 1 {
+		t.Fatalf("executed txs mismatch: have %v, want 1", numTx)
+	}
+
+	// an open-ended segment cannot be resolved without a substate DB
+	pool.DB = nil
+	if err := execute(BlockSegmentList{NewBlockSegment(0, OpenBlockSegmentLast)}); err == nil || !strings.Contains(err.Error(), "cannot resolve open-ended block segment") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := strideLen(NewBlockSegment(0, OpenBlockSegmentLast), 1); n != math.MaxUint64 {
+		t.Fatalf("stride length of the full range wraps around: %v", n)
+	}
+}
+
+func TestNewSubstateTaskConfigCli(t *testing.T) {
+	flags := []cli.Flag{
+		WorkersFlag, MinValueFlag, ErrorBudgetFlag, TxTypesFlag, SkipTransferTxsFlag,
+		TargetAddressFlag, CreatedContractFlag,
+	}
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{"--workers", "4", "--min-value", "1eth", "--address", "0x00000000219ab540356cbb839cbe05303d7705fa"}},
+		{args: []string{"--workers", "many"}, err: "invalid --workers"},
+		{args: []string{"--min-value", "-1"}, err: "invalid --min-value"},
+		{args: []string{"--error-budget", "-1"}, err: "invalid --error-budget"},
+		{args: []string{"--tx-types", "bogus"}, err: "invalid --tx-types"},
+		{args: []string{"--tx-types", "call", "--skip-transfer-txs"}, err: "cannot be used together"},
+		{args: []string{"--address", "0x01"}, err: "invalid --address"},
+		{args: []string{"--created-contract", "contract"}, err: "invalid --created-contract"},
+	}
+	for _, tt := range tests {
+		var config *SubstateTaskConfig
+		var configErr error
+		app := &cli.App{
+			Flags: flags,
+			Action: func(ctx *cli.Context) error {
+				config, configErr = NewSubstateTaskConfigCli(ctx)
+				return nil
+			},
+		}
+		if err := app.Run(append([]string{"test"}, tt.args...)); err != nil {
+			t.Fatalf("%v: unexpected error: %v", tt.args, err)
+		}
+		if tt.err == "" {
+			if configErr != nil || config == nil || config.Workers != 4 || len(config.TargetAddresses) != 1 {
+				t.Fatalf("%v: config mismatch: have %+v (%v)", tt.args, config, configErr)
+			}
+			continue
+		}
+		if configErr == nil || !strings.Contains(configErr.Error(), tt.err) || config != nil {
+			t.Fatalf("%v: unexpected error: have %v, want %s", tt.args, configErr, tt.err)
+		}
+	}
+}
+
+func TestNumWorkers(t *testing.T) {
+	defer func(f func() int) { numCPUCores = f }(numCPUCores)
+
+	tests := []struct {
+		flag    string
+		cores   int
+		workers int
+	}{
+		{"4", 16, 4},
+		{"32", 1, 32},
+		{"0", 16, 16},
+		{"auto-cpu", 16, 16},
+		{" auto-cpu ", 1, 1},
+		{"auto-io", 16, IOConservativeWorkers},
+		{"auto-io", 1, 1},
+	}
+	for _, test := range tests {
+		numCPUCores = func() int { return test.cores }
+		workers, strategy, err := ParseWorkers(test.flag)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", test.flag, err)
+		}
+		pool := &SubstateTaskPool{Config: &SubstateTaskConfig{Workers: workers, WorkersStrategy: strategy}}
+		if have := pool.NumWorkers(); have != test.workers {
+			t.Fatalf("%q with %v cores: workers mismatch: have %v, want %v", test.flag, test.cores, have, test.workers)
+		}
+	}
+
+	// strategies other than WorkersStrategyFixed ignore Workers
+	numCPUCores = func() int { return 8 }
+	pool := &SubstateTaskPool{Config: &SubstateTaskConfig{Workers: 4, WorkersStrategy: WorkersStrategyCPU}}
+	if have := pool.NumWorkers(); have != 8 {
+		t.Fatalf("workers mismatch: have %v, want 8", have)
+	}
+
+	for _, flag := range []string{"", "-1", "auto", "io", "2x"} {
+		if _, _, err := ParseWorkers(flag); err == nil {
+			t.Fatalf("%q: error is not raised", flag)
+		}
+	}
+}
+
+func TestProgressCadence(t *testing.T) {
+	type completion struct {
+		block   uint64
+		sec     float64
+		pending int
+	}
+	tests := []struct {
+		name     string
+		stream   []completion
+		reported []uint64
+	}{
+		{
+			name: "by block",
+			stream: []completion{
+				{10_000, 6, 0}, {10_001, 12, 0}, {11_000, 17, 0}, {11_100, 38, 0}, {11_110, 79, 0}, {11_111, 140, 0},
+			},
+			reported: []uint64{10_000, 11_000, 11_100, 11_110, 11_111},
+		},
+		{
+			name: "too soon",
+			stream: []completion{
+				{10_000, 1, 0}, {10_000, 3, 0}, {10_000, 6, 0}, {20_000, 7, 0},
+			},
+			reported: []uint64{10_000},
+		},
+		{
+			name: "coalesced backlog",
+			stream: []completion{
+				{10_000, 6, 5}, {20_000, 12, 3}, {30_000, 14, 2}, {40_000, 30, 2},
+			},
+			reported: []uint64{30_000, 40_000},
+		},
+		{
+			name: "coalesced at most max interval",
+			stream: []completion{
+				{10_000, 6, 100}, {10_001, 50, 100}, {10_002, 61, 100}, {10_003, 62, 0},
+			},
+			reported: []uint64{10_002},
+		},
+		{
+			name: "last block",
+			stream: []completion{
+				{99_999, 0.1, 100}, {99_999, 0.2, 100},
+			},
+			reported: []uint64{99_999, 99_999},
+		},
+	}
+	for _, test := range tests {
+		cadence := progressCadence{maxPending: 2}
+		var reported []uint64
+		for _, c := range test.stream {
+			if cadence.due(c.block, 99_999, c.sec, c.pending) {
+				reported = append(reported, c.block)
+				cadence.lastSec = c.sec
+			}
+		}
+		if !reflect.DeepEqual(reported, test.reported) {
+			t.Fatalf("%s: reported blocks mismatch: have %v, want %v", test.name, reported, test.reported)
+		}
+	}
+}
+
+func TestRestoreGOMAXPROCS(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	db := newTestSubstateDB(map[uint64][]int{1: {0}, 2: {0}, 3: {0}, 4: {0}})
+	defer db.Close()
+
+	tests := []struct {
+		name    string
+		restore bool
+		taskErr error
+		procs   int
+	}{
+		{name: "restored", restore: true, procs: 1},
+		{name: "restored after error", restore: true, taskErr: errors.New("task error"), procs: 1},
+		{name: "kept", restore: false, procs: 4 + 2},
+	}
+	for _, test := range tests {
+		runtime.GOMAXPROCS(1)
+		pool := NewSubstateTaskPoolWithDB("test", func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			if have := runtime.GOMAXPROCS(0); have != 4+2 {
+				t.Errorf("%s: GOMAXPROCS during execution mismatch: have %v, want %v", test.name, have, 4+2)
+			}
+			return test.taskErr
+		}, &SubstateTaskConfig{Workers: 4}, db)
+		pool.Quiet = true
+		pool.RestoreGOMAXPROCS = test.restore
+		err := pool.ExecuteSegment(NewBlockSegment(1, 4))
+		if (err != nil) != (test.taskErr != nil) {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if have := runtime.GOMAXPROCS(0); have != test.procs {
+			t.Fatalf("%s: GOMAXPROCS mismatch: have %v, want %v", test.name, have, test.procs)
+		}
+	}
+}
+
+func TestExecuteSegmentDebugSerial(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1: {0, 1, 2}, 2: {0}, 3: {0, 1}, 5: {0, 1, 2, 3}, 8: {0}, 9: {0, 1}, 10: {0},
+	})
+	defer db.Close()
+
+	var visited []SubstateKey
+	pool := NewSubstateTaskPoolWithDB("test", func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		// no synchronization, as the task is never called concurrently
+		visited = append(visited, SubstateKey{block, tx})
+		return nil
+	}, &SubstateTaskConfig{Workers: 8, ParallelTxs: 4, DebugSerial: true, SkipFailedTxs: true}, db)
+	pool.Quiet = true
+	var done []uint64
+	pool.BlockDoneFunc = func(block uint64) { done = append(done, block) }
+
+	stats, err := pool.executeSegmentList(context.Background(), BlockSegmentList{NewBlockSegment(1, 5), NewBlockSegment(8, 10)})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []SubstateKey{{1, 0}, {1, 1}, {1, 2}, {2, 0}, {3, 0}, {3, 1}, {5, 0}, {5, 1}, {5, 2}, {5, 3}, {8, 0}, {9, 0}, {9, 1}, {10, 0}}
+	if !reflect.DeepEqual(visited, want) {
+		t.Fatalf("visited substates mismatch: have %v, want %v", visited, want)
+	}
+	if wantDone := []uint64{1, 2, 3, 4, 5, 8, 9, 10}; !reflect.DeepEqual(done, wantDone) {
+		t.Fatalf("done blocks mismatch: have %v, want %v", done, wantDone)
+	}
+	if stats.NumBlock != 8 || stats.NumTx != int64(len(want)) {
+		t.Fatalf("stats mismatch: have %+v", stats)
+	}
+	if have := pool.NumWorkers(); have != 1 {
+		t.Fatalf("workers mismatch: have %v, want 1", have)
+	}
+}
+
+func TestExecuteFollow(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{1: {0}, 2: {0, 1}, 3: {0}})
+	defer db.Close()
+
+	var mu sync.Mutex
+	var visited []SubstateKey
+	pool := NewSubstateTaskPoolWithDB("test", func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		mu.Lock()
+		visited = append(visited, SubstateKey{block, tx})
+		mu.Unlock()
+		return nil
+	}, &SubstateTaskConfig{Workers: 2}, db)
+	pool.Quiet = true
+	// append blocks mid-run, once after the initial blocks and once while
+	// polling
+	pool.BlockDoneFunc = func(block uint64) {
+		if block == 3 {
+			db.PutSubstate(4, 0, newTestSubstate(4, common.Address{0x01}, common.Address{0x02}))
+			db.PutSubstate(6, 0, newTestSubstate(6, common.Address{0x01}, common.Address{0x02}))
+		}
+	}
+	var polls int
+	release := func() error { return nil }
+	reopen := func() error {
+		polls++
+		if polls == 2 {
+			db.PutSubstate(7, 0, newTestSubstate(7, common.Address{0x01}, common.Address{0x02}))
+		}
+		return nil
+	}
+
+	start := time.Now()
+	err := pool.ExecuteFollowContext(context.Background(), 2, FollowConfig{Interval: 10 * time.Millisecond, Timeout: 100 * time.Millisecond, Release: release, Reopen: reopen})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("follow returns before timeout: %v", elapsed)
+	}
+	sort.Slice(visited, func(i, j int) bool {
+		return visited[i].Block < visited[j].Block || visited[i].Block == visited[j].Block && visited[i].Tx < visited[j].Tx
+	})
+	if want := []SubstateKey{{2, 0}, {2, 1}, {3, 0}, {4, 0}, {6, 0}, {7, 0}}; !reflect.DeepEqual(visited, want) {
+		t.Fatalf("visited substates mismatch: have %v, want %v", visited, want)
+	}
+
+	// cancelling ctx stops following
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- pool.ExecuteFollowContext(ctx, 8, FollowConfig{Interval: 10 * time.Millisecond})
+	}()
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("follow is not stopped by ctx")
+	}
+
+	if err := pool.ExecuteFollowContext(context.Background(), 8, FollowConfig{}); err == nil {
+		t.Fatalf("zero follow interval is valid")
+	}
+}
+
+func TestExecuteFollowLevelDB(t *testing.T) {
+	defer func(dir string) { substateDir = dir }(substateDir)
+	substateDir = t.TempDir()
+
+	recorder, err := rawdb.NewLevelDBDatabase(substateDir, 16, 16, "recorder", false)
+	if err != nil {
+		t.Fatalf("error opening recorder DB: %v", err)
+	}
+	NewSubstateDB(recorder).PutSubstate(1, 0, newTestSubstate(1, common.Address{0x01}, common.Address{0x02}))
+	recorder.Close()
+
+	OpenSubstateDBReadOnly()
+	defer CloseSubstateDB()
+	if _, err := rawdb.NewLevelDBDatabase(substateDir, 16, 16, "recorder", false); err == nil {
+		t.Fatalf("recorder opens DB opened read-only")
+	}
+
+	var visited []uint64
+	pool := NewSubstateTaskPoolWithDB("test", func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		visited = append(visited, block)
+		return nil
+	}, &SubstateTaskConfig{Workers: 1}, staticSubstateDB)
+	pool.Quiet = true
+	// the recorder appends block 2 at the first poll and keeps the DB locked
+	// until the second poll
+	var polls, locked int
+	reopen := func() error {
+		polls++
+		switch polls {
+		case 1:
+			if recorder, err = rawdb.NewLevelDBDatabase(substateDir, 16, 16, "recorder", false); err != nil {
+				return fmt.Errorf("error opening recorder DB: %v", err)
+			}
+			NewSubstateDB(recorder).PutSubstate(2, 0, newTestSubstate(2, common.Address{0x01}, common.Address{0x02}))
+		case 2:
+			recorder.Close()
+		}
+		err := ReopenSubstateDBReadOnly()
+		if errors.Is(err, ErrSubstateDBLocked) {
+			locked++
+		}
+		return err
+	}
+
+	err = pool.ExecuteFollowContext(context.Background(), 1, FollowConfig{Interval: 10 * time.Millisecond, Timeout: 100 * time.Millisecond, Release: ReleaseSubstateDB, Reopen: reopen})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []uint64{1, 2}; !reflect.DeepEqual(visited, want) {
+		t.Fatalf("visited blocks mismatch: have %v, want %v", visited, want)
+	}
+	if locked != 1 {
+		t.Fatalf("locked reopens mismatch: have %v, want 1", locked)
+	}
+}
+
+func TestMaxBlocksPerSec(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{1: {0}})
+	defer db.Close()
+
+	const maxBlocksPerSec, numBlocks = 100, 21
+	for _, serial := range []bool{false, true} {
+		var mu sync.Mutex
+		var doneAt []time.Time
+		pool := NewSubstateTaskPoolWithDB("test", func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			return nil
+		}, &SubstateTaskConfig{Workers: 4, MaxBlocksPerSec: maxBlocksPerSec, DebugSerial: serial}, db)
+		pool.Quiet = true
+		pool.BlockDoneFunc = func(block uint64) {
+			mu.Lock()
+			doneAt = append(doneAt, time.Now())
+			mu.Unlock()
+		}
+
+		stats, err := pool.ExecuteSegmentStats(NewBlockSegment(1, numBlocks))
+		if err != nil {
+			t.Fatalf("serial %v: unexpected error: %v", serial, err)
+		}
+		if stats.NumBlock != numBlocks {
+			t.Fatalf("serial %v: blocks mismatch: have %v, want %v", serial, stats.NumBlock, numBlocks)
+		}
+		// the first block is scheduled at once, and the others at the cap
+		window := doneAt[len(doneAt)-1].Sub(doneAt[0])
+		if have := float64(numBlocks-1) / window.Seconds(); have > maxBlocksPerSec*1.2 {
+			t.Fatalf("serial %v: scheduling rate above cap: have %.1f blocks/s, want at most %v", serial, have, maxBlocksPerSec)
+		}
+	}
+
+	// the limiter does not delay cancellation
+	pool := NewSubstateTaskPoolWithDB("test", func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		return nil
+	}, &SubstateTaskConfig{Workers: 2, MaxBlocksPerSec: 0.1}, db)
+	pool.Quiet = true
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := pool.ExecuteSegmentContext(ctx, NewBlockSegment(1, 10)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("cancellation delayed by limiter: %v", elapsed)
+	}
+}
+
+// decodeCountingDB is a SubstateDB calling decoded with blocks decoded by a
+// task pool.
+type decodeCountingDB struct {
+	*SubstateDB
+	decoded func(block uint64)
+}
+
+func (db *decodeCountingDB) GetBlockSubstates(block uint64) BlockSubstates {
+	db.decoded(block)
+	return db.SubstateDB.GetBlockSubstates(block)
+}
+
+func (db *decodeCountingDB) GetBlockSubstatesTolerant(block uint64) (BlockSubstates, []*SubstateDecodeError) {
+	db.decoded(block)
+	return db.SubstateDB.GetBlockSubstatesTolerant(block)
+}
+
+func TestMaxInFlightBytes(t *testing.T) {
+	db := NewMemorySubstateDB()
+	defer db.Close()
+	sender, recipient, contract := common.Address{0x01}, common.Address{0x02}, common.Address{0xc0}
+	// oversized substates with 100 storage slots, and 4 times as many in
+	// block 7
+	for block := uint64(1); block <= 12; block++ {
+		numSlots := 100
+		if block == 7 {
+			numSlots = 400
+		}
+		substate := newTestSubstate(block, sender, recipient)
+		account := NewSubstateAccount(1, big.NewInt(0), nil)
+		for i := 0; i < numSlots; i++ {
+			account.Storage[common.BigToHash(big.NewInt(int64(i)))] = common.Hash{0x01}
+		}
+		substate.InputAlloc[contract] = account
+		db.PutSubstate(block, 0, substate)
+	}
+	blockSize, largeSize := db.GetBlockSubstatesSize(1), db.GetBlockSubstatesSize(7)
+	if min := uint64(100 * 2 * common.HashLength); blockSize < min {
+		t.Fatalf("stored size mismatch: have %v, want at least %v", blockSize, min)
+	}
+
+	// at most 2 of the substates fit in the budget, and the one of block 7
+	// is larger than the budget
+	budget := blockSize*2 + blockSize/2
+	if largeSize <= budget {
+		t.Fatalf("block 7 fits in budget: %v <= %v", largeSize, budget)
+	}
+	var mu sync.Mutex
+	var concurrent, maxConcurrent int
+	// decoded is the size of blocks decoded whose task is not done, which
+	// includes blocks decoded but waiting for the budget
+	var decoded uint64
+	countingDB := &decodeCountingDB{SubstateDB: db, decoded: func(block uint64) {
+		mu.Lock()
+		defer mu.Unlock()
+		decoded += db.GetBlockSubstatesSize(block)
+		if decoded > budget && decoded != largeSize {
+			t.Errorf("block %v: decoded bytes %v exceed budget %v", block, decoded, budget)
+		}
+	}}
+	var pool *SubstateTaskPool
+	pool = NewSubstateTaskPoolWithDB("test", func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+		pool.inFlight.mu.Lock()
+		inFlight := pool.inFlight.bytes
+		pool.inFlight.mu.Unlock()
+		if inFlight > budget && block != 7 {
+			t.Errorf("block %v: in-flight bytes %v exceed budget %v", block, inFlight, budget)
+		}
+		if block == 7 && inFlight != largeSize {
+			t.Errorf("block 7 is not executed alone: in-flight bytes %v", inFlight)
+		}
+
+		mu.Lock()
+		concurrent++
+		if concurrent > maxConcurrent {
+			maxConcurrent = concurrent
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		concurrent--
+		decoded -= db.GetBlockSubstatesSize(block)
+		mu.Unlock()
+		return nil
+	}, &SubstateTaskConfig{Workers: 8, MaxInFlightBytes: budget}, countingDB)
+	pool.Quiet = true
+
+	stats, err := pool.ExecuteSegmentStats(NewBlockSegment(1, 12))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.NumTx != 12 {
+		t.Fatalf("txs mismatch: have %v, want 12", stats.NumTx)
+	}
+	if maxConcurrent > 2 {
+		t.Fatalf("concurrent blocks mismatch: have %v, want at most 2", maxConcurrent)
+	}
+	if pool.inFlight.bytes != 0 {
+		t.Fatalf("in-flight bytes are not released: %v", pool.inFlight.bytes)
+	}
+}
@@ -1,15 +1,75 @@
 package research
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
 	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
 )
 
+// newTestSubstate returns a minimal substate of a value transfer from
+// sender to recipient.
+func newTestSubstate(block uint64, sender, recipient common.Address) *Substate {
+	inputAlloc := SubstateAlloc{
+		sender: NewSubstateAccount(0, big.NewInt(1_000_000), nil),
+	}
+	outputAlloc := SubstateAlloc{
+		sender:    NewSubstateAccount(1, big.NewInt(999_000), nil),
+		recipient: NewSubstateAccount(0, big.NewInt(1_000), nil),
+	}
+	env := &SubstateEnv{
+		Coinbase:    common.Address{0xcb},
+		Difficulty:  big.NewInt(1),
+		GasLimit:    30_000_000,
+		Number:      block,
+		Timestamp:   block * 12,
+		BlockHashes: make(map[uint64]common.Hash),
+	}
+	msg := &SubstateMessage{
+		Nonce:      0,
+		CheckNonce: true,
+		GasPrice:   big.NewInt(1),
+		Gas:        21_000,
+		From:       sender,
+		To:         &recipient,
+		Value:      big.NewInt(1_000),
+		GasFeeCap:  big.NewInt(1),
+		GasTipCap:  big.NewInt(1),
+	}
+	result := &SubstateResult{
+		Status:  types.ReceiptStatusSuccessful,
+		GasUsed: 21_000,
+	}
+	return NewSubstate(inputAlloc, outputAlloc, env, msg, result)
+}
+
+// newTestSubstateDB returns an in-memory substate DB with a substate at every
+// given block and transaction index.
+func newTestSubstateDB(blockTxs map[uint64][]int) *SubstateDB {
+	db := NewMemorySubstateDB()
+	for block, txs := range blockTxs {
+		for _, tx := range txs {
+			sender := common.Address{0x01, byte(tx)}
+			recipient := common.Address{0x02, byte(tx)}
+			db.PutSubstate(block, tx, newTestSubstate(block, sender, recipient))
+		}
+	}
+	return db
+}
+
 func TestBlockSegmentList(t *testing.T) {
 	flags := []string{
 		"1", "1_001", "1-2", "1_001-2_000",
 		"1_000-2_000k", "1-2M",
 		"1,1-2M,1_001", "1_000-2_000k,1-2,1_001-2_000",
+		"0-0", "1-", "1M-", "1,1_001-",
+		"1-2G", "1G-", "18_446_743-18_446_744G",
 	}
 	brs := []BlockSegmentList{
 		{
@@ -40,6 +100,28 @@ func TestBlockSegmentList(t *testing.T) {
 			NewBlockSegment(1, 2),
 			NewBlockSegment(1001, 2000),
 		},
+		{
+			NewBlockSegment(0, 0),
+		},
+		{
+			NewBlockSegment(1, OpenBlockSegmentLast),
+		},
+		{
+			NewBlockSegment(1000001, OpenBlockSegmentLast),
+		},
+		{
+			NewBlockSegment(1, 1),
+			NewBlockSegment(1001, OpenBlockSegmentLast),
+		},
+		{
+			NewBlockSegment(1_000_000_001, 2_000_000_000),
+		},
+		{
+			NewBlockSegment(1_000_000_001, OpenBlockSegmentLast),
+		},
+		{
+			NewBlockSegment(18_446_743_000_000_001, 18_446_744_000_000_000),
+		},
 	}
 	for i, flag := range flags {
 		br, err := ParseBlockSegmentList(flag)
@@ -60,9 +142,12 @@ func TestBlockSegmentList(t *testing.T) {
 
 func TestBlockSegmentListBad(t *testing.T) {
 	flags := []string{
-		"", ",", "1x", "1-", "-1",
+		"", ",", "1x", "-1", "1--", "1-k",
 		"1k", "2M",
-		"1,2M", "1,1-", "1-,1", "1,-1", "-1,1",
+		"1,2M", "1,-1", "-1,1",
+		"1G", "1-2g", "1-100000000000G", "18_446_745-18_446_745G",
+		"18_446_744_073_709_552-18_446_744_073_709_552k", "100000000000G-",
+		"1-18446744073709551616",
 	}
 	for _, flag := range flags {
 		_, err := ParseBlockSegmentList(flag)
@@ -71,3 +156,536 @@ func TestBlockSegmentListBad(t *testing.T) {
 		}
 	}
 }
+
+func TestBlockSegmentMixedUnit(t *testing.T) {
+	tests := []struct {
+		flag        string
+		first, last uint64
+	}{
+		{"500-2000", 500, 2_000},
+		{"1-2k", 1_001, 2_000},
+		{"1-2M", 1_000_001, 2_000_000},
+		{"500k-2000", 0, 0},
+		{"500k-2000k", 500_001, 2_000_000},
+		{"500k-2M", 500_001, 2_000_000},
+		{"1M-2000", 0, 0},
+		{"1M-2000k", 1_000_001, 2_000_000},
+		{"1M-2M", 1_000_001, 2_000_000},
+		{"1k-5", 0, 0},
+		{"999-1k", 0, 0},
+		{"1_000k-2M", 1_000_001, 2_000_000},
+		{"2M-1_000k", 0, 0},
+		{"1G-2G", 1_000_000_001, 2_000_000_000},
+	}
+	for _, tt := range tests {
+		seg, err := ParseBlockSegment(tt.flag)
+		if tt.first == 0 && tt.last == 0 {
+			if err == nil {
+				t.Fatalf("%q: error is not raised when first is larger than last: %v-%v", tt.flag, seg.First, seg.Last)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.flag, err)
+		}
+		if seg.First != tt.first || seg.Last != tt.last {
+			t.Fatalf("%q: block segment mismatch: have %v-%v, want %v-%v", tt.flag, seg.First, seg.Last, tt.first, tt.last)
+		}
+	}
+}
+
+func TestBlockSegmentHex(t *testing.T) {
+	tests := []struct {
+		flag        string
+		first, last uint64
+	}{
+		{"0xbef8a7-0xbef900", 12_515_495, 12_515_584},
+		{"0xbef8a7", 12_515_495, 12_515_495},
+		{"0xBEF8A7~0xbef8a8", 12_515_495, 12_515_496},
+		{"0x0-1_000", 0, 1_000},
+		{"1_000-0x3e9", 1_000, 1_001},
+		{"0x3e9-", 1_001, OpenBlockSegmentLast},
+		{"0xffffffffffffffff", math.MaxUint64, math.MaxUint64},
+	}
+	for _, tt := range tests {
+		seg, err := ParseBlockSegment(tt.flag)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.flag, err)
+		}
+		if seg.First != tt.first || seg.Last != tt.last {
+			t.Fatalf("%q: block segment mismatch: have %v-%v, want %v-%v", tt.flag, seg.First, seg.Last, tt.first, tt.last)
+		}
+	}
+
+	bad := []string{
+		"0x1k", "0x1-0x2M", "1-0x2k", "0x1k-2k", "0x1M-",
+		"0x", "0x_1", "0xg", "0x1_0", "0x10000000000000000", "0x2-0x1",
+	}
+	for _, flag := range bad {
+		if _, err := ParseBlockSegment(flag); err == nil {
+			t.Fatalf("%q: error is not raised", flag)
+		}
+	}
+}
+
+func TestBlockSegmentError(t *testing.T) {
+	tests := []struct {
+		flag string
+		kind BlockSegmentErrorKind
+	}{
+		{"", BlockSegmentInvalidFormat},
+		{"1x", BlockSegmentInvalidFormat},
+		{"1k", BlockSegmentInvalidFormat},
+		{"0x1-2M", BlockSegmentInvalidFormat},
+		{"18446744073709551616", BlockSegmentBadFirst},
+		{"0x10000000000000000-", BlockSegmentBadFirst},
+		{"1-18446744073709551616", BlockSegmentBadLast},
+		{"2-1", BlockSegmentFirstExceedsLast},
+		{"2M-1_000k", BlockSegmentFirstExceedsLast},
+		{"100000000000G-", BlockSegmentOverflow},
+		{"1-100000000000G", BlockSegmentOverflow},
+	}
+	for _, tt := range tests {
+		_, err := ParseBlockSegment(tt.flag)
+		var segErr *BlockSegmentError
+		if !errors.As(err, &segErr) {
+			t.Fatalf("%q: error is not a BlockSegmentError: %v", tt.flag, err)
+		}
+		if segErr.Kind != tt.kind || segErr.Input != tt.flag {
+			t.Fatalf("%q: error mismatch: have %v (%q), want %v", tt.flag, segErr.Kind, segErr.Input, tt.kind)
+		}
+	}
+
+	// a list reports the failing block segment
+	_, err := ParseBlockSegmentList("1-2,3-1")
+	var segErr *BlockSegmentError
+	if !errors.As(err, &segErr) || segErr.Kind != BlockSegmentFirstExceedsLast || segErr.First != 3 || segErr.Last != 1 {
+		t.Fatalf("block segment list error mismatch: %v", err)
+	}
+	if want := `block segment first is larger than last: 3-1 ("3-1")`; err.Error() != want {
+		t.Fatalf("error string mismatch: have %q, want %q", err.Error(), want)
+	}
+}
+
+func TestBlockSegmentContainsOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b     *BlockSegment
+		overlaps bool
+	}{
+		{NewBlockSegment(1, 10), NewBlockSegment(11, 20), false}, // adjacent
+		{NewBlockSegment(1, 10), NewBlockSegment(10, 20), true},
+		{NewBlockSegment(1, 10), NewBlockSegment(15, 20), false}, // disjoint
+		{NewBlockSegment(1, 20), NewBlockSegment(5, 10), true},   // nested
+		{NewBlockSegment(5, 5), NewBlockSegment(5, 5), true},     // single block
+		{NewBlockSegment(5, 5), NewBlockSegment(6, 6), false},
+		{NewBlockSegment(5, 5), NewBlockSegment(1, 10), true},
+		{NewBlockSegment(0, OpenBlockSegmentLast), NewBlockSegment(7, 7), true},
+	}
+	for _, tt := range tests {
+		if have := tt.a.Overlaps(tt.b); have != tt.overlaps {
+			t.Fatalf("%v.Overlaps(%v) = %v, want %v", tt.a, tt.b, have, tt.overlaps)
+		}
+		if have := tt.b.Overlaps(tt.a); have != tt.overlaps {
+			t.Fatalf("%v.Overlaps(%v) = %v, want %v", tt.b, tt.a, have, tt.overlaps)
+		}
+	}
+
+	seg := NewBlockSegment(5, 5)
+	if seg.Len() != 1 || !seg.Contains(5) || seg.Contains(4) || seg.Contains(6) {
+		t.Fatalf("single block segment %v is inconsistent", seg)
+	}
+	seg = NewBlockSegment(1_001, 2_000)
+	if seg.Len() != 1_000 || !seg.Contains(1_001) || !seg.Contains(2_000) || seg.Contains(1_000) || seg.Contains(2_001) {
+		t.Fatalf("block segment %v is inconsistent", seg)
+	}
+}
+
+func TestNormalizeSegmentList(t *testing.T) {
+	tests := []struct {
+		flag string
+		want BlockSegmentList
+	}{
+		// already disjoint
+		{"1-5,10-20", BlockSegmentList{NewBlockSegment(1, 5), NewBlockSegment(10, 20)}},
+		// out of order and overlapping
+		{"5-10,1-6", BlockSegmentList{NewBlockSegment(1, 10)}},
+		// touching
+		{"10-20,21-30", BlockSegmentList{NewBlockSegment(10, 30)}},
+		// fully contained duplicates
+		{"1-100,5-10,5-10,50", BlockSegmentList{NewBlockSegment(1, 100)}},
+		// out of order but disjoint
+		{"30-40,1-2,10", BlockSegmentList{NewBlockSegment(1, 2), NewBlockSegment(10, 10), NewBlockSegment(30, 40)}},
+		// open-ended
+		{"100-,1-5,200-300", BlockSegmentList{NewBlockSegment(1, 5), NewBlockSegment(100, OpenBlockSegmentLast)}},
+	}
+	for _, tt := range tests {
+		have, err := ParseAndNormalizeBlockSegmentList(tt.flag)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.flag, err)
+		}
+		if len(have) != len(tt.want) {
+			t.Fatalf("%q: number of block segments mismatch: have %v, want %v", tt.flag, len(have), len(tt.want))
+		}
+		for i, seg := range tt.want {
+			if have[i].First != seg.First || have[i].Last != seg.Last {
+				t.Fatalf("%q: block segment %d mismatch: have %v, want %v", tt.flag, i, have[i], seg)
+			}
+		}
+	}
+
+	// input list must be unchanged
+	list, _ := ParseBlockSegmentList("5-10,1-6")
+	NormalizeSegmentList(list)
+	if list[0].First != 5 || list[0].Last != 10 || list[1].First != 1 || list[1].Last != 6 {
+		t.Fatalf("NormalizeSegmentList modified its input")
+	}
+}
+
+func TestBlockSegmentWithDB(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		10:    {0, 1},
+		1_000: {0},
+		1_234: {0, 1, 2},
+	})
+	defer db.Close()
+
+	tests := []struct {
+		flag        string
+		first, last uint64
+	}{
+		{"1-", 1, 1_234},
+		{"1k-", 1_001, 1_234},
+		{"1_234-", 1_234, 1_234},
+		{"0-0", 0, 0},
+		{"1-2k", 1_001, 2_000},
+		{"latest-1", 1_234, 1_234},
+		{"latest-235", 1_000, 1_234},
+		{"-1_000", 235, 1_234},
+		{"latest-1k", 235, 1_234},
+		{"latest-1_225", 10, 1_234},
+		// clamped at the first block
+		{"latest-1_226", 10, 1_234},
+		{"-1M", 10, 1_234},
+	}
+	for _, tt := range tests {
+		seg, err := ParseBlockSegmentWithDB(tt.flag, db)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.flag, err)
+		}
+		if seg.First != tt.first || seg.Last != tt.last {
+			t.Fatalf("%q: block segment mismatch: have %v-%v, want %v-%v", tt.flag, seg.First, seg.Last, tt.first, tt.last)
+		}
+	}
+
+	if _, err := ParseBlockSegmentWithDB("1_235-", db); err == nil {
+		t.Fatalf("error is not raised for open-ended segment beyond the last block")
+	}
+
+	// the latest blocks are only resolved with a substate DB
+	for _, flag := range []string{"latest-100", "-100"} {
+		if _, err := ParseBlockSegment(flag); err == nil {
+			t.Fatalf("%q: error is not raised without substate DB", flag)
+		}
+	}
+	for _, flag := range []string{"latest-0", "-0", "latest-", "latest", "latest-1x", "latest-100000000000G"} {
+		if _, err := ParseBlockSegmentWithDB(flag, db); err == nil {
+			t.Fatalf("%q: error is not raised", flag)
+		}
+	}
+
+	empty := NewSubstateDB(rawdb.NewMemoryDatabase())
+	defer empty.Close()
+	if _, err := ParseBlockSegmentWithDB("1-", empty); err == nil {
+		t.Fatalf("error is not raised for open-ended segment in empty DB")
+	}
+	if _, err := ParseBlockSegmentWithDB("latest-10", empty); err == nil {
+		t.Fatalf("error is not raised for latest block segment in empty DB")
+	}
+}
+
+func TestSubstateCopy(t *testing.T) {
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+	substate := newTestSubstate(10, sender, recipient)
+	substate.InputAlloc[recipient] = NewSubstateAccount(0, big.NewInt(0), []byte{0x60, 0x00})
+	substate.InputAlloc[recipient].Storage[common.Hash{0x01}] = common.Hash{0x01}
+	substate.Env.BlockHashes[9] = common.Hash{0x09}
+	substate.Message.Data = []byte{0x01, 0x02}
+	substate.Message.AccessList = types.AccessList{{Address: recipient, StorageKeys: []common.Hash{{0x01}}}}
+	substate.Result.Logs = []*types.Log{{Address: recipient, Topics: []common.Hash{{0x01}}, Data: []byte{0x01}}}
+
+	original := newTestSubstate(10, sender, recipient)
+	original.InputAlloc[recipient] = substate.InputAlloc[recipient].Copy()
+	original.Env.BlockHashes[9] = common.Hash{0x09}
+	original.Message.Data = []byte{0x01, 0x02}
+	original.Message.AccessList = types.AccessList{{Address: recipient, StorageKeys: []common.Hash{{0x01}}}}
+	original.Result.Logs = []*types.Log{{Address: recipient, Topics: []common.Hash{{0x01}}, Data: []byte{0x01}}}
+
+	c := substate.Copy()
+	if !c.Equal(substate) {
+		t.Fatalf("copy is not equal to the original")
+	}
+
+	// mutate every nested field of the copy
+	c.InputAlloc[recipient].Storage[common.Hash{0x01}] = common.Hash{0x02}
+	c.InputAlloc[recipient].Code[0] = 0x61
+	c.InputAlloc[sender].Balance.SetUint64(1)
+	delete(c.OutputAlloc, recipient)
+	c.Env.BlockHashes[9] = common.Hash{0x99}
+	c.Env.Difficulty.SetUint64(100)
+	c.Message.Data[0] = 0xff
+	c.Message.Value.SetUint64(1)
+	*c.Message.To = common.Address{0xff}
+	c.Message.AccessList[0].StorageKeys[0] = common.Hash{0xff}
+	c.Result.Logs[0].Topics[0] = common.Hash{0xff}
+	c.Result.Logs[0].Data[0] = 0xff
+	c.Result.Logs = append(c.Result.Logs, &types.Log{})
+
+	if !substate.Equal(original) {
+		t.Fatalf("mutation of copy affects the original")
+	}
+	if substate.Message.AccessList[0].StorageKeys[0] != (common.Hash{0x01}) {
+		t.Fatalf("mutation of copy affects access list of the original")
+	}
+}
+
+func TestSubstateAccountStorageRoot(t *testing.T) {
+	// keccak256(rlp("")), the root of an empty trie
+	emptyRoot := common.HexToHash("0x56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+	account := NewSubstateAccount(1, big.NewInt(0), nil)
+	if have := account.StorageRoot(); have != emptyRoot {
+		t.Fatalf("storage root of empty storage mismatch: have %v, want %v", have.Hex(), emptyRoot.Hex())
+	}
+	// a zero slot is not in the storage trie
+	account.Storage[common.Hash{0x01}] = common.Hash{}
+	if have := account.StorageRoot(); have != emptyRoot {
+		t.Fatalf("storage root of zero storage mismatch: have %v, want %v", have.Hex(), emptyRoot.Hex())
+	}
+
+	// the storage root of slot 0 set to 1, a single leaf node
+	// [0x20 ++ keccak256(slot), rlp(0x01)]
+	account.Storage[common.Hash{}] = common.BigToHash(big.NewInt(1))
+	if have, want := account.StorageRoot(), common.HexToHash("0x821e2556a290c86405f8160a2d662042a431ba456b9db265c79bb837c04be5f0"); have != want {
+		t.Fatalf("storage root of a single slot mismatch: have %v, want %v", have.Hex(), want.Hex())
+	}
+
+	// the storage root is deterministic regardless of map iteration order
+	account.Storage[common.BigToHash(big.NewInt(1))] = common.BigToHash(big.NewInt(0x1234))
+	account.Storage[common.BigToHash(big.NewInt(2))] = common.HexToHash("0xff00000000000000000000000000000000000000000000000000000000000001")
+	root := account.StorageRoot()
+	for i := 0; i < 3; i++ {
+		if have := account.StorageRoot(); have != root {
+			t.Fatalf("storage root mismatch: have %v, want %v", have.Hex(), root.Hex())
+		}
+	}
+	if have := account.Copy().StorageRoot(); have != root {
+		t.Fatalf("storage root of copy mismatch: have %v, want %v", have.Hex(), root.Hex())
+	}
+}
+
+func TestSubstateMessageEffectiveGasPrice(t *testing.T) {
+	to := common.Address{0x02}
+	legacyTx := types.NewTx(&types.LegacyTx{GasPrice: big.NewInt(50), Gas: 21_000, To: &to})
+	accessListTx := types.NewTx(&types.AccessListTx{GasPrice: big.NewInt(50), Gas: 21_000, To: &to})
+	dynamicFeeTx := types.NewTx(&types.DynamicFeeTx{GasFeeCap: big.NewInt(100), GasTipCap: big.NewInt(2), Gas: 21_000, To: &to})
+
+	tests := []struct {
+		name    string
+		tx      *types.Transaction
+		baseFee *big.Int
+		want    int64
+	}{
+		{name: "legacy before London", tx: legacyTx, want: 50},
+		{name: "legacy", tx: legacyTx, baseFee: big.NewInt(30), want: 50},
+		{name: "access list before London", tx: accessListTx, want: 50},
+		{name: "access list", tx: accessListTx, baseFee: big.NewInt(30), want: 50},
+		{name: "dynamic fee", tx: dynamicFeeTx, baseFee: big.NewInt(30), want: 32},
+		{name: "dynamic fee capped", tx: dynamicFeeTx, baseFee: big.NewInt(99), want: 100},
+	}
+
+	for _, test := range tests {
+		// gas price recorded by the state processor
+		gasPrice := test.tx.GasPrice()
+		if test.baseFee != nil {
+			gasPrice = new(big.Int).Add(test.baseFee, test.tx.EffectiveGasTipValue(test.baseFee))
+		}
+		msg := NewSubstateMessage(test.tx, common.Address{0x01}, gasPrice)
+
+		have := msg.EffectiveGasPrice(test.baseFee)
+		if have.Int64() != test.want {
+			t.Fatalf("%s: effective gas price mismatch: have %v, want %v", test.name, have, test.want)
+		}
+		if have.Cmp(gasPrice) != 0 {
+			t.Fatalf("%s: effective gas price %v differs from recorded gas price %v", test.name, have, gasPrice)
+		}
+		// the returned value is not shared with the message
+		have.SetInt64(0)
+		if msg.EffectiveGasPrice(test.baseFee).Int64() != test.want {
+			t.Fatalf("%s: message is modified through effective gas price", test.name)
+		}
+	}
+}
+
+func TestSubstateResultBloomMatchesLogs(t *testing.T) {
+	logs := []*types.Log{{Address: common.Address{0x02}, Topics: []common.Hash{{0x01}}, Data: []byte{0x03}}}
+	result := &SubstateResult{
+		Status: types.ReceiptStatusSuccessful,
+		Bloom:  types.BytesToBloom(types.LogsBloom(logs)),
+		Logs:   logs,
+	}
+	if !result.BloomMatchesLogs() {
+		t.Fatalf("bloom of logs does not match")
+	}
+	if !(&SubstateResult{}).BloomMatchesLogs() {
+		t.Fatalf("empty bloom without logs does not match")
+	}
+
+	result.Bloom[0] ^= 0x80
+	if result.BloomMatchesLogs() {
+		t.Fatalf("wrong bloom matches")
+	}
+	if (&SubstateResult{Logs: logs}).BloomMatchesLogs() {
+		t.Fatalf("empty bloom matches logs")
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	if err := ValidateEnv(newTestSubstate(1, common.Address{0x01}, common.Address{0x02}).Env); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		field  string
+		modify func(env *SubstateEnv)
+	}{
+		{"Number", func(env *SubstateEnv) { env.Number = 0 }},
+		{"GasLimit", func(env *SubstateEnv) { env.GasLimit = 0 }},
+		{"Difficulty", func(env *SubstateEnv) { env.Difficulty = nil }},
+	}
+	for _, test := range tests {
+		env := newTestSubstate(1, common.Address{0x01}, common.Address{0x02}).Env
+		test.modify(env)
+		err := ValidateEnv(env)
+		if want := "missing env field " + test.field; err == nil || err.Error() != want {
+			t.Fatalf("%s: error mismatch: have %v, want %q", test.field, err, want)
+		}
+	}
+
+	if err := ValidateEnv(nil); err == nil {
+		t.Fatalf("nil env is valid")
+	}
+	// zero difficulty after the merge
+	env := newTestSubstate(1, common.Address{0x01}, common.Address{0x02}).Env
+	env.Difficulty = big.NewInt(0)
+	if err := ValidateEnv(env); err != nil {
+		t.Fatalf("unexpected error with zero difficulty: %v", err)
+	}
+	// zero coinbase on Clique chains
+	env = newTestSubstate(1, common.Address{0x01}, common.Address{0x02}).Env
+	env.Coinbase = common.Address{}
+	if err := ValidateEnv(env); err != nil {
+		t.Fatalf("unexpected error with zero coinbase: %v", err)
+	}
+}
+
+func TestSubstateEnvRandom(t *testing.T) {
+	db := NewMemorySubstateDB()
+	defer db.Close()
+	preMerge := newTestSubstate(1, common.Address{0x01}, common.Address{0x02})
+	postMerge := newTestSubstate(2, common.Address{0x01}, common.Address{0x02})
+	postMerge.Env.Difficulty = big.NewInt(0)
+	postMerge.Env.Random = &common.Hash{0xaa}
+	db.PutSubstate(1, 0, preMerge)
+	db.PutSubstate(2, 0, postMerge)
+
+	// Random survives RLP, and is still nil without it
+	if have := db.GetSubstate(1, 0); !have.Equal(preMerge) || have.Env.Random != nil {
+		t.Fatalf("pre-merge substate mismatch: have random %v", have.Env.Random)
+	}
+	if have := db.GetSubstate(2, 0); !have.Equal(postMerge) {
+		t.Fatalf("post-merge substate mismatch: have random %v", have.Env.Random)
+	}
+
+	envCopy := postMerge.Env.Copy()
+	envCopy.Random[0] = 0xbb
+	if postMerge.Env.Equal(envCopy) || (*postMerge.Env.Random != common.Hash{0xaa}) {
+		t.Fatalf("random of copy is not a copy")
+	}
+	if preMerge.Env.Equal(postMerge.Env.Copy()) {
+		t.Fatalf("env without random equals env with random")
+	}
+
+	chainConfig := *params.MainnetChainConfig
+	tests := []struct {
+		name       string
+		env        *SubstateEnv
+		mergeBlock *big.Int
+		postMerge  bool
+	}{
+		{"pre-merge", preMerge.Env, nil, false},
+		{"recorded random", postMerge.Env, nil, true},
+		{"before merge block", preMerge.Env, big.NewInt(2), false},
+		{"merge block", preMerge.Env, big.NewInt(1), true},
+	}
+	for _, test := range tests {
+		chainConfig.MergeNetsplitBlock = test.mergeBlock
+		if have := test.env.IsPostMerge(&chainConfig); have != test.postMerge {
+			t.Fatalf("%s: post-merge mismatch: have %v, want %v", test.name, have, test.postMerge)
+		}
+	}
+}
+
+func TestSubstateAccountEqualWith(t *testing.T) {
+	newAccount := func() *SubstateAccount {
+		acc := NewSubstateAccount(1, big.NewInt(100), []byte{0x60, 0x00})
+		acc.Storage[common.Hash{0x01}] = common.Hash{0x01}
+		return acc
+	}
+
+	otherCode := newAccount()
+	otherCode.Code = []byte{0x60, 0x01}
+	otherNonce := newAccount()
+	otherNonce.Nonce = 2
+	zeroSlot := newAccount()
+	zeroSlot.Storage[common.Hash{0x02}] = common.Hash{}
+	nonZeroSlot := newAccount()
+	nonZeroSlot.Storage[common.Hash{0x02}] = common.Hash{0x02}
+	otherBalance := newAccount()
+	otherBalance.Balance = big.NewInt(101)
+
+	tests := []struct {
+		name   string
+		y      *SubstateAccount
+		opts   CompareOptions
+		expect bool
+	}{
+		{"equal", newAccount(), CompareOptions{}, true},
+		{"code", otherCode, CompareOptions{}, false},
+		{"code ignored", otherCode, CompareOptions{IgnoreCode: true}, true},
+		{"code with other options", otherCode, CompareOptions{IgnoreNonce: true, TreatMissingStorageAsZero: true}, false},
+		{"nonce", otherNonce, CompareOptions{}, false},
+		{"nonce ignored", otherNonce, CompareOptions{IgnoreNonce: true}, true},
+		{"nonce with other options", otherNonce, CompareOptions{IgnoreCode: true, TreatMissingStorageAsZero: true}, false},
+		{"zero slot", zeroSlot, CompareOptions{}, false},
+		{"zero slot as missing", zeroSlot, CompareOptions{TreatMissingStorageAsZero: true}, true},
+		{"zero slot with other options", zeroSlot, CompareOptions{IgnoreCode: true, IgnoreNonce: true}, false},
+		{"non-zero slot as missing", nonZeroSlot, CompareOptions{TreatMissingStorageAsZero: true}, false},
+		{"balance", otherBalance, CompareOptions{IgnoreCode: true, IgnoreNonce: true, TreatMissingStorageAsZero: true}, false},
+		{"nil", nil, CompareOptions{IgnoreCode: true, IgnoreNonce: true, TreatMissingStorageAsZero: true}, false},
+	}
+	for _, test := range tests {
+		x := newAccount()
+		if have := x.EqualWith(test.y, test.opts); have != test.expect {
+			t.Fatalf("%s: x.EqualWith(y) = %v, want %v", test.name, have, test.expect)
+		}
+		if test.y == nil {
+			continue
+		}
+		if have := test.y.EqualWith(x, test.opts); have != test.expect {
+			t.Fatalf("%s: y.EqualWith(x) = %v, want %v", test.name, have, test.expect)
+		}
+		// zero options are the same as Equal
+		if have, want := x.EqualWith(test.y, CompareOptions{}), x.Equal(test.y); have != want {
+			t.Fatalf("%s: EqualWith without options = %v, Equal = %v", test.name, have, want)
+		}
+	}
+}
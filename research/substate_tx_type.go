@@ -0,0 +1,108 @@
+package research
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// TxType is the type of a transaction by the recipient of its message.
+type TxType int
+
+const (
+	// TxTypeTransfer is a transaction to an account without bytecode, which
+	// only transfers ETH.
+	TxTypeTransfer TxType = iota
+	// TxTypeCall is a transaction to an account with bytecode.
+	TxTypeCall
+	// TxTypeCreate is a transaction creating a contract.
+	TxTypeCreate
+)
+
+func (txType TxType) String() string {
+	switch txType {
+	case TxTypeTransfer:
+		return "transfer"
+	case TxTypeCall:
+		return "call"
+	case TxTypeCreate:
+		return "create"
+	}
+	return fmt.Sprintf("TxType(%d)", int(txType))
+}
+
+// ParseTxTypes parses a comma-separated list of TxType names, e.g.
+// "call,create".
+func ParseTxTypes(s string) (map[TxType]bool, error) {
+	txTypes := make(map[TxType]bool)
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case TxTypeTransfer.String():
+			txTypes[TxTypeTransfer] = true
+		case TxTypeCall.String():
+			txTypes[TxTypeCall] = true
+		case TxTypeCreate.String():
+			txTypes[TxTypeCreate] = true
+		default:
+			return nil, fmt.Errorf("unknown transaction type %q", name)
+		}
+	}
+	return txTypes, nil
+}
+
+// ClassifyTx returns the type of a transaction substate. A transaction with
+// Message.To is a call if the recipient has bytecode in InputAlloc, and a
+// transfer otherwise.
+func ClassifyTx(substate *Substate) TxType {
+	to := substate.Message.To
+	if to == nil {
+		return TxTypeCreate
+	}
+	if account, exist := substate.InputAlloc[*to]; exist && len(account.Code) > 0 {
+		return TxTypeCall
+	}
+	return TxTypeTransfer
+}
+
+// CreatesOrCallsContract returns true if a transaction substate creates the
+// contract, i.e. a CREATE whose crypto.CreateAddress of Message.From and
+// Message.Nonce is the contract address, or calls the contract with
+// Message.To.
+func CreatesOrCallsContract(substate *Substate, contract common.Address) bool {
+	msg := substate.Message
+	if msg.To == nil {
+		return crypto.CreateAddress(msg.From, msg.Nonce) == contract
+	}
+	return *msg.To == contract
+}
+
+// TxTypeCounts is the number of transactions of each TxType.
+type TxTypeCounts struct {
+	Transfer int64 `json:"transfer"`
+	Call     int64 `json:"call"`
+	Create   int64 `json:"create"`
+}
+
+// add atomically counts a transaction of txType.
+func (counts *TxTypeCounts) add(txType TxType) {
+	switch txType {
+	case TxTypeTransfer:
+		atomic.AddInt64(&counts.Transfer, 1)
+	case TxTypeCall:
+		atomic.AddInt64(&counts.Call, 1)
+	case TxTypeCreate:
+		atomic.AddInt64(&counts.Create, 1)
+	}
+}
+
+// load atomically returns a copy of counts.
+func (counts *TxTypeCounts) load() TxTypeCounts {
+	return TxTypeCounts{
+		Transfer: atomic.LoadInt64(&counts.Transfer),
+		Call:     atomic.LoadInt64(&counts.Call),
+		Create:   atomic.LoadInt64(&counts.Create),
+	}
+}
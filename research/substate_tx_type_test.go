@@ -0,0 +1,143 @@
+package research
+
+import (
+	"math/big"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestClassifyTx(t *testing.T) {
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+
+	transfer := newTestSubstate(1, sender, recipient)
+	// a recipient without bytecode in InputAlloc is still a transfer
+	emptyRecipient := newTestSubstate(1, sender, recipient)
+	emptyRecipient.InputAlloc[recipient] = NewSubstateAccount(0, big.NewInt(0), nil)
+	call := newTestSubstate(1, sender, recipient)
+	call.InputAlloc[recipient] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+	create := newTestSubstate(1, sender, recipient)
+	create.Message.To = nil
+	// a codeful account does not make a CREATE a call
+	create.InputAlloc[recipient] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+
+	tests := []struct {
+		name     string
+		substate *Substate
+		txType   TxType
+	}{
+		{"transfer", transfer, TxTypeTransfer},
+		{"transfer to account without code", emptyRecipient, TxTypeTransfer},
+		{"call", call, TxTypeCall},
+		{"create", create, TxTypeCreate},
+	}
+	for _, test := range tests {
+		if have := ClassifyTx(test.substate); have != test.txType {
+			t.Fatalf("%s: tx type mismatch: have %v, want %v", test.name, have, test.txType)
+		}
+	}
+}
+
+func TestExecuteSegmentTxTypes(t *testing.T) {
+	db := NewMemorySubstateDB()
+	defer db.Close()
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+	for block := uint64(1); block <= 6; block++ {
+		substate := newTestSubstate(block, sender, recipient)
+		switch block % 3 {
+		case 1:
+			substate.InputAlloc[recipient] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+		case 2:
+			substate.Message.To = nil
+		}
+		db.PutSubstate(block, 0, substate)
+		db.PutSubstate(block, 1, newTestSubstate(block, sender, recipient))
+	}
+
+	tests := []struct {
+		name   string
+		config SubstateTaskConfig
+		want   TxTypeCounts
+	}{
+		{"breakdown", SubstateTaskConfig{Workers: 2, TxTypeBreakdown: true}, TxTypeCounts{Transfer: 8, Call: 2, Create: 2}},
+		{"parallel txs", SubstateTaskConfig{Workers: 2, ParallelTxs: 2, TxTypeBreakdown: true}, TxTypeCounts{Transfer: 8, Call: 2, Create: 2}},
+		// skipped transactions are not counted
+		{"skip calls", SubstateTaskConfig{Workers: 2, SkipCallTxs: true, TxTypeBreakdown: true}, TxTypeCounts{Transfer: 8, Create: 2}},
+		{"without breakdown", SubstateTaskConfig{Workers: 2}, TxTypeCounts{}},
+	}
+	for _, test := range tests {
+		config := test.config
+		taskPool := NewSubstateTaskPoolWithDB("test", func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			return nil
+		}, &config, db)
+		// counts are reset at every execution
+		for i := 0; i < 2; i++ {
+			stats, err := taskPool.ExecuteSegmentStats(NewBlockSegment(1, 6))
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", test.name, err)
+			}
+			if stats.TxTypes != test.want {
+				t.Fatalf("%s: tx types mismatch: have %+v, want %+v", test.name, stats.TxTypes, test.want)
+			}
+		}
+	}
+}
+
+func TestExecuteSegmentOnlyTxTypes(t *testing.T) {
+	db := NewMemorySubstateDB()
+	defer db.Close()
+	sender, recipient := common.Address{0x01}, common.Address{0x02}
+	for block := uint64(1); block <= 6; block++ {
+		substate := newTestSubstate(block, sender, recipient)
+		switch block % 3 {
+		case 1:
+			substate.InputAlloc[recipient] = NewSubstateAccount(1, big.NewInt(0), []byte{0x60, 0x00})
+		case 2:
+			substate.Message.To = nil
+		}
+		db.PutSubstate(block, 0, substate)
+	}
+
+	tests := []struct {
+		flag   string
+		blocks []uint64
+	}{
+		{"transfer", []uint64{3, 6}},
+		{"call", []uint64{1, 4}},
+		{"create", []uint64{2, 5}},
+		{"call,create", []uint64{1, 2, 4, 5}},
+		{" transfer , call ", []uint64{1, 3, 4, 6}},
+		{"transfer,call,create", []uint64{1, 2, 3, 4, 5, 6}},
+	}
+	for _, test := range tests {
+		txTypes, err := ParseTxTypes(test.flag)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", test.flag, err)
+		}
+		var mu sync.Mutex
+		var blocks []uint64
+		taskPool := NewSubstateTaskPoolWithDB("test", func(block uint64, tx int, substate *Substate, taskPool *SubstateTaskPool) error {
+			mu.Lock()
+			blocks = append(blocks, block)
+			mu.Unlock()
+			return nil
+		}, &SubstateTaskConfig{Workers: 2, TxTypes: txTypes}, db)
+		taskPool.Quiet = true
+		if err := taskPool.ExecuteSegment(NewBlockSegment(1, 6)); err != nil {
+			t.Fatalf("%q: unexpected error: %v", test.flag, err)
+		}
+		sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+		if !reflect.DeepEqual(blocks, test.blocks) {
+			t.Fatalf("%q: executed blocks mismatch: have %v, want %v", test.flag, blocks, test.blocks)
+		}
+	}
+
+	for _, flag := range []string{"", "calls", "call,", "CREATE"} {
+		if _, err := ParseTxTypes(flag); err == nil {
+			t.Fatalf("%q: error is not raised", flag)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package research
+
+import (
+	"fmt"
+)
+
+// Kinds of anomalies found by ValidateSubstates
+const (
+	SubstateAnomalyMissingBlocks  = "missing blocks"
+	SubstateAnomalyTxGap          = "tx gap"
+	SubstateAnomalyDecodeError    = "decode error"
+	SubstateAnomalyBloomMismatch  = "bloom mismatch"
+	SubstateAnomalySenderMismatch = "sender mismatch"
+)
+
+// SubstateAnomaly is a problem of stored substates found by ValidateSubstates.
+type SubstateAnomaly struct {
+	Kind string
+
+	// First and Last are the range of missing blocks, or the block of a tx
+	// gap or a decode error.
+	First, Last uint64
+
+	Detail string
+}
+
+func (a SubstateAnomaly) String() string {
+	if a.First == a.Last {
+		return fmt.Sprintf("block %v: %s: %s", a.First, a.Kind, a.Detail)
+	}
+	return fmt.Sprintf("blocks %v-%v: %s: %s", a.First, a.Last, a.Kind, a.Detail)
+}
+
+// ValidateSubstates checks substates from block first to block last without
+// executing them. It reports ranges of blocks without any substate, blocks
+// whose tx indices are not 0..n-1, and, if deep is true, substates failing to
+// decode or whose Result.Bloom does not match Result.Logs. If verifySender is
+// true, substates failing to decode or whose Message.From does not match
+// VerifyMessageSender are reported. If last is OpenBlockSegmentLast, blocks
+// after the last stored block are not reported as missing.
+func (db *SubstateDB) ValidateSubstates(first, last uint64, deep, verifySender bool) ([]SubstateAnomaly, error) {
+	var anomalies []SubstateAnomaly
+
+	missing := func(from, to uint64) {
+		anomalies = append(anomalies, SubstateAnomaly{
+			Kind:   SubstateAnomalyMissingBlocks,
+			First:  from,
+			Last:   to,
+			Detail: fmt.Sprintf("%v blocks without substates", to-from+1),
+		})
+	}
+	var txs []int
+	var block uint64
+	checkBlock := func() {
+		for i, tx := range txs {
+			if tx != i {
+				anomalies = append(anomalies, SubstateAnomaly{
+					Kind:   SubstateAnomalyTxGap,
+					First:  block,
+					Last:   block,
+					Detail: fmt.Sprintf("tx indices %v, want 0-%v", txs, len(txs)-1),
+				})
+				return
+			}
+		}
+	}
+
+	prefix := []byte(stage1SubstatePrefix)
+	start := Stage1SubstateBlockPrefix(first)[len(prefix):]
+	iter := db.backend.NewIterator(prefix, start)
+	defer iter.Release()
+
+	// next is the first block not checked yet
+	next := first
+	for iter.Next() {
+		b, tx, err := DecodeSubstateKey(iter.Key())
+		if err != nil {
+			return nil, fmt.Errorf("record-replay: invalid substate key found: %v", err)
+		}
+		if b > last {
+			break
+		}
+		if len(txs) == 0 || b != block {
+			if len(txs) > 0 {
+				checkBlock()
+			}
+			if b > next {
+				missing(next, b-1)
+			}
+			block, txs, next = b, txs[:0], b+1
+		}
+		txs = append(txs, tx)
+
+		if !deep && !verifySender {
+			continue
+		}
+		substateRLP, _, err := decodeSubstateRLP(iter.Value())
+		if err != nil {
+			anomalies = append(anomalies, SubstateAnomaly{
+				Kind:   SubstateAnomalyDecodeError,
+				First:  b,
+				Last:   b,
+				Detail: fmt.Sprintf("tx %v: %v", tx, err),
+			})
+			continue
+		}
+		if result := substateRLP.Result; deep && result != nil {
+			r := &SubstateResult{Bloom: result.Bloom, Logs: result.Logs}
+			if !r.BloomMatchesLogs() {
+				anomalies = append(anomalies, SubstateAnomaly{
+					Kind:   SubstateAnomalyBloomMismatch,
+					First:  b,
+					Last:   b,
+					Detail: fmt.Sprintf("tx %v: bloom does not match %v logs", tx, len(result.Logs)),
+				})
+			}
+		}
+		if verifySender && substateRLP.Message != nil {
+			var msg SubstateMessage
+			msg.SetRLP(substateRLP.Message, db)
+			sender, ok, err := VerifyMessageSender(&msg)
+			if err != nil || !ok {
+				detail := fmt.Sprintf("tx %v: from %v, recovered sender %v", tx, msg.From.Hex(), sender.Hex())
+				if err != nil {
+					detail = fmt.Sprintf("tx %v: error recovering sender: %v", tx, err)
+				}
+				anomalies = append(anomalies, SubstateAnomaly{
+					Kind:   SubstateAnomalySenderMismatch,
+					First:  b,
+					Last:   b,
+					Detail: detail,
+				})
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if len(txs) > 0 {
+		checkBlock()
+	}
+
+	if last != OpenBlockSegmentLast && next <= last {
+		missing(next, last)
+	}
+
+	return anomalies, nil
+}
@@ -0,0 +1,79 @@
+package research
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestValidateSubstates(t *testing.T) {
+	db := newTestSubstateDB(map[uint64][]int{
+		1:  {0, 1, 2},
+		2:  {0, 1, 5},
+		5:  {0},
+		6:  {1},
+		10: {0, 1},
+	})
+	defer db.Close()
+	// a substate failing to decode
+	if err := db.backend.Put(Stage1SubstateKey(10, 1), []byte{0xc3, 0x01}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a substate whose bloom does not match its logs
+	corrupt := newTestSubstate(6, common.Address{0x01}, common.Address{0x02})
+	corrupt.Result.Logs = []*types.Log{{Address: common.Address{0x02}}}
+	db.PutSubstate(6, 1, corrupt)
+
+	tests := []struct {
+		first, last  uint64
+		deep         bool
+		verifySender bool
+		want         []string
+	}{
+		{1, 10, false, false, []string{
+			"block 2: tx gap: tx indices [0 1 5], want 0-2",
+			"blocks 3-4: missing blocks: 2 blocks without substates",
+			"block 6: tx gap: tx indices [1], want 0-0",
+			"blocks 7-9: missing blocks: 3 blocks without substates",
+		}},
+		{1, 12, true, false, []string{
+			"block 2: tx gap: tx indices [0 1 5], want 0-2",
+			"blocks 3-4: missing blocks: 2 blocks without substates",
+			"block 6: bloom mismatch: tx 1: bloom does not match 1 logs",
+			"block 6: tx gap: tx indices [1], want 0-0",
+			"blocks 7-9: missing blocks: 3 blocks without substates",
+			"block 10: decode error: tx 1: rlp: value size exceeds available input length",
+			"blocks 11-12: missing blocks: 2 blocks without substates",
+		}},
+		{0, 1, false, false, []string{
+			"block 0: missing blocks: 1 blocks without substates",
+		}},
+		{5, 5, true, false, nil},
+		{7, OpenBlockSegmentLast, false, false, []string{
+			"blocks 7-9: missing blocks: 3 blocks without substates",
+		}},
+		// senders are not recovered without signatures, but decode errors
+		// are reported
+		{5, 6, false, true, []string{
+			"block 6: tx gap: tx indices [1], want 0-0",
+		}},
+		{10, 10, false, true, []string{
+			"block 10: decode error: tx 1: rlp: value size exceeds available input length",
+		}},
+	}
+	for _, tt := range tests {
+		anomalies, err := db.ValidateSubstates(tt.first, tt.last, tt.deep, tt.verifySender)
+		if err != nil {
+			t.Fatalf("%v-%v: unexpected error: %v", tt.first, tt.last, err)
+		}
+		if len(anomalies) != len(tt.want) {
+			t.Fatalf("%v-%v: anomalies mismatch: have %v, want %v", tt.first, tt.last, anomalies, tt.want)
+		}
+		for i, anomaly := range anomalies {
+			if have := anomaly.String(); have != tt.want[i] {
+				t.Fatalf("%v-%v: anomaly mismatch: have %q, want %q", tt.first, tt.last, have, tt.want[i])
+			}
+		}
+	}
+}